@@ -0,0 +1,617 @@
+// Package anthropic provides middleware for partial compatibility with the
+// Anthropic Messages API
+package anthropic
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+)
+
+type Error struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+type ErrorResponse struct {
+	Type  string `json:"type"`
+	Error Error  `json:"error"`
+}
+
+func NewError(code int, message string) ErrorResponse {
+	var etype string
+	switch code {
+	case http.StatusBadRequest:
+		etype = "invalid_request_error"
+	case http.StatusNotFound:
+		etype = "not_found_error"
+	default:
+		etype = "api_error"
+	}
+
+	return ErrorResponse{Type: "error", Error: Error{Type: etype, Message: message}}
+}
+
+// MessagesRequest is a request to the /v1/messages endpoint
+type MessagesRequest struct {
+	Model         string          `json:"model"`
+	MaxTokens     int             `json:"max_tokens"`
+	System        json.RawMessage `json:"system"`
+	Messages      []Message       `json:"messages"`
+	StopSequences []string        `json:"stop_sequences"`
+	Stream        bool            `json:"stream"`
+	Temperature   *float64        `json:"temperature"`
+	TopP          *float64        `json:"top_p"`
+	TopK          *int            `json:"top_k"`
+	Tools         []Tool          `json:"tools"`
+	ToolChoice    *ToolChoice     `json:"tool_choice"`
+}
+
+// Message is a message of a conversation. Content is either a string or a
+// list of content blocks
+type Message struct {
+	Role    string          `json:"role"`
+	Content json.RawMessage `json:"content"`
+}
+
+// ContentBlock is a block of text, an image, a tool call made by the model
+// or the result of a tool call
+type ContentBlock struct {
+	Type string `json:"type"`
+
+	// Text is set for text blocks
+	Text *string `json:"text,omitempty"`
+
+	// Source is set for image blocks
+	Source *ImageSource `json:"source,omitempty"`
+
+	// ID, Name and Input are set for tool_use blocks
+	ID    string          `json:"id,omitempty"`
+	Name  string          `json:"name,omitempty"`
+	Input json.RawMessage `json:"input,omitempty"`
+
+	// ToolUseID, Content and IsError are set for tool_result blocks
+	ToolUseID string          `json:"tool_use_id,omitempty"`
+	Content   json.RawMessage `json:"content,omitempty"`
+	IsError   bool            `json:"is_error,omitempty"`
+}
+
+type ImageSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type"`
+	Data      string `json:"data"`
+}
+
+type Tool struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	InputSchema api.ToolSchema `json:"input_schema"`
+}
+
+type ToolChoice struct {
+	Type string `json:"type"`
+	Name string `json:"name,omitempty"`
+}
+
+// MessagesResponse is the response of the /v1/messages endpoint
+type MessagesResponse struct {
+	ID           string         `json:"id"`
+	Type         string         `json:"type"`
+	Role         string         `json:"role"`
+	Model        string         `json:"model"`
+	Content      []ContentBlock `json:"content"`
+	StopReason   *string        `json:"stop_reason"`
+	StopSequence *string        `json:"stop_sequence"`
+	Usage        Usage          `json:"usage"`
+}
+
+type Usage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+// StreamEvent is a server-sent event of a streamed response
+type StreamEvent struct {
+	Type         string            `json:"type"`
+	Message      *MessagesResponse `json:"message,omitempty"`
+	Index        *int              `json:"index,omitempty"`
+	ContentBlock *ContentBlock     `json:"content_block,omitempty"`
+	Delta        any               `json:"delta,omitempty"`
+	Usage        *Usage            `json:"usage,omitempty"`
+}
+
+type TextDelta struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type InputJSONDelta struct {
+	Type        string `json:"type"`
+	PartialJSON string `json:"partial_json"`
+}
+
+type MessageDelta struct {
+	StopReason   *string `json:"stop_reason"`
+	StopSequence *string `json:"stop_sequence"`
+}
+
+func newID(prefix string) string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return prefix + hex.EncodeToString(b)
+}
+
+// text returns the text of content that is either a string or a list of
+// text blocks
+func text(content json.RawMessage) (string, error) {
+	if len(content) == 0 {
+		return "", nil
+	}
+
+	var s string
+	if err := json.Unmarshal(content, &s); err == nil {
+		return s, nil
+	}
+
+	var blocks []ContentBlock
+	if err := json.Unmarshal(content, &blocks); err != nil {
+		return "", errors.New("invalid content: expected a string or a list of content blocks")
+	}
+
+	var parts []string
+	for _, b := range blocks {
+		if b.Type != "text" || b.Text == nil {
+			return "", fmt.Errorf("unsupported content block type %q", b.Type)
+		}
+
+		parts = append(parts, *b.Text)
+	}
+
+	return strings.Join(parts, "\n"), nil
+}
+
+func fromMessage(m Message) ([]api.Message, error) {
+	if m.Role != "user" && m.Role != "assistant" {
+		return nil, fmt.Errorf("invalid message role %q", m.Role)
+	}
+
+	var s string
+	if err := json.Unmarshal(m.Content, &s); err == nil {
+		return []api.Message{{Role: m.Role, Content: s}}, nil
+	}
+
+	var blocks []ContentBlock
+	if err := json.Unmarshal(m.Content, &blocks); err != nil {
+		return nil, errors.New("invalid message content: expected a string or a list of content blocks")
+	}
+
+	// tool results are sent as separate messages ahead of the rest of the
+	// message that holds them
+	var messages []api.Message
+	msg := api.Message{Role: m.Role}
+	var texts []string
+	for _, b := range blocks {
+		switch b.Type {
+		case "text":
+			if b.Text == nil {
+				return nil, errors.New("invalid text block")
+			}
+			texts = append(texts, *b.Text)
+		case "image":
+			if b.Source == nil || b.Source.Type != "base64" {
+				return nil, errors.New("invalid image: only base64 encoded images are supported")
+			}
+
+			img, err := base64.StdEncoding.DecodeString(b.Source.Data)
+			if err != nil {
+				return nil, errors.New("invalid image data")
+			}
+			msg.Images = append(msg.Images, img)
+		case "tool_use":
+			var call api.ToolCall
+			call.Function.Index = len(msg.ToolCalls)
+			call.Function.Name = b.Name
+			if err := json.Unmarshal(b.Input, &call.Function.Arguments); err != nil {
+				return nil, errors.New("invalid tool_use input")
+			}
+			msg.ToolCalls = append(msg.ToolCalls, call)
+		case "tool_result":
+			content, err := text(b.Content)
+			if err != nil {
+				return nil, err
+			}
+			messages = append(messages, api.Message{Role: "tool", Content: content})
+		default:
+			return nil, fmt.Errorf("unsupported content block type %q", b.Type)
+		}
+	}
+
+	msg.Content = strings.Join(texts, "\n")
+	if msg.Content != "" || len(msg.Images) > 0 || len(msg.ToolCalls) > 0 {
+		messages = append(messages, msg)
+	}
+
+	return messages, nil
+}
+
+func fromMessagesRequest(r MessagesRequest) (*api.ChatRequest, error) {
+	var messages []api.Message
+
+	system, err := text(r.System)
+	if err != nil {
+		return nil, err
+	}
+
+	if system != "" {
+		messages = append(messages, api.Message{Role: "system", Content: system})
+	}
+
+	for _, m := range r.Messages {
+		msgs, err := fromMessage(m)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msgs...)
+	}
+
+	var tools api.Tools
+	for _, t := range r.Tools {
+		tools = append(tools, api.Tool{
+			Type: "function",
+			Function: api.ToolFunction{
+				Name:        t.Name,
+				Description: t.Description,
+				Parameters:  t.InputSchema,
+			},
+		})
+	}
+
+	var toolChoice *api.ToolChoice
+	if r.ToolChoice != nil {
+		switch r.ToolChoice.Type {
+		case "auto":
+			toolChoice = &api.ToolChoice{Type: api.ToolChoiceAuto}
+		case "any":
+			toolChoice = &api.ToolChoice{Type: api.ToolChoiceRequired}
+		case "none":
+			toolChoice = &api.ToolChoice{Type: api.ToolChoiceNone}
+		case "tool":
+			toolChoice = &api.ToolChoice{Type: api.ToolChoiceNamed, Function: api.ToolChoiceFunction{Name: r.ToolChoice.Name}}
+		default:
+			return nil, fmt.Errorf("invalid tool_choice type %q", r.ToolChoice.Type)
+		}
+	}
+
+	options := map[string]any{
+		"num_predict": r.MaxTokens,
+	}
+
+	if len(r.StopSequences) > 0 {
+		options["stop"] = r.StopSequences
+	}
+
+	if r.Temperature != nil {
+		options["temperature"] = *r.Temperature
+	}
+
+	if r.TopP != nil {
+		options["top_p"] = *r.TopP
+	}
+
+	if r.TopK != nil {
+		options["top_k"] = *r.TopK
+	}
+
+	return &api.ChatRequest{
+		Model:      r.Model,
+		Messages:   messages,
+		Options:    options,
+		Stream:     &r.Stream,
+		Tools:      tools,
+		ToolChoice: toolChoice,
+	}, nil
+}
+
+func stopReason(r api.ChatResponse, toolUse bool) *string {
+	reason := "end_turn"
+	switch {
+	case toolUse:
+		reason = "tool_use"
+	case r.DoneReason == "length":
+		reason = "max_tokens"
+	}
+
+	return &reason
+}
+
+func toolUseBlock(id string, tc api.ToolCall) (ContentBlock, error) {
+	input, err := json.Marshal(tc.Function.Arguments)
+	if err != nil {
+		return ContentBlock{}, err
+	}
+
+	return ContentBlock{Type: "tool_use", ID: id, Name: tc.Function.Name, Input: input}, nil
+}
+
+func toMessagesResponse(id string, r api.ChatResponse) (MessagesResponse, error) {
+	content := []ContentBlock{}
+	if r.Message.Content != "" {
+		content = append(content, ContentBlock{Type: "text", Text: &r.Message.Content})
+	}
+
+	for _, tc := range r.Message.ToolCalls {
+		b, err := toolUseBlock(newID("toolu_"), tc)
+		if err != nil {
+			return MessagesResponse{}, err
+		}
+		content = append(content, b)
+	}
+
+	return MessagesResponse{
+		ID:         id,
+		Type:       "message",
+		Role:       "assistant",
+		Model:      r.Model,
+		Content:    content,
+		StopReason: stopReason(r, len(r.Message.ToolCalls) > 0),
+		Usage: Usage{
+			InputTokens:  r.PromptEvalCount,
+			OutputTokens: r.EvalCount,
+		},
+	}, nil
+}
+
+// MessagesWriter translates the output of the chat handler into a response
+// or a stream of events
+type MessagesWriter struct {
+	gin.ResponseWriter
+	stream bool
+	id     string
+
+	started bool
+
+	// block is the index of the open content block, or -1 if none is open
+	block int
+	next  int
+
+	// calls maps the index of each streamed tool call to its content block
+	calls   map[int]int
+	toolUse bool
+}
+
+func (w *MessagesWriter) event(e StreamEvent) error {
+	d, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	w.ResponseWriter.Header().Set("Content-Type", "text/event-stream")
+	_, err = fmt.Fprintf(w.ResponseWriter, "event: %s\ndata: %s\n\n", e.Type, d)
+	return err
+}
+
+// start opens a new content block, closing the open one if any
+func (w *MessagesWriter) start(b ContentBlock) (int, error) {
+	if err := w.stop(); err != nil {
+		return 0, err
+	}
+
+	i := w.next
+	w.next++
+	w.block = i
+	return i, w.event(StreamEvent{Type: "content_block_start", Index: &i, ContentBlock: &b})
+}
+
+// stop closes the open content block
+func (w *MessagesWriter) stop() error {
+	if w.block < 0 {
+		return nil
+	}
+
+	i := w.block
+	w.block = -1
+	return w.event(StreamEvent{Type: "content_block_stop", Index: &i})
+}
+
+func (w *MessagesWriter) writeEvents(r api.ChatResponse) error {
+	if !w.started {
+		w.started = true
+		if err := w.event(StreamEvent{Type: "message_start", Message: &MessagesResponse{
+			ID:      w.id,
+			Type:    "message",
+			Role:    "assistant",
+			Model:   r.Model,
+			Content: []ContentBlock{},
+			Usage:   Usage{InputTokens: r.PromptEvalCount},
+		}}); err != nil {
+			return err
+		}
+	}
+
+	if r.Message.Content != "" {
+		if w.block < 0 || w.isToolBlock(w.block) {
+			empty := ""
+			if _, err := w.start(ContentBlock{Type: "text", Text: &empty}); err != nil {
+				return err
+			}
+		}
+
+		i := w.block
+		if err := w.event(StreamEvent{Type: "content_block_delta", Index: &i, Delta: TextDelta{Type: "text_delta", Text: r.Message.Content}}); err != nil {
+			return err
+		}
+	}
+
+	for _, d := range r.Message.ToolCallDeltas {
+		i, ok := w.calls[d.Index]
+		if !ok {
+			var err error
+			i, err = w.start(ContentBlock{Type: "tool_use", ID: newID("toolu_"), Name: d.Name, Input: json.RawMessage(`{}`)})
+			if err != nil {
+				return err
+			}
+			w.calls[d.Index] = i
+		}
+
+		if err := w.event(StreamEvent{Type: "content_block_delta", Index: &i, Delta: InputJSONDelta{Type: "input_json_delta", PartialJSON: d.Arguments}}); err != nil {
+			return err
+		}
+	}
+
+	for _, tc := range r.Message.ToolCalls {
+		w.toolUse = true
+		if _, ok := w.calls[tc.Function.Index]; ok {
+			// the input was sent as it was generated
+			continue
+		}
+
+		i, err := w.start(ContentBlock{Type: "tool_use", ID: newID("toolu_"), Name: tc.Function.Name, Input: json.RawMessage(`{}`)})
+		if err != nil {
+			return err
+		}
+		w.calls[tc.Function.Index] = i
+
+		input, err := json.Marshal(tc.Function.Arguments)
+		if err != nil {
+			return err
+		}
+
+		if err := w.event(StreamEvent{Type: "content_block_delta", Index: &i, Delta: InputJSONDelta{Type: "input_json_delta", PartialJSON: string(input)}}); err != nil {
+			return err
+		}
+	}
+
+	if r.Done {
+		if err := w.stop(); err != nil {
+			return err
+		}
+
+		if err := w.event(StreamEvent{
+			Type:  "message_delta",
+			Delta: MessageDelta{StopReason: stopReason(r, w.toolUse)},
+			Usage: &Usage{InputTokens: r.PromptEvalCount, OutputTokens: r.EvalCount},
+		}); err != nil {
+			return err
+		}
+
+		return w.event(StreamEvent{Type: "message_stop"})
+	}
+
+	return nil
+}
+
+func (w *MessagesWriter) isToolBlock(i int) bool {
+	for _, b := range w.calls {
+		if b == i {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (w *MessagesWriter) writeError(data []byte) (int, error) {
+	var serr api.StatusError
+	if err := json.Unmarshal(data, &serr); err != nil {
+		return 0, err
+	}
+
+	w.ResponseWriter.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w.ResponseWriter).Encode(NewError(w.ResponseWriter.Status(), serr.Error())); err != nil {
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
+func (w *MessagesWriter) writeResponse(data []byte) (int, error) {
+	var r api.ChatResponse
+	if err := json.Unmarshal(data, &r); err != nil {
+		return 0, err
+	}
+
+	if w.stream {
+		if err := w.writeEvents(r); err != nil {
+			return 0, err
+		}
+
+		return len(data), nil
+	}
+
+	resp, err := toMessagesResponse(w.id, r)
+	if err != nil {
+		return 0, err
+	}
+
+	w.ResponseWriter.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w.ResponseWriter).Encode(resp); err != nil {
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
+func (w *MessagesWriter) Write(data []byte) (int, error) {
+	code := w.ResponseWriter.Status()
+	if code != http.StatusOK {
+		return w.writeError(data)
+	}
+
+	return w.writeResponse(data)
+}
+
+func MessagesMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req MessagesRequest
+		err := c.ShouldBindJSON(&req)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewError(http.StatusBadRequest, err.Error()))
+			return
+		}
+
+		if req.MaxTokens <= 0 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewError(http.StatusBadRequest, "max_tokens: must be at least 1"))
+			return
+		}
+
+		if len(req.Messages) == 0 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewError(http.StatusBadRequest, "messages: at least one message is required"))
+			return
+		}
+
+		chatReq, err := fromMessagesRequest(req)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewError(http.StatusBadRequest, err.Error()))
+			return
+		}
+
+		var b bytes.Buffer
+		if err := json.NewEncoder(&b).Encode(chatReq); err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, NewError(http.StatusInternalServerError, err.Error()))
+			return
+		}
+
+		c.Request.Body = io.NopCloser(&b)
+
+		c.Writer = &MessagesWriter{
+			ResponseWriter: c.Writer,
+			stream:         req.Stream,
+			id:             newID("msg_"),
+			block:          -1,
+			calls:          make(map[int]int),
+		}
+
+		c.Next()
+	}
+}
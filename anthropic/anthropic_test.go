@@ -0,0 +1,403 @@
+package anthropic
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+)
+
+const image = `iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJAAAAAXNSR0IArs4c6QAAAA1JREFUGFdj+L+U4T8ABu8CpCYJ1DQAAAAASUVORK5CYII=`
+
+func captureRequestMiddleware(capturedRequest any) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		bodyBytes, _ := io.ReadAll(c.Request.Body)
+		c.Request.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+		err := json.Unmarshal(bodyBytes, capturedRequest)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, "failed to unmarshal request")
+		}
+		c.Next()
+	}
+}
+
+func TestMessagesMiddleware(t *testing.T) {
+	type testCase struct {
+		name string
+		body string
+		req  api.ChatRequest
+		err  ErrorResponse
+	}
+
+	var capturedRequest *api.ChatRequest
+
+	img, _ := base64.StdEncoding.DecodeString(image)
+
+	testCases := []testCase{
+		{
+			name: "text",
+			body: `{
+				"model": "test-model",
+				"max_tokens": 1024,
+				"system": "You are a helpful assistant.",
+				"messages": [{"role": "user", "content": "Hello"}],
+				"temperature": 0.5,
+				"top_k": 40,
+				"stop_sequences": ["\n\n"]
+			}`,
+			req: api.ChatRequest{
+				Model: "test-model",
+				Messages: []api.Message{
+					{Role: "system", Content: "You are a helpful assistant."},
+					{Role: "user", Content: "Hello"},
+				},
+				Options: map[string]any{
+					"num_predict": 1024.0,
+					"temperature": 0.5,
+					"top_k":       40.0,
+					"stop":        []any{"\n\n"},
+				},
+				Stream: &False,
+			},
+		},
+		{
+			name: "content blocks",
+			body: `{
+				"model": "test-model",
+				"max_tokens": 100,
+				"system": [{"type": "text", "text": "Be brief."}],
+				"messages": [
+					{"role": "user", "content": [
+						{"type": "text", "text": "What's in this image?"},
+						{"type": "image", "source": {"type": "base64", "media_type": "image/png", "data": "` + image + `"}}
+					]}
+				],
+				"stream": true
+			}`,
+			req: api.ChatRequest{
+				Model: "test-model",
+				Messages: []api.Message{
+					{Role: "system", Content: "Be brief."},
+					{Role: "user", Content: "What's in this image?", Images: []api.ImageData{img}},
+				},
+				Options: map[string]any{"num_predict": 100.0},
+				Stream:  &True,
+			},
+		},
+		{
+			name: "tools",
+			body: `{
+				"model": "test-model",
+				"max_tokens": 100,
+				"messages": [
+					{"role": "user", "content": "What's the weather in Paris?"},
+					{"role": "assistant", "content": [
+						{"type": "text", "text": "Let me check."},
+						{"type": "tool_use", "id": "toolu_1", "name": "get_weather", "input": {"location": "Paris"}}
+					]},
+					{"role": "user", "content": [
+						{"type": "tool_result", "tool_use_id": "toolu_1", "content": [{"type": "text", "text": "22"}]},
+						{"type": "text", "text": "And in Rome?"}
+					]}
+				],
+				"tools": [{"name": "get_weather", "description": "Get the weather", "input_schema": {"type": "object", "properties": {"location": {"type": "string"}}}}],
+				"tool_choice": {"type": "tool", "name": "get_weather"}
+			}`,
+			req: api.ChatRequest{
+				Model: "test-model",
+				Messages: []api.Message{
+					{Role: "user", Content: "What's the weather in Paris?"},
+					{
+						Role:      "assistant",
+						Content:   "Let me check.",
+						ToolCalls: []api.ToolCall{{Function: api.ToolCallFunction{Name: "get_weather", Arguments: api.ToolCallFunctionArguments{"location": "Paris"}}}},
+					},
+					{Role: "tool", Content: "22"},
+					{Role: "user", Content: "And in Rome?"},
+				},
+				Options: map[string]any{"num_predict": 100.0},
+				Stream:  &False,
+				Tools: api.Tools{{
+					Type: "function",
+					Function: api.ToolFunction{
+						Name:        "get_weather",
+						Description: "Get the weather",
+						Parameters:  api.ToolSchema(`{"type":"object","properties":{"location":{"type":"string"}}}`),
+					},
+				}},
+				ToolChoice: &api.ToolChoice{Type: api.ToolChoiceNamed, Function: api.ToolChoiceFunction{Name: "get_weather"}},
+			},
+		},
+		{
+			name: "missing max_tokens",
+			body: `{"model": "test-model", "messages": [{"role": "user", "content": "Hello"}]}`,
+			err:  NewError(http.StatusBadRequest, "max_tokens: must be at least 1"),
+		},
+		{
+			name: "invalid role",
+			body: `{"model": "test-model", "max_tokens": 10, "messages": [{"role": "system", "content": "Hello"}]}`,
+			err:  NewError(http.StatusBadRequest, `invalid message role "system"`),
+		},
+		{
+			name: "url image",
+			body: `{"model": "test-model", "max_tokens": 10, "messages": [{"role": "user", "content": [{"type": "image", "source": {"type": "url", "url": "https://example.com/image.png"}}]}]}`,
+			err:  NewError(http.StatusBadRequest, "invalid image: only base64 encoded images are supported"),
+		},
+	}
+
+	endpoint := func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(MessagesMiddleware(), captureRequestMiddleware(&capturedRequest))
+	router.Handle(http.MethodPost, "/v1/messages", endpoint)
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			capturedRequest = nil
+
+			req, _ := http.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, req)
+
+			var errResp ErrorResponse
+			if resp.Code != http.StatusOK {
+				if err := json.Unmarshal(resp.Body.Bytes(), &errResp); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if capturedRequest != nil {
+				if diff := cmp.Diff(&tc.req, capturedRequest); diff != "" {
+					t.Fatalf("requests did not match (-want +got):\n%s", diff)
+				}
+			}
+
+			if diff := cmp.Diff(tc.err, errResp); diff != "" {
+				t.Fatalf("errors did not match (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+var (
+	False = false
+	True  = true
+)
+
+func TestMessagesWriter(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	// responses are what the chat handler writes for the next request
+	var responses []api.ChatResponse
+	var status int
+
+	router := gin.New()
+	router.POST("/v1/messages", MessagesMiddleware(), func(c *gin.Context) {
+		if status != 0 {
+			c.JSON(status, gin.H{"error": "model \"missing\" not found"})
+			return
+		}
+
+		for _, r := range responses {
+			b, err := json.Marshal(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c.Writer.Write(b)
+		}
+	})
+
+	request := func(t *testing.T, body string) *httptest.ResponseRecorder {
+		t.Helper()
+
+		req, _ := http.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("response", func(t *testing.T) {
+		status = 0
+		responses = []api.ChatResponse{{
+			Model: "test-model",
+			Message: api.Message{
+				Role:      "assistant",
+				Content:   "Let me check.",
+				ToolCalls: []api.ToolCall{{Function: api.ToolCallFunction{Name: "get_weather", Arguments: api.ToolCallFunctionArguments{"location": "Paris"}}}},
+			},
+			Done:       true,
+			DoneReason: "stop",
+			Metrics:    api.Metrics{PromptEvalCount: 10, EvalCount: 6},
+		}}
+
+		w := request(t, `{"model": "test-model", "max_tokens": 100, "messages": [{"role": "user", "content": "What's the weather in Paris?"}]}`)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp MessagesResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if !strings.HasPrefix(resp.ID, "msg_") || resp.Type != "message" || resp.Role != "assistant" || resp.Model != "test-model" {
+			t.Errorf("unexpected response %+v", resp)
+		}
+
+		if len(resp.Content) != 2 {
+			t.Fatalf("expected 2 content blocks, got %d", len(resp.Content))
+		}
+
+		if b := resp.Content[0]; b.Type != "text" || *b.Text != "Let me check." {
+			t.Errorf("unexpected text block %+v", b)
+		}
+
+		if b := resp.Content[1]; b.Type != "tool_use" || b.Name != "get_weather" || string(b.Input) != `{"location":"Paris"}` || !strings.HasPrefix(b.ID, "toolu_") {
+			t.Errorf("unexpected tool_use block %+v", b)
+		}
+
+		if *resp.StopReason != "tool_use" {
+			t.Errorf("stop_reason = %q, want %q", *resp.StopReason, "tool_use")
+		}
+
+		if diff := cmp.Diff(resp.Usage, Usage{InputTokens: 10, OutputTokens: 6}); diff != "" {
+			t.Errorf("usage mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("max tokens", func(t *testing.T) {
+		status = 0
+		responses = []api.ChatResponse{{
+			Message:    api.Message{Role: "assistant", Content: "Once upon"},
+			Done:       true,
+			DoneReason: "length",
+		}}
+
+		w := request(t, `{"model": "test-model", "max_tokens": 2, "messages": [{"role": "user", "content": "Tell me a story"}]}`)
+
+		var resp MessagesResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if *resp.StopReason != "max_tokens" {
+			t.Errorf("stop_reason = %q, want %q", *resp.StopReason, "max_tokens")
+		}
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		status = 0
+		responses = []api.ChatResponse{
+			{Model: "test-model", Message: api.Message{Role: "assistant", Content: "Let me "}, Metrics: api.Metrics{PromptEvalCount: 10}},
+			{Model: "test-model", Message: api.Message{Role: "assistant", Content: "check."}},
+			{Model: "test-model", Message: api.Message{Role: "assistant", ToolCallDeltas: []api.ToolCallDelta{{Index: 0, Name: "get_weather", Arguments: `{"location":`}}}},
+			{Model: "test-model", Message: api.Message{Role: "assistant", ToolCallDeltas: []api.ToolCallDelta{{Index: 0, Arguments: `"Paris"}`}}}},
+			{
+				Model:      "test-model",
+				Message:    api.Message{Role: "assistant", ToolCalls: []api.ToolCall{{Function: api.ToolCallFunction{Name: "get_weather", Arguments: api.ToolCallFunctionArguments{"location": "Paris"}}}}},
+				Done:       true,
+				DoneReason: "stop",
+				Metrics:    api.Metrics{PromptEvalCount: 10, EvalCount: 12},
+			},
+		}
+
+		w := request(t, `{"model": "test-model", "max_tokens": 100, "messages": [{"role": "user", "content": "What's the weather in Paris?"}], "stream": true}`)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if ct := w.Header().Get("Content-Type"); ct != "text/event-stream" {
+			t.Errorf("Content-Type = %q, want %q", ct, "text/event-stream")
+		}
+
+		var types []string
+		var events []map[string]any
+		var event string
+		s := bufio.NewScanner(w.Body)
+		for s.Scan() {
+			if e, ok := strings.CutPrefix(s.Text(), "event: "); ok {
+				event = e
+			} else if data, ok := strings.CutPrefix(s.Text(), "data: "); ok {
+				var e map[string]any
+				if err := json.Unmarshal([]byte(data), &e); err != nil {
+					t.Fatal(err)
+				}
+
+				if e["type"] != event {
+					t.Errorf("event %q has type %q", event, e["type"])
+				}
+
+				events = append(events, e)
+				types = append(types, event)
+			}
+		}
+
+		if diff := cmp.Diff(types, []string{
+			"message_start",
+			"content_block_start",
+			"content_block_delta",
+			"content_block_delta",
+			"content_block_stop",
+			"content_block_start",
+			"content_block_delta",
+			"content_block_delta",
+			"content_block_stop",
+			"message_delta",
+			"message_stop",
+		}); diff != "" {
+			t.Fatalf("events mismatch (-got +want):\n%s", diff)
+		}
+
+		if diff := cmp.Diff(events[6], map[string]any{
+			"type":  "content_block_delta",
+			"index": 1.0,
+			"delta": map[string]any{"type": "input_json_delta", "partial_json": `{"location":`},
+		}); diff != "" {
+			t.Errorf("delta mismatch (-got +want):\n%s", diff)
+		}
+
+		if diff := cmp.Diff(events[9], map[string]any{
+			"type":  "message_delta",
+			"delta": map[string]any{"stop_reason": "tool_use", "stop_sequence": nil},
+			"usage": map[string]any{"input_tokens": 10.0, "output_tokens": 12.0},
+		}); diff != "" {
+			t.Errorf("message_delta mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("error", func(t *testing.T) {
+		status = http.StatusNotFound
+
+		w := request(t, `{"model": "missing", "max_tokens": 100, "messages": [{"role": "user", "content": "Hello"}]}`)
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("expected status 404, got %d", w.Code)
+		}
+
+		var resp ErrorResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(resp, NewError(http.StatusNotFound, `model "missing" not found`)); diff != "" {
+			t.Errorf("error mismatch (-got +want):\n%s", diff)
+		}
+	})
+}
@@ -33,8 +33,9 @@ import (
 // Client encapsulates client state for interacting with the ollama
 // service. Use [ClientFromEnvironment] to create new Clients.
 type Client struct {
-	base *url.URL
-	http *http.Client
+	base   *url.URL
+	http   *http.Client
+	apiKey string
 }
 
 func checkError(resp *http.Response, body []byte) error {
@@ -62,10 +63,14 @@ func checkError(resp *http.Response, body []byte) error {
 //
 // If the variable is not specified, a default ollama host and port will be
 // used.
+//
+// If the environment variable OLLAMA_API_KEY is set, it is sent to the
+// service as a bearer token.
 func ClientFromEnvironment() (*Client, error) {
 	return &Client{
-		base: envconfig.Host(),
-		http: http.DefaultClient,
+		base:   envconfig.Host(),
+		http:   http.DefaultClient,
+		apiKey: envconfig.APIKey(),
 	}, nil
 }
 
@@ -105,6 +110,9 @@ func (c *Client) do(ctx context.Context, method, path string, reqData, respData
 	request.Header.Set("Content-Type", "application/json")
 	request.Header.Set("Accept", "application/json")
 	request.Header.Set("User-Agent", fmt.Sprintf("ollama/%s (%s %s) Go/%s", version.Version, runtime.GOARCH, runtime.GOOS, runtime.Version()))
+	if c.apiKey != "" {
+		request.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
 
 	respObj, err := c.http.Do(request)
 	if err != nil {
@@ -151,6 +159,9 @@ func (c *Client) stream(ctx context.Context, method, path string, data any, fn f
 	request.Header.Set("Content-Type", "application/json")
 	request.Header.Set("Accept", "application/x-ndjson")
 	request.Header.Set("User-Agent", fmt.Sprintf("ollama/%s (%s %s) Go/%s", version.Version, runtime.GOARCH, runtime.GOOS, runtime.Version()))
+	if c.apiKey != "" {
+		request.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
 
 	response, err := c.http.Do(request)
 	if err != nil {
@@ -307,6 +318,63 @@ func (c *Client) ListRunning(ctx context.Context) (*ProcessResponse, error) {
 	return &lr, nil
 }
 
+// Quotas lists the clients of the server with their usage and quotas.
+func (c *Client) Quotas(ctx context.Context) (*QuotasResponse, error) {
+	var resp QuotasResponse
+	if err := c.do(ctx, http.MethodGet, "/api/quotas", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Pin processes a prompt and keeps it in the cache of the loaded model, so
+// that requests with prompts starting the same way don't process it again.
+// Pins last until they are removed with [Client.Unpin] or the model is
+// unloaded.
+func (c *Client) Pin(ctx context.Context, req *PinRequest) (*PinResponse, error) {
+	var resp PinResponse
+	if err := c.do(ctx, http.MethodPost, "/api/cache/pin", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// ListPins lists the prompts pinned in loaded models.
+func (c *Client) ListPins(ctx context.Context) (*ListPinsResponse, error) {
+	var resp ListPinsResponse
+	if err := c.do(ctx, http.MethodGet, "/api/cache/pins", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Unpin removes a pinned prompt, allowing it to be evicted from the cache.
+func (c *Client) Unpin(ctx context.Context, req *UnpinRequest) error {
+	if err := c.do(ctx, http.MethodDelete, "/api/cache/pin", req, nil); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Tokenize converts a prompt, or messages formatted with the model's
+// template, to the model's tokens.
+func (c *Client) Tokenize(ctx context.Context, req *TokenizeRequest) (*TokenizeResponse, error) {
+	var resp TokenizeResponse
+	if err := c.do(ctx, http.MethodPost, "/api/tokenize", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Detokenize converts the model's tokens to text.
+func (c *Client) Detokenize(ctx context.Context, req *DetokenizeRequest) (*DetokenizeResponse, error) {
+	var resp DetokenizeResponse
+	if err := c.do(ctx, http.MethodPost, "/api/detokenize", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
 // Copy copies a model - creating a model with another name from an existing
 // model.
 func (c *Client) Copy(ctx context.Context, req *CopyRequest) error {
@@ -351,6 +419,15 @@ func (c *Client) Embed(ctx context.Context, req *EmbedRequest) (*EmbedResponse,
 	return &resp, nil
 }
 
+// Rerank scores documents by their relevance to a query.
+func (c *Client) Rerank(ctx context.Context, req *RerankRequest) (*RerankResponse, error) {
+	var resp RerankResponse
+	if err := c.do(ctx, http.MethodPost, "/api/rerank", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
 // Embeddings generates an embedding from a model.
 func (c *Client) Embeddings(ctx context.Context, req *EmbeddingRequest) (*EmbeddingResponse, error) {
 	var resp EmbeddingResponse
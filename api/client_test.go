@@ -253,3 +253,33 @@ func TestClientDo(t *testing.T) {
 		})
 	}
 }
+
+func TestClientAPIKey(t *testing.T) {
+	var got []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, r.Header.Get("Authorization"))
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{}`)
+	}))
+	defer ts.Close()
+
+	t.Setenv("OLLAMA_HOST", ts.URL)
+	t.Setenv("OLLAMA_API_KEY", "secret")
+
+	client, err := ClientFromEnvironment()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.List(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client.Pull(t.Context(), &PullRequest{Model: "model"}, func(ProgressResponse) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != 2 || got[0] != "Bearer secret" || got[1] != "Bearer secret" {
+		t.Errorf("expected bearer tokens, got %v", got)
+	}
+}
@@ -1,7 +1,9 @@
 package api
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"math"
@@ -83,6 +85,25 @@ type GenerateRequest struct {
 	// Options lists model-specific options. For example, temperature can be
 	// set through this field, if the model supports it.
 	Options map[string]any `json:"options"`
+
+	// Logprobs specifies whether to return the log probability of each
+	// generated token.
+	Logprobs bool `json:"logprobs,omitempty"`
+
+	// TopLogprobs is the number of most likely alternative tokens, up to
+	// [MaxTopLogprobs], to return at each position along with their log
+	// probabilities. It requires Logprobs to be set.
+	TopLogprobs int `json:"top_logprobs,omitempty"`
+
+	// N is the number of completions to generate for the prompt; 1 by
+	// default. Streamed responses are labeled with the Index of the
+	// completion they belong to, while a non-streamed response returns
+	// every completion in Choices.
+	N int `json:"n,omitempty"`
+
+	// Priority is the scheduling priority of the request, interactive by
+	// default.
+	Priority Priority `json:"priority,omitempty"`
 }
 
 // ChatRequest describes a request sent by [Client.Chat].
@@ -106,8 +127,82 @@ type ChatRequest struct {
 	// Tools is an optional list of tools the model has access to.
 	Tools `json:"tools,omitempty"`
 
+	// ToolChoice controls whether the model calls tools. The model decides
+	// by default.
+	ToolChoice *ToolChoice `json:"tool_choice,omitempty"`
+
 	// Options lists model-specific options.
 	Options map[string]any `json:"options"`
+
+	// Logprobs, TopLogprobs, N and Priority are the same as in
+	// [GenerateRequest].
+	Logprobs    bool     `json:"logprobs,omitempty"`
+	TopLogprobs int      `json:"top_logprobs,omitempty"`
+	N           int      `json:"n,omitempty"`
+	Priority    Priority `json:"priority,omitempty"`
+}
+
+const (
+	// ToolChoiceNone means the model does not call tools.
+	ToolChoiceNone = "none"
+
+	// ToolChoiceAuto means the model decides whether to call tools.
+	ToolChoiceAuto = "auto"
+
+	// ToolChoiceRequired means the model must call one or more tools.
+	ToolChoiceRequired = "required"
+
+	// ToolChoiceNamed means the model must call the function named in
+	// [ToolChoice.Function].
+	ToolChoiceNamed = "function"
+)
+
+// ToolChoice is either one of "none", "auto" or "required", or an object
+// naming the function the model must call, as in
+// {"type": "function", "function": {"name": "get_current_weather"}}.
+type ToolChoice struct {
+	Type     string             `json:"type"`
+	Function ToolChoiceFunction `json:"function"`
+}
+
+// ToolChoiceFunction names the function in a [ToolChoice].
+type ToolChoiceFunction struct {
+	Name string `json:"name"`
+}
+
+func (t *ToolChoice) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		switch s {
+		case ToolChoiceNone, ToolChoiceAuto, ToolChoiceRequired:
+			*t = ToolChoice{Type: s}
+			return nil
+		default:
+			return fmt.Errorf("invalid tool_choice %q", s)
+		}
+	}
+
+	type Alias ToolChoice
+	var a Alias
+	if err := json.Unmarshal(b, &a); err != nil {
+		return err
+	}
+
+	if a.Type != ToolChoiceNamed || a.Function.Name == "" {
+		return errors.New(`invalid tool_choice: expected "none", "auto", "required" or a function`)
+	}
+
+	*t = ToolChoice(a)
+	return nil
+}
+
+func (t ToolChoice) MarshalJSON() ([]byte, error) {
+	if t.Type != ToolChoiceNamed {
+		return json.Marshal(t.Type)
+	}
+
+	type Alias ToolChoice
+	return json.Marshal(Alias(t))
 }
 
 type Tools []Tool
@@ -130,6 +225,11 @@ type Message struct {
 	Content   string      `json:"content"`
 	Images    []ImageData `json:"images,omitempty"`
 	ToolCalls []ToolCall  `json:"tool_calls,omitempty"`
+
+	// ToolCallDeltas holds the parts of tool calls as they are generated
+	// when streaming a chat with tools. Each tool call is also sent in full
+	// in ToolCalls once it is complete.
+	ToolCallDeltas []ToolCallDelta `json:"tool_call_deltas,omitempty"`
 }
 
 func (m *Message) UnmarshalJSON(b []byte) error {
@@ -156,6 +256,18 @@ type ToolCallFunction struct {
 
 type ToolCallFunctionArguments map[string]any
 
+// ToolCallDelta is part of a tool call that is being streamed.
+type ToolCallDelta struct {
+	// Index is the index of the tool call, as in [ToolCallFunction].
+	Index int `json:"index"`
+
+	// Name is set in the first delta of each tool call.
+	Name string `json:"name,omitempty"`
+
+	// Arguments continues the JSON encoded arguments of the tool call.
+	Arguments string `json:"arguments,omitempty"`
+}
+
 func (t *ToolCallFunctionArguments) String() string {
 	bts, _ := json.Marshal(t)
 	return string(bts)
@@ -209,17 +321,106 @@ func (pt PropertyType) String() string {
 }
 
 type ToolFunction struct {
-	Name        string `json:"name"`
-	Description string `json:"description"`
-	Parameters  struct {
-		Type       string   `json:"type"`
-		Required   []string `json:"required"`
-		Properties map[string]struct {
-			Type        PropertyType `json:"type"`
-			Description string       `json:"description"`
-			Enum        []any        `json:"enum,omitempty"`
-		} `json:"properties"`
-	} `json:"parameters"`
+	Name        string     `json:"name"`
+	Description string     `json:"description"`
+	Parameters  ToolSchema `json:"parameters,omitempty"`
+}
+
+// ToolSchema is a JSON Schema, such as the parameters of a [ToolFunction].
+// The schema is kept as it was given so that every keyword is preserved when
+// it is encoded again. Methods return the keywords that templates commonly
+// use, and are empty if the keyword is missing or invalid.
+type ToolSchema json.RawMessage
+
+func (s ToolSchema) MarshalJSON() ([]byte, error) {
+	if len(s) == 0 {
+		return []byte("null"), nil
+	}
+
+	return s, nil
+}
+
+func (s *ToolSchema) UnmarshalJSON(b []byte) error {
+	b = bytes.TrimSpace(b)
+	switch {
+	case string(b) == "null":
+		*s = nil
+		return nil
+	case string(b) == "true", string(b) == "false":
+	case len(b) > 0 && b[0] == '{':
+	default:
+		return fmt.Errorf("invalid JSON schema: %s", b)
+	}
+
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, b); err != nil {
+		return err
+	}
+
+	*s = buf.Bytes()
+	return nil
+}
+
+func (s ToolSchema) String() string {
+	return string(s)
+}
+
+// keyword decodes the value of a keyword of the schema into v, returning
+// whether it was found
+func (s ToolSchema) keyword(name string, v any) bool {
+	var keywords map[string]json.RawMessage
+	if err := json.Unmarshal(s, &keywords); err != nil {
+		return false
+	}
+
+	raw, ok := keywords[name]
+	if !ok {
+		return false
+	}
+
+	return json.Unmarshal(raw, v) == nil
+}
+
+// Type returns the type keyword.
+func (s ToolSchema) Type() PropertyType {
+	var t PropertyType
+	s.keyword("type", &t)
+	return t
+}
+
+// Description returns the description keyword.
+func (s ToolSchema) Description() string {
+	var d string
+	s.keyword("description", &d)
+	return d
+}
+
+// Enum returns the enum keyword.
+func (s ToolSchema) Enum() []any {
+	var e []any
+	s.keyword("enum", &e)
+	return e
+}
+
+// Required returns the required keyword.
+func (s ToolSchema) Required() []string {
+	var r []string
+	s.keyword("required", &r)
+	return r
+}
+
+// Properties returns the schemas of the properties of an object.
+func (s ToolSchema) Properties() map[string]ToolSchema {
+	var p map[string]ToolSchema
+	s.keyword("properties", &p)
+	return p
+}
+
+// Items returns the schema of the items of an array.
+func (s ToolSchema) Items() ToolSchema {
+	var i ToolSchema
+	s.keyword("items", &i)
+	return i
 }
 
 func (t *ToolFunction) String() string {
@@ -237,9 +438,46 @@ type ChatResponse struct {
 
 	Done bool `json:"done"`
 
+	// Logprobs holds the log probabilities of the tokens in Message, if
+	// requested.
+	Logprobs []Logprob `json:"logprobs,omitempty"`
+
+	// Index and Choices are the same as in [GenerateResponse].
+	Index   int          `json:"index,omitempty"`
+	Choices []ChatChoice `json:"choices,omitempty"`
+
 	Metrics
 }
 
+// ChatChoice is one of the completions of a chat request with N > 1.
+type ChatChoice struct {
+	Index      int       `json:"index"`
+	Message    Message   `json:"message"`
+	DoneReason string    `json:"done_reason,omitempty"`
+	Logprobs   []Logprob `json:"logprobs,omitempty"`
+
+	// Error describes why the completion failed when DoneReason is "error".
+	// The other completions of the request are unaffected.
+	Error string `json:"error,omitempty"`
+}
+
+// MaxTopLogprobs is the largest number of alternative tokens that can be
+// requested per position.
+const MaxTopLogprobs = 20
+
+// TokenLogprob is a token and its log probability.
+type TokenLogprob struct {
+	Token   string  `json:"token"`
+	Logprob float64 `json:"logprob"`
+}
+
+// Logprob is the log probability of a generated token along with the most
+// likely tokens at its position.
+type Logprob struct {
+	TokenLogprob
+	TopLogprobs []TokenLogprob `json:"top_logprobs,omitempty"`
+}
+
 type Metrics struct {
 	TotalDuration      time.Duration `json:"total_duration,omitempty"`
 	LoadDuration       time.Duration `json:"load_duration,omitempty"`
@@ -271,6 +509,11 @@ type Options struct {
 	MirostatTau      float32  `json:"mirostat_tau,omitempty"`
 	MirostatEta      float32  `json:"mirostat_eta,omitempty"`
 	Stop             []string `json:"stop,omitempty"`
+
+	// LogitBias is added to the logits of tokens before sampling. Keys
+	// are token ids or strings, whose tokens are all biased. A bias of
+	// -100 or less effectively bans a token
+	LogitBias map[string]float32 `json:"logit_bias,omitempty"`
 }
 
 // Runner options which must be set when the model is loaded into memory
@@ -286,8 +529,41 @@ type Runner struct {
 	UseMMap   *bool `json:"use_mmap,omitempty"`
 	UseMLock  bool  `json:"use_mlock,omitempty"`
 	NumThread int   `json:"num_thread,omitempty"`
+
+	// DraftModel is the name of a smaller model with the same vocabulary
+	// that proposes NumDraft tokens at a time for the model to verify in a
+	// single batch (speculative decoding)
+	DraftModel string `json:"draft_model,omitempty"`
+	NumDraft   int    `json:"num_draft,omitempty"`
+
+	// GPUs restricts the model to the GPUs with these IDs, as reported
+	// in the server log and by [Client.ListRunning].
+	GPUs []string `json:"gpus,omitempty"`
+
+	// Placement chooses between GPUs that the model fits on by itself. See
+	// [PlacementBinpack] and [PlacementSpread].
+	Placement string `json:"placement,omitempty"`
+
+	// NoCPUOffload fails to load the model if it doesn't fit in VRAM,
+	// instead of loading some of its layers on the CPU.
+	NoCPUOffload bool `json:"no_cpu_offload,omitempty"`
+
+	// MaxVRAMFraction limits the model to this fraction of the VRAM of
+	// each GPU it is loaded on, between 0 and 1.
+	MaxVRAMFraction float32 `json:"max_vram_fraction,omitempty"`
 }
 
+const (
+	// PlacementBinpack loads a model on the GPU with the least free
+	// memory that it fits on, leaving room on the others for larger
+	// models.
+	PlacementBinpack = "binpack"
+
+	// PlacementSpread loads a model across all GPUs, even if it fits on
+	// one of them.
+	PlacementSpread = "spread"
+)
+
 // EmbedRequest is the request passed to [Client.Embed].
 type EmbedRequest struct {
 	// Model is the model name.
@@ -302,6 +578,18 @@ type EmbedRequest struct {
 
 	Truncate *bool `json:"truncate,omitempty"`
 
+	// Dimensions shortens embeddings to their first Dimensions values, for
+	// models trained so that these hold the most information. Embeddings are
+	// shortened before they are normalized.
+	Dimensions int `json:"dimensions,omitempty"`
+
+	// Normalize scales embeddings to unit length. It defaults to true.
+	Normalize *bool `json:"normalize,omitempty"`
+
+	// Priority is the scheduling priority of the request, as in
+	// [GenerateRequest]. Bulk indexing jobs should use [PriorityBatch].
+	Priority Priority `json:"priority,omitempty"`
+
 	// Options lists model-specific options.
 	Options map[string]any `json:"options"`
 }
@@ -316,6 +604,54 @@ type EmbedResponse struct {
 	PromptEvalCount int           `json:"prompt_eval_count,omitempty"`
 }
 
+// RerankRequest is the request passed to [Client.Rerank].
+type RerankRequest struct {
+	// Model is the model name.
+	Model string `json:"model"`
+
+	// Query is the text that documents are scored against.
+	Query string `json:"query"`
+
+	// Documents are the texts to score.
+	Documents []string `json:"documents"`
+
+	// TopN limits the results to the highest scoring documents. All
+	// documents are returned if it is 0.
+	TopN int `json:"top_n,omitempty"`
+
+	// KeepAlive controls how long the model will stay loaded in memory following
+	// this request.
+	KeepAlive *Duration `json:"keep_alive,omitempty"`
+
+	Truncate *bool `json:"truncate,omitempty"`
+
+	// Options lists model-specific options.
+	Options map[string]any `json:"options"`
+}
+
+// RerankResponse is the response from [Client.Rerank].
+type RerankResponse struct {
+	Model string `json:"model"`
+
+	// Results are sorted from the most to the least relevant document.
+	Results []RerankResult `json:"results"`
+
+	TotalDuration   time.Duration `json:"total_duration,omitempty"`
+	LoadDuration    time.Duration `json:"load_duration,omitempty"`
+	PromptEvalCount int           `json:"prompt_eval_count,omitempty"`
+}
+
+// RerankResult is the score of a document in [RerankResponse].
+type RerankResult struct {
+	// Index is the position of the document in [RerankRequest].
+	Index    int    `json:"index"`
+	Document string `json:"document"`
+
+	// RelevanceScore is between 0 and 1, with higher scores for documents
+	// that are more relevant to the query.
+	RelevanceScore float64 `json:"relevance_score"`
+}
+
 // EmbeddingRequest is the request passed to [Client.Embeddings].
 type EmbeddingRequest struct {
 	// Model is the model name.
@@ -465,6 +801,174 @@ type ProcessModelResponse struct {
 	Details   ModelDetails `json:"details,omitempty"`
 	ExpiresAt time.Time    `json:"expires_at"`
 	SizeVRAM  int64        `json:"size_vram"`
+
+	// Stats is the activity of the model. It is omitted while the model is
+	// loading.
+	Stats *ProcessStats `json:"stats,omitempty"`
+}
+
+// ProcessStats is the activity of a model in [ProcessModelResponse].
+type ProcessStats struct {
+	// ActiveRequests are being processed and QueuedRequests are waiting
+	// for a free slot.
+	ActiveRequests int `json:"active_requests"`
+	QueuedRequests int `json:"queued_requests"`
+
+	// SlotsInUse is how many of the model's Slots are processing requests.
+	SlotsInUse int `json:"slots_in_use"`
+	Slots      int `json:"slots"`
+
+	// ContextUsed is how many tokens are held in the cache, out of the
+	// ContextLength of all slots together.
+	ContextUsed   int `json:"context_used"`
+	ContextLength int `json:"context_length"`
+
+	// PromptTokensPerSecond and TokensPerSecond are the average rates at
+	// which prompt tokens were processed and tokens were generated over
+	// the last minute.
+	PromptTokensPerSecond float64 `json:"prompt_tokens_per_second"`
+	TokensPerSecond       float64 `json:"tokens_per_second"`
+
+	// Layers are the ranges of the model's layers and the devices that
+	// they are loaded on, as estimated when the model was loaded.
+	Layers []LayerPlacement `json:"layers,omitempty"`
+}
+
+// LayerPlacement is a range of layers, from First to Last inclusive, that
+// are loaded on the same device.
+type LayerPlacement struct {
+	Library string `json:"library"`
+	ID      string `json:"id"`
+	First   int    `json:"first"`
+	Last    int    `json:"last"`
+}
+
+// Quota limits how much a client can use the server's inference endpoints.
+// Limits that are zero aren't enforced.
+type Quota struct {
+	RequestsPerMinute  int   `json:"requests_per_minute,omitempty"`
+	ConcurrentRequests int   `json:"concurrent_requests,omitempty"`
+	TokensPerDay       int64 `json:"tokens_per_day,omitempty"`
+}
+
+// QuotasResponse is the response from [Client.Quotas].
+type QuotasResponse struct {
+	Clients []ClientQuota `json:"clients"`
+}
+
+// ClientQuota is the usage of a client in [QuotasResponse] and the quota
+// it is limited to.
+type ClientQuota struct {
+	// Name is the name of the client in the server's quota configuration,
+	// or its IP address if it isn't listed there.
+	Name  string `json:"name"`
+	Quota Quota  `json:"quota"`
+
+	ActiveRequests     int `json:"active_requests"`
+	RequestsLastMinute int `json:"requests_last_minute"`
+
+	// TokensToday is the number of prompt and generated tokens counted
+	// against the client's quota since midnight UTC.
+	TokensToday int64 `json:"tokens_today"`
+
+	// RejectedRequests is the number of requests refused because the
+	// client was over its quota since the server started.
+	RejectedRequests int64 `json:"rejected_requests"`
+}
+
+// PinRequest is the request passed to [Client.Pin].
+type PinRequest struct {
+	// Model is the model name.
+	Model string `json:"model"`
+
+	// Prompt is pinned as given, without applying the model's template.
+	Prompt string `json:"prompt,omitempty"`
+
+	// Messages are formatted with the model's template, as for
+	// [ChatRequest], and pinned. One of Prompt or Messages is required.
+	Messages []Message `json:"messages,omitempty"`
+
+	// KeepAlive controls how long the model will stay loaded, and so how
+	// long the prompt stays pinned, following the request.
+	KeepAlive *Duration `json:"keep_alive,omitempty"`
+
+	// Options lists model-specific options.
+	Options map[string]any `json:"options"`
+}
+
+// PinResponse is a prompt that is pinned in the cache of a loaded model. It
+// is returned by [Client.Pin] and listed in [ListPinsResponse].
+type PinResponse struct {
+	Model string `json:"model"`
+
+	// ID identifies the pinned prompt in [UnpinRequest] while the model
+	// is loaded.
+	ID int `json:"id"`
+
+	// Tokens is the number of tokens that are pinned.
+	Tokens int `json:"tokens"`
+}
+
+// ListPinsResponse is the response from [Client.ListPins].
+type ListPinsResponse struct {
+	Pins []PinResponse `json:"pins"`
+}
+
+// UnpinRequest is the request passed to [Client.Unpin].
+type UnpinRequest struct {
+	Model string `json:"model"`
+	ID    int    `json:"id"`
+}
+
+// TokenizeRequest is the request passed to [Client.Tokenize].
+type TokenizeRequest struct {
+	// Model is the model name.
+	Model string `json:"model"`
+
+	// Prompt is tokenized as given, without applying the model's template.
+	Prompt string `json:"prompt,omitempty"`
+
+	// Messages are formatted with the model's template, as for
+	// [ChatRequest], and tokenized. One of Prompt or Messages is required.
+	Messages []Message `json:"messages,omitempty"`
+
+	// Tools are included in the template when formatting Messages.
+	Tools `json:"tools,omitempty"`
+
+	// KeepAlive controls how long the model will stay loaded in memory following
+	// this request.
+	KeepAlive *Duration `json:"keep_alive,omitempty"`
+
+	// Options lists model-specific options.
+	Options map[string]any `json:"options"`
+}
+
+// TokenizeResponse is the response from [Client.Tokenize].
+type TokenizeResponse struct {
+	Model  string `json:"model"`
+	Tokens []int  `json:"tokens"`
+}
+
+// DetokenizeRequest is the request passed to [Client.Detokenize].
+type DetokenizeRequest struct {
+	// Model is the model name.
+	Model string `json:"model"`
+
+	// Tokens are the tokens to convert to text.
+	Tokens []int `json:"tokens"`
+
+	// KeepAlive controls how long the model will stay loaded in memory following
+	// this request.
+	KeepAlive *Duration `json:"keep_alive,omitempty"`
+
+	// Options lists model-specific options.
+	Options map[string]any `json:"options"`
+}
+
+// DetokenizeResponse is the response from [Client.Detokenize].
+type DetokenizeResponse struct {
+	Model   string `json:"model"`
+	Content string `json:"content"`
 }
 
 type RetrieveModelResponse struct {
@@ -499,9 +1003,32 @@ type GenerateResponse struct {
 	// can be sent in the next request to keep a conversational memory.
 	Context []int `json:"context,omitempty"`
 
+	// Logprobs holds the log probabilities of the tokens in Response, if
+	// requested.
+	Logprobs []Logprob `json:"logprobs,omitempty"`
+
+	// Index identifies the completion a streamed response belongs to when
+	// more than one is requested.
+	Index int `json:"index,omitempty"`
+
+	// Choices holds every completion of a non-streamed request with N > 1.
+	// The first is also returned in Response.
+	Choices []GenerateChoice `json:"choices,omitempty"`
+
 	Metrics
 }
 
+// GenerateChoice is one of the completions of a generate request with N > 1.
+type GenerateChoice struct {
+	Index      int       `json:"index"`
+	Response   string    `json:"response"`
+	DoneReason string    `json:"done_reason,omitempty"`
+	Logprobs   []Logprob `json:"logprobs,omitempty"`
+
+	// Error is the same as in [ChatChoice].
+	Error string `json:"error,omitempty"`
+}
+
 // ModelDetails provides details about a model.
 type ModelDetails struct {
 	ParentModel       string   `json:"parent_model"`
@@ -619,6 +1146,22 @@ func (opts *Options) FromMap(m map[string]any) error {
 					slice[i] = str
 				}
 				field.Set(reflect.ValueOf(slice))
+			case reflect.Map:
+				// JSON unmarshals to map[string]any, not map[string]float32
+				val, ok := val.(map[string]any)
+				if !ok {
+					return fmt.Errorf("option %q must be of type object", key)
+				}
+				// convert map[string]any to map[string]float32
+				m := make(map[string]float32, len(val))
+				for k, v := range val {
+					f, ok := v.(float64)
+					if !ok {
+						return fmt.Errorf("option %q must be an object of numbers", key)
+					}
+					m[k] = float32(f)
+				}
+				field.Set(reflect.ValueOf(m))
 			case reflect.Pointer:
 				var b bool
 				if field.Type() == reflect.TypeOf(&b) {
@@ -670,10 +1213,37 @@ func DefaultOptions() Options {
 			LowVRAM:   false,
 			UseMLock:  false,
 			UseMMap:   nil,
+			NumDraft:  4,
 		},
 	}
 }
 
+// Priority is how urgently the server schedules a request. Requests with
+// [PriorityInteractive] are run ahead of those with [PriorityBatch], and
+// requests of the same priority are shared fairly between clients and
+// models.
+type Priority string
+
+const (
+	PriorityInteractive Priority = "interactive"
+	PriorityBatch       Priority = "batch"
+)
+
+func (p *Priority) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	switch Priority(s) {
+	case "", PriorityInteractive, PriorityBatch:
+		*p = Priority(s)
+		return nil
+	default:
+		return fmt.Errorf("invalid priority %q, expected %q or %q", s, PriorityInteractive, PriorityBatch)
+	}
+}
+
 type Duration struct {
 	time.Duration
 }
@@ -765,6 +1335,25 @@ func FormatParams(params map[string][]string) (map[string]any, error) {
 				case reflect.Slice:
 					// TODO: only string slices are supported right now
 					out[key] = vals
+				case reflect.Map:
+					// each value is a key and a number separated by a colon,
+					// such as 128001:-100
+					m := make(map[string]any, len(vals))
+					for _, v := range vals {
+						i := strings.LastIndex(v, ":")
+						if i < 0 {
+							return nil, fmt.Errorf("invalid %s value %s", key, v)
+						}
+
+						f, err := strconv.ParseFloat(v[i+1:], 32)
+						if err != nil {
+							return nil, fmt.Errorf("invalid float value %s", v)
+						}
+
+						m[v[:i]] = f
+					}
+
+					out[key] = m
 				case reflect.Pointer:
 					var b bool
 					if field.Type() == reflect.TypeOf(&b) {
@@ -1,6 +1,7 @@
 package api
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"math"
@@ -209,6 +210,29 @@ func TestUseMmapFormatParams(t *testing.T) {
 	}
 }
 
+func TestLogitBiasParsingFromJSON(t *testing.T) {
+	var oMap map[string]any
+	err := json.Unmarshal([]byte(`{ "logit_bias": { "128001": -100, "hello": 2.5 } }`), &oMap)
+	require.NoError(t, err)
+
+	opts := DefaultOptions()
+	require.NoError(t, opts.FromMap(oMap))
+	assert.Equal(t, map[string]float32{"128001": -100, "hello": 2.5}, opts.LogitBias)
+
+	err = json.Unmarshal([]byte(`{ "logit_bias": { "128001": "ban" } }`), &oMap)
+	require.NoError(t, err)
+	require.Error(t, opts.FromMap(oMap))
+}
+
+func TestLogitBiasFormatParams(t *testing.T) {
+	resp, err := FormatParams(map[string][]string{"logit_bias": {"128001:-100", "a:b:1.5"}})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{"128001": -100.0, "a:b": 1.5}, resp["logit_bias"])
+
+	_, err = FormatParams(map[string][]string{"logit_bias": {"128001"}})
+	require.Error(t, err)
+}
+
 func TestMessage_UnmarshalJSON(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -372,3 +396,170 @@ func TestPropertyType_MarshalJSON(t *testing.T) {
 		})
 	}
 }
+
+func TestToolChoice_UnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected ToolChoice
+		wantErr  bool
+	}{
+		{
+			name:     "none",
+			input:    `"none"`,
+			expected: ToolChoice{Type: ToolChoiceNone},
+		},
+		{
+			name:     "required",
+			input:    `"required"`,
+			expected: ToolChoice{Type: ToolChoiceRequired},
+		},
+		{
+			name:     "function",
+			input:    `{"type": "function", "function": {"name": "get_weather"}}`,
+			expected: ToolChoice{Type: ToolChoiceNamed, Function: ToolChoiceFunction{Name: "get_weather"}},
+		},
+		{
+			name:    "unknown string",
+			input:   `"any"`,
+			wantErr: true,
+		},
+		{
+			name:    "function without name",
+			input:   `{"type": "function"}`,
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var tc ToolChoice
+			err := json.Unmarshal([]byte(test.input), &tc)
+			if test.wantErr {
+				if err == nil {
+					t.Error("expected error")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if tc != test.expected {
+				t.Errorf("got %+v, expected %+v", tc, test.expected)
+			}
+
+			data, err := json.Marshal(tc)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var roundtrip ToolChoice
+			if err := json.Unmarshal(data, &roundtrip); err != nil || roundtrip != tc {
+				t.Errorf("round trip of %s = %+v, %v", data, roundtrip, err)
+			}
+		})
+	}
+}
+
+func TestPriority_UnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected Priority
+		wantErr  bool
+	}{
+		{input: `{}`},
+		{input: `{"priority": "interactive"}`, expected: PriorityInteractive},
+		{input: `{"priority": "batch"}`, expected: PriorityBatch},
+		{input: `{"priority": "urgent"}`, wantErr: true},
+		{input: `{"priority": 1}`, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			var req GenerateRequest
+			err := json.Unmarshal([]byte(test.input), &req)
+			if test.wantErr {
+				if err == nil {
+					t.Error("expected error")
+				}
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, req.Priority)
+		})
+	}
+}
+
+func TestToolSchema(t *testing.T) {
+	schema := `{
+		"type": "object",
+		"properties": {
+			"query": {"type": "string", "description": "The query", "minLength": 1},
+			"filters": {
+				"type": "array",
+				"items": {
+					"type": "object",
+					"properties": {
+						"field": {"type": "string", "enum": ["title", "body"]},
+						"value": {"anyOf": [{"type": "string"}, {"type": "number"}]}
+					}
+				}
+			},
+			"since": {"type": ["string", "null"], "format": "date", "default": null}
+		},
+		"required": ["query"],
+		"additionalProperties": false
+	}`
+
+	var tf ToolFunction
+	if err := json.Unmarshal([]byte(`{"name": "search", "parameters": `+schema+`}`), &tf); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := json.Marshal(tf.Parameters)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var want bytes.Buffer
+	if err := json.Compact(&want, []byte(schema)); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(got) != want.String() {
+		t.Errorf("parameters did not round trip:\ngot  %s\nwant %s", got, want.String())
+	}
+
+	params := tf.Parameters
+	assert.Equal(t, PropertyType{"object"}, params.Type())
+	assert.Equal(t, []string{"query"}, params.Required())
+
+	props := params.Properties()
+	assert.Len(t, props, 3)
+	assert.Equal(t, "The query", props["query"].Description())
+	assert.Equal(t, PropertyType{"string", "null"}, props["since"].Type())
+
+	item := props["filters"].Items()
+	assert.Equal(t, PropertyType{"object"}, item.Type())
+	assert.Equal(t, []any{"title", "body"}, item.Properties()["field"].Enum())
+
+	assert.Empty(t, props["query"].Properties())
+	assert.Empty(t, ToolSchema(nil).Type())
+
+	t.Run("no parameters", func(t *testing.T) {
+		b, err := json.Marshal(ToolFunction{Name: "now"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.JSONEq(t, `{"name": "now", "description": ""}`, string(b))
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		var tf ToolFunction
+		require.Error(t, json.Unmarshal([]byte(`{"name": "search", "parameters": "query"}`), &tf))
+	})
+}
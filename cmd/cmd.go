@@ -494,6 +494,11 @@ func ListRunningHandler(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
+	verbose, err := cmd.Flags().GetBool("verbose")
+	if err != nil {
+		return err
+	}
+
 	var data [][]string
 
 	for _, m := range models.Models {
@@ -519,12 +524,21 @@ func ListRunningHandler(cmd *cobra.Command, args []string) error {
 			} else {
 				until = format.HumanTime(m.ExpiresAt, "Never")
 			}
-			data = append(data, []string{m.Name, m.Digest[:12], format.HumanBytes(m.Size), procStr, until})
+			row := []string{m.Name, m.Digest[:12], format.HumanBytes(m.Size), procStr, until}
+			if verbose {
+				row = append(row, processStats(m.Stats)...)
+			}
+			data = append(data, row)
 		}
 	}
 
+	header := []string{"NAME", "ID", "SIZE", "PROCESSOR", "UNTIL"}
+	if verbose {
+		header = append(header, "REQUESTS", "SLOTS", "CONTEXT", "TOKENS/S", "LAYERS")
+	}
+
 	table := tablewriter.NewWriter(os.Stdout)
-	table.SetHeader([]string{"NAME", "ID", "SIZE", "PROCESSOR", "UNTIL"})
+	table.SetHeader(header)
 	table.SetHeaderAlignment(tablewriter.ALIGN_LEFT)
 	table.SetAlignment(tablewriter.ALIGN_LEFT)
 	table.SetHeaderLine(false)
@@ -537,6 +551,37 @@ func ListRunningHandler(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
+// processStats formats the activity of a running model for the verbose
+// columns of ListRunningHandler
+func processStats(stats *api.ProcessStats) []string {
+	if stats == nil {
+		return []string{"-", "-", "-", "-", "-"}
+	}
+
+	var contextUsed string
+	if stats.ContextLength > 0 {
+		contextUsed = fmt.Sprintf("%d%%", int(math.Round(float64(stats.ContextUsed)/float64(stats.ContextLength)*100)))
+	}
+
+	var layers []string
+	for _, l := range stats.Layers {
+		device := strings.ToUpper(l.Library)
+		if l.Library != "cpu" {
+			device += " " + l.ID
+		}
+
+		layers = append(layers, fmt.Sprintf("%d-%d %s", l.First, l.Last, device))
+	}
+
+	return []string{
+		fmt.Sprintf("%d active, %d queued", stats.ActiveRequests, stats.QueuedRequests),
+		fmt.Sprintf("%d/%d", stats.SlotsInUse, stats.Slots),
+		contextUsed,
+		fmt.Sprintf("%.1f", stats.TokensPerSecond),
+		strings.Join(layers, ", "),
+	}
+}
+
 func DeleteHandler(cmd *cobra.Command, args []string) error {
 	client, err := api.ClientFromEnvironment()
 	if err != nil {
@@ -1321,6 +1366,8 @@ func NewCLI() *cobra.Command {
 		RunE:    ListRunningHandler,
 	}
 
+	psCmd.Flags().BoolP("verbose", "v", false, "Show requests, cache usage, throughput and layer placement")
+
 	copyCmd := &cobra.Command{
 		Use:     "cp SOURCE DESTINATION",
 		Short:   "Copy a model",
@@ -1351,7 +1398,7 @@ func NewCLI() *cobra.Command {
 
 	envVars := envconfig.AsMap()
 
-	envs := []envconfig.EnvVar{envVars["OLLAMA_HOST"]}
+	envs := []envconfig.EnvVar{envVars["OLLAMA_HOST"], envVars["OLLAMA_API_KEY"]}
 
 	for _, cmd := range []*cobra.Command{
 		createCmd,
@@ -1368,7 +1415,7 @@ func NewCLI() *cobra.Command {
 	} {
 		switch cmd {
 		case runCmd:
-			appendEnvDocs(cmd, []envconfig.EnvVar{envVars["OLLAMA_HOST"], envVars["OLLAMA_NOHISTORY"]})
+			appendEnvDocs(cmd, []envconfig.EnvVar{envVars["OLLAMA_HOST"], envVars["OLLAMA_API_KEY"], envVars["OLLAMA_NOHISTORY"]})
 		case serveCmd:
 			appendEnvDocs(cmd, []envconfig.EnvVar{
 				envVars["OLLAMA_DEBUG"],
@@ -1377,12 +1424,17 @@ func NewCLI() *cobra.Command {
 				envVars["OLLAMA_MAX_LOADED_MODELS"],
 				envVars["OLLAMA_MAX_QUEUE"],
 				envVars["OLLAMA_MODELS"],
+				envVars["OLLAMA_MODEL_CONFIG"],
 				envVars["OLLAMA_NUM_PARALLEL"],
 				envVars["OLLAMA_NOPRUNE"],
 				envVars["OLLAMA_ORIGINS"],
 				envVars["OLLAMA_SCHED_SPREAD"],
 				envVars["OLLAMA_FLASH_ATTENTION"],
 				envVars["OLLAMA_KV_CACHE_TYPE"],
+				envVars["OLLAMA_PROMPT_CACHE_DIR"],
+				envVars["OLLAMA_QUOTAS"],
+				envVars["OLLAMA_TRUSTED_PROXIES"],
+				envVars["OLLAMA_AUTH_KEYS"],
 				envVars["OLLAMA_LLM_LIBRARY"],
 				envVars["OLLAMA_GPU_OVERHEAD"],
 				envVars["OLLAMA_LOAD_TIMEOUT"],
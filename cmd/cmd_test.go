@@ -664,6 +664,75 @@ func TestListHandler(t *testing.T) {
 	}
 }
 
+func TestListRunningHandler(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/ps" || r.Method != http.MethodGet {
+			t.Errorf("unexpected request to %s %s", r.Method, r.URL.Path)
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+
+		response := api.ProcessResponse{Models: []api.ProcessModelResponse{
+			{
+				Name:      "model1",
+				Digest:    "sha256:abc123def456",
+				Size:      1024,
+				SizeVRAM:  1024,
+				ExpiresAt: time.Now().Add(time.Hour),
+				Stats: &api.ProcessStats{
+					ActiveRequests:  2,
+					QueuedRequests:  1,
+					SlotsInUse:      2,
+					Slots:           4,
+					ContextUsed:     1024,
+					ContextLength:   8192,
+					TokensPerSecond: 25,
+					Layers: []api.LayerPlacement{
+						{Library: "cpu", ID: "0", First: 0, Last: 3},
+						{Library: "cuda", ID: "0", First: 4, Last: 8},
+					},
+				},
+			},
+			{
+				Name:      "model2",
+				Digest:    "sha256:def456abc123",
+				Size:      2048,
+				ExpiresAt: time.Now().Add(time.Hour),
+			},
+		}}
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			t.Fatal(err)
+		}
+	}))
+	defer mockServer.Close()
+
+	t.Setenv("OLLAMA_HOST", mockServer.URL)
+
+	cmd := &cobra.Command{}
+	cmd.SetContext(context.TODO())
+	cmd.Flags().Bool("verbose", true, "")
+
+	oldStdout := os.Stdout
+	r, w, _ := os.Pipe()
+	os.Stdout = w
+
+	err := ListRunningHandler(cmd, nil)
+
+	w.Close()
+	os.Stdout = oldStdout
+	output, _ := io.ReadAll(r)
+
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	for _, want := range []string{"REQUESTS", "2 active, 1 queued", "2/4", "13%", "25.0", "0-3 CPU, 4-8 CUDA 0"} {
+		if !strings.Contains(string(output), want) {
+			t.Errorf("expected output to contain %q, got:\n%s", want, output)
+		}
+	}
+}
+
 func TestCreateHandler(t *testing.T) {
 	tests := []struct {
 		name           string
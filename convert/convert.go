@@ -198,7 +198,7 @@ func ConvertModel(fsys fs.FS, ws io.WriteSeeker) error {
 		conv = &phi3Model{}
 	case "Qwen2ForCausalLM":
 		conv = &qwen2Model{}
-	case "BertModel":
+	case "BertModel", "BertForSequenceClassification":
 		conv = &bertModel{}
 	case "CohereForCausalLM":
 		conv = &commandrModel{}
@@ -3,6 +3,7 @@ package convert
 import (
 	"cmp"
 	"encoding/json"
+	"fmt"
 	"io/fs"
 	"path/filepath"
 	"slices"
@@ -29,7 +30,13 @@ type bertModel struct {
 	LayerNormEpsilon      float32 `json:"layer_norm_epsilon"`
 	NormEpsilon           float32 `json:"norm_epsilon"`
 
+	ID2Label map[string]string `json:"id2label"`
+
 	PoolingType uint32
+
+	// classifier is set for cross-encoders, which score a pair of texts
+	// with a classification head instead of pooling the embeddings
+	classifier bool
 }
 
 var (
@@ -38,6 +45,16 @@ var (
 )
 
 func (p *bertModel) parseMore(fsys fs.FS) error {
+	if slices.Contains(p.Architectures, "BertForSequenceClassification") {
+		if len(p.ID2Label) > 1 {
+			return fmt.Errorf("unsupported classifier with %d labels", len(p.ID2Label))
+		}
+
+		p.classifier = true
+		p.PoolingType = 4
+		return nil
+	}
+
 	bts, err := fs.ReadFile(fsys, "modules.json")
 	if err != nil {
 		return err
@@ -135,11 +152,12 @@ func (p *bertModel) KV(t *Tokenizer) ggml.KV {
 func (p *bertModel) Tensors(ts []Tensor) []ggml.Tensor {
 	var out []ggml.Tensor
 	for _, t := range ts {
-		if slices.Contains([]string{
-			"embeddings.position_ids",
-			"pooler.dense.weight",
-			"pooler.dense.bias",
-		}, t.Name()) {
+		if t.Name() == "embeddings.position_ids" {
+			continue
+		}
+
+		// the pooler is only used by the classification head
+		if !p.classifier && slices.Contains([]string{"cls.weight", "cls.bias"}, t.Name()) {
 			continue
 		}
 
@@ -156,6 +174,7 @@ func (p *bertModel) Tensors(ts []Tensor) []ggml.Tensor {
 
 func (bertModel) Replacements() []string {
 	return []string{
+		"bert.", "",
 		"encoder.layer", "blk",
 		"encoder.layers", "blk",
 		"embeddings.word_embeddings", "token_embd",
@@ -170,5 +189,7 @@ func (bertModel) Replacements() []string {
 		"intermediate.dense", "ffn_up",
 		"output.dense", "ffn_down",
 		"output.LayerNorm", "layer_output_norm",
+		"pooler.dense", "cls",
+		"classifier", "cls.output",
 	}
 }
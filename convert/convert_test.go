@@ -210,6 +210,84 @@ func TestConvertInvalidDatatype(t *testing.T) {
 	}
 }
 
+func TestConvertBertClassifier(t *testing.T) {
+	tempDir := t.TempDir()
+
+	shapes := map[string][]int{
+		"bert.embeddings.word_embeddings.weight":           {4, 2},
+		"bert.encoder.layer.0.attention.self.query.weight": {2, 2},
+		"bert.pooler.dense.weight":                         {2, 2},
+		"bert.pooler.dense.bias":                           {2},
+		"classifier.weight":                                {1, 2},
+		"classifier.bias":                                  {1},
+	}
+
+	td := map[string]*tensorData{}
+	var offset int
+	for name, shape := range shapes {
+		n := 4
+		for _, d := range shape {
+			n *= d
+		}
+
+		td[name] = &tensorData{Offsets: []int{offset, offset + n}, Type: "F32", Shape: shape}
+		offset += n
+	}
+
+	header, err := json.Marshal(td)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, int64(len(header))); err != nil {
+		t.Fatal(err)
+	}
+	buf.Write(header)
+	buf.Write(make([]byte, offset))
+
+	for name, data := range map[string][]byte{
+		"model.safetensors": buf.Bytes(),
+		"config.json": []byte(`{
+			"architectures": ["BertForSequenceClassification"],
+			"num_hidden_layers": 1,
+			"hidden_size": 2,
+			"num_attention_heads": 1,
+			"max_position_embeddings": 8,
+			"vocab_size": 4,
+			"id2label": {"0": "LABEL_0"}
+		}`),
+		"tokenizer.json": []byte(`{"model": {"vocab": {"[PAD]": 0, "[CLS]": 1, "[SEP]": 2, "hello": 3}}}`),
+	} {
+		if err := os.WriteFile(filepath.Join(tempDir, name), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, kv, tensors := convertFull(t, os.DirFS(tempDir))
+
+	if arch := kv.Architecture(); arch != "bert" {
+		t.Errorf("expected architecture bert, got %s", arch)
+	}
+
+	if pooling := kv["bert.pooling_type"]; pooling != uint32(4) {
+		t.Errorf("expected rank pooling, got %v", pooling)
+	}
+
+	var names []string
+	for _, tensor := range tensors.Items() {
+		names = append(names, tensor.Name)
+	}
+	slices.Sort(names)
+
+	// the bert. prefix is removed and the pooler and classifier are kept
+	// as the classification head
+	want := []string{"blk.0.attn_q.weight", "cls.bias", "cls.output.bias", "cls.output.weight", "cls.weight", "token_embd.weight"}
+	if !slices.Equal(names, want) {
+		t.Errorf("expected tensors %v, got %v", want, names)
+	}
+}
+
 func generateSafetensorTestData(t *testing.T, tempDir string, tensorData map[string]*tensorData) {
 	data, err := json.Marshal(tensorData)
 	if err != nil {
@@ -79,6 +79,20 @@ func AllowedOrigins() (origins []string) {
 	return origins
 }
 
+// TrustedProxies returns the addresses of the proxies that the server trusts
+// to report the IP address of the client of a request in X-Forwarded-For and
+// X-Real-IP. No proxies are trusted by default. TrustedProxies can be
+// configured via the OLLAMA_TRUSTED_PROXIES environment variable.
+func TrustedProxies() (proxies []string) {
+	for p := range strings.SplitSeq(Var("OLLAMA_TRUSTED_PROXIES"), ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			proxies = append(proxies, p)
+		}
+	}
+
+	return proxies
+}
+
 // Models returns the path to the models directory. Models directory can be configured via the OLLAMA_MODELS environment variable.
 // Default is $HOME/.ollama/models
 func Models() string {
@@ -168,6 +182,18 @@ var (
 	MultiUserCache = Bool("OLLAMA_MULTIUSER_CACHE")
 	// Enable the new Ollama engine
 	NewEngine = Bool("OLLAMA_NEW_ENGINE")
+	// PromptCacheDir is the directory that shared prompt prefixes are saved to so that they
+	// can be reused after a model is reloaded. Disabled if empty.
+	PromptCacheDir = String("OLLAMA_PROMPT_CACHE_DIR")
+	// Quotas is the path to a JSON file of per client request and token quotas. Disabled if empty.
+	Quotas = String("OLLAMA_QUOTAS")
+	// AuthKeys is the path to a JSON file of the API keys that may use the server and their roles.
+	// Authentication is disabled if empty.
+	AuthKeys = String("OLLAMA_AUTH_KEYS")
+	// APIKey is the API key that the client sends to the server.
+	APIKey = String("OLLAMA_API_KEY")
+	// ModelConfig is the path to a JSON file of options that the server uses for particular models.
+	ModelConfig = String("OLLAMA_MODEL_CONFIG")
 	// ContextLength sets the default context length
 	ContextLength = Uint("OLLAMA_CONTEXT_LENGTH", 2048)
 )
@@ -238,6 +264,8 @@ type EnvVar struct {
 
 func AsMap() map[string]EnvVar {
 	ret := map[string]EnvVar{
+		"OLLAMA_API_KEY":           {"OLLAMA_API_KEY", APIKey(), "API key to send to the ollama server"},
+		"OLLAMA_AUTH_KEYS":         {"OLLAMA_AUTH_KEYS", AuthKeys(), "Path to a JSON file of the API keys allowed to use the server and their roles"},
 		"OLLAMA_DEBUG":             {"OLLAMA_DEBUG", Debug(), "Show additional debug information (e.g. OLLAMA_DEBUG=1)"},
 		"OLLAMA_FLASH_ATTENTION":   {"OLLAMA_FLASH_ATTENTION", FlashAttention(), "Enabled flash attention"},
 		"OLLAMA_KV_CACHE_TYPE":     {"OLLAMA_KV_CACHE_TYPE", KvCacheType(), "Quantization type for the K/V cache (default: f16)"},
@@ -249,11 +277,15 @@ func AsMap() map[string]EnvVar {
 		"OLLAMA_MAX_LOADED_MODELS": {"OLLAMA_MAX_LOADED_MODELS", MaxRunners(), "Maximum number of loaded models per GPU"},
 		"OLLAMA_MAX_QUEUE":         {"OLLAMA_MAX_QUEUE", MaxQueue(), "Maximum number of queued requests"},
 		"OLLAMA_MODELS":            {"OLLAMA_MODELS", Models(), "The path to the models directory"},
+		"OLLAMA_MODEL_CONFIG":      {"OLLAMA_MODEL_CONFIG", ModelConfig(), "Path to a JSON file configuring how particular models run and which to preload"},
 		"OLLAMA_NOHISTORY":         {"OLLAMA_NOHISTORY", NoHistory(), "Do not preserve readline history"},
 		"OLLAMA_NOPRUNE":           {"OLLAMA_NOPRUNE", NoPrune(), "Do not prune model blobs on startup"},
 		"OLLAMA_NUM_PARALLEL":      {"OLLAMA_NUM_PARALLEL", NumParallel(), "Maximum number of parallel requests"},
 		"OLLAMA_ORIGINS":           {"OLLAMA_ORIGINS", AllowedOrigins(), "A comma separated list of allowed origins"},
+		"OLLAMA_PROMPT_CACHE_DIR":  {"OLLAMA_PROMPT_CACHE_DIR", PromptCacheDir(), "Directory to save shared prompt prefixes to across model reloads"},
+		"OLLAMA_QUOTAS":            {"OLLAMA_QUOTAS", Quotas(), "Path to a JSON file of per client request and token quotas"},
 		"OLLAMA_SCHED_SPREAD":      {"OLLAMA_SCHED_SPREAD", SchedSpread(), "Always schedule model across all GPUs"},
+		"OLLAMA_TRUSTED_PROXIES":   {"OLLAMA_TRUSTED_PROXIES", TrustedProxies(), "A comma separated list of proxy IP addresses or CIDR prefixes trusted to forward client IP addresses"},
 		"OLLAMA_MULTIUSER_CACHE":   {"OLLAMA_MULTIUSER_CACHE", MultiUserCache(), "Optimize prompt caching for multi-user scenarios"},
 		"OLLAMA_CONTEXT_LENGTH":    {"OLLAMA_CONTEXT_LENGTH", ContextLength(), "Context length to use unless otherwise specified (default: 2048)"},
 		"OLLAMA_NEW_ENGINE":        {"OLLAMA_NEW_ENGINE", NewEngine(), "Enable the new Ollama engine"},
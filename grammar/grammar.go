@@ -0,0 +1,542 @@
+// Package grammar implements GBNF grammars and the matching of text against
+// them, for use in constrained generation.
+//
+// The grammar format is the one used by llama.cpp:
+//
+//	root   ::= answer
+//	answer ::= "yes" | "no" | [0-9]+
+//
+// Rules are made of literals ("..."), character classes ([a-z], [^"]),
+// any character (.), references to other rules and parenthesized groups,
+// which can be repeated with *, +, ?, {m}, {m,} or {m,n}.
+package grammar
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// charRange is an inclusive range of runes
+type charRange struct {
+	lo, hi rune
+}
+
+// element is a single symbol in an alternative: either a set of characters
+// or a reference to another rule
+type element struct {
+	ranges  []charRange
+	negated bool
+
+	// rule is the index of the referenced rule, or -1 for a character set
+	rule int
+}
+
+func (e element) isChar() bool {
+	return e.rule < 0
+}
+
+func (e element) matches(r rune) bool {
+	for _, cr := range e.ranges {
+		if r >= cr.lo && r <= cr.hi {
+			return !e.negated
+		}
+	}
+
+	return e.negated
+}
+
+// intersects reports whether e matches any rune in [lo, hi]
+func (e element) intersects(lo, hi rune) bool {
+	for _, cr := range e.ranges {
+		if e.negated && cr.lo <= lo && cr.hi >= hi {
+			return false
+		} else if !e.negated && cr.lo <= hi && cr.hi >= lo {
+			return true
+		}
+	}
+
+	return e.negated
+}
+
+type alternative []element
+
+type rule struct {
+	name         string
+	alternatives []alternative
+}
+
+// Grammar is a parsed GBNF grammar
+type Grammar struct {
+	rules []rule
+	root  int
+}
+
+// Parse parses a GBNF grammar. The grammar must define a rule named root
+// and must not be left recursive.
+func Parse(s string) (*Grammar, error) {
+	p := parser{src: s, ids: make(map[string]int)}
+	if err := p.parse(); err != nil {
+		return nil, err
+	}
+
+	for i, r := range p.rules {
+		if !p.defined[i] {
+			return nil, fmt.Errorf("grammar: undefined rule %q", r.name)
+		}
+	}
+
+	root, ok := p.ids["root"]
+	if !ok {
+		return nil, errors.New("grammar: missing root rule")
+	}
+
+	g := &Grammar{rules: p.rules, root: root}
+	if err := g.checkLeftRecursion(); err != nil {
+		return nil, err
+	}
+
+	return g, nil
+}
+
+// checkLeftRecursion returns an error if any rule can reference itself
+// without consuming input, which would make matching loop forever
+func (g *Grammar) checkLeftRecursion() error {
+	nullable := make([]bool, len(g.rules))
+	for changed := true; changed; {
+		changed = false
+		for i, r := range g.rules {
+			if nullable[i] {
+				continue
+			}
+
+			for _, alt := range r.alternatives {
+				if !slices.ContainsFunc(alt, func(e element) bool { return e.isChar() || !nullable[e.rule] }) {
+					nullable[i] = true
+					changed = true
+					break
+				}
+			}
+		}
+	}
+
+	// the rules that can be reached from each rule without consuming input
+	edges := make([][]int, len(g.rules))
+	for i, r := range g.rules {
+		for _, alt := range r.alternatives {
+			for _, e := range alt {
+				if e.isChar() {
+					break
+				}
+
+				edges[i] = append(edges[i], e.rule)
+				if !nullable[e.rule] {
+					break
+				}
+			}
+		}
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	state := make([]int, len(g.rules))
+	var visit func(int) error
+	visit = func(i int) error {
+		switch state[i] {
+		case visiting:
+			return fmt.Errorf("grammar: left recursion in rule %q", g.rules[i].name)
+		case visited:
+			return nil
+		}
+
+		state[i] = visiting
+		for _, j := range edges[i] {
+			if err := visit(j); err != nil {
+				return err
+			}
+		}
+		state[i] = visited
+		return nil
+	}
+
+	for i := range g.rules {
+		if err := visit(i); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type parser struct {
+	src string
+	pos int
+
+	rules   []rule
+	defined []bool
+	ids     map[string]int
+}
+
+func (p *parser) errorf(format string, args ...any) error {
+	line := strings.Count(p.src[:p.pos], "\n") + 1
+	return fmt.Errorf("grammar: line %d: %s", line, fmt.Sprintf(format, args...))
+}
+
+// ruleID returns the index of the named rule, creating it if it has not
+// been seen yet
+func (p *parser) ruleID(name string) int {
+	if id, ok := p.ids[name]; ok {
+		return id
+	}
+
+	id := len(p.rules)
+	p.ids[name] = id
+	p.rules = append(p.rules, rule{name: name})
+	p.defined = append(p.defined, false)
+	return id
+}
+
+// newRule creates an anonymous rule used for groups and repetitions
+func (p *parser) newRule(parent int, alternatives []alternative) int {
+	name := p.rules[parent].name
+	for i := 1; ; i++ {
+		candidate := name + "_" + strconv.Itoa(i)
+		if _, ok := p.ids[candidate]; !ok {
+			id := p.ruleID(candidate)
+			p.rules[id].alternatives = alternatives
+			p.defined[id] = true
+			return id
+		}
+	}
+}
+
+func (p *parser) peek() byte {
+	if p.pos < len(p.src) {
+		return p.src[p.pos]
+	}
+
+	return 0
+}
+
+func (p *parser) eof() bool {
+	return p.pos >= len(p.src)
+}
+
+// skipSpace skips whitespace and comments. Newlines are only skipped if
+// multiline is set since they otherwise end a rule
+func (p *parser) skipSpace(multiline bool) {
+	for !p.eof() {
+		switch c := p.peek(); {
+		case c == ' ' || c == '\t':
+			p.pos++
+		case c == '#':
+			for !p.eof() && p.peek() != '\n' {
+				p.pos++
+			}
+		case multiline && (c == '\r' || c == '\n'):
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+func isWordChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_'
+}
+
+func (p *parser) name() string {
+	start := p.pos
+	for !p.eof() && isWordChar(p.peek()) {
+		p.pos++
+	}
+
+	return p.src[start:p.pos]
+}
+
+func (p *parser) parse() error {
+	p.skipSpace(true)
+	for !p.eof() {
+		name := p.name()
+		if name == "" {
+			return p.errorf("expected rule name, found %q", p.peek())
+		}
+
+		id := p.ruleID(name)
+		if p.defined[id] {
+			return p.errorf("rule %q defined more than once", name)
+		}
+		p.defined[id] = true
+
+		p.skipSpace(false)
+		if !strings.HasPrefix(p.src[p.pos:], "::=") {
+			return p.errorf("expected ::= after %q", name)
+		}
+		p.pos += 3
+		p.skipSpace(true)
+
+		alternatives, err := p.alternatives(id, false)
+		if err != nil {
+			return err
+		}
+		p.rules[id].alternatives = alternatives
+
+		if !p.eof() && p.peek() != '\n' && p.peek() != '\r' {
+			return p.errorf("unexpected %q", p.peek())
+		}
+		p.skipSpace(true)
+	}
+
+	return nil
+}
+
+// alternatives parses a list of sequences separated by |
+func (p *parser) alternatives(id int, nested bool) ([]alternative, error) {
+	var alternatives []alternative
+	for {
+		seq, err := p.sequence(id, nested)
+		if err != nil {
+			return nil, err
+		}
+		alternatives = append(alternatives, seq)
+
+		if p.peek() != '|' {
+			return alternatives, nil
+		}
+		p.pos++
+		p.skipSpace(true)
+	}
+}
+
+// sequence parses symbols up to the end of an alternative
+func (p *parser) sequence(id int, nested bool) (alternative, error) {
+	var seq alternative
+
+	// last is the start of the most recent symbol in seq, which is what
+	// a repetition operator applies to
+	last := -1
+	for !p.eof() {
+		start := len(seq)
+		switch c := p.peek(); {
+		case c == '"':
+			p.pos++
+			for p.peek() != '"' {
+				if p.eof() {
+					return nil, p.errorf("unterminated literal")
+				}
+
+				r, err := p.char()
+				if err != nil {
+					return nil, err
+				}
+				seq = append(seq, element{ranges: []charRange{{r, r}}, rule: -1})
+			}
+			p.pos++
+		case c == '[':
+			p.pos++
+			e := element{rule: -1}
+			if p.peek() == '^' {
+				e.negated = true
+				p.pos++
+			}
+
+			for p.peek() != ']' {
+				if p.eof() {
+					return nil, p.errorf("unterminated character class")
+				}
+
+				lo, err := p.char()
+				if err != nil {
+					return nil, err
+				}
+
+				hi := lo
+				if p.peek() == '-' && p.pos+1 < len(p.src) && p.src[p.pos+1] != ']' {
+					p.pos++
+					if hi, err = p.char(); err != nil {
+						return nil, err
+					}
+				}
+				e.ranges = append(e.ranges, charRange{lo, hi})
+			}
+			p.pos++
+			seq = append(seq, e)
+		case c == '.':
+			p.pos++
+			seq = append(seq, element{negated: true, rule: -1})
+		case c == '(':
+			p.pos++
+			p.skipSpace(true)
+			alternatives, err := p.alternatives(id, true)
+			if err != nil {
+				return nil, err
+			}
+			if p.peek() != ')' {
+				return nil, p.errorf("expected )")
+			}
+			p.pos++
+			seq = append(seq, element{rule: p.newRule(id, alternatives)})
+		case isWordChar(c):
+			seq = append(seq, element{rule: p.ruleID(p.name())})
+		case c == '*' || c == '+' || c == '?' || c == '{':
+			if last < 0 {
+				return nil, p.errorf("expected item before %q", c)
+			}
+
+			var err error
+			seq, err = p.repeat(id, seq, last)
+			if err != nil {
+				return nil, err
+			}
+			start = last
+		default:
+			return seq, nil
+		}
+
+		last = start
+		p.skipSpace(nested)
+	}
+
+	return seq, nil
+}
+
+// repeat applies the repetition operator at the current position to the
+// symbol in seq starting at last
+func (p *parser) repeat(id int, seq alternative, last int) (alternative, error) {
+	item := slices.Clone(seq[last:])
+	seq = seq[:last]
+
+	var lo, hi int
+	switch p.peek() {
+	case '*':
+		lo, hi = 0, -1
+	case '+':
+		lo, hi = 1, -1
+	case '?':
+		lo, hi = 0, 1
+	case '{':
+		p.pos++
+		p.skipSpace(false)
+
+		var err error
+		if lo, err = p.number(); err != nil {
+			return nil, err
+		}
+		hi = lo
+
+		p.skipSpace(false)
+		if p.peek() == ',' {
+			p.pos++
+			p.skipSpace(false)
+			hi = -1
+			if c := p.peek(); c >= '0' && c <= '9' {
+				if hi, err = p.number(); err != nil {
+					return nil, err
+				}
+			}
+			p.skipSpace(false)
+		}
+
+		if p.peek() != '}' {
+			return nil, p.errorf("expected }")
+		}
+
+		if hi >= 0 && hi < lo {
+			return nil, p.errorf("invalid repetition {%d,%d}", lo, hi)
+		}
+	}
+	p.pos++
+
+	for range lo {
+		seq = append(seq, item...)
+	}
+
+	if hi < 0 {
+		// item* becomes: rest ::= item rest |
+		rest := p.newRule(id, nil)
+		p.rules[rest].alternatives = []alternative{
+			append(slices.Clone(item), element{rule: rest}),
+			{},
+		}
+		return append(seq, element{rule: rest}), nil
+	}
+
+	// up to n optional items are nested to avoid ambiguity:
+	// opt ::= item opt' |
+	var tail []element
+	for range hi - lo {
+		opt := p.newRule(id, []alternative{
+			append(slices.Clone(item), tail...),
+			{},
+		})
+		tail = []element{{rule: opt}}
+	}
+
+	return append(seq, tail...), nil
+}
+
+func (p *parser) number() (int, error) {
+	start := p.pos
+	for c := p.peek(); c >= '0' && c <= '9'; c = p.peek() {
+		p.pos++
+	}
+
+	n, err := strconv.Atoi(p.src[start:p.pos])
+	if err != nil {
+		return 0, p.errorf("expected number")
+	}
+
+	return n, nil
+}
+
+// char parses a single, possibly escaped, character in a literal or
+// character class
+func (p *parser) char() (rune, error) {
+	if p.peek() != '\\' {
+		r, size := utf8.DecodeRuneInString(p.src[p.pos:])
+		if r == utf8.RuneError && size <= 1 {
+			return 0, p.errorf("invalid UTF-8")
+		}
+		p.pos += size
+		return r, nil
+	}
+
+	p.pos++
+	if p.eof() {
+		return 0, p.errorf("unterminated escape")
+	}
+
+	c := p.peek()
+	p.pos++
+	switch c {
+	case 'n':
+		return '\n', nil
+	case 'r':
+		return '\r', nil
+	case 't':
+		return '\t', nil
+	case '\\', '"', '[', ']', '-', '^', '/':
+		return rune(c), nil
+	case 'x', 'u', 'U':
+		size := map[byte]int{'x': 2, 'u': 4, 'U': 8}[c]
+		if p.pos+size > len(p.src) {
+			return 0, p.errorf("unterminated escape")
+		}
+
+		n, err := strconv.ParseUint(p.src[p.pos:p.pos+size], 16, 32)
+		if err != nil {
+			return 0, p.errorf("invalid escape %q", p.src[p.pos-2:p.pos+size])
+		}
+		p.pos += size
+		return rune(n), nil
+	default:
+		return 0, p.errorf("unknown escape \\%c", c)
+	}
+}
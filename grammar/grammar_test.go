@@ -0,0 +1,239 @@
+package grammar
+
+import (
+	"strings"
+	"testing"
+)
+
+// grammarJSON is the grammar used for the json format
+const grammarJSON = `
+root   ::= object
+value  ::= object | array | string | number | ("true" | "false" | "null") ws
+object ::=
+  "{" ws (
+            string ":" ws value
+    ("," ws string ":" ws value)*
+  )? "}" ws
+array  ::=
+  "[" ws (
+            value
+    ("," ws value)*
+  )? "]" ws
+string ::=
+  "\"" (
+    [^"\\\x7F\x00-\x1F] |
+    "\\" (["\\/bfnrt] | "u" [0-9a-fA-F] [0-9a-fA-F] [0-9a-fA-F] [0-9a-fA-F]) # escapes
+  )* "\"" ws
+number ::= ("-"? ([0-9] | [1-9] [0-9]*)) ("." [0-9]+)? ([eE] [-+]? [0-9]+)? ws
+# Optional space: by convention, applied in this grammar after literal chars when allowed
+ws ::= ([ \t\n] ws)?
+`
+
+func match(t *testing.T, g *Grammar, s string) bool {
+	t.Helper()
+	m := g.Matcher()
+	return m.AcceptString(s) && m.Complete()
+}
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		name    string
+		grammar string
+		match   []string
+		reject  []string
+	}{
+		{
+			name:    "literal",
+			grammar: `root ::= "yes" | "no"`,
+			match:   []string{"yes", "no"},
+			reject:  []string{"", "y", "yesno", "maybe"},
+		},
+		{
+			name:    "char class",
+			grammar: `root ::= [a-c0-9_] [^a-z]`,
+			match:   []string{"a1", "9Z", "__"},
+			reject:  []string{"d1", "aa", "a"},
+		},
+		{
+			name:    "any",
+			grammar: `root ::= "<" . ">"`,
+			match:   []string{"<a>", "<é>", "<>>"},
+			reject:  []string{"<>", "<ab>"},
+		},
+		{
+			name:    "star",
+			grammar: `root ::= "a"*`,
+			match:   []string{"", "a", "aaaa"},
+			reject:  []string{"b", "ab"},
+		},
+		{
+			name:    "plus",
+			grammar: `root ::= ("ab")+`,
+			match:   []string{"ab", "abab"},
+			reject:  []string{"", "a", "aba"},
+		},
+		{
+			name:    "optional",
+			grammar: `root ::= "a" "b"? "c"`,
+			match:   []string{"ac", "abc"},
+			reject:  []string{"abbc", "a"},
+		},
+		{
+			name:    "bounded",
+			grammar: `root ::= [0-9]{2,4}`,
+			match:   []string{"12", "123", "1234"},
+			reject:  []string{"1", "12345"},
+		},
+		{
+			name:    "exact",
+			grammar: `root ::= "x"{3}`,
+			match:   []string{"xxx"},
+			reject:  []string{"xx", "xxxx"},
+		},
+		{
+			name:    "at least",
+			grammar: `root ::= "x"{2,}`,
+			match:   []string{"xx", "xxxxx"},
+			reject:  []string{"x"},
+		},
+		{
+			name: "rules",
+			grammar: `
+root ::= greeting " " name # a comment
+greeting ::= "hello" | "hi"
+name ::= [A-Z] [a-z]*
+`,
+			match:  []string{"hello World", "hi Al"},
+			reject: []string{"hello world", "hey Al"},
+		},
+		{
+			name:    "escapes",
+			grammar: `root ::= "\"" [\x41-\x43] "é\n" [\]]`,
+			match:   []string{"\"Bé\n]"},
+			reject:  []string{"\"Dé\n]"},
+		},
+		{
+			name:    "recursion",
+			grammar: `root ::= "(" root ")" | ""`,
+			match:   []string{"", "()", "((()))"},
+			reject:  []string{"(", "())"},
+		},
+		{
+			name:    "json",
+			grammar: grammarJSON,
+			match:   []string{`{}`, `{"a": [1, 2.5, -3e10, "x\"y"], "b": {"c": null}}`, "{\n  \"ok\": true\n}"},
+			reject:  []string{`[]`, `{"a": }`, `{"a": 01}`, `{'a': 1}`},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			g, err := Parse(tt.grammar)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, s := range tt.match {
+				if !match(t, g, s) {
+					t.Errorf("%q should match", s)
+				}
+			}
+
+			for _, s := range tt.reject {
+				if match(t, g, s) {
+					t.Errorf("%q should not match", s)
+				}
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	cases := []struct {
+		grammar string
+		err     string
+	}{
+		{`expr ::= "a"`, "missing root rule"},
+		{`root ::= value`, `undefined rule "value"`},
+		{`root ::= "a"` + "\n" + `root ::= "b"`, "defined more than once"},
+		{`root ::= root "a" | "b"`, "left recursion"},
+		{`root ::= x "a"` + "\n" + `x ::= "b"? root`, "left recursion"},
+		{`root ::= "a`, "unterminated literal"},
+		{`root ::= [a-`, "unterminated"},
+		{`root ::= ("a"`, "expected )"},
+		{`root ::= * "a"`, "expected item"},
+		{`root ::= "a"{3,2}`, "invalid repetition"},
+		{`root = "a"`, "expected ::="},
+		{`root ::= "\q"`, "unknown escape"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.grammar, func(t *testing.T) {
+			_, err := Parse(tt.grammar)
+			if err == nil {
+				t.Fatal("expected error")
+			}
+
+			if !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("error = %q, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestMatcher(t *testing.T) {
+	g, err := Parse(`root ::= "ab" "c"?`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := g.Matcher()
+	if m.Complete() || m.Done() {
+		t.Fatal("new matcher should not be complete")
+	}
+
+	if m.AcceptString("ax") {
+		t.Fatal("ax should not be accepted")
+	}
+
+	// a failed match leaves the matcher unchanged
+	if !m.AcceptRune('a') || !m.AcceptRune('b') {
+		t.Fatal("ab should be accepted")
+	}
+
+	if !m.Complete() || m.Done() {
+		t.Error("ab should be complete with more input possible")
+	}
+
+	clone := m.Clone()
+	if !clone.AcceptRune('c') {
+		t.Fatal("c should be accepted")
+	}
+
+	if !clone.Complete() || !clone.Done() {
+		t.Error("abc should be complete with no more input possible")
+	}
+
+	if m.Done() {
+		t.Error("advancing a clone should not change the original")
+	}
+}
+
+func TestMatcherAmbiguous(t *testing.T) {
+	// many equivalent parses should not grow the number of stacks
+	g, err := Parse(`root ::= ("a" | "a" | "a" "a"?)*`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := g.Matcher()
+	for range 100 {
+		if !m.AcceptRune('a') {
+			t.Fatal("a should be accepted")
+		}
+	}
+
+	if len(m.state.stacks) > 10 {
+		t.Errorf("too many stacks: %d", len(m.state.stacks))
+	}
+}
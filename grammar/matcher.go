@@ -0,0 +1,275 @@
+package grammar
+
+import (
+	"encoding/binary"
+	"slices"
+)
+
+// frame is a position within an alternative of a rule
+type frame struct {
+	rule, alt, elem int
+}
+
+// stack is an immutable linked list of frames. The top frame points at the
+// next element to match and its parents are where to continue once the
+// top frame's alternative is complete. A nil stack has matched everything
+type stack struct {
+	frame
+	parent *stack
+
+	// id uniquely identifies the stack within its pool
+	id uint64
+}
+
+type stackKey struct {
+	frame
+	parent *stack
+}
+
+// state is the set of stacks reached after matching some text. Each stack
+// has a character set as the next element to match, or is nil if the text
+// so far is a complete match
+type state struct {
+	stacks []*stack
+
+	// next caches the state reached by matching a rune, or nil if the
+	// rune cannot be matched
+	next map[rune]*state
+}
+
+// pool interns stacks and states so that structurally identical ones are
+// the same pointer. This keeps ambiguous grammars from growing the number
+// of stacks without bound and lets transitions between states be cached
+type pool struct {
+	stacks map[stackKey]*stack
+	states map[string]*state
+	nextID uint64
+}
+
+func newPool(nextID uint64) *pool {
+	return &pool{
+		stacks: make(map[stackKey]*stack),
+		states: make(map[string]*state),
+		nextID: nextID,
+	}
+}
+
+// maxPoolSize bounds the memory used for interning. Once reached, interning
+// starts over which only affects how much work is shared
+const maxPoolSize = 1 << 16
+
+// Matcher tracks the possible positions in a grammar after matching some
+// text. It is not safe for concurrent use
+type Matcher struct {
+	g     *Grammar
+	pool  *pool
+	state *state
+}
+
+// Matcher returns a new Matcher positioned at the start of the grammar
+func (g *Grammar) Matcher() *Matcher {
+	m := &Matcher{g: g, pool: newPool(1)}
+
+	e := m.expander()
+	for i := range g.rules[g.root].alternatives {
+		e.expand(e.push(frame{rule: g.root, alt: i}, nil))
+	}
+
+	m.state = m.intern(e.out)
+	return m
+}
+
+// Clone returns a copy of m that can advance independently. Clones share
+// internal state and must not be used concurrently with m
+func (m *Matcher) Clone() *Matcher {
+	clone := *m
+	return &clone
+}
+
+// Complete reports whether the text matched so far is a full match of
+// the grammar
+func (m *Matcher) Complete() bool {
+	return slices.Contains(m.state.stacks, nil)
+}
+
+// Done reports whether no more text can be matched
+func (m *Matcher) Done() bool {
+	for _, s := range m.state.stacks {
+		if s != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// CanAcceptRange reports whether m can advance past any rune in [lo, hi]
+// without changing m
+func (m *Matcher) CanAcceptRange(lo, hi rune) bool {
+	for _, s := range m.state.stacks {
+		if s != nil && m.g.element(s.frame).intersects(lo, hi) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AcceptRune advances m past r. If r cannot be matched it returns false
+// and m is unchanged
+func (m *Matcher) AcceptRune(r rune) bool {
+	if len(m.pool.stacks)+len(m.pool.states) > maxPoolSize {
+		// drop the cached transitions so that old states can be freed.
+		// Ids keep increasing so they stay unique among live stacks
+		m.pool = newPool(m.pool.nextID)
+		m.state = &state{stacks: m.state.stacks}
+	}
+
+	next := m.next(m.state, r)
+	if next == nil {
+		return false
+	}
+
+	m.state = next
+	return true
+}
+
+// AcceptString advances m past each rune in s. If s cannot be matched it
+// returns false and m is unchanged
+func (m *Matcher) AcceptString(s string) bool {
+	clone := *m
+	for _, r := range s {
+		if !clone.AcceptRune(r) {
+			return false
+		}
+	}
+
+	*m = clone
+	return true
+}
+
+// next returns the state reached by matching r from st, or nil if r
+// cannot be matched
+func (m *Matcher) next(st *state, r rune) *state {
+	if next, ok := st.next[r]; ok {
+		return next
+	}
+
+	e := m.expander()
+	for _, s := range st.stacks {
+		if s == nil {
+			continue
+		}
+
+		if m.g.element(s.frame).matches(r) {
+			f := s.frame
+			f.elem++
+			e.expand(e.push(f, s.parent))
+		}
+	}
+
+	var next *state
+	if len(e.out) > 0 {
+		next = m.intern(e.out)
+	}
+
+	if st.next == nil {
+		st.next = make(map[rune]*state)
+	}
+	st.next[r] = next
+
+	return next
+}
+
+// intern returns the state for a set of stacks
+func (m *Matcher) intern(stacks []*stack) *state {
+	ids := make([]uint64, len(stacks))
+	for i, s := range stacks {
+		if s != nil {
+			ids[i] = s.id
+		}
+	}
+	slices.Sort(ids)
+
+	key := make([]byte, 0, len(ids)*binary.MaxVarintLen32)
+	for _, id := range ids {
+		key = binary.AppendUvarint(key, id)
+	}
+
+	if st, ok := m.pool.states[string(key)]; ok {
+		return st
+	}
+
+	st := &state{stacks: stacks}
+	m.pool.states[string(key)] = st
+	return st
+}
+
+func (g *Grammar) element(f frame) element {
+	return g.rules[f.rule].alternatives[f.alt][f.elem]
+}
+
+func (m *Matcher) expander() *expander {
+	return &expander{g: m.g, pool: m.pool}
+}
+
+// expander resolves stacks until their next element is a character set
+type expander struct {
+	g    *Grammar
+	pool *pool
+
+	// out holds the resolved stacks, each at most once
+	out     []*stack
+	visited []*stack
+}
+
+func (e *expander) push(f frame, parent *stack) *stack {
+	key := stackKey{f, parent}
+	if s, ok := e.pool.stacks[key]; ok {
+		return s
+	}
+
+	s := &stack{frame: f, parent: parent, id: e.pool.nextID}
+	e.pool.nextID++
+	e.pool.stacks[key] = s
+	return s
+}
+
+// expand adds to e.out the stacks that can be reached from s without
+// consuming input
+func (e *expander) expand(s *stack) {
+	for s != nil {
+		alt := e.g.rules[s.rule].alternatives[s.alt]
+		if s.elem < len(alt) {
+			break
+		}
+
+		// this alternative is complete so continue with the parent
+		s = s.parent
+	}
+
+	if slices.Contains(e.visited, s) {
+		return
+	}
+	e.visited = append(e.visited, s)
+
+	if s == nil || e.g.element(s.frame).isChar() {
+		e.out = append(e.out, s)
+		return
+	}
+
+	el := e.g.element(s.frame)
+
+	// if the reference is the last element of its alternative, the rule
+	// continues directly with the parent. This keeps right recursive rules
+	// from growing the stack on every repetition
+	parent := s.parent
+	if f := s.frame; f.elem+1 < len(e.g.rules[f.rule].alternatives[f.alt]) {
+		f.elem++
+		parent = e.push(f, s.parent)
+	}
+
+	for i := range e.g.rules[el.rule].alternatives {
+		e.expand(e.push(frame{rule: el.rule, alt: i}, parent))
+	}
+}
@@ -0,0 +1,655 @@
+package grammar
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// primitives are the rules shared by all grammars generated from schemas
+var primitives = map[string]string{
+	"space":            `| " " | "\n" [ \t]{0,20}`,
+	"boolean":          `("true" | "false") space`,
+	"null":             `"null" space`,
+	"char":             `[^"\\\x7F\x00-\x1F] | [\\] (["\\bfnrt] | "u" [0-9a-fA-F]{4})`,
+	"string":           `"\"" char* "\"" space`,
+	"integral-part":    `[0] | [1-9] [0-9]{0,15}`,
+	"decimal-part":     `[0-9]{1,16}`,
+	"integer":          `("-"? integral-part) space`,
+	"number":           `("-"? integral-part) ("." decimal-part)? ([eE] [-+]? integral-part)? space`,
+	"value":            `object | array | string | number | boolean | null`,
+	"object":           `"{" space ( string ":" space value ("," space string ":" space value)* )? "}" space`,
+	"array":            `"[" space ( value ("," space value)* )? "]" space`,
+	"date":             `[0-9]{4} "-" ( "0" [1-9] | "1" [0-2] ) "-" ( "0" [1-9] | [1-2] [0-9] | "3" [0-1] )`,
+	"time":             `([01] [0-9] | "2" [0-3]) ":" [0-5] [0-9] ":" [0-5] [0-9] ( "." [0-9]{3} )? ( "Z" | ( "+" | "-" ) ( [01] [0-9] | "2" [0-3] ) ":" [0-5] [0-9] )`,
+	"date-time":        `date "T" time`,
+	"date-string":      `"\"" date "\"" space`,
+	"time-string":      `"\"" time "\"" space`,
+	"date-time-string": `"\"" date-time "\"" space`,
+	"uuid":             `"\"" [0-9a-fA-F]{8} "-" [0-9a-fA-F]{4} "-" [0-9a-fA-F]{4} "-" [0-9a-fA-F]{4} "-" [0-9a-fA-F]{12} "\"" space`,
+}
+
+// dependencies lists the primitives each primitive refers to
+var dependencies = map[string][]string{
+	"string":           {"char", "space"},
+	"boolean":          {"space"},
+	"null":             {"space"},
+	"integer":          {"integral-part", "space"},
+	"number":           {"integral-part", "decimal-part", "space"},
+	"value":            {"object", "array", "string", "number", "boolean", "null"},
+	"object":           {"string", "value", "space"},
+	"array":            {"value", "space"},
+	"date-time":        {"date", "time"},
+	"date-string":      {"date", "space"},
+	"time-string":      {"time", "space"},
+	"date-time-string": {"date-time", "space"},
+	"uuid":             {"space"},
+}
+
+// stringFormats maps supported string formats to their primitive rule
+var stringFormats = map[string]string{
+	"date":      "date-string",
+	"time":      "time-string",
+	"date-time": "date-time-string",
+	"uuid":      "uuid",
+}
+
+// schema is the subset of JSON Schema that can be converted to a grammar
+type schema struct {
+	Type                 types                      `json:"type"`
+	Properties           properties                 `json:"properties"`
+	Required             []string                   `json:"required"`
+	AdditionalProperties *schema                    `json:"additionalProperties"`
+	Items                *schema                    `json:"items"`
+	PrefixItems          []*schema                  `json:"prefixItems"`
+	MinItems             *int                       `json:"minItems"`
+	MaxItems             *int                       `json:"maxItems"`
+	MinLength            *int                       `json:"minLength"`
+	MaxLength            *int                       `json:"maxLength"`
+	Format               string                     `json:"format"`
+	Enum                 []json.RawMessage          `json:"enum"`
+	Const                json.RawMessage            `json:"const"`
+	AnyOf                []*schema                  `json:"anyOf"`
+	OneOf                []*schema                  `json:"oneOf"`
+	AllOf                []*schema                  `json:"allOf"`
+	Ref                  string                     `json:"$ref"`
+	Defs                 map[string]json.RawMessage `json:"$defs"`
+	Definitions          map[string]json.RawMessage `json:"definitions"`
+
+	// boolean is set if the schema is the literal true or false
+	boolean *bool
+}
+
+func (s *schema) UnmarshalJSON(b []byte) error {
+	switch string(bytes.TrimSpace(b)) {
+	case "true", "false":
+		v := string(bytes.TrimSpace(b)) == "true"
+		*s = schema{boolean: &v}
+		return nil
+	}
+
+	type plain schema
+	return json.Unmarshal(b, (*plain)(s))
+}
+
+// types is the type keyword, which can be a single type or a list
+type types []string
+
+func (t *types) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*t = types{s}
+		return nil
+	}
+
+	return json.Unmarshal(b, (*[]string)(t))
+}
+
+type property struct {
+	name   string
+	schema *schema
+}
+
+// properties preserves the order properties are declared in since that
+// is the order they are generated in
+type properties []property
+
+func (ps *properties) UnmarshalJSON(b []byte) error {
+	if string(bytes.TrimSpace(b)) == "null" {
+		return nil
+	}
+
+	d := json.NewDecoder(bytes.NewReader(b))
+	if t, err := d.Token(); err != nil {
+		return err
+	} else if t != json.Delim('{') {
+		return errors.New("properties must be an object")
+	}
+
+	for d.More() {
+		t, err := d.Token()
+		if err != nil {
+			return err
+		}
+
+		var p property
+		p.name = t.(string)
+		if err := d.Decode(&p.schema); err != nil {
+			return err
+		}
+		*ps = append(*ps, p)
+	}
+
+	_, err := d.Token()
+	return err
+}
+
+// SchemaToGrammar converts a JSON Schema to a GBNF grammar that matches
+// JSON documents conforming to the schema
+func SchemaToGrammar(b []byte) ([]byte, error) {
+	c, body, err := convert(b)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.grammar(body), nil
+}
+
+// SchemaListToGrammar converts a JSON Schema to a GBNF grammar that matches
+// the literal prefix, one or more JSON documents conforming to the schema
+// separated by sep, and then the literal suffix. Whitespace is allowed
+// around each document
+func SchemaListToGrammar(b []byte, prefix, sep, suffix string) ([]byte, error) {
+	c, body, err := convert(b)
+	if err != nil {
+		return nil, err
+	}
+
+	space := c.primitive("space")
+	item := c.add("item", body)
+
+	var sb strings.Builder
+	if prefix != "" {
+		sb.WriteString(quote(prefix) + " ")
+	}
+	sb.WriteString(space + " " + item)
+
+	sb.WriteString(" ( ")
+	if sep != "" {
+		sb.WriteString(quote(sep) + " ")
+	}
+	sb.WriteString(space + " " + item + " )*")
+
+	if suffix != "" {
+		sb.WriteString(" " + quote(suffix))
+	}
+
+	return c.grammar(sb.String()), nil
+}
+
+// convert returns a converter holding the rules for the schema in b and the
+// body of its root rule
+func convert(b []byte) (*converter, string, error) {
+	var root schema
+	if err := json.Unmarshal(b, &root); err != nil {
+		return nil, "", fmt.Errorf("invalid JSON schema: %w", err)
+	}
+
+	c := converter{
+		rules: make(map[string]string),
+		refs:  make(map[string]string),
+		defs:  make(map[string]json.RawMessage),
+	}
+	maps.Copy(c.defs, root.Definitions)
+	maps.Copy(c.defs, root.Defs)
+
+	body, err := c.visit(&root, "")
+	if err != nil {
+		return nil, "", err
+	}
+
+	return &c, body, nil
+}
+
+// grammar returns the grammar with root as the body of its root rule
+func (c *converter) grammar(root string) []byte {
+	c.rules["root"] = root
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "root ::= %s\n", root)
+	for _, name := range slices.Sorted(maps.Keys(c.rules)) {
+		if name != "root" {
+			fmt.Fprintf(&sb, "%s ::= %s\n", name, c.rules[name])
+		}
+	}
+
+	return []byte(sb.String())
+}
+
+type converter struct {
+	rules map[string]string
+
+	// refs maps each $ref to the rule generated for it
+	refs map[string]string
+	defs map[string]json.RawMessage
+}
+
+var invalidRuleChars = regexp.MustCompile(`[^a-zA-Z0-9-]+`)
+
+// ruleName joins a parent rule name with a child's name in a form that
+// is valid in a grammar
+func ruleName(parent, name string) string {
+	name = invalidRuleChars.ReplaceAllString(name, "-")
+	if parent == "" {
+		return name
+	}
+
+	return parent + "-" + name
+}
+
+// primitive adds the named primitive and the primitives it depends on
+func (c *converter) primitive(name string) string {
+	if _, ok := c.rules[name]; !ok {
+		c.rules[name] = primitives[name]
+		for _, dep := range dependencies[name] {
+			c.primitive(dep)
+		}
+	}
+
+	return name
+}
+
+// add adds a rule, returning its name which may have a suffix if a
+// different rule already uses the name
+func (c *converter) add(name, body string) string {
+	if name == "" || name == "root" {
+		name = "root-" + strconv.Itoa(len(c.rules))
+	}
+
+	key := name
+	for i := 1; ; i++ {
+		existing, ok := c.rules[key]
+		_, primitive := primitives[key]
+		if !primitive && (!ok || existing == body) {
+			break
+		}
+		key = name + strconv.Itoa(i)
+	}
+
+	c.rules[key] = body
+	return key
+}
+
+// literal returns a grammar literal matching the JSON encoding of v
+func literal(v []byte) (string, error) {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, v); err != nil {
+		return "", err
+	}
+
+	return quote(buf.String()), nil
+}
+
+// quote returns s as a grammar literal
+func quote(s string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r == '"' || r == '\\':
+			sb.WriteByte('\\')
+			sb.WriteRune(r)
+		case r == '\n':
+			sb.WriteString(`\n`)
+		case r == '\r':
+			sb.WriteString(`\r`)
+		case r == '\t':
+			sb.WriteString(`\t`)
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&sb, `\x%02X`, r)
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+// visit returns the body of a rule matching s. name is used as the
+// prefix of any rules created for sub-schemas
+func (c *converter) visit(s *schema, name string) (string, error) {
+	switch {
+	case s == nil:
+		return c.primitive("value"), nil
+	case s.boolean != nil:
+		if !*s.boolean {
+			return "", errors.New("schema false cannot match any value")
+		}
+		return c.primitive("value"), nil
+	case s.Ref != "":
+		return c.ref(s.Ref)
+	case s.Const != nil:
+		lit, err := literal(s.Const)
+		if err != nil {
+			return "", err
+		}
+		return lit + " " + c.primitive("space"), nil
+	case len(s.Enum) > 0:
+		alts := make([]string, len(s.Enum))
+		for i, v := range s.Enum {
+			lit, err := literal(v)
+			if err != nil {
+				return "", err
+			}
+			alts[i] = lit
+		}
+		return "(" + strings.Join(alts, " | ") + ") " + c.primitive("space"), nil
+	case len(s.AnyOf) > 0 || len(s.OneOf) > 0:
+		return c.alternatives(append(slices.Clone(s.AnyOf), s.OneOf...), name)
+	case len(s.AllOf) > 0:
+		return c.visit(merge(s), name)
+	case len(s.Type) > 1:
+		var alts []*schema
+		for _, t := range s.Type {
+			alt := *s
+			alt.Type = types{t}
+			alts = append(alts, &alt)
+		}
+		return c.alternatives(alts, name)
+	}
+
+	var t string
+	switch {
+	case len(s.Type) == 1:
+		t = s.Type[0]
+	case len(s.Properties) > 0 || s.AdditionalProperties != nil:
+		t = "object"
+	case s.Items != nil || len(s.PrefixItems) > 0:
+		t = "array"
+	default:
+		return c.primitive("value"), nil
+	}
+
+	switch t {
+	case "object":
+		return c.object(s, name)
+	case "array":
+		return c.array(s, name)
+	case "string":
+		return c.string(s), nil
+	case "number", "integer", "boolean", "null":
+		return c.primitive(t), nil
+	default:
+		return "", fmt.Errorf("unsupported type %q", t)
+	}
+}
+
+// ref returns the name of the rule for a local reference, generating it
+// the first time it is seen
+func (c *converter) ref(ref string) (string, error) {
+	if name, ok := c.refs[ref]; ok {
+		return name, nil
+	}
+
+	var def string
+	if d, ok := strings.CutPrefix(ref, "#/$defs/"); ok {
+		def = d
+	} else if d, ok := strings.CutPrefix(ref, "#/definitions/"); ok {
+		def = d
+	} else {
+		return "", fmt.Errorf("unsupported $ref %q", ref)
+	}
+
+	raw, ok := c.defs[def]
+	if !ok {
+		return "", fmt.Errorf("undefined $ref %q", ref)
+	}
+
+	var s schema
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return "", err
+	}
+
+	// reserve the name first so recursive references resolve to it
+	name := c.add(ruleName("", def), ref)
+	c.refs[ref] = name
+
+	body, err := c.visit(&s, name)
+	if err != nil {
+		return "", err
+	}
+	c.rules[name] = body
+
+	return name, nil
+}
+
+func (c *converter) alternatives(alts []*schema, name string) (string, error) {
+	rules := make([]string, len(alts))
+	for i, alt := range alts {
+		body, err := c.visit(alt, ruleName(name, strconv.Itoa(i)))
+		if err != nil {
+			return "", err
+		}
+		rules[i] = c.add(ruleName(name, strconv.Itoa(i)), body)
+	}
+
+	return strings.Join(rules, " | "), nil
+}
+
+// group parenthesizes body if it has alternatives so that it can be used
+// within a sequence
+func group(body string) string {
+	if strings.Contains(body, "|") {
+		return "( " + body + " )"
+	}
+
+	return body
+}
+
+// merge combines the schemas in allOf into a single schema
+func merge(s *schema) *schema {
+	merged := *s
+	merged.AllOf = nil
+	for _, sub := range s.AllOf {
+		if sub == nil {
+			continue
+		}
+
+		if len(merged.Type) == 0 {
+			merged.Type = sub.Type
+		}
+		merged.Properties = append(merged.Properties, sub.Properties...)
+		merged.Required = append(merged.Required, sub.Required...)
+		if sub.AdditionalProperties != nil {
+			merged.AdditionalProperties = sub.AdditionalProperties
+		}
+	}
+
+	return &merged
+}
+
+func (c *converter) object(s *schema, name string) (string, error) {
+	space := c.primitive("space")
+
+	additional := s.AdditionalProperties
+	if additional != nil && additional.boolean != nil && !*additional.boolean {
+		additional = nil
+	}
+
+	if len(s.Properties) == 0 {
+		if additional == nil && s.AdditionalProperties != nil {
+			return `"{" ` + space + ` "}" ` + space, nil
+		}
+
+		if additional == nil || additional.boolean != nil {
+			return c.primitive("object"), nil
+		}
+	}
+
+	var required, optional []string
+	for _, p := range s.Properties {
+		propName := ruleName(name, p.name)
+		value, err := c.visit(p.schema, propName)
+		if err != nil {
+			return "", err
+		}
+
+		key, err := json.Marshal(p.name)
+		if err != nil {
+			return "", err
+		}
+		keyLit, err := literal(key)
+		if err != nil {
+			return "", err
+		}
+
+		kv := c.add(propName+"-kv", keyLit+" "+space+` ":" `+space+" "+group(value))
+		if slices.Contains(s.Required, p.name) {
+			required = append(required, kv)
+		} else {
+			optional = append(optional, kv)
+		}
+	}
+
+	if additional != nil {
+		value, err := c.visit(additional, ruleName(name, "additional"))
+		if err != nil {
+			return "", err
+		}
+
+		kv := c.add(ruleName(name, "additional-kv"), c.primitive("string")+` ":" `+space+" "+group(value))
+		optional = append(optional, c.add(ruleName(name, "additional-kvs"), kv+` ( "," `+space+" "+kv+" )*"))
+	}
+
+	var sb strings.Builder
+	sb.WriteString(`"{" ` + space)
+	for i, kv := range required {
+		if i > 0 {
+			sb.WriteString(` "," ` + space)
+		}
+		sb.WriteString(" " + kv)
+	}
+
+	if len(optional) > 0 {
+		sb.WriteString(" (")
+		if len(required) > 0 {
+			sb.WriteString(` "," ` + space + " (")
+		}
+		sb.WriteString(" " + c.optional(optional))
+		if len(required) > 0 {
+			sb.WriteString(" )")
+		}
+		sb.WriteString(" )?")
+	}
+
+	sb.WriteString(` "}" ` + space)
+	return sb.String(), nil
+}
+
+// optional returns alternatives that match any ordered subset of kvs, in
+// the same order, as long as it is not empty
+func (c *converter) optional(kvs []string) string {
+	alts := make([]string, len(kvs))
+	for i, kv := range kvs {
+		if i == len(kvs)-1 {
+			alts[i] = kv
+			continue
+		}
+
+		rest := c.add(strings.TrimSuffix(kv, "-kv")+"-rest", `( "," `+c.primitive("space")+" ( "+c.optional(kvs[i+1:])+" ) )?")
+		alts[i] = kv + " " + rest
+	}
+
+	return strings.Join(alts, " | ")
+}
+
+func (c *converter) array(s *schema, name string) (string, error) {
+	space := c.primitive("space")
+
+	if len(s.PrefixItems) > 0 {
+		items := make([]string, len(s.PrefixItems))
+		for i, item := range s.PrefixItems {
+			body, err := c.visit(item, ruleName(name, "tuple-"+strconv.Itoa(i)))
+			if err != nil {
+				return "", err
+			}
+			items[i] = c.add(ruleName(name, "tuple-"+strconv.Itoa(i)), body)
+		}
+
+		return `"[" ` + space + " " + strings.Join(items, ` "," `+space+" ") + ` "]" ` + space, nil
+	}
+
+	body, err := c.visit(s.Items, ruleName(name, "item"))
+	if err != nil {
+		return "", err
+	}
+	item := c.add(ruleName(name, "item"), body)
+
+	return `"[" ` + space + " " + repeat(item, `"," `+space+" ", s.MinItems, s.MaxItems) + ` "]" ` + space, nil
+}
+
+func (c *converter) string(s *schema) string {
+	if rule, ok := stringFormats[s.Format]; ok {
+		return c.primitive(rule)
+	}
+
+	if s.MinLength == nil && s.MaxLength == nil {
+		return c.primitive("string")
+	}
+
+	lo, hi := 0, -1
+	if s.MinLength != nil {
+		lo = *s.MinLength
+	}
+	if s.MaxLength != nil {
+		hi = *s.MaxLength
+	}
+
+	var count string
+	if hi < 0 {
+		count = fmt.Sprintf("{%d,}", lo)
+	} else {
+		count = fmt.Sprintf("{%d,%d}", lo, hi)
+	}
+
+	return `"\"" ` + c.primitive("char") + count + ` "\"" ` + c.primitive("space")
+}
+
+// repeat returns a grammar matching between minItems and maxItems of item,
+// separated by sep
+func repeat(item, sep string, minItems, maxItems *int) string {
+	lo, hi := 0, -1
+	if minItems != nil {
+		lo = max(*minItems, 0)
+	}
+	if maxItems != nil {
+		hi = *maxItems
+	}
+
+	if hi == 0 {
+		return ""
+	}
+
+	var more string
+	switch {
+	case hi < 0 && lo <= 1:
+		more = "*"
+	case hi < 0:
+		more = fmt.Sprintf("{%d,}", lo-1)
+	default:
+		more = fmt.Sprintf("{%d,%d}", max(lo-1, 0), hi-1)
+	}
+
+	seq := item + " ( " + sep + item + " )" + more
+	if lo == 0 {
+		return "( " + seq + " )?"
+	}
+
+	return seq
+}
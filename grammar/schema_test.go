@@ -0,0 +1,291 @@
+package grammar
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// https://github.com/ollama/ollama/issues/7978
+const issue7978JSONSchema = `{
+  "type": "object",
+  "properties": {
+    "steps": {
+      "type": "array",
+      "items": {
+        "type": "object",
+        "properties": {
+          "explanation": { "type": "string" },
+          "output": { "type": "string" },
+          "nested": {
+            "type": "object",
+            "properties": {
+              "deep": { "type": "string" }
+            }
+          }
+        },
+        "required": ["explanation", "output"],
+        "additionalProperties": false
+      }
+    },
+    "final_answer": { "type": "string" },
+    "01_numbered_key": { "type": "string" },
+    "numbers": {
+      "type": "array",
+      "items": { "type": "number" }
+    },
+    "booleans": {
+      "type": "array",
+      "items": { "type": "boolean" }
+    },
+    "mixed": {
+      "type": "array",
+      "items": {
+        "oneOf": [
+          { "type": "string" },
+          { "type": "number" },
+          { "type": "boolean" }
+        ]
+      }
+    }
+  },
+  "required": ["steps", "final_answer"],
+  "additionalProperties": false
+}`
+
+func TestIssue7978(t *testing.T) {
+	g, err := SchemaToGrammar([]byte(issue7978JSONSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got string
+	s := bufio.NewScanner(bytes.NewReader(g))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		step, _, _ := strings.Cut(line, " ::= ")
+		if strings.TrimSpace(step) == "root" {
+			got = line
+		}
+	}
+
+	want := `root ::= "{" space steps-kv "," space final-answer-kv ( "," space ( 01-numbered-key-kv 01-numbered-key-rest | numbers-kv numbers-rest | booleans-kv booleans-rest | mixed-kv ) )? "}" space`
+	if got != want {
+		t.Errorf("root =\n%q\nwant:\n%q", got, want)
+	}
+
+	parsed, err := Parse(string(g))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	doc := `{"steps": [{"explanation": "add", "output": "2", "nested": {"deep": "x"}}], "final_answer": "2", "numbers": [1, 2.5], "mixed": ["a", 1, true]}`
+	if !match(t, parsed, doc) {
+		t.Errorf("%s should match", doc)
+	}
+
+	doc = `{"final_answer": "2", "steps": []}`
+	if match(t, parsed, doc) {
+		t.Errorf("%s should not match", doc)
+	}
+}
+
+func TestSchemaToGrammar(t *testing.T) {
+	cases := []struct {
+		name   string
+		schema string
+		match  []string
+		reject []string
+	}{
+		{
+			name:   "object",
+			schema: `{"type": "object"}`,
+			match:  []string{`{}`, `{"a": [1, {"b": null}]}`},
+			reject: []string{`[]`, `"a"`},
+		},
+		{
+			name:   "primitives",
+			schema: `{"type": "object", "properties": {"s": {"type": "string"}, "i": {"type": "integer"}, "n": {"type": "number"}, "b": {"type": "boolean"}, "z": {"type": "null"}}, "required": ["s", "i", "n", "b", "z"]}`,
+			match:  []string{`{"s": "x", "i": -12, "n": 1.5e3, "b": false, "z": null}`},
+			reject: []string{`{"s": "x", "i": 1.5, "n": 1, "b": false, "z": null}`, `{"s": 1, "i": 1, "n": 1, "b": false, "z": null}`},
+		},
+		{
+			name:   "optional",
+			schema: `{"type": "object", "properties": {"a": {"type": "integer"}, "b": {"type": "integer"}, "c": {"type": "integer"}}}`,
+			match:  []string{`{}`, `{"a": 1}`, `{"b": 1}`, `{"a": 1, "c": 3}`, `{"a": 1, "b": 2, "c": 3}`},
+			reject: []string{`{"b": 1, "a": 2}`, `{"a": 1,}`, `{"d": 1}`},
+		},
+		{
+			name:   "additional properties",
+			schema: `{"type": "object", "properties": {"a": {"type": "integer"}}, "required": ["a"], "additionalProperties": {"type": "string"}}`,
+			match:  []string{`{"a": 1}`, `{"a": 1, "x": "y", "z": "w"}`},
+			reject: []string{`{"a": 1, "x": 2}`},
+		},
+		{
+			name:   "enum",
+			schema: `{"enum": ["red", "green", 3, null]}`,
+			match:  []string{`"red"`, `"green"`, `3`, `null`},
+			reject: []string{`"blue"`, `4`},
+		},
+		{
+			name:   "const",
+			schema: `{"const": {"a": "b"}}`,
+			match:  []string{`{"a":"b"}`},
+			reject: []string{`{"a": "b"}`, `{"a":"c"}`},
+		},
+		{
+			name:   "array bounds",
+			schema: `{"type": "array", "items": {"type": "integer"}, "minItems": 2, "maxItems": 3}`,
+			match:  []string{`[1, 2]`, `[1, 2, 3]`},
+			reject: []string{`[]`, `[1]`, `[1, 2, 3, 4]`},
+		},
+		{
+			name:   "tuple",
+			schema: `{"type": "array", "prefixItems": [{"type": "string"}, {"type": "integer"}]}`,
+			match:  []string{`["a", 1]`},
+			reject: []string{`[1, "a"]`, `["a"]`},
+		},
+		{
+			name:   "string length",
+			schema: `{"type": "string", "minLength": 2, "maxLength": 3}`,
+			match:  []string{`"ab"`, `"abc"`},
+			reject: []string{`"a"`, `"abcd"`},
+		},
+		{
+			name:   "formats",
+			schema: `{"type": "array", "prefixItems": [{"type": "string", "format": "date"}, {"type": "string", "format": "date-time"}, {"type": "string", "format": "uuid"}]}`,
+			match:  []string{`["2024-01-31", "2024-01-31T12:30:00Z", "123e4567-e89b-12d3-a456-426614174000"]`},
+			reject: []string{`["2024-13-01", "2024-01-31T12:30:00Z", "123e4567-e89b-12d3-a456-426614174000"]`},
+		},
+		{
+			name:   "nullable",
+			schema: `{"type": ["string", "null"]}`,
+			match:  []string{`"a"`, `null`},
+			reject: []string{`1`},
+		},
+		{
+			name:   "any of",
+			schema: `{"anyOf": [{"type": "integer"}, {"type": "array", "items": {"type": "integer"}}]}`,
+			match:  []string{`1`, `[1, 2]`},
+			reject: []string{`"a"`, `["a"]`},
+		},
+		{
+			name:   "all of",
+			schema: `{"allOf": [{"type": "object", "properties": {"a": {"type": "integer"}}, "required": ["a"]}, {"properties": {"b": {"type": "string"}}, "required": ["b"]}]}`,
+			match:  []string{`{"a": 1, "b": "x"}`},
+			reject: []string{`{"a": 1}`, `{"b": "x"}`},
+		},
+		{
+			name:   "ref",
+			schema: `{"$defs": {"node": {"type": "object", "properties": {"value": {"type": "integer"}, "next": {"anyOf": [{"$ref": "#/$defs/node"}, {"type": "null"}]}}, "required": ["value", "next"]}}, "$ref": "#/$defs/node"}`,
+			match:  []string{`{"value": 1, "next": null}`, `{"value": 1, "next": {"value": 2, "next": null}}`},
+			reject: []string{`{"value": 1}`, `{"value": 1, "next": {"value": "x", "next": null}}`},
+		},
+		{
+			name:   "escaped keys",
+			schema: `{"type": "object", "properties": {"a \"quoted\" key": {"type": "integer"}}, "required": ["a \"quoted\" key"]}`,
+			match:  []string{`{"a \"quoted\" key": 1}`},
+		},
+		{
+			name:   "conflicting names",
+			schema: `{"type": "object", "properties": {"string": {"type": "integer"}, "value": {"type": "object", "properties": {"string": {"type": "boolean"}}, "required": ["string"]}}, "required": ["string", "value"]}`,
+			match:  []string{`{"string": 1, "value": {"string": true}}`},
+			reject: []string{`{"string": "a", "value": {"string": true}}`},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := SchemaToGrammar([]byte(tt.schema))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			g, err := Parse(string(b))
+			if err != nil {
+				t.Fatalf("%v\n%s", err, b)
+			}
+
+			for _, s := range tt.match {
+				if !match(t, g, s) {
+					t.Errorf("%s should match\n%s", s, b)
+				}
+			}
+
+			for _, s := range tt.reject {
+				if match(t, g, s) {
+					t.Errorf("%s should not match\n%s", s, b)
+				}
+			}
+		})
+	}
+}
+
+func TestSchemaListToGrammar(t *testing.T) {
+	cases := []struct {
+		name                string
+		prefix, sep, suffix string
+		match               []string
+		reject              []string
+	}{
+		{
+			name:   "tag",
+			prefix: "<tool_call>",
+			match:  []string{`<tool_call>{"a": 1}`, "<tool_call>\n{\"a\": 1}\n{\"a\": 2}"},
+			reject: []string{`{"a": 1}`, `<tool_call>`, `<tool_call>{"a": "x"}`},
+		},
+		{
+			name:   "array",
+			prefix: "[TOOL_CALLS] [",
+			sep:    ",",
+			suffix: "]",
+			match:  []string{`[TOOL_CALLS] [{"a": 1}]`, `[TOOL_CALLS] [ {"a": 1}, {"a": 2} ]`},
+			reject: []string{`[TOOL_CALLS] []`, `[TOOL_CALLS] [{"a": 1} {"a": 2}]`, `[TOOL_CALLS] [{"a": 1}`},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := SchemaListToGrammar([]byte(`{"type": "object", "properties": {"a": {"type": "integer"}}, "required": ["a"]}`), tt.prefix, tt.sep, tt.suffix)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			g, err := Parse(string(b))
+			if err != nil {
+				t.Fatalf("%v\n%s", err, b)
+			}
+
+			for _, s := range tt.match {
+				if !match(t, g, s) {
+					t.Errorf("%s should match\n%s", s, b)
+				}
+			}
+
+			for _, s := range tt.reject {
+				if match(t, g, s) {
+					t.Errorf("%s should not match\n%s", s, b)
+				}
+			}
+		})
+	}
+}
+
+func TestSchemaToGrammarErrors(t *testing.T) {
+	cases := []string{
+		`invalid`,
+		`{"type": "unknown"}`,
+		`{"$ref": "https://example.com/schema.json"}`,
+		`{"$ref": "#/$defs/missing"}`,
+		`false`,
+	}
+
+	for _, schema := range cases {
+		t.Run(schema, func(t *testing.T) {
+			if _, err := SchemaToGrammar([]byte(schema)); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package kvcache
 
 import (
 	"errors"
+	"io"
 
 	"github.com/ollama/ollama/ml"
 	"github.com/ollama/ollama/model/input"
@@ -75,3 +76,27 @@ type Cache interface {
 	// removed by calling Remove(seq, 0, math.MaxInt32)
 	Remove(seq int, beginIndex, endIndex int32) error
 }
+
+// Snapshotter is implemented by caches that can save the entries of a
+// sequence and restore them later, possibly in another process
+type Snapshotter interface {
+	// Snapshot starts copying the entries of seq in the range [0, len). The
+	// entries must not change until the copy is complete
+	Snapshot(seq int, len int32) (Snapshot, error)
+
+	// Load replaces the contents of seq with entries previously written
+	// by a Snapshot and returns the number of entries that were restored
+	Load(r io.Reader, seq int) (int32, error)
+}
+
+// Snapshot copies the entries of a sequence from the cache in steps, so that
+// the cache can be used for other sequences in between
+type Snapshot interface {
+	// Next copies the next part of the entries and returns true once all of
+	// them have been copied
+	Next() (bool, error)
+
+	// Save writes the copied entries to w. It doesn't use the cache, so it
+	// can be called from any goroutine once Next returns true
+	Save(w io.Writer) error
+}
@@ -1,12 +1,17 @@
 package kvcache
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"maps"
 	"math"
 	"slices"
 
+	"github.com/x448/float16"
+
 	"github.com/ollama/ollama/ml"
 	"github.com/ollama/ollama/model/input"
 )
@@ -127,6 +132,10 @@ func (c *Causal) Init(backend ml.Backend, dtype ml.DType, maxSequences, capacity
 	cacheSize = roundUp(cacheSize, c.config.CachePadding)
 	c.cells = make([]cacheCell, cacheSize)
 
+	if quantized(dtype) && c.config.PermutedV {
+		slog.Warn("quantized kv cache requires flash attention to store values, using f16 for values")
+	}
+
 	c.DType = dtype
 	c.cellRanges = make(map[int]cellRange)
 	c.backend = backend
@@ -156,10 +165,10 @@ func (c *Causal) StartForward(ctx ml.Context, batch input.Batch, reserve bool) e
 		c.updateSlidingWindow()
 
 		var err error
-		c.curLoc, err = c.findStartLoc()
+		c.curLoc, err = c.findStartLoc(c.curBatchSize)
 		if errors.Is(err, ErrKvCacheFull) {
 			c.defrag()
-			c.curLoc, err = c.findStartLoc()
+			c.curLoc, err = c.findStartLoc(c.curBatchSize)
 		}
 		if err != nil {
 			return err
@@ -212,13 +221,13 @@ func newRange() cellRange {
 	}
 }
 
-// Find the first contiguous block of at least curBatchSize
-func (c *Causal) findStartLoc() (int, error) {
+// Find the first contiguous block of at least size cells
+func (c *Causal) findStartLoc(size int) (int, error) {
 	var start, count int
 	for i := range c.cells {
 		if len(c.cells[i].sequences) == 0 {
 			count++
-			if count >= c.curBatchSize {
+			if count >= size {
 				return start, nil
 			}
 		} else {
@@ -326,34 +335,30 @@ func (c *Causal) buildMask(ctx ml.Context) (ml.Tensor, error) {
 	return maskTensor, nil
 }
 
+// cellViews returns views of the entries [loc, loc+length) of a layer's key
+// and value tensors, which are laid out in the same way as the cache
+func (c *Causal) cellViews(ctx ml.Context, key, value ml.Tensor, loc, length int) (ml.Tensor, ml.Tensor) {
+	kView := key.View(ctx, key.Stride(2)*loc, key.Dim(0)*key.Dim(1)*length)
+
+	var vView ml.Tensor
+	if c.config.PermutedV {
+		elemSize := value.Stride(0)
+		vView = value.View(ctx, elemSize*loc, length, value.Dim(0)*elemSize, value.Dim(1)*value.Dim(2))
+	} else {
+		vView = value.View(ctx, value.Stride(2)*loc, value.Dim(0)*value.Dim(1)*length)
+	}
+
+	return kView, vView
+}
+
 func (c *Causal) moveCells(ctx ml.Context, src, dst, length int) {
 	for i, key := range c.keys {
 		if key == nil {
 			continue
 		}
 
-		kHeadDim := key.Dim(0)
-		numKVHeads := key.Dim(1)
-		rowSize := key.Stride(2)
-
-		kSrcView := key.View(ctx, rowSize*src, kHeadDim*numKVHeads*length)
-		kDstView := key.View(ctx, rowSize*dst, kHeadDim*numKVHeads*length)
-
-		value := c.values[i]
-		var vSrcView, vDstView ml.Tensor
-		if c.config.PermutedV {
-			vHeadDim := value.Dim(1)
-			elemSize := value.Stride(0)
-
-			vSrcView = value.View(ctx, elemSize*src, length, len(c.cells)*elemSize, vHeadDim*numKVHeads)
-			vDstView = value.View(ctx, elemSize*dst, length, len(c.cells)*elemSize, vHeadDim*numKVHeads)
-		} else {
-			vHeadDim := value.Dim(0)
-			rowSize := value.Stride(2)
-
-			vSrcView = value.View(ctx, rowSize*src, vHeadDim*numKVHeads*length)
-			vDstView = value.View(ctx, rowSize*dst, vHeadDim*numKVHeads*length)
-		}
+		kSrcView, vSrcView := c.cellViews(ctx, key, c.values[i], src, length)
+		kDstView, vDstView := c.cellViews(ctx, key, c.values[i], dst, length)
 
 		ctx.Forward(
 			kSrcView.Copy(ctx, kDstView),
@@ -540,15 +545,17 @@ func (c *Causal) Put(ctx ml.Context, key, value ml.Tensor) {
 		c.ctxs[c.curLayer] = c.backend.NewContextSize(2).Layer(c.curLayer)
 	}
 
+	kDType, vDType := c.layerDTypes(kHeadDim, vHeadDim)
+
 	if _, ok := c.keys[c.curLayer]; !ok {
-		c.keys[c.curLayer] = c.ctxs[c.curLayer].Zeros(c.DType, kHeadDim, numKVHeads, len(c.cells))
+		c.keys[c.curLayer] = c.ctxs[c.curLayer].Zeros(kDType, kHeadDim, numKVHeads, len(c.cells))
 	}
 
 	if _, ok := c.values[c.curLayer]; !ok {
 		if c.config.PermutedV {
-			c.values[c.curLayer] = c.ctxs[c.curLayer].Zeros(c.DType, len(c.cells), vHeadDim, numKVHeads)
+			c.values[c.curLayer] = c.ctxs[c.curLayer].Zeros(vDType, len(c.cells), vHeadDim, numKVHeads)
 		} else {
-			c.values[c.curLayer] = c.ctxs[c.curLayer].Zeros(c.DType, vHeadDim, numKVHeads, len(c.cells))
+			c.values[c.curLayer] = c.ctxs[c.curLayer].Zeros(vDType, vHeadDim, numKVHeads, len(c.cells))
 		}
 	}
 
@@ -567,6 +574,36 @@ func (c *Causal) Put(ctx ml.Context, key, value ml.Tensor) {
 	}
 }
 
+// quantBlockSize is the number of values that are quantized together by
+// DTypeQ80 and DTypeQ40
+const quantBlockSize = 32
+
+func quantized(dtype ml.DType) bool {
+	return dtype == ml.DTypeQ80 || dtype == ml.DTypeQ40
+}
+
+// layerDTypes returns the types used to store the keys and values of a layer.
+// Quantized types pack blocks of values along the first dimension of a tensor,
+// so they are only used where each cell holds whole blocks. Otherwise, F16 is
+// used instead.
+func (c *Causal) layerDTypes(kHeadDim, vHeadDim int) (ml.DType, ml.DType) {
+	if !quantized(c.DType) {
+		return c.DType, c.DType
+	}
+
+	kDType, vDType := c.DType, c.DType
+	if kHeadDim%quantBlockSize != 0 {
+		kDType = ml.DTypeF16
+	}
+
+	// permuted values have cells along the first dimension
+	if c.config.PermutedV || vHeadDim%quantBlockSize != 0 {
+		vDType = ml.DTypeF16
+	}
+
+	return kDType, vDType
+}
+
 func (c *Causal) CopyPrefix(srcSeq, dstSeq int, len int32) {
 	seqRange := newRange()
 
@@ -659,7 +696,14 @@ func (c *Causal) shift(seq int, beginIndex, offset int32) error {
 			size,
 		)
 
-		roped, err := c.shiftFn(ctx, i, key, kShift)
+		// quantized keys can't be shifted directly, so they are converted
+		// to F32 and quantized again afterwards
+		shiftKey := key
+		if quantized(key.DType()) {
+			shiftKey = key.Copy(ctx, ctx.Layer(i).Empty(ml.DTypeF32, kHeadDim, numKVHeads, size))
+		}
+
+		roped, err := c.shiftFn(ctx, i, shiftKey, kShift)
 		if err != nil {
 			return err
 		}
@@ -724,3 +768,376 @@ func (c *Causal) Remove(seq int, beginIndex, endIndex int32) error {
 
 	return nil
 }
+
+var snapshotMagic = [4]byte{'o', 'k', 'v', 'c'}
+
+const snapshotVersion = 1
+
+type snapshotHeader struct {
+	Magic     [4]byte
+	Version   uint32
+	DType     uint32
+	PermutedV bool
+	Layers    uint32
+	Len       uint32
+}
+
+type snapshotLayer struct {
+	Layer      uint32
+	KHeadDim   uint32
+	VHeadDim   uint32
+	NumKVHeads uint32
+}
+
+// Save writes the entries of seq in the range [0, length) to w, copying them
+// from the cache all at once
+func (c *Causal) Save(w io.Writer, seq int, length int32) error {
+	s, err := c.Snapshot(seq, length)
+	if err != nil {
+		return err
+	}
+
+	for {
+		done, err := s.Next()
+		if err != nil {
+			return err
+		}
+
+		if done {
+			break
+		}
+	}
+
+	return s.Save(w)
+}
+
+// Snapshot starts copying the entries of seq in the range [0, length). Entries
+// are stored as F16 unless the cache is F32, so quantized caches are quantized
+// again when the snapshot is loaded
+func (c *Causal) Snapshot(seq int, length int32) (Snapshot, error) {
+	if _, err := c.snapshotLocs(seq, length); err != nil {
+		return nil, err
+	}
+
+	var layers []int
+	for _, layer := range slices.Sorted(maps.Keys(c.keys)) {
+		if c.keys[layer] != nil {
+			layers = append(layers, layer)
+		}
+	}
+
+	dtype := ml.DTypeF16
+	if c.DType == ml.DTypeF32 {
+		dtype = ml.DTypeF32
+	}
+
+	return &causalSnapshot{
+		c:      c,
+		seq:    seq,
+		length: length,
+		dtype:  dtype,
+		layers: layers,
+	}, nil
+}
+
+// snapshotLocs returns the cells that hold positions [0, length) of seq
+func (c *Causal) snapshotLocs(seq int, length int32) ([]int, error) {
+	locs := make([]int, length)
+	for i := range locs {
+		locs[i] = -1
+	}
+
+	for i, cell := range c.cells {
+		if cell.pos < length && slices.Contains(cell.sequences, seq) {
+			locs[cell.pos] = i
+		}
+	}
+
+	if slices.Contains(locs, -1) {
+		return nil, fmt.Errorf("sequence %v does not contain all positions before %v", seq, length)
+	}
+
+	return locs, nil
+}
+
+// causalSnapshot copies a layer of the cache on each call to Next. The cells
+// are found again for each layer since they can move in between
+type causalSnapshot struct {
+	c      *Causal
+	seq    int
+	length int32
+	dtype  ml.DType
+	layers []int
+
+	// copied holds the layers that have been copied so far
+	copied []snapshotData
+}
+
+type snapshotData struct {
+	snapshotLayer
+	k, v []float32
+}
+
+func (s *causalSnapshot) Next() (bool, error) {
+	if len(s.copied) == len(s.layers) {
+		return true, nil
+	}
+
+	locs, err := s.c.snapshotLocs(s.seq, s.length)
+	if err != nil {
+		return false, err
+	}
+
+	layer := s.layers[len(s.copied)]
+
+	ctx := s.c.backend.NewContextSize(2).Input()
+	defer ctx.Close()
+
+	k, v := s.c.gatherCells(ctx, layer, locs)
+	s.copied = append(s.copied, snapshotData{
+		snapshotLayer: snapshotLayer{
+			Layer:      uint32(layer),
+			KHeadDim:   uint32(k.Dim(0)),
+			VHeadDim:   uint32(s.c.vHeadDim(v)),
+			NumKVHeads: uint32(k.Dim(1)),
+		},
+		k: k.Floats(),
+		v: v.Floats(),
+	})
+
+	return len(s.copied) == len(s.layers), nil
+}
+
+func (s *causalSnapshot) Save(w io.Writer) error {
+	if len(s.copied) != len(s.layers) {
+		return errors.New("kv cache snapshot is incomplete")
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, snapshotHeader{
+		Magic:     snapshotMagic,
+		Version:   snapshotVersion,
+		DType:     uint32(s.dtype),
+		PermutedV: s.c.config.PermutedV,
+		Layers:    uint32(len(s.layers)),
+		Len:       uint32(s.length),
+	}); err != nil {
+		return err
+	}
+
+	for _, l := range s.copied {
+		if err := binary.Write(w, binary.LittleEndian, l.snapshotLayer); err != nil {
+			return err
+		}
+
+		if err := writeFloats(w, s.dtype, l.k); err != nil {
+			return err
+		}
+
+		if err := writeFloats(w, s.dtype, l.v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Load replaces the contents of seq with a snapshot written by Save or a
+// Snapshot. The snapshot must come from a cache with the same layers and
+// layout
+func (c *Causal) Load(r io.Reader, seq int) (int32, error) {
+	var header snapshotHeader
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return 0, err
+	}
+
+	if header.Magic != snapshotMagic || header.Version != snapshotVersion {
+		return 0, errors.New("unsupported kv cache snapshot")
+	}
+
+	dtype := ml.DType(header.DType)
+	if dtype != ml.DTypeF16 && dtype != ml.DTypeF32 {
+		return 0, fmt.Errorf("unsupported kv cache snapshot type: %v", dtype)
+	}
+
+	var layers uint32
+	for _, key := range c.keys {
+		if key != nil {
+			layers++
+		}
+	}
+
+	if header.PermutedV != c.config.PermutedV || header.Layers != layers {
+		return 0, errors.New("kv cache snapshot does not match the cache layout")
+	}
+
+	if err := c.Remove(seq, 0, math.MaxInt32); err != nil {
+		return 0, err
+	}
+
+	length := int(header.Len)
+	if length == 0 {
+		return 0, nil
+	}
+
+	loc, err := c.findStartLoc(length)
+	if errors.Is(err, ErrKvCacheFull) {
+		c.defrag()
+		loc, err = c.findStartLoc(length)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	for range header.Layers {
+		var l snapshotLayer
+		if err := binary.Read(r, binary.LittleEndian, &l); err != nil {
+			return 0, err
+		}
+
+		key, value := c.keys[int(l.Layer)], c.values[int(l.Layer)]
+		if key == nil || key.Dim(0) != int(l.KHeadDim) || key.Dim(1) != int(l.NumKVHeads) || c.vHeadDim(value) != int(l.VHeadDim) {
+			return 0, fmt.Errorf("kv cache snapshot does not match the cache layout (layer: %v)", l.Layer)
+		}
+
+		k, err := readFloats(r, dtype, int(l.KHeadDim*l.NumKVHeads)*length)
+		if err != nil {
+			return 0, err
+		}
+
+		v, err := readFloats(r, dtype, int(l.VHeadDim*l.NumKVHeads)*length)
+		if err != nil {
+			return 0, err
+		}
+
+		if err := c.scatterCells(int(l.Layer), loc, length, k, v); err != nil {
+			return 0, err
+		}
+	}
+
+	// the cells are only claimed once all of the data has been written
+	for i := range length {
+		c.cells[loc+i] = cacheCell{pos: int32(i), sequences: []int{seq}}
+	}
+	c.cellRanges[seq] = cellRange{min: loc, max: loc + length - 1}
+
+	return int32(length), nil
+}
+
+func (c *Causal) vHeadDim(value ml.Tensor) int {
+	if c.config.PermutedV {
+		return value.Dim(1)
+	}
+
+	return value.Dim(0)
+}
+
+// gatherCells copies the entries of a layer at locs into F32 tensors allocated
+// from dataCtx, with the same layout as the cache
+func (c *Causal) gatherCells(dataCtx ml.Context, layer int, locs []int) (ml.Tensor, ml.Tensor) {
+	key, value := c.keys[layer], c.values[layer]
+	length := len(locs)
+
+	k := dataCtx.Empty(ml.DTypeF32, key.Dim(0), key.Dim(1), length)
+
+	var v ml.Tensor
+	if c.config.PermutedV {
+		v = dataCtx.Empty(ml.DTypeF32, length, value.Dim(1), value.Dim(2))
+	} else {
+		v = dataCtx.Empty(ml.DTypeF32, value.Dim(0), value.Dim(1), length)
+	}
+
+	ctx := c.backend.NewContext()
+
+	// Each run of adjacent cells takes 6 tensors, as with defrag
+	maxRuns := max(1, (ctx.MaxGraphNodes()-4)/6)
+	runs := 0
+
+	for start := 0; start < length; {
+		end := start + 1
+		for end < length && locs[end] == locs[end-1]+1 {
+			end++
+		}
+
+		kSrcView, vSrcView := c.cellViews(ctx, key, value, locs[start], end-start)
+		kDstView, vDstView := c.cellViews(ctx, k, v, start, end-start)
+		ctx.Forward(
+			kSrcView.Copy(ctx, kDstView),
+			vSrcView.Copy(ctx, vDstView),
+		)
+
+		start = end
+		runs++
+
+		if runs >= maxRuns || start == length {
+			ctx.Compute(k, v)
+			ctx.Close()
+			ctx = c.backend.NewContext()
+			runs = 0
+		}
+	}
+	ctx.Close()
+
+	return k, v
+}
+
+// scatterCells writes F32 data for the entries [loc, loc+length) of a layer
+func (c *Causal) scatterCells(layer, loc, length int, k, v []float32) error {
+	key, value := c.keys[layer], c.values[layer]
+
+	ctx := c.backend.NewContext()
+	defer ctx.Close()
+
+	kSrc, err := ctx.Input().FromFloatSlice(k, key.Dim(0), key.Dim(1), length)
+	if err != nil {
+		return err
+	}
+
+	var vSrc ml.Tensor
+	if c.config.PermutedV {
+		vSrc, err = ctx.Input().FromFloatSlice(v, length, value.Dim(1), value.Dim(2))
+	} else {
+		vSrc, err = ctx.Input().FromFloatSlice(v, value.Dim(0), value.Dim(1), length)
+	}
+	if err != nil {
+		return err
+	}
+
+	kDstView, vDstView := c.cellViews(ctx, key, value, loc, length)
+	ctx.Forward(
+		kSrc.Copy(ctx, kDstView),
+		vSrc.Copy(ctx, vDstView),
+	).Compute()
+
+	return nil
+}
+
+func writeFloats(w io.Writer, dtype ml.DType, f []float32) error {
+	if dtype == ml.DTypeF32 {
+		return binary.Write(w, binary.LittleEndian, f)
+	}
+
+	u16s := make([]uint16, len(f))
+	for i := range f {
+		u16s[i] = float16.Fromfloat32(f[i]).Bits()
+	}
+
+	return binary.Write(w, binary.LittleEndian, u16s)
+}
+
+func readFloats(r io.Reader, dtype ml.DType, n int) ([]float32, error) {
+	f := make([]float32, n)
+	if dtype == ml.DTypeF32 {
+		return f, binary.Read(r, binary.LittleEndian, f)
+	}
+
+	u16s := make([]uint16, n)
+	if err := binary.Read(r, binary.LittleEndian, u16s); err != nil {
+		return nil, err
+	}
+
+	for i := range u16s {
+		f[i] = float16.Frombits(u16s[i]).Float32()
+	}
+
+	return f, nil
+}
@@ -1,6 +1,8 @@
 package kvcache
 
 import (
+	"bytes"
+	"fmt"
 	"math"
 	"slices"
 	"testing"
@@ -274,6 +276,206 @@ func TestCopy(t *testing.T) {
 	testCache(t, backend, cache, tests)
 }
 
+func TestSnapshot(t *testing.T) {
+	backend := &testBackend{}
+	cache := NewCausalCache(nil)
+	defer cache.Close()
+
+	cache.Init(backend, ml.DTypeF16, 2, 16, 16)
+
+	testCache(t, backend, cache, []testCase{
+		{
+			name:          "Interleaved",
+			in:            []float32{1, 10, 2, 20, 3, 30},
+			inShape:       []int{1, 1, 6},
+			seqs:          []int{0, 1, 0, 1, 0, 1},
+			pos:           []int32{0, 0, 1, 1, 2, 2},
+			expected:      []float32{1, 10, 2, 20, 3, 30},
+			expectedShape: []int{1, 1, 6},
+			expectedMask:  []float32{0, float32(math.Inf(-1)), float32(math.Inf(-1)), float32(math.Inf(-1)), float32(math.Inf(-1)), float32(math.Inf(-1)), float32(math.Inf(-1)), 0, float32(math.Inf(-1)), float32(math.Inf(-1)), float32(math.Inf(-1)), float32(math.Inf(-1)), 0, float32(math.Inf(-1)), 0, float32(math.Inf(-1)), float32(math.Inf(-1)), float32(math.Inf(-1)), float32(math.Inf(-1)), 0, float32(math.Inf(-1)), 0, float32(math.Inf(-1)), float32(math.Inf(-1)), 0, float32(math.Inf(-1)), 0, float32(math.Inf(-1)), 0, float32(math.Inf(-1)), float32(math.Inf(-1)), 0, float32(math.Inf(-1)), 0, float32(math.Inf(-1)), 0},
+		},
+	})
+
+	var b bytes.Buffer
+	if err := cache.Save(&b, 1, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cache.Save(&bytes.Buffer{}, 1, 4); err == nil {
+		t.Error("expected error saving positions that are not in the cache")
+	}
+
+	// a snapshot fails if the entries are removed before it is complete
+	snapshot, err := cache.Snapshot(0, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cache.Remove(0, 1, math.MaxInt32); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := snapshot.Next(); err == nil {
+		t.Error("expected error copying entries that were removed")
+	}
+
+	restored := NewCausalCache(nil)
+	defer restored.Close()
+
+	restored.Init(backend, ml.DTypeF16, 2, 16, 16)
+
+	testCache(t, backend, restored, []testCase{
+		{
+			name:          "Other",
+			in:            []float32{5},
+			inShape:       []int{1, 1, 1},
+			seqs:          []int{0},
+			pos:           []int32{0},
+			expected:      []float32{5},
+			expectedShape: []int{1, 1, 1},
+			expectedMask:  []float32{0},
+		},
+	})
+
+	n, err := restored.Load(&b, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 3 {
+		t.Fatalf("restored %v entries, want 3", n)
+	}
+
+	testCache(t, backend, restored, []testCase{
+		{
+			name:          "Restored",
+			in:            []float32{40},
+			inShape:       []int{1, 1, 1},
+			seqs:          []int{1},
+			pos:           []int32{3},
+			expected:      []float32{10, 20, 30, 40},
+			expectedShape: []int{1, 1, 4},
+			expectedMask:  []float32{0, 0, 0, 0},
+		},
+	})
+}
+
+func TestQuantized(t *testing.T) {
+	for name, dtype := range map[string]ml.DType{"q8_0": ml.DTypeQ80, "q4_0": ml.DTypeQ40} {
+		t.Run(name, func(t *testing.T) {
+			backend := &testBackend{}
+			cache := NewCausalCache(func(ctx ml.Context, layer int, key, shift ml.Tensor) (ml.Tensor, error) {
+				if key.DType() != ml.DTypeF32 {
+					return nil, fmt.Errorf("unexpected key type for shift: %v", key.DType())
+				}
+
+				// shift every entry of a cell by its offset
+				out := ctx.Empty(ml.DTypeF32, key.Shape()...).(*testTensor)
+				cellSize := len(out.data) / shift.Dim(0)
+				for i := range out.data {
+					out.data[i] = key.(*testTensor).data[i] + shift.(*testTensor).data[i/cellSize]
+				}
+
+				return out, nil
+			})
+			defer cache.Close()
+
+			cache.Init(backend, dtype, 1, 5, 5)
+
+			// cells hold a whole block, with values that can't be represented exactly
+			in := make([]float32, quantBlockSize*4)
+			for i := range in {
+				in[i] = float32(i%quantBlockSize)/7 - float32(i/quantBlockSize)
+			}
+			cell := func(s []float32, i int) []float32 {
+				return s[i*quantBlockSize : (i+1)*quantBlockSize]
+			}
+
+			stored := slices.Clone(in)
+			testQuantize(dtype, stored)
+			if slices.Equal(stored, in) {
+				t.Fatal("test data is not changed by quantization")
+			}
+
+			testCache(t, backend, cache, []testCase{
+				{
+					name:          "FirstBatch",
+					in:            in,
+					inShape:       []int{quantBlockSize, 1, 4},
+					seqs:          []int{0, 0, 0, 0},
+					pos:           []int32{0, 1, 2, 3},
+					expected:      stored,
+					expectedShape: []int{quantBlockSize, 1, 4},
+					expectedMask:  []float32{0, float32(math.Inf(-1)), float32(math.Inf(-1)), float32(math.Inf(-1)), 0, 0, float32(math.Inf(-1)), float32(math.Inf(-1)), 0, 0, 0, float32(math.Inf(-1)), 0, 0, 0, 0},
+				},
+			})
+
+			// removing position 1 shifts the following cells, which are
+			// dequantized and then quantized again
+			if err := cache.Remove(0, 1, 2); err != nil {
+				t.Fatal(err)
+			}
+
+			shifted := slices.Clone(stored)
+			for i := range shifted[2*quantBlockSize:] {
+				shifted[2*quantBlockSize+i]--
+			}
+			testQuantize(dtype, shifted)
+
+			next := make([]float32, quantBlockSize*2)
+			for i := range next {
+				next[i] = float32(i%quantBlockSize)/3 + float32(i/quantBlockSize)
+			}
+			nextStored := slices.Clone(next)
+			testQuantize(dtype, nextStored)
+
+			// the new cells don't fit without moving the last cell into
+			// the hole left by the removed one
+			testCache(t, backend, cache, []testCase{
+				{
+					name:          "Defrag",
+					in:            next,
+					inShape:       []int{quantBlockSize, 1, 2},
+					seqs:          []int{0, 0},
+					pos:           []int32{3, 4},
+					expected:      slices.Concat(cell(stored, 0), cell(shifted, 3), cell(shifted, 2), nextStored),
+					expectedShape: []int{quantBlockSize, 1, 5},
+					expectedMask:  []float32{0, 0, 0, 0, float32(math.Inf(-1)), 0, 0, 0, 0, 0},
+				},
+			})
+		})
+	}
+}
+
+func TestQuantizedLayout(t *testing.T) {
+	backend := &testBackend{}
+
+	cache := NewCausalCache(nil)
+	defer cache.Close()
+
+	cache.Init(backend, ml.DTypeQ80, 1, 16, 16)
+
+	if k, v := cache.layerDTypes(quantBlockSize, quantBlockSize); k != ml.DTypeQ80 || v != ml.DTypeQ80 {
+		t.Errorf("layerDTypes = %v, %v; want %v, %v", k, v, ml.DTypeQ80, ml.DTypeQ80)
+	}
+
+	// head dimensions that aren't whole blocks can't be quantized
+	if k, v := cache.layerDTypes(quantBlockSize, 16); k != ml.DTypeQ80 || v != ml.DTypeF16 {
+		t.Errorf("layerDTypes = %v, %v; want %v, %v", k, v, ml.DTypeQ80, ml.DTypeF16)
+	}
+
+	// permuted values have cells along the quantized dimension
+	permuted := NewCausalCache(nil)
+	defer permuted.Close()
+
+	permuted.SetConfig(ml.CacheConfig{PermutedV: true})
+	permuted.Init(backend, ml.DTypeQ40, 1, 16, 16)
+
+	if k, v := permuted.layerDTypes(quantBlockSize, quantBlockSize); k != ml.DTypeQ40 || v != ml.DTypeF16 {
+		t.Errorf("layerDTypes = %v, %v; want %v, %v", k, v, ml.DTypeQ40, ml.DTypeF16)
+	}
+}
+
 func testCache(t *testing.T, backend ml.Backend, cache Cache, tests []testCase) {
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
@@ -484,6 +686,10 @@ func (t *testTensor) Neg(ctx ml.Context) ml.Tensor {
 }
 
 func (t *testTensor) Add(ctx ml.Context, t2 ml.Tensor) ml.Tensor {
+	if quantized(t.dtype) {
+		panic("operations are not supported on quantized tensors")
+	}
+
 	out := ctx.Empty(t.DType(), t.Shape()...).(*testTensor)
 
 	for i := range out.data {
@@ -512,10 +718,52 @@ func (t *testTensor) View(ctx ml.Context, offset int, shape ...int) ml.Tensor {
 	view := context.Empty(t.dtype, s...).(*testTensor)
 	view.data = t.data[offset : offset+len(view.data)]
 
+	// views can't split the blocks of quantized tensors
+	if quantized(t.dtype) && (offset%quantBlockSize != 0 || s[0]%quantBlockSize != 0) {
+		panic(fmt.Errorf("view splits quantized blocks (offset: %v, shape: %v)", offset, s))
+	}
+
 	return view
 }
 
 func (t *testTensor) Copy(ctx ml.Context, t2 ml.Tensor) ml.Tensor {
-	copy(t2.(*testTensor).data, t.data)
-	return nil
+	dst := t2.(*testTensor)
+	copy(dst.data, t.data)
+
+	if quantized(dst.dtype) && t.dtype != dst.dtype {
+		testQuantize(dst.dtype, dst.data)
+	}
+
+	return dst
+}
+
+// testQuantize rounds each block of data to the values that can be stored with
+// dtype, following the Q8_0 and Q4_0 formats
+func testQuantize(dtype ml.DType, data []float32) {
+	for b := 0; b < len(data); b += quantBlockSize {
+		block := data[b:min(b+quantBlockSize, len(data))]
+
+		var amax, m float32
+		for _, f := range block {
+			if abs := float32(math.Abs(float64(f))); abs > amax {
+				amax, m = abs, f
+			}
+		}
+
+		if amax == 0 {
+			continue
+		}
+
+		for i, f := range block {
+			switch dtype {
+			case ml.DTypeQ80:
+				d := amax / 127
+				block[i] = float32(math.Round(float64(f/d))) * d
+			case ml.DTypeQ40:
+				d := m / -8
+				q := min(15, max(0, math.Floor(float64(f/d)+8.5)))
+				block[i] = float32(q-8) * d
+			}
+		}
+	}
 }
@@ -177,8 +177,14 @@ func (c *Context) GetEmbeddingsSeq(seqId int) []float32 {
 		return nil
 	}
 
-	embeddings := make([]float32, c.Model().NEmbd())
-	_ = copy(embeddings, unsafe.Slice((*float32)(e), c.Model().NEmbd()))
+	// models with rank pooling return a single score for each sequence
+	n := c.Model().NEmbd()
+	if C.llama_pooling_type(c.c) == C.LLAMA_POOLING_TYPE_RANK {
+		n = 1
+	}
+
+	embeddings := make([]float32, n)
+	_ = copy(embeddings, unsafe.Slice((*float32)(e), n))
 	return embeddings
 }
 
@@ -193,6 +199,18 @@ func (c *Context) GetEmbeddingsIth(i int) []float32 {
 	return embeddings
 }
 
+// GetLogitsIth returns the logits for the ith output of the last batch
+func (c *Context) GetLogitsIth(i int) []float32 {
+	l := unsafe.Pointer(C.llama_get_logits_ith(c.c, C.int32_t(i)))
+	if l == nil {
+		return nil
+	}
+
+	logits := make([]float32, c.Model().NumVocab())
+	_ = copy(logits, unsafe.Slice((*float32)(l), c.Model().NumVocab()))
+	return logits
+}
+
 type ModelParams struct {
 	NumGpuLayers int
 	MainGpu      int
@@ -629,6 +647,7 @@ type SamplingParams struct {
 	PenalizeNl     bool
 	Seed           uint32
 	Grammar        string
+	LogitBias      map[int32]float32
 }
 
 func NewSamplingContext(model *Model, params SamplingParams) (*SamplingContext, error) {
@@ -651,6 +670,22 @@ func NewSamplingContext(model *Model, params SamplingParams) (*SamplingContext,
 	defer C.free(unsafe.Pointer(grammar))
 
 	cparams.grammar = grammar
+
+	if len(params.LogitBias) > 0 {
+		logitBias := C.malloc(C.size_t(len(params.LogitBias)) * C.size_t(unsafe.Sizeof(C.llama_logit_bias{})))
+		defer C.free(logitBias)
+
+		biases := unsafe.Slice((*C.llama_logit_bias)(logitBias), len(params.LogitBias))
+		i := 0
+		for token, bias := range params.LogitBias {
+			biases[i] = C.llama_logit_bias{token: C.llama_token(token), bias: C.float(bias)}
+			i++
+		}
+
+		cparams.logit_bias = (*C.llama_logit_bias)(logitBias)
+		cparams.n_logit_bias = C.size_t(len(biases))
+	}
+
 	context := &SamplingContext{c: C.common_sampler_cinit(model.c, &cparams)}
 	if context.c == nil {
 		return nil, errors.New("unable to create sampling context")
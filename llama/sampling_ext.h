@@ -25,6 +25,8 @@ extern "C"
         float mirostat_eta;
         uint32_t seed;
         char *grammar;
+        const llama_logit_bias *logit_bias;
+        size_t n_logit_bias;
     };
 
     struct common_sampler *common_sampler_cinit(const struct llama_model *model, struct common_sampler_cparams *params);
@@ -46,6 +46,7 @@ type MemoryEstimate struct {
 	VRAMSize uint64
 
 	// The total size of the model if loaded into VRAM.  If all layers are loaded, VRAMSize == TotalSize
+	// unless there is a draft model, which is always loaded into system memory
 	TotalSize uint64
 
 	// For multi-GPU scenarios, this provides the tensor split parameter
@@ -67,6 +68,8 @@ type MemoryEstimate struct {
 	graphPartialOffload uint64
 
 	projectorWeights, projectorGraph uint64
+
+	draftWeights, draftKV, draftGraph uint64
 }
 
 // Given a model and one or more GPU targets, predict how many layers and bytes we can load, and the total size
@@ -139,6 +142,12 @@ func EstimateGPULayers(gpus []discover.GpuInfo, f *ggml.GGML, projectors []strin
 
 	kv, graphPartialOffload, graphFullOffload := f.GraphSize(uint64(opts.NumCtx), uint64(min(opts.NumCtx, opts.NumBatch)), numParallel, kvct)
 
+	// the draft model runs on the CPU, so it only needs system memory
+	var draftWeights, draftKV, draftGraph uint64
+	if opts.DraftModel != "" {
+		draftWeights, draftKV, draftGraph = draftMemoryRequirements(opts.DraftModel, opts, numParallel, kvct)
+	}
+
 	if len(kv) > 0 {
 		layerSize += kv[0]
 	}
@@ -295,7 +304,7 @@ func EstimateGPULayers(gpus []discover.GpuInfo, f *ggml.GGML, projectors []strin
 	for i := range gpuAllocations {
 		memoryRequiredPartial += gpuAllocations[i]
 	}
-	memoryRequiredTotal = memoryRequiredPartial + overflow
+	memoryRequiredTotal = memoryRequiredPartial + overflow + draftWeights + draftKV + draftGraph
 
 	tensorSplit := ""
 	if len(gpus) > 1 {
@@ -329,6 +338,9 @@ func EstimateGPULayers(gpus []discover.GpuInfo, f *ggml.GGML, projectors []strin
 		graphPartialOffload: graphPartialOffload,
 		projectorWeights:    projectorWeights,
 		projectorGraph:      projectorGraph,
+		draftWeights:        draftWeights,
+		draftKV:             draftKV,
+		draftGraph:          draftGraph,
 	}
 
 	if gpus[0].Library == "cpu" {
@@ -404,9 +416,44 @@ func (m MemoryEstimate) LogValue() slog.Value {
 		))
 	}
 
+	if m.draftWeights > 0 {
+		attrs = append(attrs, slog.Group(
+			"draft",
+			"weights", format.HumanBytes2(m.draftWeights),
+			"kv", format.HumanBytes2(m.draftKV),
+			"graph", format.HumanBytes2(m.draftGraph),
+		))
+	}
+
 	return slog.GroupValue(attrs...)
 }
 
+// draftMemoryRequirements returns the memory needed by the draft model in
+// filename, which has a cache of the same size as the model's
+func draftMemoryRequirements(filename string, opts api.Options, numParallel int, kvct string) (weights, kv, graphSize uint64) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, 0, 0
+	}
+	defer file.Close()
+
+	f, _, err := ggml.Decode(file, 0)
+	if err != nil {
+		return 0, 0, 0
+	}
+
+	for _, layer := range f.Tensors().GroupLayers() {
+		weights += layer.Size()
+	}
+
+	kvLayers, graphPartialOffload, graphFullOffload := f.GraphSize(uint64(opts.NumCtx), uint64(min(opts.NumCtx, opts.NumBatch)), numParallel, kvct)
+	for _, l := range kvLayers {
+		kv += l
+	}
+
+	return weights, kv, max(graphPartialOffload, graphFullOffload)
+}
+
 func projectorMemoryRequirements(filename string) (weights, graphSize uint64) {
 	file, err := os.Open(filename)
 	if err != nil {
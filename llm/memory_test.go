@@ -128,4 +128,23 @@ func TestEstimateGPULayers(t *testing.T) {
 			}
 		})
 	}
+
+	t.Run("draft", func(t *testing.T) {
+		// the draft model only needs system memory, so it doesn't change
+		// what is offloaded
+		withDraft := opts
+		withDraft.DraftModel = f.Name()
+
+		weights, kv, graph := draftMemoryRequirements(f.Name(), opts, 1, "")
+		require.NotZero(t, weights)
+		require.NotZero(t, kv)
+
+		for _, gpus := range [][]discover.GpuInfo{{{Library: "cpu"}}, gpus} {
+			estimate := EstimateGPULayers(gpus, ggml, projectors, opts, 1)
+			draft := EstimateGPULayers(gpus, ggml, projectors, withDraft, 1)
+			assert.Equal(t, estimate.Layers, draft.Layers)
+			assert.Equal(t, estimate.VRAMSize, draft.VRAMSize)
+			assert.Equal(t, estimate.TotalSize+weights+kv+graph, draft.TotalSize)
+		}
+	})
 }
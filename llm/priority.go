@@ -0,0 +1,94 @@
+package llm
+
+import (
+	"context"
+	"slices"
+	"sync"
+
+	"github.com/ollama/ollama/api"
+)
+
+type priorityKey struct{}
+
+// WithPriority returns a copy of ctx that gets requests given it a free slot
+// in a runner ahead of waiting requests with a lower priority
+func WithPriority(ctx context.Context, priority api.Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, priority)
+}
+
+// priorityFromContext returns the index of the priority of ctx in
+// waiters, where interactive requests come first
+func priorityFromContext(ctx context.Context) int {
+	if p, _ := ctx.Value(priorityKey{}).(api.Priority); p == api.PriorityBatch {
+		return 1
+	}
+
+	return 0
+}
+
+// prioritySemaphore limits how many requests a runner processes at once.
+// Waiting requests get a slot in order of priority, then in the order
+// they started waiting
+type prioritySemaphore struct {
+	mu      sync.Mutex
+	size    int
+	used    int
+	waiters [2][]chan struct{}
+}
+
+func newPrioritySemaphore(n int) *prioritySemaphore {
+	return &prioritySemaphore{size: n}
+}
+
+// Acquire waits for a free slot, or until ctx is done
+func (s *prioritySemaphore) Acquire(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	if s.used < s.size && len(s.waiters[0])+len(s.waiters[1]) == 0 {
+		s.used++
+		s.mu.Unlock()
+		return nil
+	}
+
+	i := priorityFromContext(ctx)
+	ready := make(chan struct{})
+	s.waiters[i] = append(s.waiters[i], ready)
+	s.mu.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		select {
+		case <-ready:
+			// the slot was handed over as ctx was done, so pass it on
+			s.mu.Unlock()
+			s.Release()
+		default:
+			s.waiters[i] = slices.DeleteFunc(s.waiters[i], func(c chan struct{}) bool { return c == ready })
+			s.mu.Unlock()
+		}
+		return ctx.Err()
+	}
+}
+
+// Release frees a slot, handing it to the next waiting request if there is
+// one
+func (s *prioritySemaphore) Release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.waiters {
+		if len(s.waiters[i]) > 0 {
+			close(s.waiters[i][0])
+			s.waiters[i] = s.waiters[i][1:]
+			return
+		}
+	}
+
+	s.used--
+}
@@ -0,0 +1,94 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+func TestPrioritySemaphore(t *testing.T) {
+	s := newPrioritySemaphore(1)
+	if err := s.Acquire(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+
+	order := make(chan api.Priority, 3)
+	var queued []api.Priority
+	wait := func(priority api.Priority) {
+		t.Helper()
+		go func() {
+			if err := s.Acquire(WithPriority(t.Context(), priority)); err != nil {
+				t.Error(err)
+				return
+			}
+			order <- priority
+			s.Release()
+		}()
+
+		// wait for the request to be queued so the order is known
+		deadline := time.Now().Add(time.Second)
+		for {
+			s.mu.Lock()
+			n := len(s.waiters[0]) + len(s.waiters[1])
+			s.mu.Unlock()
+			if n > 0 && n == len(queued)+1 {
+				break
+			} else if time.Now().After(deadline) {
+				t.Fatal("timed out waiting for request to queue")
+			}
+			time.Sleep(time.Millisecond)
+		}
+		queued = append(queued, priority)
+	}
+
+	// a canceled request gives up its place
+	ctx, cancel := context.WithCancel(t.Context())
+	errCh := make(chan error, 1)
+	go func() { errCh <- s.Acquire(ctx) }()
+	for {
+		s.mu.Lock()
+		n := len(s.waiters[0])
+		s.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-errCh; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	wait(api.PriorityBatch)
+	wait(api.PriorityInteractive)
+	wait(api.PriorityBatch)
+
+	s.Release()
+	for _, want := range []api.Priority{api.PriorityInteractive, api.PriorityBatch, api.PriorityBatch} {
+		select {
+		case got := <-order:
+			if got != want {
+				t.Fatalf("expected %s request, got %s", want, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for a slot")
+		}
+	}
+
+	// the last request releases its slot after it is received
+	deadline := time.Now().Add(time.Second)
+	for {
+		s.mu.Lock()
+		used := s.used
+		s.mu.Unlock()
+		if used == 0 {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("expected no slots in use, got %d", used)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
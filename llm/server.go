@@ -20,15 +20,15 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"golang.org/x/sync/semaphore"
-
 	"github.com/ollama/ollama/api"
 	"github.com/ollama/ollama/discover"
 	"github.com/ollama/ollama/envconfig"
 	"github.com/ollama/ollama/format"
 	"github.com/ollama/ollama/fs/ggml"
+	"github.com/ollama/ollama/grammar"
 	"github.com/ollama/ollama/llama"
 	"github.com/ollama/ollama/model"
 )
@@ -37,9 +37,13 @@ type LlamaServer interface {
 	Ping(ctx context.Context) error
 	WaitUntilRunning(ctx context.Context) error
 	Completion(ctx context.Context, req CompletionRequest, fn func(CompletionResponse)) error
-	Embedding(ctx context.Context, input string) ([]float32, error)
+	Embedding(ctx context.Context, input []string) ([][]float32, error)
 	Tokenize(ctx context.Context, content string) ([]int, error)
 	Detokenize(ctx context.Context, tokens []int) (string, error)
+	Pin(ctx context.Context, prompt string) (Pin, error)
+	Pins(ctx context.Context) ([]Pin, error)
+	Unpin(ctx context.Context, id int) error
+	Stats(ctx context.Context) (Stats, error)
 	Close() error
 	EstimatedVRAM() uint64 // Total VRAM across all GPUs
 	EstimatedTotal() uint64
@@ -65,6 +69,10 @@ type llmServer struct {
 	// nil if this server is running the llama.cpp based engine
 	textProcessor model.TextProcessor
 
+	// promptCache is set if the runner saves prompts to disk, which it is
+	// asked to do before it is stopped
+	promptCache bool
+
 	estimate    MemoryEstimate
 	totalLayers uint64
 	// gpuCount     int
@@ -72,7 +80,10 @@ type llmServer struct {
 	loadDuration time.Duration        // Record how long it took the model to load
 	loadProgress float32
 
-	sem *semaphore.Weighted
+	sem *prioritySemaphore
+
+	// requests that hold a slot in sem and requests waiting for one
+	active, queued atomic.Int32
 }
 
 // LoadModel will load a model from disk. The model must be in the GGML format.
@@ -289,6 +300,25 @@ func NewLlamaServer(gpus discover.GpuInfoList, modelPath string, f *ggml.GGML, a
 		params = append(params, "--mmproj", projectors[0])
 	}
 
+	var promptCache bool
+	if dir := envconfig.PromptCacheDir(); dir != "" {
+		if textProcessor != nil {
+			// model blobs are named by their digest, which keys the saved prompts
+			params = append(params, "--prompt-cache-dir", filepath.Join(dir, filepath.Base(modelPath)))
+			promptCache = true
+		} else {
+			slog.Warn("saving the prompt cache to disk is not supported by this model", "model", modelPath)
+		}
+	}
+
+	if opts.DraftModel != "" {
+		if textProcessor != nil {
+			params = append(params, "--draft-model", opts.DraftModel, "--draft-max", strconv.Itoa(opts.NumDraft))
+		} else {
+			slog.Warn("speculative decoding is not supported by this model, ignoring draft model", "model", modelPath)
+		}
+	}
+
 	// iterate through compatible GPU libraries such as 'cuda_v12', 'cuda_v11', 'rocm', etc.
 	// adding each library's respective path to the LD_LIBRARY_PATH, until finally running
 	// without any LD_LIBRARY_PATH flags
@@ -356,9 +386,10 @@ func NewLlamaServer(gpus discover.GpuInfoList, modelPath string, f *ggml.GGML, a
 			modelPath:     modelPath,
 			llamaModel:    llamaModel,
 			textProcessor: textProcessor,
+			promptCache:   promptCache,
 			estimate:      estimate,
 			numParallel:   numParallel,
-			sem:           semaphore.NewWeighted(int64(numParallel)),
+			sem:           newPrioritySemaphore(numParallel),
 			totalLayers:   f.KV().BlockCount() + 1,
 			gpus:          gpus,
 			done:          make(chan error, 1),
@@ -660,6 +691,10 @@ ws ::= ([ \t\n] ws)?
 
 const maxBufferSize = 512 * format.KiloByte
 
+// promptCacheSaveTimeout limits how long stopping a runner waits for it to
+// save its prompt cache
+const promptCacheSaveTimeout = 30 * time.Second
+
 type ImageData struct {
 	Data          []byte `json:"data"`
 	ID            int    `json:"id"`
@@ -672,7 +707,16 @@ type CompletionRequest struct {
 	Images  []ImageData
 	Options *api.Options
 
-	Grammar string // set before sending the request to the subprocess
+	// Logprobs requests the log probability of each generated token along
+	// with the TopLogprobs most likely alternatives
+	Logprobs    bool
+	TopLogprobs int
+
+	// N is the number of completions to generate for the prompt
+	N int
+
+	// Grammar constrains the output. It is set from Format if that is given
+	Grammar string
 }
 
 // DoneReason represents the reason why a completion response is done
@@ -685,6 +729,9 @@ const (
 	DoneReasonLength
 	// DoneReasonConnectionClosed indicates the completion stopped due to the connection being closed
 	DoneReasonConnectionClosed
+	// DoneReasonError indicates the completion failed, as described by
+	// [CompletionResponse.Error]
+	DoneReasonError
 )
 
 func (d DoneReason) String() string {
@@ -693,12 +740,18 @@ func (d DoneReason) String() string {
 		return "length"
 	case DoneReasonStop:
 		return "stop"
+	case DoneReasonError:
+		return "error"
 	default:
 		return "" // closed
 	}
 }
 
+// CompletionResponse is part of the output of a completion. When more than
+// one completion is requested, Index identifies which one it belongs to and
+// each completion ends with its own response with Done set
 type CompletionResponse struct {
+	Index              int           `json:"index,omitempty"`
 	Content            string        `json:"content"`
 	DoneReason         DoneReason    `json:"done_reason"`
 	Done               bool          `json:"done"`
@@ -706,6 +759,12 @@ type CompletionResponse struct {
 	PromptEvalDuration time.Duration `json:"prompt_eval_duration"`
 	EvalCount          int           `json:"eval_count"`
 	EvalDuration       time.Duration `json:"eval_duration"`
+
+	// Logprobs holds an entry for each token in Content
+	Logprobs []api.Logprob `json:"logprobs,omitempty"`
+
+	// Error is set on the final response of a completion that failed
+	Error string `json:"error,omitempty"`
 }
 
 func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn func(CompletionResponse)) error {
@@ -722,12 +781,22 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 				return fmt.Errorf("invalid format: %q; expected \"json\" or a valid JSON Schema object", req.Format)
 			}
 
-			// User provided a JSON schema
-			g := llama.SchemaToGrammar(req.Format)
-			if g == nil {
-				return fmt.Errorf("invalid JSON schema in format")
+			// User provided a JSON schema. llama.cpp keeps using its own
+			// converter so that its grammar parser gets the output it
+			// expects
+			if s.textProcessor != nil {
+				g, err := grammar.SchemaToGrammar(req.Format)
+				if err != nil {
+					return fmt.Errorf("invalid JSON schema in format: %w", err)
+				}
+				req.Grammar = string(g)
+			} else {
+				g := llama.SchemaToGrammar(req.Format)
+				if g == nil {
+					return fmt.Errorf("invalid JSON schema in format")
+				}
+				req.Grammar = string(g)
 			}
-			req.Grammar = string(g)
 		}
 	}
 
@@ -736,7 +805,7 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 		req.Options = &opts
 	}
 
-	if err := s.sem.Acquire(ctx, 1); err != nil {
+	if err := s.acquire(ctx); err != nil {
 		if errors.Is(err, context.Canceled) {
 			slog.Info("aborting completion request due to client closing the connection")
 		} else {
@@ -744,7 +813,7 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 		}
 		return err
 	}
-	defer s.sem.Release(1)
+	defer s.release()
 
 	// put an upper limit on num_predict to avoid the model running on forever
 	if req.Options.NumPredict < 0 || req.Options.NumPredict > 10*s.options.NumCtx {
@@ -794,9 +863,16 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 	buf := make([]byte, 0, maxBufferSize)
 	scanner.Buffer(buf, maxBufferSize)
 
+	n := max(req.N, 1)
+
 	// keep track of the last token generated, this is used to abort if the model starts looping
-	var lastToken string
-	var tokenRepeat int
+	lastToken := make([]string, n)
+	tokenRepeat := make([]int, n)
+
+	// ended is set for completions that failed, whose remaining output is
+	// ignored while the others finish
+	ended := make([]bool, n)
+	var done int
 
 	for scanner.Scan() {
 		select {
@@ -818,29 +894,51 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 			if err := json.Unmarshal(evt, &c); err != nil {
 				return fmt.Errorf("error unmarshalling llm prediction response: %v", err)
 			}
+
+			if c.Index < 0 || c.Index >= n {
+				return fmt.Errorf("unexpected completion index %d", c.Index)
+			}
+
+			if ended[c.Index] {
+				continue
+			}
+
 			switch {
-			case strings.TrimSpace(c.Content) == lastToken:
-				tokenRepeat++
+			case strings.TrimSpace(c.Content) == lastToken[c.Index]:
+				tokenRepeat[c.Index]++
 			default:
-				lastToken = strings.TrimSpace(c.Content)
-				tokenRepeat = 0
+				lastToken[c.Index] = strings.TrimSpace(c.Content)
+				tokenRepeat[c.Index] = 0
 			}
 
 			// 30 picked as an arbitrary max token repeat limit, modify as needed
-			if tokenRepeat > 30 {
-				slog.Debug("prediction aborted, token repeat limit reached")
-				return ctx.Err()
+			if tokenRepeat[c.Index] > 30 {
+				slog.Debug("prediction aborted, token repeat limit reached", "index", c.Index)
+				c = CompletionResponse{Index: c.Index, Done: true, Error: "token repeat limit reached"}
 			}
 
-			if c.Content != "" {
+			if c.Content != "" || len(c.Logprobs) > 0 {
 				fn(CompletionResponse{
-					Content: c.Content,
+					Index:    c.Index,
+					Content:  c.Content,
+					Logprobs: c.Logprobs,
 				})
 			}
 
 			if c.Done {
+				// a failed completion ends on its own, leaving the others
+				if c.Error != "" {
+					slog.Warn("completion failed", "index", c.Index, "error", c.Error)
+					c.DoneReason = DoneReasonError
+					ended[c.Index] = true
+				}
+
 				fn(c)
-				return nil
+
+				done++
+				if done == n {
+					return nil
+				}
 			}
 		}
 	}
@@ -864,15 +962,18 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 }
 
 type EmbeddingRequest struct {
-	Content string `json:"content"`
+	Content []string `json:"content"`
 }
 
 type EmbeddingResponse struct {
-	Embedding []float32 `json:"embedding"`
+	Embedding [][]float32 `json:"embedding"`
 }
 
-func (s *llmServer) Embedding(ctx context.Context, input string) ([]float32, error) {
-	if err := s.sem.Acquire(ctx, 1); err != nil {
+// Embedding returns an embedding for each input. The runner processes the
+// inputs as separate sequences that share batches, so a single call is much
+// faster than one call per input.
+func (s *llmServer) Embedding(ctx context.Context, input []string) ([][]float32, error) {
+	if err := s.acquire(ctx); err != nil {
 		if errors.Is(err, context.Canceled) {
 			slog.Info("aborting embedding request due to client closing the connection")
 		} else {
@@ -880,7 +981,7 @@ func (s *llmServer) Embedding(ctx context.Context, input string) ([]float32, err
 		}
 		return nil, err
 	}
-	defer s.sem.Release(1)
+	defer s.release()
 
 	// Make sure the server is ready
 	status, err := s.getServerStatusRetry(ctx)
@@ -922,6 +1023,10 @@ func (s *llmServer) Embedding(ctx context.Context, input string) ([]float32, err
 		return nil, fmt.Errorf("unmarshal tokenize response: %w", err)
 	}
 
+	if len(e.Embedding) != len(input) {
+		return nil, fmt.Errorf("expected %d embeddings, got %d", len(input), len(e.Embedding))
+	}
+
 	return e.Embedding, nil
 }
 
@@ -963,10 +1068,27 @@ type DetokenizeResponse struct {
 	Content string `json:"content"`
 }
 
+// ErrInvalidToken is returned when detokenizing a token that isn't in the
+// model's vocabulary
+var ErrInvalidToken = errors.New("invalid token")
+
 func (s *llmServer) Detokenize(ctx context.Context, tokens []int) (string, error) {
 	s.llamaModelLock.Lock()
 	defer s.llamaModelLock.Unlock()
 
+	// looking up a token outside the vocabulary crashes the tokenizer
+	var n int
+	if s.llamaModel != nil {
+		n = s.llamaModel.NumVocab()
+	} else if s.textProcessor != nil {
+		n = len(s.textProcessor.Vocabulary().Values)
+	}
+	for _, t := range tokens {
+		if t < 0 || t >= n {
+			return "", fmt.Errorf("%w %d: the vocabulary has %d tokens", ErrInvalidToken, t, n)
+		}
+	}
+
 	if s.llamaModel != nil {
 		var resp string
 		for _, token := range tokens {
@@ -989,6 +1111,260 @@ func (s *llmServer) Detokenize(ctx context.Context, tokens []int) (string, error
 	return "", fmt.Errorf("no tokenizer configured")
 }
 
+// ErrPinNotSupported is returned when the runner of a model cannot pin prompts
+var ErrPinNotSupported = errors.New("pinning prompts is not supported by this model")
+
+type PinRequest struct {
+	Prompt string `json:"prompt"`
+}
+
+// Pin is a prompt that is kept in the cache of a runner
+type Pin struct {
+	ID     int `json:"id"`
+	Inputs int `json:"inputs"`
+}
+
+type PinsResponse struct {
+	Pins []Pin `json:"pins"`
+}
+
+// Pin processes prompt and keeps it in the cache so that requests with a
+// prompt that starts with it don't need to process it again
+func (s *llmServer) Pin(ctx context.Context, prompt string) (Pin, error) {
+	if err := s.acquire(ctx); err != nil {
+		if errors.Is(err, context.Canceled) {
+			slog.Info("aborting pin request due to client closing the connection")
+		} else {
+			slog.Error("Failed to acquire semaphore", "error", err)
+		}
+		return Pin{}, err
+	}
+	defer s.release()
+
+	// Make sure the server is ready
+	status, err := s.getServerStatusRetry(ctx)
+	if err != nil {
+		return Pin{}, err
+	} else if status != ServerStatusReady {
+		return Pin{}, fmt.Errorf("unexpected server status: %s", status)
+	}
+
+	var pin Pin
+	if err := s.pinRequest(ctx, http.MethodPost, "/pin", PinRequest{Prompt: prompt}, &pin); err != nil {
+		return Pin{}, err
+	}
+
+	return pin, nil
+}
+
+// Pins lists the prompts pinned with Pin
+func (s *llmServer) Pins(ctx context.Context) ([]Pin, error) {
+	var resp PinsResponse
+	if err := s.pinRequest(ctx, http.MethodGet, "/pins", nil, &resp); err != nil {
+		return nil, err
+	}
+
+	return resp.Pins, nil
+}
+
+// Unpin allows the cache of a pinned prompt to be evicted again
+func (s *llmServer) Unpin(ctx context.Context, id int) error {
+	return s.pinRequest(ctx, http.MethodDelete, fmt.Sprintf("/pin/%d", id), nil, nil)
+}
+
+func (s *llmServer) pinRequest(ctx context.Context, method, path string, reqData, respData any) error {
+	var body io.Reader
+	if reqData != nil {
+		data, err := json.Marshal(reqData)
+		if err != nil {
+			return fmt.Errorf("error marshaling pin data: %w", err)
+		}
+		body = bytes.NewBuffer(data)
+	}
+
+	r, err := http.NewRequestWithContext(ctx, method, fmt.Sprintf("http://127.0.0.1:%d%s", s.port, path), body)
+	if err != nil {
+		return fmt.Errorf("error creating pin request: %w", err)
+	}
+	r.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return fmt.Errorf("do pin request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("error reading pin response: %w", err)
+	}
+
+	// only the Ollama engine runner handles pins
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrPinNotSupported
+	} else if resp.StatusCode >= 400 {
+		return fmt.Errorf("%s", bytes.TrimSpace(data))
+	}
+
+	if respData != nil {
+		if err := json.Unmarshal(data, respData); err != nil {
+			return fmt.Errorf("unmarshal pin response: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// acquire waits for a free slot in the runner, ahead of requests with a
+// lower priority, keeping count of the requests that are active and queued
+// for Stats
+func (s *llmServer) acquire(ctx context.Context) error {
+	s.queued.Add(1)
+	defer s.queued.Add(-1)
+
+	if err := s.sem.Acquire(ctx); err != nil {
+		return err
+	}
+
+	s.active.Add(1)
+	return nil
+}
+
+func (s *llmServer) release() {
+	s.active.Add(-1)
+	s.sem.Release()
+}
+
+// Stats is a snapshot of the activity of a runner
+type Stats struct {
+	// ActiveRequests are being processed by the runner and QueuedRequests
+	// are waiting for it to have a free slot
+	ActiveRequests int `json:"active_requests"`
+	QueuedRequests int `json:"queued_requests"`
+
+	// Slots is the number of slots in the runner's cache and SlotsInUse is
+	// the number being used by sequences
+	Slots      int `json:"slots"`
+	SlotsInUse int `json:"slots_in_use"`
+
+	// ContextLength is the number of inputs that all slots can hold and
+	// ContextUsed is the number that they currently hold
+	ContextLength int `json:"context_length"`
+	ContextUsed   int `json:"context_used"`
+
+	// PromptTokensPerSecond and TokensPerSecond are the rates at which
+	// prompt tokens were processed and tokens were generated over the last
+	// minute
+	PromptTokensPerSecond float64 `json:"prompt_tokens_per_second"`
+	TokensPerSecond       float64 `json:"tokens_per_second"`
+
+	// Layers is where each range of the model's layers is loaded
+	Layers []LayerPlacement `json:"layers,omitempty"`
+}
+
+// LayerPlacement is a range of layers, from First to Last inclusive, that
+// are loaded on the same device
+type LayerPlacement struct {
+	Library string `json:"library"`
+	ID      string `json:"id"`
+	First   int    `json:"first"`
+	Last    int    `json:"last"`
+}
+
+// Stats reports the activity of the runner along with where the model's
+// layers are loaded
+func (s *llmServer) Stats(ctx context.Context) (Stats, error) {
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("http://127.0.0.1:%d/stats", s.port), nil)
+	if err != nil {
+		return Stats{}, fmt.Errorf("error creating stats request: %w", err)
+	}
+
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return Stats{}, fmt.Errorf("do stats request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return Stats{}, fmt.Errorf("error reading stats response: %w", err)
+	}
+
+	if resp.StatusCode >= 400 {
+		return Stats{}, fmt.Errorf("%s", bytes.TrimSpace(data))
+	}
+
+	var stats Stats
+	if err := json.Unmarshal(data, &stats); err != nil {
+		return Stats{}, fmt.Errorf("unmarshal stats response: %w", err)
+	}
+
+	stats.ActiveRequests = int(s.active.Load())
+	stats.QueuedRequests = int(s.queued.Load())
+	stats.Layers = layerPlacement(s.gpus, s.estimate, s.options.NumGPU, int(s.totalLayers))
+	return stats, nil
+}
+
+// layerPlacement follows how the runners assign layers to devices: the last
+// numGPU repeating layers are offloaded, along with the output layer if
+// numGPU covers it, split between the GPUs in the proportions of the
+// estimate's tensor split. The rest stay on the CPU
+func layerPlacement(gpus discover.GpuInfoList, estimate MemoryEstimate, numGPU, totalLayers int) []LayerPlacement {
+	if numGPU < 0 {
+		numGPU = totalLayers
+	}
+
+	if len(gpus) == 0 || gpus[0].Library == "cpu" {
+		numGPU = 0
+	}
+
+	// the last layer is the output layer
+	start := max(0, totalLayers-1-numGPU)
+	stop := min(start+numGPU, totalLayers)
+
+	splits := make([]float64, len(gpus))
+	if counts := strings.Split(estimate.TensorSplit, ","); len(gpus) > 1 && len(counts) == len(gpus) {
+		for i, count := range counts {
+			n, _ := strconv.Atoi(count)
+			splits[i] = float64(n)
+		}
+	} else if len(splits) > 0 {
+		splits[0] = 1
+	}
+
+	var sum float64
+	for i := range splits {
+		sum += splits[i]
+		splits[i] = sum
+	}
+
+	device := func(i int) LayerPlacement {
+		if i >= start && i < stop {
+			for j, split := range splits {
+				if float64(i-start)/float64(stop-start) < split/sum {
+					return LayerPlacement{Library: gpus[j].Library, ID: gpus[j].ID}
+				}
+			}
+		}
+
+		return LayerPlacement{Library: "cpu", ID: "0"}
+	}
+
+	var placements []LayerPlacement
+	for i := range totalLayers {
+		p := device(i)
+		if n := len(placements); n > 0 && placements[n-1].Library == p.Library && placements[n-1].ID == p.ID {
+			placements[n-1].Last = i
+			continue
+		}
+
+		p.First, p.Last = i, i
+		placements = append(placements, p)
+	}
+
+	return placements
+}
+
 func (s *llmServer) Close() error {
 	s.llamaModelLock.Lock()
 	if s.llamaModel != nil {
@@ -998,6 +1374,10 @@ func (s *llmServer) Close() error {
 	s.llamaModelLock.Unlock()
 
 	if s.cmd != nil {
+		if s.promptCache && s.cmd.ProcessState == nil {
+			s.savePromptCache()
+		}
+
 		slog.Debug("stopping llama server")
 		if err := s.cmd.Process.Kill(); err != nil {
 			return err
@@ -1014,6 +1394,34 @@ func (s *llmServer) Close() error {
 	return nil
 }
 
+// savePromptCache asks the runner to save the prompts in its cache to disk so
+// that they can be restored once the model is loaded again
+func (s *llmServer) savePromptCache() {
+	ctx, cancel := context.WithTimeout(context.Background(), promptCacheSaveTimeout)
+	defer cancel()
+
+	start := time.Now()
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("http://127.0.0.1:%d/save", s.port), nil)
+	if err != nil {
+		slog.Warn("failed to save prompt cache", "error", err)
+		return
+	}
+
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		slog.Warn("failed to save prompt cache", "error", err)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		slog.Warn("failed to save prompt cache", "status", resp.Status)
+		return
+	}
+
+	slog.Debug("saved prompt cache", "duration", time.Since(start))
+}
+
 func (s *llmServer) EstimatedVRAM() uint64 {
 	return s.estimate.VRAMSize
 }
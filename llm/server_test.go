@@ -2,13 +2,21 @@ package llm
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"strconv"
 	"strings"
 	"testing"
 
+	"github.com/google/go-cmp/cmp"
+
 	"github.com/ollama/ollama/api"
-	"golang.org/x/sync/semaphore"
+	"github.com/ollama/ollama/discover"
+	"github.com/ollama/ollama/model"
 )
 
 func TestLLMServerCompletionFormat(t *testing.T) {
@@ -18,7 +26,7 @@ func TestLLMServerCompletionFormat(t *testing.T) {
 
 	ctx, cancel := context.WithCancel(context.Background())
 	s := &llmServer{
-		sem: semaphore.NewWeighted(1), // required to prevent nil panic
+		sem: newPrioritySemaphore(1), // required to prevent nil panic
 	}
 
 	checkInvalid := func(format string) {
@@ -70,3 +78,162 @@ func TestLLMServerCompletionFormat(t *testing.T) {
 	}, nil)
 	checkValid(err)
 }
+
+func TestLLMServerCompletionFailure(t *testing.T) {
+	// completion 1 fails to start and completion 2 loops, while completion 0
+	// finishes
+	lines := []CompletionResponse{
+		{Index: 0, Content: "a"},
+		{Index: 1, Done: true, Error: "no available sequence for fork"},
+	}
+	for range 32 {
+		lines = append(lines, CompletionResponse{Index: 2, Content: "b"})
+	}
+	lines = append(lines,
+		CompletionResponse{Index: 2, Done: true},
+		CompletionResponse{Index: 0, Done: true, DoneReason: DoneReasonLength},
+	)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(ServerStatusResponse{Status: ServerStatusReady})
+	})
+	mux.HandleFunc("/completion", func(w http.ResponseWriter, r *http.Request) {
+		enc := json.NewEncoder(w)
+		for _, line := range lines {
+			enc.Encode(line)
+		}
+	})
+
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	port, err := strconv.Atoi(ts.URL[strings.LastIndex(ts.URL, ":")+1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &llmServer{
+		cmd:     &exec.Cmd{},
+		port:    port,
+		sem:     newPrioritySemaphore(1),
+		options: api.Options{Runner: api.Runner{NumCtx: 8}},
+	}
+
+	content := make([]string, 3)
+	var done []CompletionResponse
+	if err := s.Completion(t.Context(), CompletionRequest{
+		Options: new(api.Options),
+		N:       3,
+	}, func(r CompletionResponse) {
+		content[r.Index] += r.Content
+		if r.Done {
+			done = append(done, r)
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff(done, []CompletionResponse{
+		{Index: 1, Done: true, DoneReason: DoneReasonError, Error: "no available sequence for fork"},
+		{Index: 2, Done: true, DoneReason: DoneReasonError, Error: "token repeat limit reached"},
+		{Index: 0, Done: true, DoneReason: DoneReasonLength},
+	}); diff != "" {
+		t.Errorf("mismatch (-got +want):\n%s", diff)
+	}
+
+	if content[0] != "a" {
+		t.Errorf("expected content %q, got %q", "a", content[0])
+	}
+}
+
+func TestLayerPlacement(t *testing.T) {
+	cpu := discover.GpuInfoList{{Library: "cpu", ID: "0"}}
+	gpus := discover.GpuInfoList{{Library: "cuda", ID: "0"}, {Library: "cuda", ID: "1"}}
+
+	tests := []struct {
+		name     string
+		gpus     discover.GpuInfoList
+		estimate MemoryEstimate
+		numGPU   int
+		want     []LayerPlacement
+	}{
+		{
+			name:   "cpu",
+			gpus:   cpu,
+			numGPU: -1,
+			want:   []LayerPlacement{{Library: "cpu", ID: "0", First: 0, Last: 8}},
+		},
+		{
+			name:   "full offload",
+			gpus:   gpus[:1],
+			numGPU: 9,
+			want:   []LayerPlacement{{Library: "cuda", ID: "0", First: 0, Last: 8}},
+		},
+		{
+			name:   "partial offload",
+			gpus:   gpus[:1],
+			numGPU: 4,
+			want: []LayerPlacement{
+				{Library: "cpu", ID: "0", First: 0, Last: 3},
+				{Library: "cuda", ID: "0", First: 4, Last: 7},
+				{Library: "cpu", ID: "0", First: 8, Last: 8},
+			},
+		},
+		{
+			name:     "split",
+			gpus:     gpus,
+			estimate: MemoryEstimate{TensorSplit: "6,3"},
+			numGPU:   9,
+			want: []LayerPlacement{
+				{Library: "cuda", ID: "0", First: 0, Last: 5},
+				{Library: "cuda", ID: "1", First: 6, Last: 8},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 8 repeating layers and the output layer
+			got := layerPlacement(tt.gpus, tt.estimate, tt.numGPU, 9)
+			if diff := cmp.Diff(got, tt.want); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
+
+type vocabularyProcessor struct {
+	model.TextProcessor
+	vocabulary *model.Vocabulary
+}
+
+func (p vocabularyProcessor) Vocabulary() *model.Vocabulary {
+	return p.vocabulary
+}
+
+func (p vocabularyProcessor) Decode(ids []int32) (string, error) {
+	var sb strings.Builder
+	for _, id := range ids {
+		sb.WriteString(p.vocabulary.Decode(id))
+	}
+	return sb.String(), nil
+}
+
+func TestDetokenizeInvalidToken(t *testing.T) {
+	s := &llmServer{textProcessor: vocabularyProcessor{vocabulary: &model.Vocabulary{Values: []string{"a", "b"}}}}
+
+	content, err := s.Detokenize(t.Context(), []int{0, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content != "ab" {
+		t.Errorf("expected %q, got %q", "ab", content)
+	}
+
+	for _, tokens := range [][]int{{2}, {0, -1}} {
+		if _, err := s.Detokenize(t.Context(), tokens); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("%v: expected ErrInvalidToken, got %v", tokens, err)
+		}
+	}
+}
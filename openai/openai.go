@@ -4,13 +4,17 @@ package openai
 import (
 	"bytes"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"maps"
+	"math"
 	"math/rand"
 	"net/http"
+	"slices"
 	"strings"
 	"time"
 
@@ -40,21 +44,47 @@ type Message struct {
 }
 
 type Choice struct {
-	Index        int     `json:"index"`
-	Message      Message `json:"message"`
-	FinishReason *string `json:"finish_reason"`
+	Index        int             `json:"index"`
+	Message      Message         `json:"message"`
+	Logprobs     *ChoiceLogprobs `json:"logprobs,omitempty"`
+	FinishReason *string         `json:"finish_reason"`
 }
 
 type ChunkChoice struct {
-	Index        int     `json:"index"`
-	Delta        Message `json:"delta"`
-	FinishReason *string `json:"finish_reason"`
+	Index        int             `json:"index"`
+	Delta        Message         `json:"delta"`
+	Logprobs     *ChoiceLogprobs `json:"logprobs,omitempty"`
+	FinishReason *string         `json:"finish_reason"`
 }
 
 type CompleteChunkChoice struct {
-	Text         string  `json:"text"`
-	Index        int     `json:"index"`
-	FinishReason *string `json:"finish_reason"`
+	Text         string              `json:"text"`
+	Index        int                 `json:"index"`
+	Logprobs     *CompletionLogprobs `json:"logprobs,omitempty"`
+	FinishReason *string             `json:"finish_reason"`
+}
+
+type TokenLogprob struct {
+	Token   string  `json:"token"`
+	Logprob float64 `json:"logprob"`
+	Bytes   []int   `json:"bytes"`
+}
+
+type Logprob struct {
+	TokenLogprob
+	TopLogprobs []TokenLogprob `json:"top_logprobs"`
+}
+
+type ChoiceLogprobs struct {
+	Content []Logprob `json:"content"`
+}
+
+// CompletionLogprobs is the legacy log probability format used by completions
+type CompletionLogprobs struct {
+	Tokens        []string             `json:"tokens"`
+	TokenLogprobs []float64            `json:"token_logprobs"`
+	TopLogprobs   []map[string]float64 `json:"top_logprobs"`
+	TextOffset    []int                `json:"text_offset"`
 }
 
 type Usage struct {
@@ -73,8 +103,20 @@ type JsonSchema struct {
 }
 
 type EmbedRequest struct {
-	Input any    `json:"input"`
-	Model string `json:"model"`
+	Input          any    `json:"input"`
+	Model          string `json:"model"`
+	Dimensions     int    `json:"dimensions"`
+	EncodingFormat string `json:"encoding_format"`
+}
+
+// RerankRequest follows the rerank APIs of Jina and Cohere, which other
+// servers have adopted for /v1/rerank
+type RerankRequest struct {
+	Model           string   `json:"model"`
+	Query           string   `json:"query"`
+	Documents       []string `json:"documents"`
+	TopN            int      `json:"top_n"`
+	ReturnDocuments *bool    `json:"return_documents"`
 }
 
 type StreamOptions struct {
@@ -82,19 +124,24 @@ type StreamOptions struct {
 }
 
 type ChatCompletionRequest struct {
-	Model            string          `json:"model"`
-	Messages         []Message       `json:"messages"`
-	Stream           bool            `json:"stream"`
-	StreamOptions    *StreamOptions  `json:"stream_options"`
-	MaxTokens        *int            `json:"max_tokens"`
-	Seed             *int            `json:"seed"`
-	Stop             any             `json:"stop"`
-	Temperature      *float64        `json:"temperature"`
-	FrequencyPenalty *float64        `json:"frequency_penalty"`
-	PresencePenalty  *float64        `json:"presence_penalty"`
-	TopP             *float64        `json:"top_p"`
-	ResponseFormat   *ResponseFormat `json:"response_format"`
-	Tools            []api.Tool      `json:"tools"`
+	Model            string             `json:"model"`
+	Messages         []Message          `json:"messages"`
+	Stream           bool               `json:"stream"`
+	StreamOptions    *StreamOptions     `json:"stream_options"`
+	MaxTokens        *int               `json:"max_tokens"`
+	Seed             *int               `json:"seed"`
+	Stop             any                `json:"stop"`
+	Temperature      *float64           `json:"temperature"`
+	FrequencyPenalty *float64           `json:"frequency_penalty"`
+	PresencePenalty  *float64           `json:"presence_penalty"`
+	TopP             *float64           `json:"top_p"`
+	ResponseFormat   *ResponseFormat    `json:"response_format"`
+	Tools            []api.Tool         `json:"tools"`
+	ToolChoice       *api.ToolChoice    `json:"tool_choice"`
+	Logprobs         bool               `json:"logprobs"`
+	TopLogprobs      int                `json:"top_logprobs"`
+	N                *int               `json:"n"`
+	LogitBias        map[string]float64 `json:"logit_bias"`
 }
 
 type ChatCompletion struct {
@@ -119,18 +166,21 @@ type ChatCompletionChunk struct {
 
 // TODO (https://github.com/ollama/ollama/issues/5259): support []string, []int and [][]int
 type CompletionRequest struct {
-	Model            string         `json:"model"`
-	Prompt           string         `json:"prompt"`
-	FrequencyPenalty float32        `json:"frequency_penalty"`
-	MaxTokens        *int           `json:"max_tokens"`
-	PresencePenalty  float32        `json:"presence_penalty"`
-	Seed             *int           `json:"seed"`
-	Stop             any            `json:"stop"`
-	Stream           bool           `json:"stream"`
-	StreamOptions    *StreamOptions `json:"stream_options"`
-	Temperature      *float32       `json:"temperature"`
-	TopP             float32        `json:"top_p"`
-	Suffix           string         `json:"suffix"`
+	Model            string             `json:"model"`
+	Prompt           string             `json:"prompt"`
+	FrequencyPenalty float32            `json:"frequency_penalty"`
+	MaxTokens        *int               `json:"max_tokens"`
+	PresencePenalty  float32            `json:"presence_penalty"`
+	Seed             *int               `json:"seed"`
+	Stop             any                `json:"stop"`
+	Stream           bool               `json:"stream"`
+	StreamOptions    *StreamOptions     `json:"stream_options"`
+	Temperature      *float32           `json:"temperature"`
+	TopP             float32            `json:"top_p"`
+	Suffix           string             `json:"suffix"`
+	Logprobs         *int               `json:"logprobs"`
+	N                *int               `json:"n"`
+	LogitBias        map[string]float64 `json:"logit_bias"`
 }
 
 type Completion struct {
@@ -154,11 +204,11 @@ type CompletionChunk struct {
 }
 
 type ToolCall struct {
-	ID       string `json:"id"`
+	ID       string `json:"id,omitempty"`
 	Index    int    `json:"index"`
-	Type     string `json:"type"`
+	Type     string `json:"type,omitempty"`
 	Function struct {
-		Name      string `json:"name"`
+		Name      string `json:"name,omitempty"`
 		Arguments string `json:"arguments"`
 	} `json:"function"`
 }
@@ -171,9 +221,12 @@ type Model struct {
 }
 
 type Embedding struct {
-	Object    string    `json:"object"`
-	Embedding []float32 `json:"embedding"`
-	Index     int       `json:"index"`
+	Object string `json:"object"`
+
+	// Embedding is a list of floats, or a base64 encoded string of their
+	// little-endian bytes
+	Embedding any `json:"embedding"`
+	Index     int `json:"index"`
 }
 
 type ListCompletion struct {
@@ -193,6 +246,23 @@ type EmbeddingUsage struct {
 	TotalTokens  int `json:"total_tokens"`
 }
 
+type RerankDocument struct {
+	Text string `json:"text"`
+}
+
+type RerankResult struct {
+	Index          int             `json:"index"`
+	RelevanceScore float64         `json:"relevance_score"`
+	Document       *RerankDocument `json:"document,omitempty"`
+}
+
+type RerankList struct {
+	Object  string         `json:"object"`
+	Model   string         `json:"model"`
+	Results []RerankResult `json:"results"`
+	Usage   EmbeddingUsage `json:"usage"`
+}
+
 func NewError(code int, message string) ErrorResponse {
 	var etype string
 	switch code {
@@ -243,33 +313,123 @@ func toToolCalls(tc []api.ToolCall) []ToolCall {
 	return toolCalls
 }
 
+// toToolCallDeltas converts the parts of streamed tool calls, which have an id,
+// type and name only in the first part of each tool call
+func toToolCallDeltas(deltas []api.ToolCallDelta) []ToolCall {
+	toolCalls := make([]ToolCall, len(deltas))
+	for i, d := range deltas {
+		toolCalls[i].Index = d.Index
+		toolCalls[i].Function.Arguments = d.Arguments
+		if d.Name != "" {
+			toolCalls[i].ID = toolCallId()
+			toolCalls[i].Type = "function"
+			toolCalls[i].Function.Name = d.Name
+		}
+	}
+	return toolCalls
+}
+
+func toTokenLogprob(lp api.TokenLogprob) TokenLogprob {
+	b := []byte(lp.Token)
+	bytes := make([]int, len(b))
+	for i := range b {
+		bytes[i] = int(b[i])
+	}
+
+	return TokenLogprob{Token: lp.Token, Logprob: lp.Logprob, Bytes: bytes}
+}
+
+func toChoiceLogprobs(lps []api.Logprob) *ChoiceLogprobs {
+	if len(lps) == 0 {
+		return nil
+	}
+
+	content := make([]Logprob, len(lps))
+	for i, lp := range lps {
+		content[i].TokenLogprob = toTokenLogprob(lp.TokenLogprob)
+		content[i].TopLogprobs = make([]TokenLogprob, len(lp.TopLogprobs))
+		for j, top := range lp.TopLogprobs {
+			content[i].TopLogprobs[j] = toTokenLogprob(top)
+		}
+	}
+
+	return &ChoiceLogprobs{Content: content}
+}
+
+// toCompletionLogprobs converts log probabilities to the legacy format, where
+// offset is the position of the first token in the generated text
+func toCompletionLogprobs(lps []api.Logprob, offset int) *CompletionLogprobs {
+	if len(lps) == 0 {
+		return nil
+	}
+
+	var c CompletionLogprobs
+	for _, lp := range lps {
+		c.Tokens = append(c.Tokens, lp.Token)
+		c.TokenLogprobs = append(c.TokenLogprobs, lp.Logprob)
+		c.TextOffset = append(c.TextOffset, offset)
+		offset += len(lp.Token)
+
+		top := make(map[string]float64, len(lp.TopLogprobs))
+		for _, t := range lp.TopLogprobs {
+			top[t.Token] = t.Logprob
+		}
+		c.TopLogprobs = append(c.TopLogprobs, top)
+	}
+
+	return &c
+}
+
+func toChoice(c api.ChatChoice) Choice {
+	toolCalls := toToolCalls(c.Message.ToolCalls)
+	return Choice{
+		Index:    c.Index,
+		Message:  Message{Role: c.Message.Role, Content: c.Message.Content, ToolCalls: toolCalls},
+		Logprobs: toChoiceLogprobs(c.Logprobs),
+		FinishReason: func(reason string) *string {
+			if len(toolCalls) > 0 {
+				reason = "tool_calls"
+			}
+			if len(reason) > 0 {
+				return &reason
+			}
+			return nil
+		}(c.DoneReason),
+	}
+}
+
 func toChatCompletion(id string, r api.ChatResponse) ChatCompletion {
-	toolCalls := toToolCalls(r.Message.ToolCalls)
-	return ChatCompletion{
+	choices := r.Choices
+	if len(choices) == 0 {
+		choices = []api.ChatChoice{{Message: r.Message, DoneReason: r.DoneReason, Logprobs: r.Logprobs}}
+	}
+
+	c := ChatCompletion{
 		Id:                id,
 		Object:            "chat.completion",
 		Created:           r.CreatedAt.Unix(),
 		Model:             r.Model,
 		SystemFingerprint: "fp_ollama",
-		Choices: []Choice{{
-			Index:   0,
-			Message: Message{Role: r.Message.Role, Content: r.Message.Content, ToolCalls: toolCalls},
-			FinishReason: func(reason string) *string {
-				if len(toolCalls) > 0 {
-					reason = "tool_calls"
-				}
-				if len(reason) > 0 {
-					return &reason
-				}
-				return nil
-			}(r.DoneReason),
-		}},
-		Usage: toUsage(r),
+		Usage:             toUsage(r),
+	}
+
+	for _, choice := range choices {
+		c.Choices = append(c.Choices, toChoice(choice))
 	}
+
+	return c
 }
 
+// toChunk converts a streamed chat response. Tool calls that are streamed in
+// parts are only sent as deltas, rather than again once complete
 func toChunk(id string, r api.ChatResponse, toolCallSent bool) ChatCompletionChunk {
-	toolCalls := toToolCalls(r.Message.ToolCalls)
+	var toolCalls []ToolCall
+	if len(r.Message.ToolCallDeltas) > 0 {
+		toolCalls = toToolCallDeltas(r.Message.ToolCallDeltas)
+	} else if !toolCallSent {
+		toolCalls = toToolCalls(r.Message.ToolCalls)
+	}
+
 	return ChatCompletionChunk{
 		Id:                id,
 		Object:            "chat.completion.chunk",
@@ -277,8 +437,9 @@ func toChunk(id string, r api.ChatResponse, toolCallSent bool) ChatCompletionChu
 		Model:             r.Model,
 		SystemFingerprint: "fp_ollama",
 		Choices: []ChunkChoice{{
-			Index: 0,
-			Delta: Message{Role: "assistant", Content: r.Message.Content, ToolCalls: toolCalls},
+			Index:    r.Index,
+			Delta:    Message{Role: "assistant", Content: r.Message.Content, ToolCalls: toolCalls},
+			Logprobs: toChoiceLogprobs(r.Logprobs),
 			FinishReason: func(reason string) *string {
 				if len(reason) > 0 {
 					if toolCallSent {
@@ -301,27 +462,38 @@ func toUsageGenerate(r api.GenerateResponse) Usage {
 }
 
 func toCompletion(id string, r api.GenerateResponse) Completion {
-	return Completion{
+	choices := r.Choices
+	if len(choices) == 0 {
+		choices = []api.GenerateChoice{{Response: r.Response, DoneReason: r.DoneReason, Logprobs: r.Logprobs}}
+	}
+
+	c := Completion{
 		Id:                id,
 		Object:            "text_completion",
 		Created:           r.CreatedAt.Unix(),
 		Model:             r.Model,
 		SystemFingerprint: "fp_ollama",
-		Choices: []CompleteChunkChoice{{
-			Text:  r.Response,
-			Index: 0,
+		Usage:             toUsageGenerate(r),
+	}
+
+	for _, choice := range choices {
+		c.Choices = append(c.Choices, CompleteChunkChoice{
+			Text:     choice.Response,
+			Index:    choice.Index,
+			Logprobs: toCompletionLogprobs(choice.Logprobs, 0),
 			FinishReason: func(reason string) *string {
 				if len(reason) > 0 {
 					return &reason
 				}
 				return nil
-			}(r.DoneReason),
-		}},
-		Usage: toUsageGenerate(r),
+			}(choice.DoneReason),
+		})
 	}
+
+	return c
 }
 
-func toCompleteChunk(id string, r api.GenerateResponse) CompletionChunk {
+func toCompleteChunk(id string, r api.GenerateResponse, offset int) CompletionChunk {
 	return CompletionChunk{
 		Id:                id,
 		Object:            "text_completion",
@@ -329,8 +501,9 @@ func toCompleteChunk(id string, r api.GenerateResponse) CompletionChunk {
 		Model:             r.Model,
 		SystemFingerprint: "fp_ollama",
 		Choices: []CompleteChunkChoice{{
-			Text:  r.Response,
-			Index: 0,
+			Text:     r.Response,
+			Index:    r.Index,
+			Logprobs: toCompletionLogprobs(r.Logprobs, offset),
 			FinishReason: func(reason string) *string {
 				if len(reason) > 0 {
 					return &reason
@@ -358,13 +531,22 @@ func toListCompletion(r api.ListResponse) ListCompletion {
 	}
 }
 
-func toEmbeddingList(model string, r api.EmbedResponse) EmbeddingList {
+func toEmbeddingList(model string, encodingFormat string, r api.EmbedResponse) EmbeddingList {
 	if r.Embeddings != nil {
 		var data []Embedding
 		for i, e := range r.Embeddings {
+			var embedding any = e
+			if encodingFormat == "base64" {
+				b := make([]byte, 0, 4*len(e))
+				for _, v := range e {
+					b = binary.LittleEndian.AppendUint32(b, math.Float32bits(v))
+				}
+				embedding = base64.StdEncoding.EncodeToString(b)
+			}
+
 			data = append(data, Embedding{
 				Object:    "embedding",
-				Embedding: e,
+				Embedding: embedding,
 				Index:     i,
 			})
 		}
@@ -383,6 +565,26 @@ func toEmbeddingList(model string, r api.EmbedResponse) EmbeddingList {
 	return EmbeddingList{}
 }
 
+func toRerankList(model string, returnDocuments bool, r api.RerankResponse) RerankList {
+	results := make([]RerankResult, len(r.Results))
+	for i, res := range r.Results {
+		results[i] = RerankResult{Index: res.Index, RelevanceScore: res.RelevanceScore}
+		if returnDocuments {
+			results[i].Document = &RerankDocument{Text: res.Document}
+		}
+	}
+
+	return RerankList{
+		Object:  "list",
+		Model:   model,
+		Results: results,
+		Usage: EmbeddingUsage{
+			PromptTokens: r.PromptEvalCount,
+			TotalTokens:  r.PromptEvalCount,
+		},
+	}
+}
+
 func toModel(r api.ShowResponse, m string) Model {
 	return Model{
 		Id:      m,
@@ -392,6 +594,31 @@ func toModel(r api.ShowResponse, m string) Model {
 	}
 }
 
+// decodeImageURL decodes an image given as a base64 data URL
+func decodeImageURL(url string) (api.ImageData, error) {
+	types := []string{"jpeg", "jpg", "png"}
+	valid := false
+	for _, t := range types {
+		prefix := "data:image/" + t + ";base64,"
+		if strings.HasPrefix(url, prefix) {
+			url = strings.TrimPrefix(url, prefix)
+			valid = true
+			break
+		}
+	}
+
+	if !valid {
+		return nil, errors.New("invalid image input")
+	}
+
+	img, err := base64.StdEncoding.DecodeString(url)
+	if err != nil {
+		return nil, errors.New("invalid message format")
+	}
+
+	return img, nil
+}
+
 func fromChatRequest(r ChatCompletionRequest) (*api.ChatRequest, error) {
 	var messages []api.Message
 	for _, msg := range r.Messages {
@@ -423,24 +650,9 @@ func fromChatRequest(r ChatCompletionRequest) (*api.ChatRequest, error) {
 						}
 					}
 
-					types := []string{"jpeg", "jpg", "png"}
-					valid := false
-					for _, t := range types {
-						prefix := "data:image/" + t + ";base64,"
-						if strings.HasPrefix(url, prefix) {
-							url = strings.TrimPrefix(url, prefix)
-							valid = true
-							break
-						}
-					}
-
-					if !valid {
-						return nil, errors.New("invalid image input")
-					}
-
-					img, err := base64.StdEncoding.DecodeString(url)
+					img, err := decodeImageURL(url)
 					if err != nil {
-						return nil, errors.New("invalid message format")
+						return nil, err
 					}
 
 					messages = append(messages, api.Message{Role: msg.Role, Images: []api.ImageData{img}})
@@ -508,6 +720,13 @@ func fromChatRequest(r ChatCompletionRequest) (*api.ChatRequest, error) {
 		options["top_p"] = 1.0
 	}
 
+	if len(r.LogitBias) > 0 {
+		if err := checkLogitBias(r.LogitBias); err != nil {
+			return nil, err
+		}
+		options["logit_bias"] = r.LogitBias
+	}
+
 	var format json.RawMessage
 	if r.ResponseFormat != nil {
 		switch strings.ToLower(strings.TrimSpace(r.ResponseFormat.Type)) {
@@ -521,14 +740,34 @@ func fromChatRequest(r ChatCompletionRequest) (*api.ChatRequest, error) {
 		}
 	}
 
-	return &api.ChatRequest{
-		Model:    r.Model,
-		Messages: messages,
-		Format:   format,
-		Options:  options,
-		Stream:   &r.Stream,
-		Tools:    r.Tools,
-	}, nil
+	req := &api.ChatRequest{
+		Model:       r.Model,
+		Messages:    messages,
+		Format:      format,
+		Options:     options,
+		Stream:      &r.Stream,
+		Tools:       r.Tools,
+		ToolChoice:  r.ToolChoice,
+		Logprobs:    r.Logprobs,
+		TopLogprobs: r.TopLogprobs,
+	}
+
+	if r.N != nil {
+		req.N = *r.N
+	}
+
+	return req, nil
+}
+
+// checkLogitBias checks that biases are within the range OpenAI accepts
+func checkLogitBias(bias map[string]float64) error {
+	for _, token := range slices.Sorted(maps.Keys(bias)) {
+		if b := bias[token]; b < -100 || b > 100 {
+			return fmt.Errorf("logit_bias for %q must be between -100 and 100, got %v", token, b)
+		}
+	}
+
+	return nil
 }
 
 func fromCompleteRequest(r CompletionRequest) (api.GenerateRequest, error) {
@@ -573,13 +812,33 @@ func fromCompleteRequest(r CompletionRequest) (api.GenerateRequest, error) {
 		options["top_p"] = 1.0
 	}
 
-	return api.GenerateRequest{
+	if len(r.LogitBias) > 0 {
+		if err := checkLogitBias(r.LogitBias); err != nil {
+			return api.GenerateRequest{}, err
+		}
+		options["logit_bias"] = r.LogitBias
+	}
+
+	req := api.GenerateRequest{
 		Model:   r.Model,
 		Prompt:  r.Prompt,
 		Options: options,
 		Stream:  &r.Stream,
 		Suffix:  r.Suffix,
-	}, nil
+	}
+
+	// logprobs is the number of most likely tokens to return in addition
+	// to the generated token
+	if r.Logprobs != nil {
+		req.Logprobs = true
+		req.TopLogprobs = *r.Logprobs
+	}
+
+	if r.N != nil {
+		req.N = *r.N
+	}
+
+	return req, nil
 }
 
 type BaseWriter struct {
@@ -590,7 +849,7 @@ type ChatWriter struct {
 	stream        bool
 	streamOptions *StreamOptions
 	id            string
-	toolCallSent  bool
+	toolCallSent  map[int]bool
 	BaseWriter
 }
 
@@ -598,6 +857,9 @@ type CompleteWriter struct {
 	stream        bool
 	streamOptions *StreamOptions
 	id            string
+
+	// offsets holds the length of the text streamed so far for each choice
+	offsets map[int]int
 	BaseWriter
 }
 
@@ -612,7 +874,14 @@ type RetrieveWriter struct {
 
 type EmbedWriter struct {
 	BaseWriter
-	model string
+	model          string
+	encodingFormat string
+}
+
+type RerankWriter struct {
+	BaseWriter
+	model           string
+	returnDocuments bool
 }
 
 func (w *BaseWriter) writeError(data []byte) (int, error) {
@@ -640,13 +909,13 @@ func (w *ChatWriter) writeResponse(data []byte) (int, error) {
 
 	// chat chunk
 	if w.stream {
-		c := toChunk(w.id, chatResponse, w.toolCallSent)
+		c := toChunk(w.id, chatResponse, w.toolCallSent[chatResponse.Index])
 		d, err := json.Marshal(c)
 		if err != nil {
 			return 0, err
 		}
-		if !w.toolCallSent && len(c.Choices) > 0 && len(c.Choices[0].Delta.ToolCalls) > 0 {
-			w.toolCallSent = true
+		if len(c.Choices) > 0 && len(c.Choices[0].Delta.ToolCalls) > 0 {
+			w.toolCallSent[chatResponse.Index] = true
 		}
 
 		w.ResponseWriter.Header().Set("Content-Type", "text/event-stream")
@@ -706,7 +975,8 @@ func (w *CompleteWriter) writeResponse(data []byte) (int, error) {
 
 	// completion chunk
 	if w.stream {
-		c := toCompleteChunk(w.id, generateResponse)
+		c := toCompleteChunk(w.id, generateResponse, w.offsets[generateResponse.Index])
+		w.offsets[generateResponse.Index] += len(generateResponse.Response)
 		if w.streamOptions != nil && w.streamOptions.IncludeUsage {
 			c.Usage = &Usage{}
 		}
@@ -822,7 +1092,7 @@ func (w *EmbedWriter) writeResponse(data []byte) (int, error) {
 	}
 
 	w.ResponseWriter.Header().Set("Content-Type", "application/json")
-	err = json.NewEncoder(w.ResponseWriter).Encode(toEmbeddingList(w.model, embedResponse))
+	err = json.NewEncoder(w.ResponseWriter).Encode(toEmbeddingList(w.model, w.encodingFormat, embedResponse))
 	if err != nil {
 		return 0, err
 	}
@@ -839,6 +1109,31 @@ func (w *EmbedWriter) Write(data []byte) (int, error) {
 	return w.writeResponse(data)
 }
 
+func (w *RerankWriter) writeResponse(data []byte) (int, error) {
+	var rerankResponse api.RerankResponse
+	err := json.Unmarshal(data, &rerankResponse)
+	if err != nil {
+		return 0, err
+	}
+
+	w.ResponseWriter.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w.ResponseWriter).Encode(toRerankList(w.model, w.returnDocuments, rerankResponse))
+	if err != nil {
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
+func (w *RerankWriter) Write(data []byte) (int, error) {
+	code := w.ResponseWriter.Status()
+	if code != http.StatusOK {
+		return w.writeError(data)
+	}
+
+	return w.writeResponse(data)
+}
+
 func ListMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		w := &ListWriter{
@@ -901,6 +1196,7 @@ func CompletionsMiddleware() gin.HandlerFunc {
 			stream:        req.Stream,
 			id:            fmt.Sprintf("cmpl-%d", rand.Intn(999)),
 			streamOptions: req.StreamOptions,
+			offsets:       make(map[int]int),
 		}
 
 		c.Writer = w
@@ -931,8 +1227,15 @@ func EmbeddingsMiddleware() gin.HandlerFunc {
 			return
 		}
 
+		switch req.EncodingFormat {
+		case "", "float", "base64":
+		default:
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewError(http.StatusBadRequest, fmt.Sprintf("invalid encoding_format %q", req.EncodingFormat)))
+			return
+		}
+
 		var b bytes.Buffer
-		if err := json.NewEncoder(&b).Encode(api.EmbedRequest{Model: req.Model, Input: req.Input}); err != nil {
+		if err := json.NewEncoder(&b).Encode(api.EmbedRequest{Model: req.Model, Input: req.Input, Dimensions: req.Dimensions}); err != nil {
 			c.AbortWithStatusJSON(http.StatusInternalServerError, NewError(http.StatusInternalServerError, err.Error()))
 			return
 		}
@@ -940,8 +1243,50 @@ func EmbeddingsMiddleware() gin.HandlerFunc {
 		c.Request.Body = io.NopCloser(&b)
 
 		w := &EmbedWriter{
+			BaseWriter:     BaseWriter{ResponseWriter: c.Writer},
+			model:          req.Model,
+			encodingFormat: req.EncodingFormat,
+		}
+
+		c.Writer = w
+
+		c.Next()
+	}
+}
+
+func RerankMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req RerankRequest
+		err := c.ShouldBindJSON(&req)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewError(http.StatusBadRequest, err.Error()))
+			return
+		}
+
+		if req.Query == "" {
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewError(http.StatusBadRequest, "query is required"))
+			return
+		}
+
+		if len(req.Documents) == 0 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewError(http.StatusBadRequest, "documents are required"))
+			return
+		}
+
+		var b bytes.Buffer
+		if err := json.NewEncoder(&b).Encode(api.RerankRequest{Model: req.Model, Query: req.Query, Documents: req.Documents, TopN: req.TopN}); err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, NewError(http.StatusInternalServerError, err.Error()))
+			return
+		}
+
+		c.Request.Body = io.NopCloser(&b)
+
+		w := &RerankWriter{
 			BaseWriter: BaseWriter{ResponseWriter: c.Writer},
 			model:      req.Model,
+
+			// documents are returned unless they are turned off
+			returnDocuments: req.ReturnDocuments == nil || *req.ReturnDocuments,
 		}
 
 		c.Writer = w
@@ -984,6 +1329,7 @@ func ChatMiddleware() gin.HandlerFunc {
 			stream:        req.Stream,
 			id:            fmt.Sprintf("chatcmpl-%d", rand.Intn(999)),
 			streamOptions: req.StreamOptions,
+			toolCallSent:  make(map[int]bool),
 		}
 
 		c.Writer = w
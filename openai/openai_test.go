@@ -151,6 +151,86 @@ func TestChatMiddleware(t *testing.T) {
 				Stream: &True,
 			},
 		},
+		{
+			name: "chat handler with logprobs",
+			body: `{
+				"model": "test-model",
+				"messages": [
+					{"role": "user", "content": "Hello"}
+				],
+				"logprobs": true,
+				"top_logprobs": 3
+			}`,
+			req: api.ChatRequest{
+				Model: "test-model",
+				Messages: []api.Message{
+					{
+						Role:    "user",
+						Content: "Hello",
+					},
+				},
+				Options: map[string]any{
+					"temperature": 1.0,
+					"top_p":       1.0,
+				},
+				Stream:      &False,
+				Logprobs:    true,
+				TopLogprobs: 3,
+			},
+		},
+		{
+			name: "chat handler with n",
+			body: `{
+				"model": "test-model",
+				"messages": [
+					{"role": "user", "content": "Hello"}
+				],
+				"n": 2
+			}`,
+			req: api.ChatRequest{
+				Model: "test-model",
+				Messages: []api.Message{
+					{
+						Role:    "user",
+						Content: "Hello",
+					},
+				},
+				Options: map[string]any{
+					"temperature": 1.0,
+					"top_p":       1.0,
+				},
+				Stream: &False,
+				N:      2,
+			},
+		},
+		{
+			name: "chat handler with logit bias",
+			body: `{
+				"model": "test-model",
+				"messages": [
+					{"role": "user", "content": "Hello"}
+				],
+				"logit_bias": {"50256": -100, "13": 5}
+			}`,
+			req: api.ChatRequest{
+				Model: "test-model",
+				Messages: []api.Message{
+					{
+						Role:    "user",
+						Content: "Hello",
+					},
+				},
+				Options: map[string]any{
+					"temperature": 1.0,
+					"top_p":       1.0,
+					"logit_bias": map[string]any{
+						"50256": -100.0,
+						"13":    5.0,
+					},
+				},
+				Stream: &False,
+			},
+		},
 		{
 			name: "chat handler with image content",
 			body: `{
@@ -279,32 +359,7 @@ func TestChatMiddleware(t *testing.T) {
 						Function: api.ToolFunction{
 							Name:        "get_weather",
 							Description: "Get the current weather",
-							Parameters: struct {
-								Type       string   `json:"type"`
-								Required   []string `json:"required"`
-								Properties map[string]struct {
-									Type        api.PropertyType `json:"type"`
-									Description string           `json:"description"`
-									Enum        []any            `json:"enum,omitempty"`
-								} `json:"properties"`
-							}{
-								Type:     "object",
-								Required: []string{"location"},
-								Properties: map[string]struct {
-									Type        api.PropertyType `json:"type"`
-									Description string           `json:"description"`
-									Enum        []any            `json:"enum,omitempty"`
-								}{
-									"location": {
-										Type:        api.PropertyType{"string"},
-										Description: "The city and state",
-									},
-									"unit": {
-										Type: api.PropertyType{"string"},
-										Enum: []any{"celsius", "fahrenheit"},
-									},
-								},
-							},
+							Parameters:  api.ToolSchema(`{"type":"object","required":["location"],"properties":{"location":{"type":"string","description":"The city and state"},"unit":{"type":"string","enum":["celsius","fahrenheit"]}}}`),
 						},
 					},
 				},
@@ -315,6 +370,57 @@ func TestChatMiddleware(t *testing.T) {
 				Stream: &True,
 			},
 		},
+		{
+			name: "chat handler with tool choice",
+			body: `{
+				"model": "test-model",
+				"messages": [
+					{"role": "user", "content": "What's the weather like in Paris?"}
+				],
+				"tools": [{"type": "function", "function": {"name": "get_weather"}}],
+				"tool_choice": {"type": "function", "function": {"name": "get_weather"}}
+			}`,
+			req: api.ChatRequest{
+				Model: "test-model",
+				Messages: []api.Message{
+					{
+						Role:    "user",
+						Content: "What's the weather like in Paris?",
+					},
+				},
+				Tools: []api.Tool{
+					{
+						Type:     "function",
+						Function: api.ToolFunction{Name: "get_weather"},
+					},
+				},
+				ToolChoice: &api.ToolChoice{
+					Type:     api.ToolChoiceNamed,
+					Function: api.ToolChoiceFunction{Name: "get_weather"},
+				},
+				Options: map[string]any{
+					"temperature": 1.0,
+					"top_p":       1.0,
+				},
+				Stream: &False,
+			},
+		},
+		{
+			name: "chat handler with invalid logit bias",
+			body: `{
+				"model": "test-model",
+				"messages": [
+					{"role": "user", "content": "Hello"}
+				],
+				"logit_bias": {"50256": -101}
+			}`,
+			err: ErrorResponse{
+				Error: Error{
+					Message: `logit_bias for "50256" must be between -100 and 100, got -101`,
+					Type:    "invalid_request_error",
+				},
+			},
+		},
 		{
 			name: "chat handler error forwarding",
 			body: `{
@@ -451,6 +557,83 @@ func TestCompletionsMiddleware(t *testing.T) {
 				Stream: &True,
 			},
 		},
+		{
+			name: "completions handler with logprobs",
+			body: `{
+				"model": "test-model",
+				"prompt": "Hello",
+				"logprobs": 2
+			}`,
+			req: api.GenerateRequest{
+				Model:  "test-model",
+				Prompt: "Hello",
+				Options: map[string]any{
+					"frequency_penalty": 0.0,
+					"presence_penalty":  0.0,
+					"temperature":       1.0,
+					"top_p":             1.0,
+				},
+				Stream:      &False,
+				Logprobs:    true,
+				TopLogprobs: 2,
+			},
+		},
+		{
+			name: "completions handler with n",
+			body: `{
+				"model": "test-model",
+				"prompt": "Hello",
+				"n": 2
+			}`,
+			req: api.GenerateRequest{
+				Model:  "test-model",
+				Prompt: "Hello",
+				Options: map[string]any{
+					"frequency_penalty": 0.0,
+					"presence_penalty":  0.0,
+					"temperature":       1.0,
+					"top_p":             1.0,
+				},
+				Stream: &False,
+				N:      2,
+			},
+		},
+		{
+			name: "completions handler with logit bias",
+			body: `{
+				"model": "test-model",
+				"prompt": "Hello",
+				"logit_bias": {"50256": -100}
+			}`,
+			req: api.GenerateRequest{
+				Model:  "test-model",
+				Prompt: "Hello",
+				Options: map[string]any{
+					"frequency_penalty": 0.0,
+					"presence_penalty":  0.0,
+					"temperature":       1.0,
+					"top_p":             1.0,
+					"logit_bias": map[string]any{
+						"50256": -100.0,
+					},
+				},
+				Stream: &False,
+			},
+		},
+		{
+			name: "completions handler with invalid logit bias",
+			body: `{
+				"model": "test-model",
+				"prompt": "Hello",
+				"logit_bias": {"13": 100.5}
+			}`,
+			err: ErrorResponse{
+				Error: Error{
+					Message: `logit_bias for "13" must be between -100 and 100, got 100.5`,
+					Type:    "invalid_request_error",
+				},
+			},
+		},
 		{
 			name: "completions handler error forwarding",
 			body: `{
@@ -539,6 +722,20 @@ func TestEmbeddingsMiddleware(t *testing.T) {
 				Model: "test-model",
 			},
 		},
+		{
+			name: "embed handler dimensions",
+			body: `{
+				"input": "Hello",
+				"model": "test-model",
+				"dimensions": 256,
+				"encoding_format": "base64"
+			}`,
+			req: api.EmbedRequest{
+				Input:      "Hello",
+				Model:      "test-model",
+				Dimensions: 256,
+			},
+		},
 		{
 			name: "embed handler error forwarding",
 			body: `{
@@ -551,6 +748,20 @@ func TestEmbeddingsMiddleware(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "embed handler invalid encoding format",
+			body: `{
+				"input": "Hello",
+				"model": "test-model",
+				"encoding_format": "int8"
+			}`,
+			err: ErrorResponse{
+				Error: Error{
+					Message: `invalid encoding_format "int8"`,
+					Type:    "invalid_request_error",
+				},
+			},
+		},
 	}
 
 	endpoint := func(c *gin.Context) {
@@ -590,6 +801,149 @@ func TestEmbeddingsMiddleware(t *testing.T) {
 	}
 }
 
+func TestEmbeddingsBase64(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(EmbeddingsMiddleware())
+	router.Handle(http.MethodPost, "/api/embed", func(c *gin.Context) {
+		c.JSON(http.StatusOK, api.EmbedResponse{Model: "test-model", Embeddings: [][]float32{{1, -2.5}}})
+	})
+
+	req, _ := http.NewRequest(http.MethodPost, "/api/embed", strings.NewReader(`{"model": "test-model", "input": "Hello", "encoding_format": "base64"}`))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	var list EmbeddingList
+	if err := json.Unmarshal(resp.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+
+	// 1.0 and -2.5 as little-endian float32
+	if diff := cmp.Diff(list.Data[0].Embedding, base64.StdEncoding.EncodeToString([]byte{0, 0, 0x80, 0x3f, 0, 0, 0x20, 0xc0})); diff != "" {
+		t.Errorf("embedding mismatch (-got +want):\n%s", diff)
+	}
+}
+
+func TestRerankMiddleware(t *testing.T) {
+	type testCase struct {
+		name string
+		body string
+		req  api.RerankRequest
+		resp RerankList
+		err  ErrorResponse
+	}
+
+	var capturedRequest *api.RerankRequest
+
+	testCases := []testCase{
+		{
+			name: "rerank handler",
+			body: `{
+				"model": "test-model",
+				"query": "What is the capital of France?",
+				"documents": ["Paris is the capital of France.", "Berlin is the capital of Germany."],
+				"top_n": 1
+			}`,
+			req: api.RerankRequest{
+				Model:     "test-model",
+				Query:     "What is the capital of France?",
+				Documents: []string{"Paris is the capital of France.", "Berlin is the capital of Germany."},
+				TopN:      1,
+			},
+			resp: RerankList{
+				Object:  "list",
+				Model:   "test-model",
+				Results: []RerankResult{{Index: 0, RelevanceScore: 0.9, Document: &RerankDocument{Text: "Paris is the capital of France."}}},
+				Usage:   EmbeddingUsage{PromptTokens: 12, TotalTokens: 12},
+			},
+		},
+		{
+			name: "rerank handler without documents in results",
+			body: `{
+				"model": "test-model",
+				"query": "What is the capital of France?",
+				"documents": ["Paris is the capital of France."],
+				"return_documents": false
+			}`,
+			req: api.RerankRequest{
+				Model:     "test-model",
+				Query:     "What is the capital of France?",
+				Documents: []string{"Paris is the capital of France."},
+			},
+			resp: RerankList{
+				Object:  "list",
+				Model:   "test-model",
+				Results: []RerankResult{{Index: 0, RelevanceScore: 0.9}},
+				Usage:   EmbeddingUsage{PromptTokens: 12, TotalTokens: 12},
+			},
+		},
+		{
+			name: "rerank handler missing documents",
+			body: `{
+				"model": "test-model",
+				"query": "What is the capital of France?"
+			}`,
+			err: ErrorResponse{
+				Error: Error{
+					Message: "documents are required",
+					Type:    "invalid_request_error",
+				},
+			},
+		},
+	}
+
+	endpoint := func(c *gin.Context) {
+		c.JSON(http.StatusOK, api.RerankResponse{
+			Model:           "test-model",
+			Results:         []api.RerankResult{{Index: 0, Document: "Paris is the capital of France.", RelevanceScore: 0.9}},
+			PromptEvalCount: 12,
+		})
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(RerankMiddleware(), captureRequestMiddleware(&capturedRequest))
+	router.Handle(http.MethodPost, "/api/rerank", endpoint)
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodPost, "/api/rerank", strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, req)
+
+			var errResp ErrorResponse
+			var rerankResp RerankList
+			if resp.Code != http.StatusOK {
+				if err := json.Unmarshal(resp.Body.Bytes(), &errResp); err != nil {
+					t.Fatal(err)
+				}
+			} else if err := json.Unmarshal(resp.Body.Bytes(), &rerankResp); err != nil {
+				t.Fatal(err)
+			}
+
+			if capturedRequest != nil {
+				if diff := cmp.Diff(tc.req, *capturedRequest); diff != "" {
+					t.Fatalf("requests did not match (-want +got):\n%s", diff)
+				}
+
+				if diff := cmp.Diff(tc.resp, rerankResp); diff != "" {
+					t.Fatalf("responses did not match (-want +got):\n%s", diff)
+				}
+			}
+
+			if !reflect.DeepEqual(tc.err, errResp) {
+				t.Fatal("errors did not match")
+			}
+
+			capturedRequest = nil
+		})
+	}
+}
+
 func TestListMiddleware(t *testing.T) {
 	type testCase struct {
 		name     string
@@ -727,3 +1081,126 @@ func TestRetrieveMiddleware(t *testing.T) {
 		}
 	}
 }
+
+func TestLogprobs(t *testing.T) {
+	lps := []api.Logprob{
+		{
+			TokenLogprob: api.TokenLogprob{Token: "Hi", Logprob: -0.5},
+			TopLogprobs:  []api.TokenLogprob{{Token: "Hi", Logprob: -0.5}, {Token: "Hello", Logprob: -1}},
+		},
+		{
+			TokenLogprob: api.TokenLogprob{Token: "!", Logprob: -0.1},
+		},
+	}
+
+	chat := toChatCompletion("id", api.ChatResponse{Message: api.Message{Role: "assistant", Content: "Hi!"}, Logprobs: lps})
+	wantChat := &ChoiceLogprobs{Content: []Logprob{
+		{
+			TokenLogprob: TokenLogprob{Token: "Hi", Logprob: -0.5, Bytes: []int{72, 105}},
+			TopLogprobs: []TokenLogprob{
+				{Token: "Hi", Logprob: -0.5, Bytes: []int{72, 105}},
+				{Token: "Hello", Logprob: -1, Bytes: []int{72, 101, 108, 108, 111}},
+			},
+		},
+		{
+			TokenLogprob: TokenLogprob{Token: "!", Logprob: -0.1, Bytes: []int{33}},
+			TopLogprobs:  []TokenLogprob{},
+		},
+	}}
+	if diff := cmp.Diff(wantChat, chat.Choices[0].Logprobs); diff != "" {
+		t.Errorf("chat logprobs mismatch (-want +got):\n%s", diff)
+	}
+
+	completion := toCompleteChunk("id", api.GenerateResponse{Response: "Hi!", Logprobs: lps}, 5)
+	wantCompletion := &CompletionLogprobs{
+		Tokens:        []string{"Hi", "!"},
+		TokenLogprobs: []float64{-0.5, -0.1},
+		TopLogprobs:   []map[string]float64{{"Hi": -0.5, "Hello": -1}, {}},
+		TextOffset:    []int{5, 7},
+	}
+	if diff := cmp.Diff(wantCompletion, completion.Choices[0].Logprobs); diff != "" {
+		t.Errorf("completion logprobs mismatch (-want +got):\n%s", diff)
+	}
+
+	if toChatCompletion("id", api.ChatResponse{}).Choices[0].Logprobs != nil {
+		t.Error("logprobs should be omitted when not requested")
+	}
+}
+
+func TestChoices(t *testing.T) {
+	chat := toChatCompletion("id", api.ChatResponse{
+		Message:    api.Message{Role: "assistant", Content: "Hi"},
+		DoneReason: "stop",
+		Choices: []api.ChatChoice{
+			{Index: 0, Message: api.Message{Role: "assistant", Content: "Hi"}, DoneReason: "stop"},
+			{Index: 1, Message: api.Message{Role: "assistant", Content: "Hello there"}, DoneReason: "length"},
+		},
+	})
+
+	if len(chat.Choices) != 2 {
+		t.Fatalf("chat choices = %d, want 2", len(chat.Choices))
+	}
+
+	for i, want := range []struct {
+		content      string
+		finishReason string
+	}{{"Hi", "stop"}, {"Hello there", "length"}} {
+		c := chat.Choices[i]
+		if c.Index != i || c.Message.Content != want.content || c.FinishReason == nil || *c.FinishReason != want.finishReason {
+			t.Errorf("chat choice %d = %+v, want content %q finish reason %q", i, c, want.content, want.finishReason)
+		}
+	}
+
+	completion := toCompletion("id", api.GenerateResponse{
+		Response: "a",
+		Choices: []api.GenerateChoice{
+			{Index: 0, Response: "a", DoneReason: "stop"},
+			{Index: 1, Response: "b", DoneReason: "stop"},
+		},
+	})
+
+	if len(completion.Choices) != 2 {
+		t.Fatalf("completion choices = %d, want 2", len(completion.Choices))
+	}
+
+	for i, want := range []string{"a", "b"} {
+		if c := completion.Choices[i]; c.Index != i || c.Text != want {
+			t.Errorf("completion choice %d = %+v, want text %q", i, c, want)
+		}
+	}
+}
+
+func TestToolCallDeltas(t *testing.T) {
+	first := toChunk("id", api.ChatResponse{Message: api.Message{
+		Role:           "assistant",
+		ToolCallDeltas: []api.ToolCallDelta{{Index: 0, Name: "get_weather", Arguments: `{"location":`}},
+	}}, false)
+
+	calls := first.Choices[0].Delta.ToolCalls
+	if len(calls) != 1 || calls[0].ID == "" || calls[0].Type != "function" || calls[0].Function.Name != "get_weather" || calls[0].Function.Arguments != `{"location":` {
+		t.Fatalf("first chunk tool calls = %+v", calls)
+	}
+
+	// the complete tool call isn't sent again
+	last := toChunk("id", api.ChatResponse{
+		Message: api.Message{
+			Role:           "assistant",
+			ToolCalls:      []api.ToolCall{{Function: api.ToolCallFunction{Name: "get_weather", Arguments: api.ToolCallFunctionArguments{"location": "Paris"}}}},
+			ToolCallDeltas: []api.ToolCallDelta{{Index: 0, Arguments: `"Paris"}`}},
+		},
+		DoneReason: "stop",
+	}, true)
+
+	b, err := json.Marshal(last.Choices[0].Delta.ToolCalls)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff(string(b), `[{"index":0,"function":{"arguments":"\"Paris\"}"}}]`); diff != "" {
+		t.Errorf("last chunk tool calls mismatch (-got +want):\n%s", diff)
+	}
+
+	if reason := last.Choices[0].FinishReason; reason == nil || *reason != "tool_calls" {
+		t.Errorf("finish reason = %v, want tool_calls", reason)
+	}
+}
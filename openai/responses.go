@@ -0,0 +1,812 @@
+package openai
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+)
+
+// ResponsesRequest is a request to create a response. The conversation can be
+// continued from a stored response with PreviousResponseID, in which case
+// Input only holds the new items.
+type ResponsesRequest struct {
+	Model              string            `json:"model"`
+	Input              json.RawMessage   `json:"input"`
+	Instructions       string            `json:"instructions"`
+	PreviousResponseID string            `json:"previous_response_id"`
+	Tools              []ResponsesTool   `json:"tools"`
+	ToolChoice         json.RawMessage   `json:"tool_choice"`
+	Text               *ResponsesText    `json:"text"`
+	Stream             bool              `json:"stream"`
+	Store              *bool             `json:"store"`
+	Temperature        *float64          `json:"temperature"`
+	TopP               *float64          `json:"top_p"`
+	MaxOutputTokens    *int              `json:"max_output_tokens"`
+	Metadata           map[string]string `json:"metadata"`
+}
+
+type ResponsesTool struct {
+	Type        string         `json:"type"`
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	Parameters  api.ToolSchema `json:"parameters"`
+}
+
+type ResponsesText struct {
+	Format struct {
+		Type   string          `json:"type"`
+		Schema json.RawMessage `json:"schema"`
+	} `json:"format"`
+}
+
+// ResponsesInputItem is a message, a function call made by the model or the
+// output of a function call
+type ResponsesInputItem struct {
+	Type      string          `json:"type"`
+	Role      string          `json:"role"`
+	Content   json.RawMessage `json:"content"`
+	CallID    string          `json:"call_id"`
+	Name      string          `json:"name"`
+	Arguments string          `json:"arguments"`
+	Output    string          `json:"output"`
+}
+
+type ResponsesInputContent struct {
+	Type     string `json:"type"`
+	Text     string `json:"text"`
+	ImageURL string `json:"image_url"`
+}
+
+type Response struct {
+	ID                 string                     `json:"id"`
+	Object             string                     `json:"object"`
+	CreatedAt          int64                      `json:"created_at"`
+	Status             string                     `json:"status"`
+	Model              string                     `json:"model"`
+	Instructions       string                     `json:"instructions,omitempty"`
+	PreviousResponseID string                     `json:"previous_response_id,omitempty"`
+	Output             []ResponseOutputItem       `json:"output"`
+	IncompleteDetails  *ResponseIncompleteDetails `json:"incomplete_details,omitempty"`
+	Usage              *ResponseUsage             `json:"usage,omitempty"`
+	Metadata           map[string]string          `json:"metadata,omitempty"`
+}
+
+// ResponseOutputItem is either a message or a function call
+type ResponseOutputItem struct {
+	Type      string               `json:"type"`
+	ID        string               `json:"id"`
+	Status    string               `json:"status"`
+	Role      string               `json:"role,omitempty"`
+	Content   []ResponseOutputText `json:"content,omitempty"`
+	CallID    string               `json:"call_id,omitempty"`
+	Name      string               `json:"name,omitempty"`
+	Arguments string               `json:"arguments,omitempty"`
+}
+
+type ResponseOutputText struct {
+	Type        string `json:"type"`
+	Text        string `json:"text"`
+	Annotations []any  `json:"annotations"`
+}
+
+type ResponseIncompleteDetails struct {
+	Reason string `json:"reason"`
+}
+
+type ResponseUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+	TotalTokens  int `json:"total_tokens"`
+}
+
+// ResponseEvent is a server-sent event of a streamed response
+type ResponseEvent struct {
+	Type           string              `json:"type"`
+	SequenceNumber int                 `json:"sequence_number"`
+	Response       *Response           `json:"response,omitempty"`
+	OutputIndex    *int                `json:"output_index,omitempty"`
+	ContentIndex   *int                `json:"content_index,omitempty"`
+	ItemID         string              `json:"item_id,omitempty"`
+	Item           *ResponseOutputItem `json:"item,omitempty"`
+	Part           *ResponseOutputText `json:"part,omitempty"`
+	Delta          string              `json:"delta,omitempty"`
+	Text           string              `json:"text,omitempty"`
+	Arguments      string              `json:"arguments,omitempty"`
+}
+
+type DeletedResponse struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Deleted bool   `json:"deleted"`
+}
+
+const (
+	// responseStoreMaxAge is how long a response is kept after it is
+	// stored
+	responseStoreMaxAge = 30 * 24 * time.Hour
+
+	// responseStoreMaxEntries is the number of responses kept, beyond which
+	// the oldest are removed
+	responseStoreMaxEntries = 10000
+)
+
+// ResponseStore keeps responses on disk so that conversations can be
+// continued with previous_response_id without sending the whole history. Each
+// response is stored in its own file along with the conversation it ends.
+// Responses are removed once they are older than maxAge or there are more
+// than maxEntries of them. Each response belongs to the client that created
+// it, as identified by owner, and other clients can't retrieve, delete or
+// continue it.
+type ResponseStore struct {
+	dir        string
+	maxAge     time.Duration
+	maxEntries int
+
+	// owner identifies the client making a request, such as by its API key.
+	// If it is nil, responses are shared by all clients
+	owner func(*gin.Context) string
+
+	// mu serializes pruning
+	mu sync.Mutex
+}
+
+func NewResponseStore(dir string, owner func(*gin.Context) string) *ResponseStore {
+	return &ResponseStore{dir: dir, maxAge: responseStoreMaxAge, maxEntries: responseStoreMaxEntries, owner: owner}
+}
+
+// requestOwner returns the owner of the responses that c creates
+func (s *ResponseStore) requestOwner(c *gin.Context) string {
+	if s.owner == nil {
+		return ""
+	}
+
+	return s.owner(c)
+}
+
+type storedResponse struct {
+	Response Response `json:"response"`
+
+	// Owner identifies the client that created the response
+	Owner string `json:"owner,omitempty"`
+
+	// Messages is the conversation up to and including the output of the
+	// response. Instructions are not included as they only apply to the
+	// response they are given for
+	Messages []api.Message `json:"messages"`
+}
+
+var responseID = regexp.MustCompile(`^resp_[0-9a-f]+$`)
+
+func (s *ResponseStore) path(id string) (string, error) {
+	if !responseID.MatchString(id) {
+		return "", os.ErrNotExist
+	}
+
+	return filepath.Join(s.dir, id+".json"), nil
+}
+
+// load returns a stored response, which must belong to owner. Responses
+// that belong to other clients don't exist as far as owner is concerned
+func (s *ResponseStore) load(id, owner string) (*storedResponse, error) {
+	p, err := s.path(id)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+
+	if time.Since(fi.ModTime()) > s.maxAge {
+		// expired but not yet pruned
+		return nil, os.ErrNotExist
+	}
+
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+
+	var r storedResponse
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, err
+	}
+
+	if r.Owner != owner {
+		return nil, os.ErrNotExist
+	}
+
+	return &r, nil
+}
+
+func (s *ResponseStore) save(r *storedResponse) error {
+	p, err := s.path(r.Response.ID)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(s.dir, r.Response.ID+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if err := json.NewEncoder(f).Encode(r); err != nil {
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(f.Name(), p); err != nil {
+		return err
+	}
+
+	s.prune()
+	return nil
+}
+
+// prune removes responses that are older than maxAge and the oldest ones
+// beyond maxEntries
+func (s *ResponseStore) prune() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	des, err := os.ReadDir(s.dir)
+	if err != nil {
+		slog.Warn("failed to list stored responses", "error", err)
+		return
+	}
+
+	type entry struct {
+		name    string
+		modTime time.Time
+	}
+
+	var entries []entry
+	for _, de := range des {
+		id, ok := strings.CutSuffix(de.Name(), ".json")
+		if !ok || !responseID.MatchString(id) {
+			continue
+		}
+
+		fi, err := de.Info()
+		if err != nil {
+			continue
+		}
+
+		entries = append(entries, entry{de.Name(), fi.ModTime()})
+	}
+
+	slices.SortFunc(entries, func(a, b entry) int {
+		return a.modTime.Compare(b.modTime)
+	})
+
+	n := max(0, len(entries)-s.maxEntries)
+	for n < len(entries) && time.Since(entries[n].modTime) > s.maxAge {
+		n++
+	}
+
+	for _, e := range entries[:n] {
+		slog.Debug("removing stored response", "file", e.name)
+		if err := os.Remove(filepath.Join(s.dir, e.name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("failed to remove stored response", "file", e.name, "error", err)
+		}
+	}
+}
+
+func (s *ResponseStore) delete(id, owner string) error {
+	if _, err := s.load(id, owner); err != nil {
+		return err
+	}
+
+	p, err := s.path(id)
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(p)
+}
+
+// RetrieveHandler returns a stored response
+func (s *ResponseStore) RetrieveHandler(c *gin.Context) {
+	id := c.Param("id")
+	r, err := s.load(id, s.requestOwner(c))
+	if errors.Is(err, os.ErrNotExist) {
+		c.AbortWithStatusJSON(http.StatusNotFound, NewError(http.StatusNotFound, fmt.Sprintf("response with id '%s' not found", id)))
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, NewError(http.StatusInternalServerError, err.Error()))
+		return
+	}
+
+	c.JSON(http.StatusOK, r.Response)
+}
+
+// DeleteHandler removes a stored response
+func (s *ResponseStore) DeleteHandler(c *gin.Context) {
+	id := c.Param("id")
+	if err := s.delete(id, s.requestOwner(c)); errors.Is(err, os.ErrNotExist) {
+		c.AbortWithStatusJSON(http.StatusNotFound, NewError(http.StatusNotFound, fmt.Sprintf("response with id '%s' not found", id)))
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, NewError(http.StatusInternalServerError, err.Error()))
+		return
+	}
+
+	c.JSON(http.StatusOK, DeletedResponse{ID: id, Object: "response", Deleted: true})
+}
+
+func newID(prefix string) string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return prefix + hex.EncodeToString(b)
+}
+
+func fromResponsesInput(input json.RawMessage) ([]api.Message, error) {
+	var s string
+	if err := json.Unmarshal(input, &s); err == nil {
+		return []api.Message{{Role: "user", Content: s}}, nil
+	}
+
+	var items []ResponsesInputItem
+	if err := json.Unmarshal(input, &items); err != nil {
+		return nil, errors.New("invalid input: expected a string or a list of input items")
+	}
+
+	var messages []api.Message
+	for _, item := range items {
+		switch item.Type {
+		case "", "message":
+			role := item.Role
+			if role == "developer" {
+				role = "system"
+			}
+
+			var text string
+			if err := json.Unmarshal(item.Content, &text); err == nil {
+				messages = append(messages, api.Message{Role: role, Content: text})
+				continue
+			}
+
+			var parts []ResponsesInputContent
+			if err := json.Unmarshal(item.Content, &parts); err != nil {
+				return nil, errors.New("invalid message content")
+			}
+
+			for _, part := range parts {
+				switch part.Type {
+				case "input_text", "output_text":
+					messages = append(messages, api.Message{Role: role, Content: part.Text})
+				case "input_image":
+					img, err := decodeImageURL(part.ImageURL)
+					if err != nil {
+						return nil, err
+					}
+
+					messages = append(messages, api.Message{Role: role, Images: []api.ImageData{img}})
+				default:
+					return nil, fmt.Errorf("unsupported content type %q", part.Type)
+				}
+			}
+		case "function_call":
+			var call api.ToolCall
+			call.Function.Name = item.Name
+			if err := json.Unmarshal([]byte(item.Arguments), &call.Function.Arguments); err != nil {
+				return nil, errors.New("invalid function call arguments")
+			}
+
+			// calls made together are part of the same message
+			if n := len(messages); n > 0 && messages[n-1].Role == "assistant" && len(messages[n-1].ToolCalls) > 0 {
+				call.Function.Index = len(messages[n-1].ToolCalls)
+				messages[n-1].ToolCalls = append(messages[n-1].ToolCalls, call)
+			} else {
+				messages = append(messages, api.Message{Role: "assistant", ToolCalls: []api.ToolCall{call}})
+			}
+		case "function_call_output":
+			messages = append(messages, api.Message{Role: "tool", Content: item.Output})
+		default:
+			return nil, fmt.Errorf("unsupported input item type %q", item.Type)
+		}
+	}
+
+	return messages, nil
+}
+
+func fromResponsesRequest(r ResponsesRequest, messages []api.Message) (*api.ChatRequest, error) {
+	if r.Instructions != "" {
+		messages = append([]api.Message{{Role: "system", Content: r.Instructions}}, messages...)
+	}
+
+	var tools []api.Tool
+	for _, t := range r.Tools {
+		if t.Type != "function" {
+			return nil, fmt.Errorf("unsupported tool type %q", t.Type)
+		}
+
+		tools = append(tools, api.Tool{
+			Type: "function",
+			Function: api.ToolFunction{
+				Name:        t.Name,
+				Description: t.Description,
+				Parameters:  t.Parameters,
+			},
+		})
+	}
+
+	var toolChoice *api.ToolChoice
+	if len(r.ToolChoice) > 0 {
+		// a function is chosen with {"type": "function", "name": "..."}
+		var function struct {
+			Type string `json:"type"`
+			Name string `json:"name"`
+		}
+		if err := json.Unmarshal(r.ToolChoice, &function); err == nil && function.Name != "" {
+			toolChoice = &api.ToolChoice{Type: function.Type, Function: api.ToolChoiceFunction{Name: function.Name}}
+		} else if err := json.Unmarshal(r.ToolChoice, &toolChoice); err != nil {
+			return nil, err
+		}
+	}
+
+	options := make(map[string]any)
+
+	if r.MaxOutputTokens != nil {
+		options["num_predict"] = *r.MaxOutputTokens
+	}
+
+	if r.Temperature != nil {
+		options["temperature"] = *r.Temperature
+	} else {
+		options["temperature"] = 1.0
+	}
+
+	if r.TopP != nil {
+		options["top_p"] = *r.TopP
+	} else {
+		options["top_p"] = 1.0
+	}
+
+	var format json.RawMessage
+	if r.Text != nil {
+		switch r.Text.Format.Type {
+		case "json_object":
+			format = json.RawMessage(`"json"`)
+		case "json_schema":
+			format = r.Text.Format.Schema
+		}
+	}
+
+	return &api.ChatRequest{
+		Model:      r.Model,
+		Messages:   messages,
+		Format:     format,
+		Options:    options,
+		Stream:     &r.Stream,
+		Tools:      tools,
+		ToolChoice: toolChoice,
+	}, nil
+}
+
+// ResponsesWriter builds a response from the output of the chat handler,
+// streaming it as events if requested, and stores it once it is done
+type ResponsesWriter struct {
+	BaseWriter
+	stream bool
+
+	// store is nil if the response is not stored
+	store *ResponseStore
+	owner string
+
+	// messages is the conversation that the response continues
+	messages []api.Message
+
+	resp Response
+	seq  int
+
+	// message is the output index of the message, or -1 if there is no text
+	message int
+	text    strings.Builder
+
+	// calls maps the index of each streamed tool call to its output index
+	calls     map[int]int
+	toolCalls []api.ToolCall
+}
+
+func (w *ResponsesWriter) event(e ResponseEvent) error {
+	e.SequenceNumber = w.seq
+	w.seq++
+
+	d, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	w.ResponseWriter.Header().Set("Content-Type", "text/event-stream")
+	_, err = fmt.Fprintf(w.ResponseWriter, "event: %s\ndata: %s\n\n", e.Type, d)
+	return err
+}
+
+// addItem adds an item to the output, returning its index
+func (w *ResponsesWriter) addItem(item ResponseOutputItem) (int, error) {
+	i := len(w.resp.Output)
+	w.resp.Output = append(w.resp.Output, item)
+
+	if w.stream {
+		if err := w.event(ResponseEvent{Type: "response.output_item.added", OutputIndex: &i, Item: &item}); err != nil {
+			return 0, err
+		}
+	}
+
+	return i, nil
+}
+
+func (w *ResponsesWriter) writeResponse(data []byte) (int, error) {
+	var r api.ChatResponse
+	if err := json.Unmarshal(data, &r); err != nil {
+		return 0, err
+	}
+
+	if w.stream && w.seq == 0 {
+		created := w.resp
+		if err := w.event(ResponseEvent{Type: "response.created", Response: &created}); err != nil {
+			return 0, err
+		}
+	}
+
+	if r.Message.Content != "" {
+		if w.message < 0 {
+			i, err := w.addItem(ResponseOutputItem{Type: "message", ID: newID("msg_"), Status: "in_progress", Role: "assistant", Content: []ResponseOutputText{}})
+			if err != nil {
+				return 0, err
+			}
+			w.message = i
+
+			if w.stream {
+				part := ResponseOutputText{Type: "output_text", Annotations: []any{}}
+				if err := w.event(ResponseEvent{Type: "response.content_part.added", OutputIndex: &i, ContentIndex: new(int), ItemID: w.resp.Output[i].ID, Part: &part}); err != nil {
+					return 0, err
+				}
+			}
+		}
+
+		w.text.WriteString(r.Message.Content)
+
+		if w.stream {
+			if err := w.event(ResponseEvent{Type: "response.output_text.delta", OutputIndex: &w.message, ContentIndex: new(int), ItemID: w.resp.Output[w.message].ID, Delta: r.Message.Content}); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	for _, d := range r.Message.ToolCallDeltas {
+		i, ok := w.calls[d.Index]
+		if !ok {
+			var err error
+			i, err = w.addItem(ResponseOutputItem{Type: "function_call", ID: newID("fc_"), Status: "in_progress", CallID: toolCallId(), Name: d.Name})
+			if err != nil {
+				return 0, err
+			}
+			w.calls[d.Index] = i
+		}
+
+		w.resp.Output[i].Arguments += d.Arguments
+		if w.stream {
+			if err := w.event(ResponseEvent{Type: "response.function_call_arguments.delta", OutputIndex: &i, ItemID: w.resp.Output[i].ID, Delta: d.Arguments}); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	for _, tc := range r.Message.ToolCalls {
+		args, err := json.Marshal(tc.Function.Arguments)
+		if err != nil {
+			return 0, err
+		}
+
+		i, ok := w.calls[tc.Function.Index]
+		if !w.stream || !ok {
+			i, err = w.addItem(ResponseOutputItem{Type: "function_call", ID: newID("fc_"), Status: "in_progress", CallID: toolCallId(), Name: tc.Function.Name})
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		item := &w.resp.Output[i]
+		item.Arguments = string(args)
+		item.Status = "completed"
+		w.toolCalls = append(w.toolCalls, tc)
+
+		if w.stream {
+			if err := w.event(ResponseEvent{Type: "response.function_call_arguments.done", OutputIndex: &i, ItemID: item.ID, Arguments: item.Arguments}); err != nil {
+				return 0, err
+			}
+
+			if err := w.event(ResponseEvent{Type: "response.output_item.done", OutputIndex: &i, Item: item}); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	if r.Done {
+		if err := w.done(r); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(data), nil
+}
+
+// done completes the response, storing it and then writing it
+func (w *ResponsesWriter) done(r api.ChatResponse) error {
+	if w.message >= 0 {
+		i := w.message
+		item := &w.resp.Output[i]
+		part := ResponseOutputText{Type: "output_text", Text: w.text.String(), Annotations: []any{}}
+		item.Content = []ResponseOutputText{part}
+		item.Status = "completed"
+
+		if w.stream {
+			if err := w.event(ResponseEvent{Type: "response.output_text.done", OutputIndex: &i, ContentIndex: new(int), ItemID: item.ID, Text: part.Text}); err != nil {
+				return err
+			}
+
+			if err := w.event(ResponseEvent{Type: "response.content_part.done", OutputIndex: &i, ContentIndex: new(int), ItemID: item.ID, Part: &part}); err != nil {
+				return err
+			}
+
+			if err := w.event(ResponseEvent{Type: "response.output_item.done", OutputIndex: &i, Item: item}); err != nil {
+				return err
+			}
+		}
+	}
+
+	// tool calls that were started but never completed
+	for i := range w.resp.Output {
+		if w.resp.Output[i].Status == "in_progress" {
+			w.resp.Output[i].Status = "incomplete"
+		}
+	}
+
+	w.resp.Status = "completed"
+	if r.DoneReason == "length" {
+		w.resp.Status = "incomplete"
+		w.resp.IncompleteDetails = &ResponseIncompleteDetails{Reason: "max_output_tokens"}
+	}
+
+	w.resp.Usage = &ResponseUsage{
+		InputTokens:  r.PromptEvalCount,
+		OutputTokens: r.EvalCount,
+		TotalTokens:  r.PromptEvalCount + r.EvalCount,
+	}
+
+	if w.store != nil {
+		messages := append(w.messages, api.Message{Role: "assistant", Content: w.text.String(), ToolCalls: w.toolCalls})
+		if err := w.store.save(&storedResponse{Response: w.resp, Owner: w.owner, Messages: messages}); err != nil {
+			slog.Warn("failed to store response", "id", w.resp.ID, "error", err)
+		}
+	}
+
+	if w.stream {
+		typ := "response.completed"
+		if w.resp.Status == "incomplete" {
+			typ = "response.incomplete"
+		}
+
+		return w.event(ResponseEvent{Type: typ, Response: &w.resp})
+	}
+
+	w.ResponseWriter.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w.ResponseWriter).Encode(w.resp)
+}
+
+func (w *ResponsesWriter) Write(data []byte) (int, error) {
+	code := w.ResponseWriter.Status()
+	if code != http.StatusOK {
+		return w.writeError(data)
+	}
+
+	return w.writeResponse(data)
+}
+
+func ResponsesMiddleware(store *ResponseStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req ResponsesRequest
+		err := c.ShouldBindJSON(&req)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewError(http.StatusBadRequest, err.Error()))
+			return
+		}
+
+		if len(req.Input) == 0 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewError(http.StatusBadRequest, "input is required"))
+			return
+		}
+
+		var messages []api.Message
+		if req.PreviousResponseID != "" {
+			prev, err := store.load(req.PreviousResponseID, store.requestOwner(c))
+			if errors.Is(err, os.ErrNotExist) {
+				c.AbortWithStatusJSON(http.StatusNotFound, NewError(http.StatusNotFound, fmt.Sprintf("previous response with id '%s' not found", req.PreviousResponseID)))
+				return
+			} else if err != nil {
+				c.AbortWithStatusJSON(http.StatusInternalServerError, NewError(http.StatusInternalServerError, err.Error()))
+				return
+			}
+
+			messages = prev.Messages
+		}
+
+		input, err := fromResponsesInput(req.Input)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewError(http.StatusBadRequest, err.Error()))
+			return
+		}
+		messages = append(messages, input...)
+
+		chatReq, err := fromResponsesRequest(req, messages)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewError(http.StatusBadRequest, err.Error()))
+			return
+		}
+
+		var b bytes.Buffer
+		if err := json.NewEncoder(&b).Encode(chatReq); err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, NewError(http.StatusInternalServerError, err.Error()))
+			return
+		}
+
+		c.Request.Body = io.NopCloser(&b)
+
+		w := &ResponsesWriter{
+			BaseWriter: BaseWriter{ResponseWriter: c.Writer},
+			stream:     req.Stream,
+			messages:   messages,
+			resp: Response{
+				ID:                 newID("resp_"),
+				Object:             "response",
+				CreatedAt:          time.Now().Unix(),
+				Status:             "in_progress",
+				Model:              req.Model,
+				Instructions:       req.Instructions,
+				PreviousResponseID: req.PreviousResponseID,
+				Output:             []ResponseOutputItem{},
+				Metadata:           req.Metadata,
+			},
+			message: -1,
+			calls:   make(map[int]int),
+		}
+
+		if req.Store == nil || *req.Store {
+			w.store = store
+			w.owner = store.requestOwner(c)
+		}
+
+		c.Writer = w
+
+		c.Next()
+	}
+}
@@ -0,0 +1,388 @@
+package openai
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+)
+
+func TestResponses(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	// owner stands in for the API key of the requests
+	var owner string
+	store := NewResponseStore(t.TempDir(), func(*gin.Context) string { return owner })
+
+	var captured *api.ChatRequest
+
+	// responses are what the chat handler writes for the next request
+	var responses []api.ChatResponse
+
+	router := gin.New()
+	router.POST("/v1/responses", ResponsesMiddleware(store), captureRequestMiddleware(&captured), func(c *gin.Context) {
+		for _, r := range responses {
+			b, err := json.Marshal(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c.Writer.Write(b)
+		}
+	})
+	router.GET("/v1/responses/:id", store.RetrieveHandler)
+	router.DELETE("/v1/responses/:id", store.DeleteHandler)
+
+	request := func(t *testing.T, method, path, body string) *httptest.ResponseRecorder {
+		t.Helper()
+
+		captured = nil
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	var first Response
+
+	t.Run("create", func(t *testing.T) {
+		responses = []api.ChatResponse{{
+			Model:      "test-model",
+			Message:    api.Message{Role: "assistant", Content: "Hi! How can I help?"},
+			Done:       true,
+			DoneReason: "stop",
+			Metrics:    api.Metrics{PromptEvalCount: 10, EvalCount: 6},
+		}}
+
+		w := request(t, http.MethodPost, "/v1/responses", `{"model": "test-model", "instructions": "Be brief.", "input": "Hello"}`)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if diff := cmp.Diff(captured.Messages, []api.Message{
+			{Role: "system", Content: "Be brief."},
+			{Role: "user", Content: "Hello"},
+		}); diff != "" {
+			t.Errorf("messages mismatch (-got +want):\n%s", diff)
+		}
+
+		if err := json.Unmarshal(w.Body.Bytes(), &first); err != nil {
+			t.Fatal(err)
+		}
+
+		if !strings.HasPrefix(first.ID, "resp_") || first.Status != "completed" || first.Instructions != "Be brief." {
+			t.Errorf("unexpected response %+v", first)
+		}
+
+		if len(first.Output) != 1 || first.Output[0].Type != "message" || first.Output[0].Content[0].Text != "Hi! How can I help?" {
+			t.Errorf("unexpected output %+v", first.Output)
+		}
+
+		if diff := cmp.Diff(first.Usage, &ResponseUsage{InputTokens: 10, OutputTokens: 6, TotalTokens: 16}); diff != "" {
+			t.Errorf("usage mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("continue", func(t *testing.T) {
+		responses = []api.ChatResponse{{
+			Message: api.Message{Role: "assistant", Content: "It's sunny."},
+			Done:    true,
+		}}
+
+		w := request(t, http.MethodPost, "/v1/responses", `{"model": "test-model", "previous_response_id": "`+first.ID+`", "input": [{"role": "user", "content": [{"type": "input_text", "text": "What's the weather?"}]}]}`)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		// instructions are not carried over
+		if diff := cmp.Diff(captured.Messages, []api.Message{
+			{Role: "user", Content: "Hello"},
+			{Role: "assistant", Content: "Hi! How can I help?"},
+			{Role: "user", Content: "What's the weather?"},
+		}); diff != "" {
+			t.Errorf("messages mismatch (-got +want):\n%s", diff)
+		}
+
+		var resp Response
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.PreviousResponseID != first.ID {
+			t.Errorf("previous_response_id = %q, want %q", resp.PreviousResponseID, first.ID)
+		}
+	})
+
+	t.Run("not stored", func(t *testing.T) {
+		responses = []api.ChatResponse{{Message: api.Message{Role: "assistant", Content: "Hi!"}, Done: true}}
+
+		w := request(t, http.MethodPost, "/v1/responses", `{"model": "test-model", "input": "Hello", "store": false}`)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp Response
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if w := request(t, http.MethodGet, "/v1/responses/"+resp.ID, ""); w.Code != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d", w.Code)
+		}
+	})
+
+	t.Run("missing previous response", func(t *testing.T) {
+		w := request(t, http.MethodPost, "/v1/responses", `{"model": "test-model", "previous_response_id": "resp_0123", "input": "Hello"}`)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d", w.Code)
+		}
+
+		w = request(t, http.MethodPost, "/v1/responses", `{"model": "test-model", "previous_response_id": "../../etc/passwd", "input": "Hello"}`)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d", w.Code)
+		}
+	})
+
+	t.Run("tools", func(t *testing.T) {
+		responses = []api.ChatResponse{{
+			Message: api.Message{Role: "assistant", ToolCalls: []api.ToolCall{{Function: api.ToolCallFunction{Name: "get_weather", Arguments: api.ToolCallFunctionArguments{"location": "Paris"}}}}},
+			Done:    true,
+		}}
+
+		w := request(t, http.MethodPost, "/v1/responses", `{
+			"model": "test-model",
+			"input": [
+				{"type": "message", "role": "developer", "content": "Use tools."},
+				{"role": "user", "content": "What's the weather in Paris and Rome?"},
+				{"type": "function_call", "call_id": "call_1", "name": "get_weather", "arguments": "{\"location\": \"Rome\"}"},
+				{"type": "function_call_output", "call_id": "call_1", "output": "22"}
+			],
+			"tools": [{"type": "function", "name": "get_weather", "parameters": {"type": "object", "properties": {"location": {"type": "string"}}}}],
+			"tool_choice": {"type": "function", "name": "get_weather"}
+		}`)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if diff := cmp.Diff(captured.Messages, []api.Message{
+			{Role: "system", Content: "Use tools."},
+			{Role: "user", Content: "What's the weather in Paris and Rome?"},
+			{Role: "assistant", ToolCalls: []api.ToolCall{{Function: api.ToolCallFunction{Name: "get_weather", Arguments: api.ToolCallFunctionArguments{"location": "Rome"}}}}},
+			{Role: "tool", Content: "22"},
+		}); diff != "" {
+			t.Errorf("messages mismatch (-got +want):\n%s", diff)
+		}
+
+		if diff := cmp.Diff(captured.Tools, api.Tools{{
+			Type:     "function",
+			Function: api.ToolFunction{Name: "get_weather", Parameters: api.ToolSchema(`{"type":"object","properties":{"location":{"type":"string"}}}`)},
+		}}); diff != "" {
+			t.Errorf("tools mismatch (-got +want):\n%s", diff)
+		}
+
+		if diff := cmp.Diff(captured.ToolChoice, &api.ToolChoice{Type: api.ToolChoiceNamed, Function: api.ToolChoiceFunction{Name: "get_weather"}}); diff != "" {
+			t.Errorf("tool choice mismatch (-got +want):\n%s", diff)
+		}
+
+		var resp Response
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(resp.Output) != 1 {
+			t.Fatalf("expected 1 output item, got %d", len(resp.Output))
+		}
+
+		call := resp.Output[0]
+		if call.Type != "function_call" || call.Name != "get_weather" || call.Arguments != `{"location":"Paris"}` || call.CallID == "" {
+			t.Errorf("unexpected function call %+v", call)
+		}
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		responses = []api.ChatResponse{
+			{Message: api.Message{Role: "assistant", Content: "Let me check."}},
+			{Message: api.Message{Role: "assistant", ToolCallDeltas: []api.ToolCallDelta{{Index: 0, Name: "get_weather", Arguments: `{"location":`}}}},
+			{Message: api.Message{Role: "assistant", ToolCallDeltas: []api.ToolCallDelta{{Index: 0, Arguments: `"Paris"}`}}}},
+			{
+				Message:    api.Message{Role: "assistant", ToolCalls: []api.ToolCall{{Function: api.ToolCallFunction{Name: "get_weather", Arguments: api.ToolCallFunctionArguments{"location": "Paris"}}}}},
+				Done:       true,
+				DoneReason: "stop",
+			},
+		}
+
+		w := request(t, http.MethodPost, "/v1/responses", `{"model": "test-model", "input": "What's the weather in Paris?", "stream": true}`)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var types []string
+		var events []ResponseEvent
+		s := bufio.NewScanner(w.Body)
+		for s.Scan() {
+			if data, ok := strings.CutPrefix(s.Text(), "data: "); ok {
+				var e ResponseEvent
+				if err := json.Unmarshal([]byte(data), &e); err != nil {
+					t.Fatal(err)
+				}
+
+				if e.SequenceNumber != len(events) {
+					t.Errorf("event %d has sequence number %d", len(events), e.SequenceNumber)
+				}
+
+				events = append(events, e)
+				types = append(types, e.Type)
+			}
+		}
+
+		if diff := cmp.Diff(types, []string{
+			"response.created",
+			"response.output_item.added",
+			"response.content_part.added",
+			"response.output_text.delta",
+			"response.output_item.added",
+			"response.function_call_arguments.delta",
+			"response.function_call_arguments.delta",
+			"response.function_call_arguments.done",
+			"response.output_item.done",
+			"response.output_text.done",
+			"response.content_part.done",
+			"response.output_item.done",
+			"response.completed",
+		}); diff != "" {
+			t.Fatalf("events mismatch (-got +want):\n%s", diff)
+		}
+
+		resp := events[len(events)-1].Response
+		if len(resp.Output) != 2 || resp.Output[0].Content[0].Text != "Let me check." || resp.Output[1].Arguments != `{"location":"Paris"}` {
+			t.Errorf("unexpected output %+v", resp.Output)
+		}
+
+		// the tool call is part of the stored conversation
+		stored, err := store.load(resp.ID, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(stored.Messages[len(stored.Messages)-1], api.Message{
+			Role:      "assistant",
+			Content:   "Let me check.",
+			ToolCalls: []api.ToolCall{{Function: api.ToolCallFunction{Name: "get_weather", Arguments: api.ToolCallFunctionArguments{"location": "Paris"}}}},
+		}); diff != "" {
+			t.Errorf("stored message mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("retrieve and delete", func(t *testing.T) {
+		w := request(t, http.MethodGet, "/v1/responses/"+first.ID, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		var resp Response
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(resp, first); diff != "" {
+			t.Errorf("response mismatch (-got +want):\n%s", diff)
+		}
+
+		if w := request(t, http.MethodDelete, "/v1/responses/"+first.ID, ""); w.Code != http.StatusOK {
+			t.Errorf("expected status 200, got %d", w.Code)
+		}
+
+		if w := request(t, http.MethodGet, "/v1/responses/"+first.ID, ""); w.Code != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d", w.Code)
+		}
+	})
+
+	t.Run("other owner", func(t *testing.T) {
+		defer func() { owner = "" }()
+
+		responses = []api.ChatResponse{{
+			Model:      "test-model",
+			Message:    api.Message{Role: "assistant", Content: "Hi!"},
+			Done:       true,
+			DoneReason: "stop",
+		}}
+
+		owner = "alice"
+		w := request(t, http.MethodPost, "/v1/responses", `{"model": "test-model", "input": "Hello"}`)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp Response
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+
+		owner = "bob"
+		if w := request(t, http.MethodGet, "/v1/responses/"+resp.ID, ""); w.Code != http.StatusNotFound {
+			t.Errorf("retrieve: expected status 404, got %d", w.Code)
+		}
+
+		if w := request(t, http.MethodDelete, "/v1/responses/"+resp.ID, ""); w.Code != http.StatusNotFound {
+			t.Errorf("delete: expected status 404, got %d", w.Code)
+		}
+
+		if w := request(t, http.MethodPost, "/v1/responses", `{"model": "test-model", "input": "Again", "previous_response_id": "`+resp.ID+`"}`); w.Code != http.StatusNotFound {
+			t.Errorf("previous_response_id: expected status 404, got %d", w.Code)
+		}
+
+		owner = "alice"
+		if w := request(t, http.MethodGet, "/v1/responses/"+resp.ID, ""); w.Code != http.StatusOK {
+			t.Errorf("retrieve: expected status 200, got %d", w.Code)
+		}
+	})
+}
+
+func TestResponseStorePrune(t *testing.T) {
+	store := NewResponseStore(t.TempDir(), nil)
+	store.maxAge = time.Hour
+	store.maxEntries = 2
+
+	save := func(id string, age time.Duration) {
+		t.Helper()
+		if err := store.save(&storedResponse{Response: Response{ID: id}}); err != nil {
+			t.Fatal(err)
+		}
+
+		modTime := time.Now().Add(-age)
+		if err := os.Chtimes(filepath.Join(store.dir, id+".json"), modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	save("resp_01", 30*time.Minute)
+	save("resp_02", 20*time.Minute)
+
+	// saving a third response removes the oldest, then it expires, after
+	// which it can't be loaded even before it is pruned
+	save("resp_03", 2*time.Hour)
+	if _, err := store.load("resp_03", ""); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected expired response to not exist, got %v", err)
+	}
+
+	// saving prunes the expired response
+	save("resp_04", 0)
+	for id, want := range map[string]bool{"resp_01": false, "resp_02": true, "resp_03": false, "resp_04": true} {
+		if _, err := os.Stat(filepath.Join(store.dir, id+".json")); (err == nil) != want {
+			t.Errorf("%s: expected exists %v, got error %v", id, want, err)
+		}
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"net/http"
 	"os"
 	"os/user"
@@ -107,6 +108,8 @@ func (f Modelfile) CreateRequest(relativeDir string) (*api.CreateRequest, error)
 			for k, v := range ps {
 				if ks, ok := params[k].([]string); ok {
 					params[k] = append(ks, v.([]string)...)
+				} else if km, ok := params[k].(map[string]any); ok {
+					maps.Copy(km, v.(map[string]any))
 				} else if vs, ok := v.([]string); ok {
 					params[k] = vs
 				} else {
@@ -733,6 +733,16 @@ MESSAGE assistant Hi! How are you?
 				},
 			},
 		},
+		{
+			`FROM test
+PARAMETER logit_bias 128001:-100
+PARAMETER logit_bias 13:5
+`,
+			&api.CreateRequest{
+				From:       "test",
+				Parameters: map[string]any{"logit_bias": map[string]any{"128001": -100.0, "13": 5.0}},
+			},
+		},
 	}
 
 	for _, c := range cases {
@@ -0,0 +1,38 @@
+package common
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// LogitBias resolves the keys of a logit bias option to token ids. Keys
+// that are integers are token ids, which must be less than vocabSize, and
+// any other key is tokenized so that each of its tokens is biased
+func LogitBias(bias map[string]float32, vocabSize int, tokenize func(string) ([]int32, error)) (map[int32]float32, error) {
+	if len(bias) == 0 {
+		return nil, nil
+	}
+
+	ids := make(map[int32]float32, len(bias))
+	for key, b := range bias {
+		if id, err := strconv.ParseInt(key, 10, 32); err == nil {
+			if id < 0 || id >= int64(vocabSize) {
+				return nil, fmt.Errorf("logit_bias: token %d is out of range", id)
+			}
+
+			ids[int32(id)] += b
+			continue
+		}
+
+		tokens, err := tokenize(key)
+		if err != nil {
+			return nil, fmt.Errorf("logit_bias: %w", err)
+		}
+
+		for _, id := range tokens {
+			ids[id] += b
+		}
+	}
+
+	return ids, nil
+}
@@ -0,0 +1,45 @@
+package common
+
+import (
+	"maps"
+	"strings"
+	"testing"
+)
+
+func TestLogitBias(t *testing.T) {
+	// each word is a token whose id is its length
+	tokenize := func(s string) ([]int32, error) {
+		var ids []int32
+		for _, w := range strings.Fields(s) {
+			ids = append(ids, int32(len(w)))
+		}
+		return ids, nil
+	}
+
+	tests := []struct {
+		name    string
+		bias    map[string]float32
+		want    map[int32]float32
+		wantErr bool
+	}{
+		{name: "empty"},
+		{name: "token ids", bias: map[string]float32{"1": -100, "5": 2}, want: map[int32]float32{1: -100, 5: 2}},
+		{name: "strings", bias: map[string]float32{"a bcd": -1, "ef": 3}, want: map[int32]float32{1: -1, 3: -1, 2: 3}},
+		{name: "overlapping", bias: map[string]float32{"2": 1, "ab": 1}, want: map[int32]float32{2: 2}},
+		{name: "out of range", bias: map[string]float32{"10": 1}, wantErr: true},
+		{name: "negative", bias: map[string]float32{"-1": 1}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := LogitBias(tt.bias, 10, tokenize)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+
+			if !maps.Equal(got, tt.want) {
+				t.Errorf("bias = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
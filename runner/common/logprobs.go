@@ -0,0 +1,68 @@
+package common
+
+import (
+	"math"
+	"slices"
+
+	"github.com/ollama/ollama/api"
+)
+
+// Logprobs returns the log probability of token under the distribution
+// given by logits, along with the topN most likely tokens. decode converts
+// a token to its text
+func Logprobs(logits []float32, token int32, topN int, decode func(int32) string) api.Logprob {
+	maxLogit := float32(math.Inf(-1))
+	for _, l := range logits {
+		maxLogit = max(maxLogit, l)
+	}
+
+	var sum float64
+	for _, l := range logits {
+		sum += math.Exp(float64(l - maxLogit))
+	}
+
+	logZ := float64(maxLogit) + math.Log(sum)
+
+	lp := api.Logprob{
+		TokenLogprob: api.TokenLogprob{
+			Token:   decode(token),
+			Logprob: float64(logits[token]) - logZ,
+		},
+	}
+
+	topN = min(topN, len(logits))
+	if topN <= 0 {
+		return lp
+	}
+
+	// top holds the ids of the most likely tokens seen so far, in
+	// descending order of their logits
+	top := make([]int32, 0, topN+1)
+	for i, l := range logits {
+		if len(top) == topN && l <= logits[top[len(top)-1]] {
+			continue
+		}
+
+		j, _ := slices.BinarySearchFunc(top, l, func(id int32, l float32) int {
+			if logits[id] >= l {
+				return -1
+			}
+			return 1
+		})
+
+		top = slices.Insert(top, j, int32(i))
+		if len(top) > topN {
+			top = top[:topN]
+		}
+	}
+
+	lp.TopLogprobs = make([]api.TokenLogprob, len(top))
+	for i, id := range top {
+		lp.TopLogprobs[i] = api.TokenLogprob{
+			Token:   decode(id),
+			Logprob: float64(logits[id]) - logZ,
+		}
+	}
+
+	return lp
+}
@@ -0,0 +1,60 @@
+package common
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestLogprobs(t *testing.T) {
+	decode := func(id int32) string { return strconv.Itoa(int(id)) }
+
+	// probabilities of 0.1, 0.2, 0.3 and 0.4
+	logits := []float32{
+		float32(math.Log(1)),
+		float32(math.Log(2)),
+		float32(math.Log(3)),
+		float32(math.Log(4)),
+	}
+
+	tests := []struct {
+		name  string
+		token int32
+		topN  int
+		top   []string
+	}{
+		{name: "no alternatives", token: 1},
+		{name: "top 2", token: 1, topN: 2, top: []string{"3", "2"}},
+		{name: "more than vocabulary", token: 0, topN: 10, top: []string{"3", "2", "1", "0"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lp := Logprobs(logits, tt.token, tt.topN, decode)
+
+			if lp.Token != decode(tt.token) {
+				t.Errorf("token = %q, want %q", lp.Token, decode(tt.token))
+			}
+
+			want := math.Log(float64(tt.token+1) / 10)
+			if math.Abs(lp.Logprob-want) > 1e-6 {
+				t.Errorf("logprob = %f, want %f", lp.Logprob, want)
+			}
+
+			if len(lp.TopLogprobs) != len(tt.top) {
+				t.Fatalf("top logprobs = %v, want tokens %v", lp.TopLogprobs, tt.top)
+			}
+
+			for i, top := range lp.TopLogprobs {
+				if top.Token != tt.top[i] {
+					t.Errorf("top[%d] = %q, want %q", i, top.Token, tt.top[i])
+				}
+
+				id, _ := strconv.Atoi(top.Token)
+				if want := math.Log(float64(id+1) / 10); math.Abs(top.Logprob-want) > 1e-6 {
+					t.Errorf("top[%d] logprob = %f, want %f", i, top.Logprob, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package common
+
+import (
+	"sync"
+	"time"
+)
+
+// throughputWindow is the number of seconds that Throughput averages over
+const throughputWindow = 60
+
+// Throughput counts tokens in one second buckets to report the rate at
+// which they were processed over the last minute
+type Throughput struct {
+	mu      sync.Mutex
+	buckets [throughputWindow]struct {
+		second int64
+		count  int
+	}
+}
+
+// Add counts n tokens as processed now
+func (t *Throughput) Add(n int) {
+	t.add(time.Now(), n)
+}
+
+// Rate returns the average number of tokens per second over the last minute
+func (t *Throughput) Rate() float64 {
+	return t.rate(time.Now())
+}
+
+func (t *Throughput) add(now time.Time, n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	second := now.Unix()
+	b := &t.buckets[second%throughputWindow]
+	if b.second != second {
+		b.second = second
+		b.count = 0
+	}
+
+	b.count += n
+}
+
+func (t *Throughput) rate(now time.Time) float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	second := now.Unix()
+
+	var count int
+	for _, b := range t.buckets {
+		if second-b.second < throughputWindow {
+			count += b.count
+		}
+	}
+
+	return float64(count) / throughputWindow
+}
@@ -0,0 +1,38 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestThroughput(t *testing.T) {
+	var tp Throughput
+
+	start := time.Unix(1000, 0)
+	if got := tp.rate(start); got != 0 {
+		t.Errorf("expected no throughput, got %v", got)
+	}
+
+	tp.add(start, 30)
+	tp.add(start.Add(500*time.Millisecond), 30)
+	tp.add(start.Add(30*time.Second), 60)
+
+	if got := tp.rate(start.Add(30 * time.Second)); got != 2 {
+		t.Errorf("expected 2 tokens per second, got %v", got)
+	}
+
+	// the first tokens are older than a minute
+	if got := tp.rate(start.Add(time.Minute)); got != 1 {
+		t.Errorf("expected 1 token per second, got %v", got)
+	}
+
+	// a bucket is reset when it is reused
+	tp.add(start.Add(time.Minute), 6)
+	if got := tp.rate(start.Add(time.Minute)); got != 1.1 {
+		t.Errorf("expected 1.1 tokens per second, got %v", got)
+	}
+
+	if got := tp.rate(start.Add(2 * time.Minute)); got != 0 {
+		t.Errorf("expected no throughput, got %v", got)
+	}
+}
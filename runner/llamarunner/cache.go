@@ -45,6 +45,20 @@ func NewInputCache(lc *llama.Context, kvSize int, numSlots int, multiUserCache b
 	}, nil
 }
 
+// Usage returns the number of slots in use by sequences and the number of
+// inputs stored across all slots
+func (c *InputCache) Usage() (inUse int, inputs int) {
+	for _, slot := range c.slots {
+		if slot.InUse {
+			inUse++
+		}
+
+		inputs += len(slot.Inputs)
+	}
+
+	return inUse, inputs
+}
+
 // Locking: Operations on InputCacheSlot (including finding one
 // through LoadCacheSlot) require a lock to be be held that serializes
 // these operations with each other and llama.Decode
@@ -17,6 +17,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unicode/utf8"
 
@@ -53,6 +54,9 @@ type Sequence struct {
 	// tokens that have been generated but not returned yet (e.g. for stop sequences)
 	pendingResponses []string
 
+	// log probabilities of the tokens in pendingResponses, if requested
+	pendingLogprobs []api.Logprob
+
 	// input cache being used by this sequence
 	cache *InputCacheSlot
 
@@ -61,7 +65,7 @@ type Sequence struct {
 	crossAttention bool
 
 	// channel to send responses over
-	responses chan string
+	responses chan response
 
 	// channel to stop decoding (such as if the remote connection is closed)
 	quit chan bool
@@ -83,6 +87,11 @@ type Sequence struct {
 	// true if an embedding are to be returned instead of text generation
 	embeddingOnly bool
 
+	// return log probabilities of generated tokens and the given
+	// number of most likely alternatives
+	logprobs    bool
+	topLogprobs int
+
 	doneReason llm.DoneReason
 
 	// Metrics
@@ -92,12 +101,20 @@ type Sequence struct {
 	numPromptInputs     int
 }
 
+// response is generated text along with its log probabilities
+type response struct {
+	content  string
+	logprobs []api.Logprob
+}
+
 type NewSequenceParams struct {
 	numPredict     int
 	stop           []string
 	numKeep        int
 	samplingParams *llama.SamplingParams
 	embedding      bool
+	logprobs       bool
+	topLogprobs    int
 }
 
 func (s *Server) NewSequence(prompt string, images []llm.ImageData, params NewSequenceParams) (*Sequence, error) {
@@ -151,13 +168,15 @@ func (s *Server) NewSequence(prompt string, images []llm.ImageData, params NewSe
 		startProcessingTime: startTime,
 		numPredict:          params.numPredict,
 		pendingResponses:    make([]string, 0),
-		responses:           make(chan string, 100),
+		responses:           make(chan response, 100),
 		quit:                make(chan bool, 1),
 		embedding:           make(chan []float32, 1),
 		samplingCtx:         sc,
 		embeddingOnly:       params.embedding,
 		stop:                params.stop,
 		numKeep:             params.numKeep,
+		logprobs:            params.logprobs,
+		topLogprobs:         params.topLogprobs,
 	}, nil
 }
 
@@ -264,6 +283,20 @@ type Server struct {
 
 	// next sequence for prompt processing to avoid starvation
 	nextSeq int
+
+	// rates of prompt processing and generation reported by stats
+	promptRate, evalRate common.Throughput
+
+	// cache usage reported by stats
+	slotsInUse, contextUsed atomic.Int64
+}
+
+// updateUsage records how much of the cache is used for stats, so that it
+// doesn't have to wait for a batch to finish to read it. s.mu must be held
+func (s *Server) updateUsage() {
+	inUse, inputs := s.cache.Usage()
+	s.slotsInUse.Store(int64(inUse))
+	s.contextUsed.Store(int64(inputs))
 }
 
 func (s *Server) allNil() bool {
@@ -279,6 +312,9 @@ func flushPending(seq *Sequence) bool {
 	joined := strings.Join(seq.pendingResponses, "")
 	seq.pendingResponses = []string{}
 
+	logprobs := seq.pendingLogprobs
+	seq.pendingLogprobs = nil
+
 	// Check if there are any partial UTF-8 characters remaining.
 	// We already check and queue as we are generating but some may
 	// still make it here:
@@ -289,12 +325,12 @@ func flushPending(seq *Sequence) bool {
 		joined = joined[:len(joined)-1]
 	}
 
-	if len(joined) == 0 {
+	if len(joined) == 0 && len(logprobs) == 0 {
 		return true
 	}
 
 	select {
-	case seq.responses <- joined:
+	case seq.responses <- response{content: joined, logprobs: logprobs}:
 		return true
 	case <-seq.quit:
 		return false
@@ -310,6 +346,7 @@ func (s *Server) removeSequence(seqIndex int, reason llm.DoneReason) {
 	close(seq.embedding)
 	seq.cache.InUse = false
 	s.seqs[seqIndex] = nil
+	s.updateUsage()
 	s.seqsSem.Release(1)
 }
 
@@ -365,6 +402,7 @@ func (s *Server) processBatch(tokenBatch *llama.Batch, embedBatch *llama.Batch)
 		s.cond.Wait() // Wait until an item is added
 	}
 	defer s.mu.Unlock()
+	defer s.updateUsage()
 
 	var batch *llama.Batch
 	crossAttention := false
@@ -384,6 +422,12 @@ func (s *Server) processBatch(tokenBatch *llama.Batch, embedBatch *llama.Batch)
 			continue
 		}
 
+		// embeddings are pooled over the whole sequence, so leave it for a
+		// later batch rather than splitting it if it doesn't fit
+		if seq.embeddingOnly && batch != nil && batch.NumTokens()+len(seq.inputs) > batch.Size() {
+			continue
+		}
+
 		for i, input := range seq.inputs {
 			if len(seq.cache.Inputs)+len(seq.pendingInputs)+1 > s.cache.numCtx {
 				if len(seq.pendingInputs) == 0 {
@@ -460,6 +504,10 @@ func (s *Server) processBatch(tokenBatch *llama.Batch, embedBatch *llama.Batch)
 
 		// After calling Decode, pending inputs are now in the cache
 		if len(seq.pendingInputs) > 0 {
+			if seq.numDecoded == 0 {
+				s.promptRate.Add(len(seq.pendingInputs))
+			}
+
 			seq.cache.Inputs = append(seq.cache.Inputs, seq.pendingInputs...)
 			seq.pendingInputs = []input{}
 		}
@@ -492,6 +540,7 @@ func (s *Server) processBatch(tokenBatch *llama.Batch, embedBatch *llama.Batch)
 		piece := s.model.TokenToPiece(token)
 
 		seq.numPredicted++
+		s.evalRate.Add(1)
 
 		// if it's an end of sequence token, break
 		if s.model.TokenIsEog(token) {
@@ -505,6 +554,13 @@ func (s *Server) processBatch(tokenBatch *llama.Batch, embedBatch *llama.Batch)
 
 		seq.inputs = []input{{token: token}}
 
+		if seq.logprobs {
+			logits := s.lc.GetLogitsIth(seq.iBatch)
+			seq.pendingLogprobs = append(seq.pendingLogprobs, common.Logprobs(logits, int32(token), seq.topLogprobs, func(id int32) string {
+				return s.model.TokenToPiece(int(id))
+			}))
+		}
+
 		seq.pendingResponses = append(seq.pendingResponses, piece)
 		sequence := strings.Join(seq.pendingResponses, "")
 
@@ -515,6 +571,9 @@ func (s *Server) processBatch(tokenBatch *llama.Batch, embedBatch *llama.Batch)
 			origLen := len(seq.pendingResponses)
 			seq.pendingResponses, tokenTruncated = common.TruncateStop(seq.pendingResponses, stop)
 			newLen := len(seq.pendingResponses)
+			if len(seq.pendingLogprobs) > newLen {
+				seq.pendingLogprobs = seq.pendingLogprobs[:newLen]
+			}
 
 			// Update the cache based on the tokens that will be returned:
 			// - We have 1 token more than is currently in the cache because
@@ -572,6 +631,28 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if req.N > 1 {
+		http.Error(w, "generating more than one completion (n > 1) is not supported by this model", http.StatusBadRequest)
+		return
+	}
+
+	logitBias, err := common.LogitBias(req.Options.LogitBias, s.model.NumVocab(), func(text string) ([]int32, error) {
+		tokens, err := s.model.Tokenize(text, false, true)
+		if err != nil {
+			return nil, err
+		}
+
+		ids := make([]int32, len(tokens))
+		for i, t := range tokens {
+			ids[i] = int32(t)
+		}
+		return ids, nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	// Extract options from the CompletionRequest
 	samplingParams := llama.SamplingParams{
 		TopK:           req.Options.TopK,
@@ -588,6 +669,7 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 		MirostatEta:    req.Options.MirostatEta,
 		Seed:           uint32(req.Options.Seed),
 		Grammar:        req.Grammar,
+		LogitBias:      logitBias,
 	}
 
 	seq, err := s.NewSequence(req.Prompt, req.Images, NewSequenceParams{
@@ -596,6 +678,8 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 		numKeep:        req.Options.NumKeep,
 		samplingParams: &samplingParams,
 		embedding:      false,
+		logprobs:       req.Logprobs,
+		topLogprobs:    req.TopLogprobs,
 	})
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to create new sequence: %v", err), http.StatusInternalServerError)
@@ -627,6 +711,7 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 			seq.crossAttention = s.image.NeedCrossAttention(seq.cache.Inputs...)
 
 			s.seqs[i] = seq
+			s.updateUsage()
 			s.cond.Signal()
 			found = true
 			break
@@ -645,10 +730,11 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 		case <-r.Context().Done():
 			close(seq.quit)
 			return
-		case content, ok := <-seq.responses:
+		case resp, ok := <-seq.responses:
 			if ok {
 				if err := json.NewEncoder(w).Encode(&llm.CompletionResponse{
-					Content: content,
+					Content:  resp.content,
+					Logprobs: resp.logprobs,
 				}); err != nil {
 					http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
 					close(seq.quit)
@@ -685,56 +771,91 @@ func (s *Server) embeddings(w http.ResponseWriter, r *http.Request) {
 
 	slog.Debug("embedding request", "content", req.Content)
 
-	seq, err := s.NewSequence(req.Content, nil, NewSequenceParams{embedding: true})
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to create new sequence: %v", err), http.StatusInternalServerError)
-		return
+	seqs := make([]*Sequence, len(req.Content))
+	for i, content := range req.Content {
+		seq, err := s.NewSequence(content, nil, NewSequenceParams{embedding: true})
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to create new sequence: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		seqs[i] = seq
 	}
 
-	// Ensure there is a place to put the sequence, released when removed from s.seqs
-	if err := s.seqsSem.Acquire(r.Context(), 1); err != nil {
-		if errors.Is(err, context.Canceled) {
-			slog.Info("aborting embeddings request due to client closing the connection")
-		} else {
-			http.Error(w, fmt.Sprintf("Failed to acquire semaphore: %v", err), http.StatusInternalServerError)
+	// Each input is its own sequence so its embedding is pooled separately.
+	// Sequences are added as soon as there is a free slot, which lets the
+	// batch loop pack as many of them as fit into each batch
+	for _, seq := range seqs {
+		// Ensure there is a place to put the sequence, released when removed from s.seqs
+		if err := s.seqsSem.Acquire(r.Context(), 1); err != nil {
+			if errors.Is(err, context.Canceled) {
+				slog.Info("aborting embeddings request due to client closing the connection")
+			} else {
+				http.Error(w, fmt.Sprintf("Failed to acquire semaphore: %v", err), http.StatusInternalServerError)
+			}
+			return
 		}
-		return
-	}
 
-	s.mu.Lock()
-	found := false
-	for i, sq := range s.seqs {
-		if sq == nil {
-			seq.cache, seq.inputs, err = s.cache.LoadCacheSlot(seq.inputs, false)
-			if err != nil {
-				s.mu.Unlock()
-				s.seqsSem.Release(1)
-				http.Error(w, fmt.Sprintf("Failed to load cache: %v", err), http.StatusInternalServerError)
-				return
+		s.mu.Lock()
+		found := false
+		for i, sq := range s.seqs {
+			if sq == nil {
+				var err error
+				seq.cache, seq.inputs, err = s.cache.LoadCacheSlot(seq.inputs, false)
+				if err != nil {
+					s.mu.Unlock()
+					s.seqsSem.Release(1)
+					http.Error(w, fmt.Sprintf("Failed to load cache: %v", err), http.StatusInternalServerError)
+					return
+				}
+				s.seqs[i] = seq
+				s.updateUsage()
+				s.cond.Signal()
+				found = true
+				break
 			}
-			s.seqs[i] = seq
-			s.cond.Signal()
-			found = true
-			break
 		}
-	}
-	s.mu.Unlock()
+		s.mu.Unlock()
 
-	if !found {
-		s.seqsSem.Release(1)
-		http.Error(w, "could not find an available sequence", http.StatusInternalServerError)
-		return
+		if !found {
+			s.seqsSem.Release(1)
+			http.Error(w, "could not find an available sequence", http.StatusInternalServerError)
+			return
+		}
 	}
 
-	embedding := <-seq.embedding
+	embeddings := make([][]float32, len(seqs))
+	for i, seq := range seqs {
+		embeddings[i] = <-seq.embedding
+	}
 
 	if err := json.NewEncoder(w).Encode(&llm.EmbeddingResponse{
-		Embedding: embedding,
+		Embedding: embeddings,
 	}); err != nil {
 		http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
 	}
 }
 
+func (s *Server) stats(w http.ResponseWriter, r *http.Request) {
+	s.ready.Wait()
+
+	// s.mu is held while batches are processed, which is when stats are
+	// most useful, so they are read without it
+	stats := llm.Stats{
+		Slots:                 len(s.cache.slots),
+		SlotsInUse:            int(s.slotsInUse.Load()),
+		ContextLength:         s.cache.numCtx * len(s.cache.slots),
+		ContextUsed:           int(s.contextUsed.Load()),
+		PromptTokensPerSecond: s.promptRate.Rate(),
+		TokensPerSecond:       s.evalRate.Rate(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&stats); err != nil {
+		http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+	}
+}
+
 func (s *Server) health(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(&llm.ServerStatusResponse{
@@ -905,6 +1026,7 @@ func Execute(args []string) error {
 	mux.HandleFunc("/embedding", server.embeddings)
 	mux.HandleFunc("/completion", server.completion)
 	mux.HandleFunc("/health", server.health)
+	mux.HandleFunc("/stats", server.stats)
 
 	httpServer := http.Server{
 		Handler: mux,
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log/slog"
 	"math"
+	"slices"
 	"time"
 
 	"github.com/ollama/ollama/kvcache"
@@ -29,6 +30,9 @@ type InputCache struct {
 	multiUserCache bool
 
 	cache kvcache.Cache
+
+	// disk saves shared prefixes so that they outlive the process, if enabled
+	disk *diskCache
 }
 
 func NewInputCache(model model.Model, kvCacheType string, kvSize int32, numSlots int, batchSize int, multiUserCache bool) (*InputCache, error) {
@@ -87,6 +91,10 @@ type InputCacheSlot struct {
 	// is this cache actively being processed as part of a sequence?
 	InUse bool
 
+	// is this cache reserved for a prefix that other slots copy from?
+	// Pinned slots are never evicted or loaded by sequences
+	Pinned bool
+
 	// last time this cache was used (as of start of processing)
 	lastUsed time.Time
 }
@@ -96,6 +104,10 @@ func (c *InputCache) LoadCacheSlot(prompt []input.Input) (*InputCacheSlot, []inp
 	var numPast int32
 	var err error
 
+	if c.disk != nil {
+		c.saveSharedPrefix(prompt)
+	}
+
 	// In single-user scenarios, the longest cache slot works fine for getting good input
 	// cache hit rates and it keeps the footprint of the cache small, which improves throughput.
 	// For multiple users, the "best" cache slot produces better input cache hit rates
@@ -112,6 +124,18 @@ func (c *InputCache) LoadCacheSlot(prompt []input.Input) (*InputCacheSlot, []inp
 	slot.InUse = true
 	slot.lastUsed = time.Now()
 
+	numPast = c.copyPinnedPrefix(slot, prompt, numPast)
+
+	if c.disk != nil {
+		if name, n := c.disk.match(prompt); n > numPast && n >= diskCacheMinInputs {
+			numPast, err = c.disk.restore(slot, name, prompt, n)
+			if err != nil {
+				slog.Warn("failed to restore prompt cache from disk", "file", name, "error", err)
+				numPast = 0
+			}
+		}
+	}
+
 	if numPast == int32(len(prompt)) {
 		// Leave one input to sample so we can get a response
 		numPast--
@@ -142,12 +166,176 @@ func (c *InputCache) LoadCacheSlot(prompt []input.Input) (*InputCacheSlot, []inp
 	return slot, prompt, nil
 }
 
+// saveSharedPrefix saves the longest prefix that prompt shares with one of the
+// slots to disk, if the two diverge after it. These are typically system
+// prompts that are common to many conversations
+func (c *InputCache) saveSharedPrefix(prompt []input.Input) {
+	var slot *InputCacheSlot
+	var shared int32
+	for i, s := range c.slots {
+		count := countCommonPrefix(s.Inputs, prompt)
+		if count > shared && count < int32(len(s.Inputs)) && count < int32(len(prompt)) {
+			slot = &c.slots[i]
+			shared = count
+		}
+	}
+
+	if slot == nil {
+		return
+	}
+
+	if err := c.disk.save(slot, shared); err != nil {
+		slog.Warn("failed to save prompt cache to disk", "id", slot.Id, "error", err)
+	}
+}
+
+// SavePending reports whether there are prompts still to be copied from the
+// cache to disk
+func (c *InputCache) SavePending() bool {
+	return c.disk != nil && len(c.disk.pending) > 0
+}
+
+// SaveNext copies the next part of the prompts being saved to disk from the
+// cache. It is called between batches so that saving a long prompt doesn't
+// hold up the sequences being processed
+func (c *InputCache) SaveNext() {
+	if c.disk != nil {
+		c.disk.next()
+	}
+}
+
+// SaveAll copies the prompts held by every slot from the cache so that they
+// are saved to disk, such as before the runner exits. WaitSaved waits for
+// them to be written
+func (c *InputCache) SaveAll() {
+	if c.disk == nil {
+		return
+	}
+
+	for i := range c.slots {
+		slot := &c.slots[i]
+		if err := c.disk.save(slot, int32(len(textTokens(slot.Inputs)))); err != nil {
+			slog.Warn("failed to save prompt cache to disk", "id", slot.Id, "error", err)
+		}
+	}
+
+	c.disk.flush()
+}
+
+// WaitSaved waits for the prompts being saved to disk to be written. Unlike
+// other operations on the cache, it doesn't require the lock to be held
+func (c *InputCache) WaitSaved() {
+	if c.disk != nil {
+		c.disk.wait()
+	}
+}
+
+// copyPinnedPrefix copies the longest prefix of prompt held by a pinned slot
+// into slot if it is longer than the numPast inputs that slot already has. It
+// returns the number of inputs that slot now has in common with prompt
+func (c *InputCache) copyPinnedPrefix(slot *InputCacheSlot, prompt []input.Input, numPast int32) int32 {
+	var pinned *InputCacheSlot
+	for i, s := range c.slots {
+		if !s.Pinned {
+			continue
+		}
+
+		if count := countCommonPrefix(s.Inputs, prompt); count > numPast {
+			pinned = &c.slots[i]
+			numPast = count
+		}
+	}
+
+	if pinned == nil {
+		return numPast
+	}
+
+	slog.Debug("copying pinned prefix", "src", pinned.Id, "dst", slot.Id, "inputs", numPast)
+
+	slot.Inputs = slices.Clone(pinned.Inputs[:numPast])
+	if c.cache != nil {
+		c.cache.CopyPrefix(pinned.Id, slot.Id, numPast)
+	}
+
+	return numPast
+}
+
+// Usage returns the number of slots in use by sequences and the number of
+// inputs stored across all slots
+func (c *InputCache) Usage() (inUse int, inputs int) {
+	for _, slot := range c.slots {
+		if slot.InUse {
+			inUse++
+		}
+
+		inputs += len(slot.Inputs)
+	}
+
+	return inUse, inputs
+}
+
+// PinnedSlots returns the slots that are currently pinned
+func (c *InputCache) PinnedSlots() []*InputCacheSlot {
+	var pinned []*InputCacheSlot
+	for i := range c.slots {
+		if c.slots[i].Pinned {
+			pinned = append(pinned, &c.slots[i])
+		}
+	}
+
+	return pinned
+}
+
+// UnpinCacheSlot returns a pinned slot to general use. Its inputs are kept
+// until it is evicted as usual
+func (c *InputCache) UnpinCacheSlot(id int) error {
+	if id < 0 || id >= len(c.slots) || !c.slots[id].Pinned {
+		return fmt.Errorf("no pinned cache slot with id %d", id)
+	}
+
+	c.slots[id].Pinned = false
+	c.slots[id].lastUsed = time.Now()
+
+	return nil
+}
+
+// ForkCacheSlot returns an unused slot holding the same inputs as src, so
+// that another sequence can continue from the same point without
+// processing them again
+func (c *InputCache) ForkCacheSlot(src *InputCacheSlot) (*InputCacheSlot, error) {
+	var slot *InputCacheSlot
+	for i, s := range c.slots {
+		if s.InUse || s.Pinned {
+			continue
+		}
+
+		if slot == nil || s.lastUsed.Before(slot.lastUsed) {
+			slot = &c.slots[i]
+		}
+	}
+
+	if slot == nil {
+		return nil, errors.New("no available cache slots")
+	}
+
+	slog.Debug("forking cache slot", "src", src.Id, "dst", slot.Id, "inputs", len(src.Inputs))
+
+	slot.InUse = true
+	slot.lastUsed = time.Now()
+	slot.Inputs = slices.Clone(src.Inputs)
+	if c.cache != nil {
+		c.cache.CopyPrefix(src.Id, slot.Id, int32(len(src.Inputs)))
+	}
+
+	return slot, nil
+}
+
 func (c *InputCache) findLongestCacheSlot(prompt []input.Input) (*InputCacheSlot, int32, error) {
 	longest := int32(-1)
 	var longestSlot *InputCacheSlot
 
 	for i, s := range c.slots {
-		if s.InUse {
+		if s.InUse || s.Pinned {
 			continue
 		}
 
@@ -179,17 +367,17 @@ func (c *InputCache) findBestCacheSlot(prompt []input.Input) (*InputCacheSlot, i
 			longestSlot = &c.slots[i]
 		}
 
-		if s.lastUsed.Compare(oldest) < 0 && !s.InUse {
+		if s.lastUsed.Compare(oldest) < 0 && !s.InUse && !s.Pinned {
 			oldest = s.lastUsed
 			oldestSlot = &c.slots[i]
 		}
 	}
 
-	if longest == int32(len(longestSlot.Inputs)) && !longestSlot.InUse {
+	if longest == int32(len(longestSlot.Inputs)) && !longestSlot.InUse && !longestSlot.Pinned {
 		return longestSlot, longest, nil
 	}
 
-	if oldestSlot.InUse {
+	if oldestSlot == nil || oldestSlot.InUse {
 		return nil, 0, errors.New("no available cache slots")
 	}
 
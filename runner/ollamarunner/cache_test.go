@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"image"
+	"reflect"
 	"testing"
 	"time"
 
@@ -429,6 +430,128 @@ func TestLoadCacheSlot(t *testing.T) {
 	}
 }
 
+func TestForkCacheSlot(t *testing.T) {
+	c := InputCache{
+		slots: []InputCacheSlot{
+			{Id: 0, Inputs: []input.Input{{Token: 1}, {Token: 2}}, InUse: true, lastUsed: time.Now()},
+			{Id: 1, Inputs: []input.Input{{Token: 5}}, lastUsed: time.Now().Add(-time.Second)},
+			{Id: 2, Inputs: []input.Input{{Token: 6}}, lastUsed: time.Now().Add(-2 * time.Second)},
+		},
+		cache: &mockCache{},
+	}
+
+	src := &c.slots[0]
+	slot, err := c.ForkCacheSlot(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the least recently used slot is replaced
+	if slot.Id != 2 {
+		t.Errorf("slot id = %d, want 2", slot.Id)
+	}
+
+	if !slot.InUse {
+		t.Error("slot not marked InUse")
+	}
+
+	if !reflect.DeepEqual(slot.Inputs, src.Inputs) {
+		t.Errorf("slot inputs = %v, want %v", slot.Inputs, src.Inputs)
+	}
+
+	// the inputs are independent of the source
+	slot.Inputs = append(slot.Inputs, input.Input{Token: 3})
+	if len(src.Inputs) != 2 {
+		t.Errorf("source inputs changed: %v", src.Inputs)
+	}
+
+	if _, err := c.ForkCacheSlot(src); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.ForkCacheSlot(src); err == nil {
+		t.Error("expected error when no slots are available")
+	}
+}
+
+func TestCacheUsage(t *testing.T) {
+	c := InputCache{
+		slots: []InputCacheSlot{
+			{Id: 0, Inputs: []input.Input{{Token: 1}, {Token: 2}}, InUse: true},
+			{Id: 1, Inputs: []input.Input{{Token: 5}}},
+			{Id: 2, Inputs: []input.Input{}},
+		},
+	}
+
+	inUse, inputs := c.Usage()
+	if inUse != 1 {
+		t.Errorf("in use = %d, want 1", inUse)
+	}
+
+	// idle slots still hold their inputs
+	if inputs != 3 {
+		t.Errorf("inputs = %d, want 3", inputs)
+	}
+}
+
+func TestPinnedCacheSlot(t *testing.T) {
+	for _, multiUser := range []bool{false, true} {
+		t.Run(fmt.Sprintf("multiuser=%v", multiUser), func(t *testing.T) {
+			c := InputCache{
+				slots: []InputCacheSlot{
+					{Id: 0, Inputs: []input.Input{{Token: 1}, {Token: 2}, {Token: 3}}, Pinned: true},
+					{Id: 1, Inputs: []input.Input{{Token: 1}, {Token: 5}}, lastUsed: time.Now().Add(-time.Second)},
+				},
+				multiUserCache: multiUser,
+				cache:          &mockCache{},
+			}
+
+			slot, remaining, err := c.LoadCacheSlot([]input.Input{{Token: 1}, {Token: 2}, {Token: 3}, {Token: 4}})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the pinned inputs are copied rather than used directly
+			if slot.Id != 1 {
+				t.Errorf("slot id = %d, want 1", slot.Id)
+			}
+
+			if !reflect.DeepEqual(slot.Inputs, []input.Input{{Token: 1}, {Token: 2}, {Token: 3}}) {
+				t.Errorf("slot inputs = %v, want the pinned prefix", slot.Inputs)
+			}
+
+			if !reflect.DeepEqual(remaining, []input.Input{{Token: 4}}) {
+				t.Errorf("remaining = %v, want [4]", remaining)
+			}
+
+			if len(c.slots[0].Inputs) != 3 {
+				t.Errorf("pinned slot inputs changed: %v", c.slots[0].Inputs)
+			}
+
+			// the pinned slot is never used for another sequence
+			if _, _, err := c.LoadCacheSlot([]input.Input{{Token: 1}, {Token: 2}}); err == nil {
+				t.Error("expected error when only the pinned slot is free")
+			}
+
+			if _, err := c.ForkCacheSlot(slot); err == nil {
+				t.Error("expected error forking into the pinned slot")
+			}
+
+			if err := c.UnpinCacheSlot(1); err == nil {
+				t.Error("expected error unpinning a slot that isn't pinned")
+			}
+
+			if err := c.UnpinCacheSlot(0); err != nil {
+				t.Fatal(err)
+			}
+
+			if len(c.PinnedSlots()) != 0 {
+				t.Errorf("pinned slots = %v, want none", c.PinnedSlots())
+			}
+		})
+	}
+}
+
 // Mock implementation of the Cache interface
 type mockCache struct {
 	shouldFail bool
@@ -0,0 +1,415 @@
+package ollamarunner
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/ollama/ollama/kvcache"
+	"github.com/ollama/ollama/model/input"
+)
+
+const (
+	// diskCacheMinInputs is the shortest prefix that is saved to disk, as
+	// shorter ones are quick to process again
+	diskCacheMinInputs = 256
+
+	// diskCacheMaxEntries is the number of prefixes kept on disk for each
+	// model, beyond which the least recently used are removed
+	diskCacheMaxEntries = 16
+)
+
+// diskCache saves prefixes of cache slots to disk so that they can be restored
+// after the model is reloaded rather than being processed again. Each prefix
+// is stored in its own file, named by the hash of its tokens, in a directory
+// for the model. Prefixes are copied from the cache a layer at a time between
+// batches and written in the background so that saving doesn't hold up the
+// sequences being processed
+type diskCache struct {
+	dir   string
+	cache kvcache.Snapshotter
+
+	// mu protects entries and saving, which saves update when they finish
+	mu sync.Mutex
+
+	// entries maps the name of each file to the tokens it holds
+	entries map[string][]int32
+
+	// saving is the names of the files being copied or written
+	saving map[string]bool
+
+	// pending holds the prefixes being copied from the cache. Like the
+	// slots, it is protected by the lock held for operations on the cache
+	pending []*pendingSave
+
+	// wg waits for the files being written
+	wg sync.WaitGroup
+}
+
+// pendingSave is a prefix of a slot that is being copied from the cache
+type pendingSave struct {
+	slot     *InputCacheSlot
+	name     string
+	tokens   []int32
+	snapshot kvcache.Snapshot
+	start    time.Time
+}
+
+func newDiskCache(dir string, cache kvcache.Cache) (*diskCache, error) {
+	snapshotter, ok := cache.(kvcache.Snapshotter)
+	if !ok {
+		return nil, errors.New("model cache cannot be saved to disk")
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &diskCache{
+		dir:     dir,
+		cache:   snapshotter,
+		entries: make(map[string][]int32),
+		saving:  make(map[string]bool),
+	}
+
+	for _, file := range files {
+		if !file.Type().IsRegular() {
+			continue
+		}
+
+		// left behind by a save that was interrupted
+		if filepath.Ext(file.Name()) == ".tmp" {
+			os.Remove(filepath.Join(dir, file.Name()))
+			continue
+		}
+
+		f, err := os.Open(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		tokens, err := readTokens(bufio.NewReader(f))
+		f.Close()
+		if err != nil {
+			slog.Warn("skipping invalid prompt cache file", "file", file.Name(), "error", err)
+			continue
+		}
+
+		d.entries[file.Name()] = tokens
+	}
+
+	slog.Debug("loaded prompt cache index", "dir", dir, "entries", len(d.entries))
+
+	return d, nil
+}
+
+func diskCacheName(tokens []int32) string {
+	h := sha256.New()
+	binary.Write(h, binary.LittleEndian, tokens)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// textTokens returns the tokens of inputs up to the first multimodal input
+func textTokens(inputs []input.Input) []int32 {
+	tokens := make([]int32, 0, len(inputs))
+	for _, inp := range inputs {
+		if inp.Multimodal != nil || inp.MultimodalHash != 0 {
+			break
+		}
+
+		tokens = append(tokens, inp.Token)
+	}
+
+	return tokens
+}
+
+// match returns the file that shares the longest prefix with prompt, and the
+// length of the prefix
+func (d *diskCache) match(prompt []input.Input) (string, int32) {
+	tokens := textTokens(prompt)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var name string
+	var longest int32
+	for n, entry := range d.entries {
+		var count int32
+		for int(count) < len(entry) && int(count) < len(tokens) && entry[count] == tokens[count] {
+			count++
+		}
+
+		if count > longest {
+			name = n
+			longest = count
+		}
+	}
+
+	return name, longest
+}
+
+// save starts saving the first n inputs of a cache slot to disk, unless they
+// are already saved or cannot be restored from the tokens alone. The inputs
+// are copied from the cache by calls to next and then written to disk in the
+// background
+func (d *diskCache) save(slot *InputCacheSlot, n int32) error {
+	tokens := textTokens(slot.Inputs[:n])
+	if len(tokens) < int(n) || n < diskCacheMinInputs {
+		return nil
+	}
+
+	name := diskCacheName(tokens)
+
+	d.mu.Lock()
+	if _, ok := d.entries[name]; ok || d.saving[name] {
+		d.mu.Unlock()
+		return nil
+	}
+	d.saving[name] = true
+	d.mu.Unlock()
+
+	snapshot, err := d.cache.Snapshot(slot.Id, n)
+	if err != nil {
+		d.finish(name, nil)
+		return err
+	}
+
+	d.pending = append(d.pending, &pendingSave{
+		slot:     slot,
+		name:     name,
+		tokens:   tokens,
+		snapshot: snapshot,
+		start:    time.Now(),
+	})
+
+	return nil
+}
+
+// next copies the next part of the first prefix being saved from the cache,
+// writing it to disk in the background once all of it has been copied. It
+// returns whether there are still prefixes to copy
+func (d *diskCache) next() bool {
+	if len(d.pending) == 0 {
+		return false
+	}
+
+	p := d.pending[0]
+
+	// the slot may have been given a different prompt since the prefix was
+	// found, in which case the cache no longer holds it
+	n := len(p.tokens)
+	if len(p.slot.Inputs) < n || !slices.Equal(textTokens(p.slot.Inputs[:n]), p.tokens) {
+		slog.Debug("prompt cache changed before it was saved to disk", "id", p.slot.Id, "file", p.name)
+		d.pending = d.pending[1:]
+		d.finish(p.name, nil)
+		return len(d.pending) > 0
+	}
+
+	done, err := p.snapshot.Next()
+	if err != nil {
+		slog.Warn("failed to save prompt cache to disk", "id", p.slot.Id, "error", err)
+		d.pending = d.pending[1:]
+		d.finish(p.name, nil)
+		return len(d.pending) > 0
+	}
+
+	if !done {
+		return true
+	}
+
+	d.pending = d.pending[1:]
+
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+
+		if err := d.write(p.name, func(w io.Writer) error {
+			if err := writeTokens(w, p.tokens); err != nil {
+				return err
+			}
+
+			return p.snapshot.Save(w)
+		}); err != nil {
+			slog.Warn("failed to save prompt cache to disk", "id", p.slot.Id, "error", err)
+			d.finish(p.name, nil)
+			return
+		}
+
+		slog.Debug("saved prompt cache to disk", "id", p.slot.Id, "inputs", n, "file", p.name, "duration", time.Since(p.start))
+		d.finish(p.name, p.tokens)
+	}()
+
+	return len(d.pending) > 0
+}
+
+// flush copies all of the prefixes being saved from the cache
+func (d *diskCache) flush() {
+	for d.next() {
+	}
+}
+
+// write atomically writes the file with the given name, with the contents
+// written by fn
+func (d *diskCache) write(name string, fn func(io.Writer) error) error {
+	f, err := os.CreateTemp(d.dir, name+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	bw := bufio.NewWriter(f)
+	if err := fn(bw); err != nil {
+		return err
+	}
+
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), filepath.Join(d.dir, name))
+}
+
+// finish records the tokens of a file that has been saved, or nil if saving
+// it failed
+func (d *diskCache) finish(name string, tokens []int32) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.saving, name)
+	if tokens != nil {
+		d.entries[name] = tokens
+		d.prune()
+	}
+}
+
+// wait waits for the files being written to be saved
+func (d *diskCache) wait() {
+	d.wg.Wait()
+}
+
+// restore replaces the contents of a cache slot with a file from disk, of which
+// the first shared inputs are the start of prompt. Any entries after them are
+// left for the caller to remove
+func (d *diskCache) restore(slot *InputCacheSlot, name string, prompt []input.Input, shared int32) (int32, error) {
+	start := time.Now()
+	path := filepath.Join(d.dir, name)
+
+	d.mu.Lock()
+	want := int32(len(d.entries[name]))
+	d.mu.Unlock()
+
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	if _, err := readTokens(r); err != nil {
+		return 0, err
+	}
+
+	n, err := d.cache.Load(r, slot.Id)
+	if err != nil {
+		return 0, err
+	}
+
+	if n != want {
+		return 0, fmt.Errorf("prompt cache file has %v entries, expected %v", n, want)
+	}
+
+	// mark the file as recently used
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); err != nil {
+		slog.Debug("failed to update prompt cache file time", "file", name, "error", err)
+	}
+
+	slot.Inputs = slices.Clone(prompt[:shared])
+	slog.Debug("restored prompt cache from disk", "id", slot.Id, "inputs", shared, "file", name, "duration", time.Since(start))
+
+	return shared, nil
+}
+
+// prune removes the least recently used files beyond diskCacheMaxEntries.
+// d.mu must be held
+func (d *diskCache) prune() {
+	if len(d.entries) <= diskCacheMaxEntries {
+		return
+	}
+
+	type entry struct {
+		name    string
+		modTime time.Time
+	}
+
+	var entries []entry
+	for name := range d.entries {
+		fi, err := os.Stat(filepath.Join(d.dir, name))
+		if err != nil {
+			delete(d.entries, name)
+			continue
+		}
+
+		entries = append(entries, entry{name, fi.ModTime()})
+	}
+
+	slices.SortFunc(entries, func(a, b entry) int {
+		return a.modTime.Compare(b.modTime)
+	})
+
+	for _, e := range entries[:max(0, len(entries)-diskCacheMaxEntries)] {
+		slog.Debug("removing prompt cache file", "file", e.name)
+		if err := os.Remove(filepath.Join(d.dir, e.name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("failed to remove prompt cache file", "file", e.name, "error", err)
+		}
+
+		delete(d.entries, e.name)
+	}
+}
+
+func writeTokens(w io.Writer, tokens []int32) error {
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(tokens))); err != nil {
+		return err
+	}
+
+	return binary.Write(w, binary.LittleEndian, tokens)
+}
+
+func readTokens(r io.Reader) ([]int32, error) {
+	var n uint32
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return nil, err
+	}
+
+	if n > math.MaxInt32/4 {
+		return nil, fmt.Errorf("invalid number of tokens: %v", n)
+	}
+
+	tokens := make([]int32, n)
+	if err := binary.Read(r, binary.LittleEndian, tokens); err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
@@ -0,0 +1,230 @@
+package ollamarunner
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"slices"
+	"testing"
+
+	"github.com/ollama/ollama/kvcache"
+	"github.com/ollama/ollama/model/input"
+)
+
+// snapshotCache stores only the number of entries in a snapshot, which is
+// copied in two steps
+type snapshotCache struct {
+	mockCache
+	loaded map[int]int32
+}
+
+type snapshot struct {
+	len   int32
+	steps int
+}
+
+func (c *snapshotCache) Snapshot(seq int, len int32) (kvcache.Snapshot, error) {
+	return &snapshot{len: len}, nil
+}
+
+func (s *snapshot) Next() (bool, error) {
+	s.steps++
+	return s.steps == 2, nil
+}
+
+func (s *snapshot) Save(w io.Writer) error {
+	if s.steps < 2 {
+		return errors.New("incomplete snapshot")
+	}
+
+	return binary.Write(w, binary.LittleEndian, s.len)
+}
+
+func (c *snapshotCache) Load(r io.Reader, seq int) (int32, error) {
+	var n int32
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return 0, err
+	}
+
+	c.loaded[seq] = n
+	return n, nil
+}
+
+func tokenInputs(tokens ...[]int32) []input.Input {
+	var inputs []input.Input
+	for _, t := range slices.Concat(tokens...) {
+		inputs = append(inputs, input.Input{Token: t})
+	}
+
+	return inputs
+}
+
+func TestDiskCache(t *testing.T) {
+	dir := t.TempDir()
+
+	system := make([]int32, diskCacheMinInputs+10)
+	for i := range system {
+		system[i] = int32(i)
+	}
+
+	newCache := func() (*InputCache, *snapshotCache) {
+		sc := &snapshotCache{loaded: make(map[int]int32)}
+
+		disk, err := newDiskCache(dir, sc)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return &InputCache{
+			numCtx:  1000,
+			enabled: true,
+			slots:   []InputCacheSlot{{Id: 0}, {Id: 1}},
+			cache:   sc,
+			disk:    disk,
+		}, sc
+	}
+
+	c, _ := newCache()
+	c.slots[0].Inputs = tokenInputs(system, []int32{1000, 1001})
+
+	// continuing the same conversation doesn't save anything
+	if _, _, err := c.LoadCacheSlot(tokenInputs(system, []int32{1000, 1001, 1002})); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.SavePending() {
+		t.Fatal("expected nothing to save")
+	}
+
+	if len(c.disk.entries) != 0 {
+		t.Fatalf("saved %d entries, want 0", len(c.disk.entries))
+	}
+
+	c.slots[0].InUse = false
+	c.slots[1].Inputs = tokenInputs(system[:10], []int32{1000})
+
+	// a new conversation with the same system prompt saves the prefix,
+	// but not the short one shared with the other slot
+	if _, _, err := c.LoadCacheSlot(tokenInputs(system, []int32{2000})); err != nil {
+		t.Fatal(err)
+	}
+
+	// the prefix is copied from the cache between batches, and only
+	// written once all of it has been copied
+	for c.SavePending() {
+		c.SaveNext()
+	}
+	c.WaitSaved()
+
+	if name, n := c.disk.match(tokenInputs(system, []int32{3000})); name != diskCacheName(system) || n != int32(len(system)) {
+		t.Fatalf("match = %v, %v, want %v, %v", name, n, diskCacheName(system), len(system))
+	}
+
+	if len(c.disk.entries) != 1 {
+		t.Fatalf("saved %d entries, want 1", len(c.disk.entries))
+	}
+
+	// after a restart, the saved prefix is restored
+	c, sc := newCache()
+	slot, remaining, err := c.LoadCacheSlot(tokenInputs(system, []int32{3000, 3001}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sc.loaded[slot.Id] != int32(len(system)) {
+		t.Errorf("loaded %v entries, want %v", sc.loaded[slot.Id], len(system))
+	}
+
+	if !slices.Equal(remaining, tokenInputs([]int32{3000, 3001})) {
+		t.Errorf("remaining prompt = %v, want [3000 3001]", remaining)
+	}
+
+	if !slices.Equal(slot.Inputs, tokenInputs(system)) {
+		t.Errorf("slot has %d inputs, want %d", len(slot.Inputs), len(system))
+	}
+
+	// prompts that don't start with the prefix don't use it
+	c, sc = newCache()
+	if _, _, err := c.LoadCacheSlot(tokenInputs(system[1:])); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sc.loaded) != 0 {
+		t.Errorf("loaded %v, want nothing", sc.loaded)
+	}
+}
+
+func TestDiskCacheSaveAll(t *testing.T) {
+	dir := t.TempDir()
+
+	system := make([]int32, diskCacheMinInputs+10)
+	for i := range system {
+		system[i] = int32(i)
+	}
+
+	newCache := func() (*InputCache, *snapshotCache) {
+		sc := &snapshotCache{loaded: make(map[int]int32)}
+
+		disk, err := newDiskCache(dir, sc)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return &InputCache{
+			numCtx:  1000,
+			enabled: true,
+			slots:   []InputCacheSlot{{Id: 0}, {Id: 1}},
+			cache:   sc,
+			disk:    disk,
+		}, sc
+	}
+
+	// a single conversation is saved when the runner exits
+	c, _ := newCache()
+	c.slots[0].Inputs = tokenInputs(system, []int32{1000, 1001})
+	c.SaveAll()
+	c.WaitSaved()
+
+	if len(c.disk.entries) != 1 {
+		t.Fatalf("saved %d entries, want 1", len(c.disk.entries))
+	}
+
+	// a new conversation with the same system prompt restores the part of
+	// the saved conversation that it shares
+	c, sc := newCache()
+	slot, remaining, err := c.LoadCacheSlot(tokenInputs(system, []int32{2000}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sc.loaded[slot.Id] != int32(len(system)+2) {
+		t.Errorf("loaded %v entries, want %v", sc.loaded[slot.Id], len(system)+2)
+	}
+
+	if !slices.Equal(remaining, tokenInputs([]int32{2000})) {
+		t.Errorf("remaining prompt = %v, want [2000]", remaining)
+	}
+
+	if !slices.Equal(slot.Inputs, tokenInputs(system)) {
+		t.Errorf("slot has %d inputs, want %d", len(slot.Inputs), len(system))
+	}
+
+	// a prefix isn't saved if its slot is given another prompt before it
+	// has been copied
+	c, _ = newCache()
+	c.slots[0].Inputs = tokenInputs(system[1:])
+	if err := c.disk.save(&c.slots[0], int32(len(system)-1)); err != nil {
+		t.Fatal(err)
+	}
+
+	c.SaveNext()
+	c.slots[0].Inputs = tokenInputs([]int32{3000})
+	for c.SavePending() {
+		c.SaveNext()
+	}
+	c.WaitSaved()
+
+	if len(c.disk.entries) != 1 {
+		t.Fatalf("saved %d entries, want 1", len(c.disk.entries))
+	}
+}
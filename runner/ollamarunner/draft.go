@@ -0,0 +1,306 @@
+package ollamarunner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+
+	"github.com/ollama/ollama/kvcache"
+	"github.com/ollama/ollama/ml"
+	"github.com/ollama/ollama/model"
+	"github.com/ollama/ollama/model/input"
+)
+
+// draft proposes tokens for speculative decoding using a smaller model that
+// shares the vocabulary of the target model. The target model then checks
+// all of the proposed tokens in a single batch rather than generating them
+// one at a time
+type draft struct {
+	model     model.Model
+	cache     kvcache.Cache
+	numCtx    int32
+	batchSize int
+
+	// numDraft is the maximum number of tokens proposed at a time
+	numDraft int
+
+	// inputs holds the tokens stored in the cache for each slot
+	inputs [][]int32
+}
+
+func newDraft(ctx context.Context, mpath string, params ml.BackendParams, target model.Model, kvCacheType string, numCtx int32, numSlots, batchSize, numDraft int) (*draft, error) {
+	if numDraft < 1 {
+		return nil, fmt.Errorf("number of draft tokens must be at least 1 (got %d)", numDraft)
+	}
+
+	m, err := model.New(ctx, mpath, params)
+	if err != nil {
+		return nil, err
+	}
+
+	tp, ok := m.(model.TextProcessor)
+	if !ok {
+		return nil, errors.New("draft model is not a text model")
+	}
+
+	if !slices.Equal(tp.Vocabulary().Values, target.(model.TextProcessor).Vocabulary().Values) {
+		return nil, errors.New("draft model vocabulary does not match the model")
+	}
+
+	cache := m.Config().Cache
+	if cache == nil {
+		return nil, errors.New("draft model does not support caching")
+	}
+	cache.Init(m.Backend(), kvCacheTypeFromStr(kvCacheType), numSlots, int(numCtx), batchSize)
+
+	d := &draft{
+		model:     m,
+		cache:     cache,
+		numCtx:    numCtx,
+		batchSize: batchSize,
+		numDraft:  numDraft,
+		inputs:    make([][]int32, numSlots),
+	}
+
+	if err := reserveWorstCaseGraph(m, batchSize, numSlots); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// proposal drafts tokens continuing the text in a cache slot
+type proposal struct {
+	slot int
+
+	// inputs are all of the tokens in the slot, ending with the next input
+	// to the target model
+	inputs []int32
+
+	// n is the number of tokens to propose
+	n int
+
+	// tokens are the proposed tokens
+	tokens []int32
+}
+
+// propose fills in the tokens of each proposal, greedily sampling from the
+// draft model. The tokens already in the draft cache are reused as far as
+// they match the inputs of the proposal
+func (d *draft) propose(ps []*proposal) error {
+	// pending holds the tokens of each proposal that have yet to be
+	// evaluated by the draft model
+	pending := make([][]int32, len(ps))
+	for i, p := range ps {
+		cached := d.inputs[p.slot]
+
+		// the last input is always evaluated to get its logits
+		n := min(countCommonTokens(cached, p.inputs), len(p.inputs)-1)
+		if n < len(cached) {
+			if err := d.cache.Remove(p.slot, int32(n), math.MaxInt32); err != nil {
+				if err := d.cache.Remove(p.slot, 0, math.MaxInt32); err != nil {
+					return err
+				}
+				n = 0
+			}
+		}
+
+		d.inputs[p.slot] = cached[:n]
+		pending[i] = p.inputs[n:]
+	}
+
+	for {
+		var tokens []int32
+		var batch input.Batch
+
+		// the proposal that each output belongs to
+		var outputs []int
+		for i, p := range ps {
+			if len(pending[i]) == 0 {
+				continue
+			}
+
+			take := min(len(pending[i]), d.batchSize-len(tokens))
+			if take == 0 {
+				break
+			}
+
+			for _, t := range pending[i][:take] {
+				tokens = append(tokens, t)
+				batch.Positions = append(batch.Positions, int32(len(d.inputs[p.slot])))
+				batch.Sequences = append(batch.Sequences, p.slot)
+				d.inputs[p.slot] = append(d.inputs[p.slot], t)
+			}
+
+			pending[i] = pending[i][take:]
+			if len(pending[i]) == 0 {
+				batch.Outputs = append(batch.Outputs, int32(len(tokens)-1))
+				outputs = append(outputs, i)
+			}
+		}
+
+		if len(tokens) == 0 {
+			return nil
+		}
+
+		logits, err := d.forward(tokens, batch)
+		if err != nil {
+			return err
+		}
+
+		vocabSize := len(logits) / len(batch.Outputs)
+		for o, i := range outputs {
+			p := ps[i]
+			token := argmax(logits[o*vocabSize : (o+1)*vocabSize])
+			p.tokens = append(p.tokens, token)
+
+			// the last proposed token is left for the target model
+			// to evaluate
+			if len(p.tokens) < p.n {
+				pending[i] = []int32{token}
+			}
+		}
+	}
+}
+
+func (d *draft) forward(tokens []int32, batch input.Batch) ([]float32, error) {
+	ctx := d.model.Backend().NewContext()
+	defer ctx.Close()
+
+	t, err := model.Forward(ctx, d.model, tokens, batch)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode draft batch: %w", err)
+	}
+
+	return t.Floats(), nil
+}
+
+func countCommonTokens(a, b []int32) int {
+	var n int
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+
+	return n
+}
+
+func argmax(logits []float32) int32 {
+	var best int
+	for i, l := range logits {
+		if l > logits[best] {
+			best = i
+		}
+	}
+
+	return int32(best)
+}
+
+// propose drafts tokens for the sequences that are generating. The drafted
+// tokens are added to the inputs of each sequence so that they are evaluated
+// in the same batch as its next input
+func (s *Server) propose() error {
+	var ps []*proposal
+	var seqs []*Sequence
+	for _, seq := range s.seqs {
+		// only sequences with a single sampled token left to evaluate
+		// are generating
+		if seq == nil || seq.embeddingOnly || seq.numPredicted == 0 || len(seq.inputs) != 1 || len(seq.draft) > 0 {
+			continue
+		}
+
+		// the drafted tokens and the token sampled after them must fit
+		// in both the context and the number of tokens to predict
+		n := min(s.draft.numDraft, int(s.cache.numCtx)-len(seq.cache.Inputs)-1)
+		if seq.numPredict > 0 {
+			n = min(n, seq.numPredict-seq.numPredicted-1)
+		}
+
+		if n < 1 {
+			continue
+		}
+
+		inputs := make([]int32, 0, len(seq.cache.Inputs)+1)
+		for _, inp := range slices.Concat(seq.cache.Inputs, seq.inputs) {
+			// the draft model only handles text
+			if inp.Multimodal != nil {
+				inputs = nil
+				break
+			}
+
+			inputs = append(inputs, inp.Token)
+		}
+
+		if inputs == nil {
+			continue
+		}
+
+		ps = append(ps, &proposal{slot: seq.cache.Id, inputs: inputs, n: n})
+		seqs = append(seqs, seq)
+	}
+
+	if len(ps) == 0 {
+		return nil
+	}
+
+	if err := s.draft.propose(ps); err != nil {
+		return err
+	}
+
+	for i, seq := range seqs {
+		seq.draft = ps[i].tokens
+
+		// the target model must see all of the drafted tokens at once
+		seq.inputs[0].SameBatch = len(seq.draft)
+		for _, t := range seq.draft {
+			seq.inputs = append(seq.inputs, input.Input{Token: t})
+		}
+	}
+
+	return nil
+}
+
+// verify samples a token from each of the outputs of seq, which are for its
+// last sampled token followed by the drafted tokens. Drafted tokens are
+// accepted as long as they match what was sampled and the rest are removed
+// from the cache. Since each token is sampled from the target model, the
+// output is the same as without a draft model
+func (s *Server) verify(i int, seq *Sequence, logits []float32, vocabSize int) error {
+	drafted := seq.draft
+	seq.draft = nil
+
+	// inputs holds the drafted tokens, which are kept only once accepted
+	inputs := seq.cache.Inputs
+	base := len(inputs) - len(drafted)
+
+	for j := 0; j <= len(drafted); j++ {
+		seq.cache.Inputs = inputs[:base+j]
+		if err := s.sample(i, seq, logits[j*vocabSize:(j+1)*vocabSize]); err != nil {
+			return err
+		}
+
+		// the sequence has finished
+		if s.seqs[i] != seq {
+			break
+		}
+
+		if j == len(drafted) || seq.inputs[0].Token != drafted[j] {
+			break
+		}
+	}
+
+	if err := s.cache.cache.Remove(seq.cache.Id, int32(len(seq.cache.Inputs)), math.MaxInt32); err != nil {
+		if err := s.cache.cache.Remove(seq.cache.Id, 0, math.MaxInt32); err != nil {
+			return err
+		}
+
+		// evaluate everything again
+		if s.seqs[i] == seq {
+			seq.inputs = append(seq.cache.Inputs, seq.inputs...)
+		}
+		seq.cache.Inputs = []input.Input{}
+	}
+
+	return nil
+}
@@ -0,0 +1,139 @@
+package ollamarunner
+
+import (
+	"slices"
+	"strconv"
+	"testing"
+
+	"golang.org/x/sync/semaphore"
+
+	"github.com/ollama/ollama/ml"
+	"github.com/ollama/ollama/model"
+	"github.com/ollama/ollama/model/input"
+	"github.com/ollama/ollama/sample"
+)
+
+// testModel decodes each token to its id. Token 0 is the end of sequence
+type testModel struct {
+	model.Base
+}
+
+func (testModel) Forward(ml.Context, input.Batch) (ml.Tensor, error) { return nil, nil }
+
+func (testModel) Encode(s string, addSpecial bool) ([]int32, error) { return nil, nil }
+
+func (testModel) Decode(ids []int32) (string, error) {
+	var s string
+	for _, id := range ids {
+		s += strconv.Itoa(int(id))
+	}
+	return s, nil
+}
+
+func (testModel) Is(id int32, special model.Special) bool {
+	return special == model.SpecialEOS && id == 0
+}
+
+func (testModel) Vocabulary() *model.Vocabulary { return &model.Vocabulary{} }
+
+func TestVerify(t *testing.T) {
+	const vocabSize = 10
+
+	tests := []struct {
+		name    string
+		drafted []int32
+
+		// sampled is the most likely token at each output
+		sampled []int32
+
+		wantInputs []int32
+		wantNext   int32
+		wantDone   bool
+	}{
+		{
+			name:       "all accepted",
+			drafted:    []int32{5, 6},
+			sampled:    []int32{5, 6, 7},
+			wantInputs: []int32{1, 2, 3, 5, 6},
+			wantNext:   7,
+		},
+		{
+			name:       "partially accepted",
+			drafted:    []int32{5, 6, 7},
+			sampled:    []int32{5, 9, 7, 8},
+			wantInputs: []int32{1, 2, 3, 5},
+			wantNext:   9,
+		},
+		{
+			name:       "rejected",
+			drafted:    []int32{5, 6},
+			sampled:    []int32{4, 6, 7},
+			wantInputs: []int32{1, 2, 3},
+			wantNext:   4,
+		},
+		{
+			name:       "end of sequence",
+			drafted:    []int32{5, 6},
+			sampled:    []int32{5, 0, 7},
+			wantInputs: []int32{1, 2, 3, 5},
+			wantDone:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var inputs []input.Input
+			for _, token := range slices.Concat([]int32{1, 2, 3}, tt.drafted) {
+				inputs = append(inputs, input.Input{Token: token})
+			}
+
+			seq := &Sequence{
+				draft:        tt.drafted,
+				cache:        &InputCacheSlot{Inputs: inputs, InUse: true},
+				responses:    make(chan response, 100),
+				quit:         make(chan bool, 1),
+				embedding:    make(chan []float32, 1),
+				sampler:      sample.NewSampler(sample.Options{}),
+				numPredicted: 1,
+			}
+
+			s := &Server{
+				model:   &testModel{},
+				cache:   &InputCache{cache: &mockCache{}},
+				seqs:    []*Sequence{seq},
+				seqsSem: semaphore.NewWeighted(1),
+			}
+			_ = s.seqsSem.Acquire(t.Context(), 1)
+
+			logits := make([]float32, len(tt.sampled)*vocabSize)
+			for i, token := range tt.sampled {
+				logits[i*vocabSize+int(token)] = 1
+			}
+
+			if err := s.verify(0, seq, logits, vocabSize); err != nil {
+				t.Fatal(err)
+			}
+
+			var got []int32
+			for _, inp := range seq.cache.Inputs {
+				got = append(got, inp.Token)
+			}
+
+			if !slices.Equal(got, tt.wantInputs) {
+				t.Errorf("cache inputs = %v, want %v", got, tt.wantInputs)
+			}
+
+			if done := s.seqs[0] == nil; done != tt.wantDone {
+				t.Fatalf("done = %v, want %v", done, tt.wantDone)
+			}
+
+			if !tt.wantDone && seq.inputs[0].Token != tt.wantNext {
+				t.Errorf("next input = %d, want %d", seq.inputs[0].Token, tt.wantNext)
+			}
+
+			if seq.draft != nil {
+				t.Errorf("draft = %v, want nil", seq.draft)
+			}
+		})
+	}
+}
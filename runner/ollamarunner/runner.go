@@ -15,9 +15,11 @@ import (
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unicode/utf8"
 
@@ -55,11 +57,14 @@ type Sequence struct {
 	// tokens that have been generated but not returned yet (e.g. for stop sequences)
 	pendingResponses []string
 
+	// log probabilities of the tokens in pendingResponses, if requested
+	pendingLogprobs []api.Logprob
+
 	// input cache being used by this sequence
 	cache *InputCacheSlot
 
 	// channel to send responses over
-	responses chan string
+	responses chan response
 
 	// channel to stop decoding (such as if the remote connection is closed)
 	quit chan bool
@@ -70,6 +75,17 @@ type Sequence struct {
 	// sampler with transforms to run on generated logits
 	sampler sample.Sampler
 
+	// index of this completion when a request generates several
+	index int
+
+	// additional completions of the same prompt, started once the
+	// prompt has been processed
+	forks []*Sequence
+
+	// tokens proposed by the draft model that follow the last sampled
+	// token in inputs
+	draft []int32
+
 	// channel to send back the embedding if embedding only
 	embedding chan []float32
 
@@ -82,8 +98,21 @@ type Sequence struct {
 	// true if an embedding are to be returned instead of text generation
 	embeddingOnly bool
 
+	// true if the prompt is processed to be pinned in its cache slot
+	// rather than to generate text
+	pin bool
+
+	// return log probabilities of generated tokens and the given
+	// number of most likely alternatives
+	logprobs    bool
+	topLogprobs int
+
 	doneReason llm.DoneReason
 
+	// err is set if the sequence ended because it failed rather than
+	// finishing
+	err error
+
 	// Metrics
 	startProcessingTime time.Time
 	startGenerationTime time.Time
@@ -91,12 +120,21 @@ type Sequence struct {
 	numPromptInputs     int
 }
 
+// response is generated text along with its log probabilities
+type response struct {
+	content  string
+	logprobs []api.Logprob
+}
+
 type NewSequenceParams struct {
-	numPredict int
-	stop       []string
-	numKeep    int32
-	sampler    sample.Sampler
-	embedding  bool
+	numPredict  int
+	stop        []string
+	numKeep     int32
+	sampler     sample.Sampler
+	embedding   bool
+	pin         bool
+	logprobs    bool
+	topLogprobs int
 }
 
 func (s *Server) NewSequence(prompt string, images []llm.ImageData, params NewSequenceParams) (*Sequence, error) {
@@ -119,6 +157,10 @@ func (s *Server) NewSequence(prompt string, images []llm.ImageData, params NewSe
 	params.numKeep = min(params.numKeep, s.cache.numCtx-1)
 
 	if int32(len(inputs)) > s.cache.numCtx {
+		if params.pin {
+			return nil, fmt.Errorf("prompt to pin (%d inputs) exceeds the context size (%d)", len(inputs), s.cache.numCtx)
+		}
+
 		discard := int32(len(inputs)) - s.cache.numCtx
 		promptStart := params.numKeep + discard
 
@@ -156,6 +198,11 @@ func (s *Server) NewSequence(prompt string, images []llm.ImageData, params NewSe
 	}
 
 	// TODO(jessegross): Ingest cached history for grammar
+	for _, inp := range inputs {
+		if inp.Multimodal == nil {
+			params.sampler.Accept(inp.Token)
+		}
+	}
 
 	return &Sequence{
 		ctxs:                ctxs,
@@ -164,16 +211,50 @@ func (s *Server) NewSequence(prompt string, images []llm.ImageData, params NewSe
 		startProcessingTime: startTime,
 		numPredict:          params.numPredict,
 		pendingResponses:    make([]string, 0),
-		responses:           make(chan string, 100),
+		responses:           make(chan response, 100),
 		quit:                make(chan bool, 1),
 		embedding:           make(chan []float32, 1),
 		sampler:             params.sampler,
 		embeddingOnly:       params.embedding,
+		pin:                 params.pin,
 		stop:                params.stop,
 		numKeep:             params.numKeep,
+		logprobs:            params.logprobs,
+		topLogprobs:         params.topLogprobs,
 	}, nil
 }
 
+// fork returns a sequence that generates another completion of seq's prompt
+// using its own sampler. It must be called before seq is loaded into a cache
+// slot and is started once seq has processed the prompt
+func (seq *Sequence) fork(index int, sampler sample.Sampler) *Sequence {
+	for _, inp := range seq.inputs {
+		if inp.Multimodal == nil {
+			sampler.Accept(inp.Token)
+		}
+	}
+
+	fork := &Sequence{
+		ctxs:                seq.ctxs,
+		numPromptInputs:     seq.numPromptInputs,
+		startProcessingTime: seq.startProcessingTime,
+		numPredict:          seq.numPredict,
+		pendingResponses:    make([]string, 0),
+		responses:           make(chan response, 100),
+		quit:                make(chan bool, 1),
+		embedding:           make(chan []float32, 1),
+		sampler:             sampler,
+		index:               index,
+		stop:                seq.stop,
+		numKeep:             seq.numKeep,
+		logprobs:            seq.logprobs,
+		topLogprobs:         seq.topLogprobs,
+	}
+
+	seq.forks = append(seq.forks, fork)
+	return fork
+}
+
 // inputs processes the prompt and images into a list of inputs
 // by splitting the prompt on [img-<n>] tags, tokenizing text and
 // decoding images
@@ -299,11 +380,26 @@ type Server struct {
 	// of non-text data
 	multimodalHash maphash.Hash
 
-	// vocab is a llama.cpp vocab required for gammar-based
-	// constrained generation (json mode, structured outputs)
-	// TODO: this is temporary until Ollama sampling supports
-	// constrained generation
+	// vocab is required for grammar-based constrained
+	// generation (json mode, structured outputs)
 	vocab *sample.Vocab
+
+	// draft model for speculative decoding, if any
+	draft *draft
+
+	// rates of prompt processing and generation reported by stats
+	promptRate, evalRate common.Throughput
+
+	// cache usage reported by stats
+	slotsInUse, contextUsed atomic.Int64
+}
+
+// updateUsage records how much of the cache is used for stats, so that it
+// doesn't have to wait for a batch to finish to read it. s.mu must be held
+func (s *Server) updateUsage() {
+	inUse, inputs := s.cache.Usage()
+	s.slotsInUse.Store(int64(inUse))
+	s.contextUsed.Store(int64(inputs))
 }
 
 func (s *Server) allNil() bool {
@@ -319,6 +415,9 @@ func flushPending(seq *Sequence) bool {
 	joined := strings.Join(seq.pendingResponses, "")
 	seq.pendingResponses = []string{}
 
+	logprobs := seq.pendingLogprobs
+	seq.pendingLogprobs = nil
+
 	// Check if there are any partial UTF-8 characters remaining.
 	// We already check and queue as we are generating but some may
 	// still make it here:
@@ -329,12 +428,12 @@ func flushPending(seq *Sequence) bool {
 		joined = joined[:len(joined)-1]
 	}
 
-	if len(joined) == 0 {
+	if len(joined) == 0 && len(logprobs) == 0 {
 		return true
 	}
 
 	select {
-	case seq.responses <- joined:
+	case seq.responses <- response{content: joined, logprobs: logprobs}:
 		return true
 	case <-seq.quit:
 		return false
@@ -350,9 +449,47 @@ func (s *Server) removeSequence(seqIndex int, reason llm.DoneReason) {
 	close(seq.embedding)
 	seq.cache.InUse = false
 	s.seqs[seqIndex] = nil
+	s.updateUsage()
+
+	// a pinned slot holds its place until it is unpinned
+	if !seq.cache.Pinned {
+		s.seqsSem.Release(1)
+	}
+
+	// forks that never started end along with seq
+	for _, fork := range seq.forks {
+		fork.doneReason = reason
+		s.endFork(fork)
+	}
+	seq.forks = nil
+}
+
+// endFork ends a fork that was never added to the running sequences
+func (s *Server) endFork(fork *Sequence) {
+	close(fork.responses)
+	close(fork.embedding)
 	s.seqsSem.Release(1)
 }
 
+// startFork adds fork to the running sequences, continuing from the inputs
+// that seq has processed so far. It returns the index of fork in s.seqs
+func (s *Server) startFork(seq, fork *Sequence) (int, error) {
+	j := slices.Index(s.seqs, nil)
+	if j < 0 {
+		return 0, errors.New("no available sequence for fork")
+	}
+
+	var err error
+	fork.cache, err = s.cache.ForkCacheSlot(seq.cache)
+	if err != nil {
+		return 0, err
+	}
+
+	fork.iBatch = seq.iBatch
+	s.seqs[j] = fork
+	return j, nil
+}
+
 func (s *Server) run(ctx context.Context) {
 	s.ready.Wait()
 
@@ -371,10 +508,24 @@ func (s *Server) run(ctx context.Context) {
 
 func (s *Server) processBatch() error {
 	s.mu.Lock()
-	for s.allNil() {
+	for s.allNil() && !s.cache.SavePending() {
 		s.cond.Wait() // Wait until an item is added
 	}
 	defer s.mu.Unlock()
+	defer s.updateUsage()
+
+	// prompts being saved to disk are copied from the cache a part at a time
+	// between batches
+	s.cache.SaveNext()
+	if s.allNil() {
+		return nil
+	}
+
+	if s.draft != nil {
+		if err := s.propose(); err != nil {
+			return err
+		}
+	}
 
 	var batchInputs []int32
 	var batch input.Batch
@@ -452,8 +603,12 @@ func (s *Server) processBatch() error {
 			batch.Positions = append(batch.Positions, int32(len(seq.cache.Inputs)+len(seq.pendingInputs)))
 			batch.Sequences = append(batch.Sequences, seq.cache.Id)
 
-			seq.iBatch = len(batch.Outputs)
-			if i+1 == len(seq.inputs) {
+			// outputs are needed for the last input and each drafted token
+			// that follows it
+			if i+1 >= len(seq.inputs)-len(seq.draft) {
+				if i+1 == len(seq.inputs)-len(seq.draft) {
+					seq.iBatch = len(batch.Outputs)
+				}
 				batch.Outputs = append(batch.Outputs, int32(len(batchInputs)-1))
 			}
 			seq.pendingInputs = append(seq.pendingInputs, inp)
@@ -489,6 +644,10 @@ func (s *Server) processBatch() error {
 
 		// After calling Forward, pending inputs are now in the cache
 		if len(seq.pendingInputs) > 0 {
+			if seq.numPredicted == 0 {
+				s.promptRate.Add(len(seq.pendingInputs))
+			}
+
 			seq.cache.Inputs = append(seq.cache.Inputs, seq.pendingInputs...)
 			seq.pendingInputs = []input.Input{}
 		}
@@ -501,89 +660,150 @@ func (s *Server) processBatch() error {
 			continue
 		}
 
-		seq.numPredicted++
-		if seq.numPredicted == 1 {
-			seq.startGenerationTime = time.Now()
-		}
-
-		// if done processing the prompt, generate an embedding and return
-		if seq.embeddingOnly {
-			// TODO(jessegross): Embedding support
-			slog.Warn("generation of embedding outputs not yet supported")
-			s.removeSequence(i, llm.DoneReasonStop)
-			continue
-		}
-
-		// sample a token
 		vocabSize := len(logits) / len(batch.Outputs)
+		seqLogits := logits[seq.iBatch*vocabSize : (seq.iBatch+1)*vocabSize]
 
-		token, err := seq.sampler.Sample(logits[seq.iBatch*vocabSize : (seq.iBatch+1)*vocabSize])
-		if err != nil {
-			return fmt.Errorf("failed to sample token: %w", err)
-		}
+		// the prompt has been processed so additional completions of it
+		// can start from here, sharing the cache
+		for _, fork := range seq.forks {
+			j, err := s.startFork(seq, fork)
+			if err != nil {
+				// only this completion fails, the others carry on
+				slog.Warn("failed to start completion", "index", fork.index, "error", err)
+				fork.err = err
+				s.endFork(fork)
+				continue
+			}
 
-		// if it's an end of sequence token, break
-		if s.model.(model.TextProcessor).Is(token, model.SpecialEOS) {
-			// TODO (jmorganca): we should send this back
-			// as it's important for the /api/generate context
-			// seq.responses <- piece
+			if err := s.sample(j, fork, seqLogits); err != nil {
+				return err
+			}
+		}
+		seq.forks = nil
 
-			s.removeSequence(i, llm.DoneReasonStop)
+		if len(seq.draft) > 0 {
+			if err := s.verify(i, seq, logits[seq.iBatch*vocabSize:], vocabSize); err != nil {
+				return err
+			}
 			continue
 		}
 
-		piece, err := s.model.(model.TextProcessor).Decode([]int32{token})
-		if err != nil {
+		if err := s.sample(i, seq, seqLogits); err != nil {
 			return err
 		}
+	}
 
-		seq.inputs = []input.Input{{Token: token}}
+	return nil
+}
 
-		seq.pendingResponses = append(seq.pendingResponses, piece)
-		sequence := strings.Join(seq.pendingResponses, "")
+// sample generates the next token for the sequence at index i from the
+// logits of its last output
+func (s *Server) sample(i int, seq *Sequence, logits []float32) error {
+	seq.numPredicted++
+	if seq.numPredicted == 1 {
+		seq.startGenerationTime = time.Now()
+	}
 
-		if ok, stop := common.FindStop(sequence, seq.stop); ok {
-			slog.Debug("hit stop token", "pending", seq.pendingResponses, "stop", stop)
+	// if done processing the prompt, generate an embedding and return
+	if seq.embeddingOnly {
+		// TODO(jessegross): Embedding support
+		slog.Warn("generation of embedding outputs not yet supported")
+		s.removeSequence(i, llm.DoneReasonStop)
+		return nil
+	}
 
-			var tokenTruncated bool
-			origLen := len(seq.pendingResponses)
-			seq.pendingResponses, tokenTruncated = common.TruncateStop(seq.pendingResponses, stop)
-			newLen := len(seq.pendingResponses)
+	// the prompt is now in the cache and stays there once pinned
+	if seq.pin {
+		seq.cache.Pinned = true
+		s.removeSequence(i, llm.DoneReasonStop)
+		return nil
+	}
 
-			// Update the cache based on the tokens that will be returned:
-			// - We have 1 token more than is currently in the cache because
-			// the last one generated wasn't submitted to Decode
-			// - Remove any stop sequences that we stripped out
-			// - If truncateStop removed a portion of a token, drop that
-			// - As defense-in-depth, if truncatedToken didn't find a stop token
-			// remove the extra one that we added to the cache len
-			tokenLen := len(seq.cache.Inputs) + 1
-			tokenLen -= origLen - newLen
-			if tokenTruncated || origLen == newLen {
-				tokenLen--
-			}
-			seq.cache.Inputs = seq.cache.Inputs[:tokenLen]
+	// sample a token
+	token, err := seq.sampler.Sample(logits)
+	if err != nil {
+		return fmt.Errorf("failed to sample token: %w", err)
+	}
+	s.evalRate.Add(1)
 
-			s.removeSequence(i, llm.DoneReasonStop)
-			continue
-		}
+	// if it's an end of sequence token, break
+	if s.model.(model.TextProcessor).Is(token, model.SpecialEOS) {
+		// TODO (jmorganca): we should send this back
+		// as it's important for the /api/generate context
+		// seq.responses <- piece
 
-		if common.ContainsStopSuffix(sequence, seq.stop) {
-			continue
-		}
+		s.removeSequence(i, llm.DoneReasonStop)
+		return nil
+	}
 
-		if common.IncompleteUnicode(sequence) {
-			continue
+	piece, err := s.model.(model.TextProcessor).Decode([]int32{token})
+	if err != nil {
+		return err
+	}
+
+	seq.inputs = []input.Input{{Token: token}}
+
+	if seq.logprobs {
+		seq.pendingLogprobs = append(seq.pendingLogprobs, common.Logprobs(logits, token, seq.topLogprobs, s.decode))
+	}
+
+	seq.pendingResponses = append(seq.pendingResponses, piece)
+	sequence := strings.Join(seq.pendingResponses, "")
+
+	if ok, stop := common.FindStop(sequence, seq.stop); ok {
+		slog.Debug("hit stop token", "pending", seq.pendingResponses, "stop", stop)
+
+		var tokenTruncated bool
+		origLen := len(seq.pendingResponses)
+		seq.pendingResponses, tokenTruncated = common.TruncateStop(seq.pendingResponses, stop)
+		newLen := len(seq.pendingResponses)
+		if len(seq.pendingLogprobs) > newLen {
+			seq.pendingLogprobs = seq.pendingLogprobs[:newLen]
 		}
 
-		if !flushPending(seq) {
-			s.removeSequence(i, llm.DoneReasonConnectionClosed)
+		// Update the cache based on the tokens that will be returned:
+		// - We have 1 token more than is currently in the cache because
+		// the last one generated wasn't submitted to Decode
+		// - Remove any stop sequences that we stripped out
+		// - If truncateStop removed a portion of a token, drop that
+		// - As defense-in-depth, if truncatedToken didn't find a stop token
+		// remove the extra one that we added to the cache len
+		tokenLen := len(seq.cache.Inputs) + 1
+		tokenLen -= origLen - newLen
+		if tokenTruncated || origLen == newLen {
+			tokenLen--
 		}
+		seq.cache.Inputs = seq.cache.Inputs[:tokenLen]
+
+		s.removeSequence(i, llm.DoneReasonStop)
+		return nil
+	}
+
+	if common.ContainsStopSuffix(sequence, seq.stop) {
+		return nil
+	}
+
+	if common.IncompleteUnicode(sequence) {
+		return nil
+	}
+
+	if !flushPending(seq) {
+		s.removeSequence(i, llm.DoneReasonConnectionClosed)
 	}
 
 	return nil
 }
 
+// decode returns the text of a single token, used for log probabilities
+func (s *Server) decode(token int32) string {
+	piece, err := s.model.(model.TextProcessor).Decode([]int32{token})
+	if err != nil {
+		return ""
+	}
+
+	return piece
+}
+
 func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 	var req llm.CompletionRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -606,39 +826,96 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var grammar *sample.Grammar
-	var err error
-	if req.Grammar != "" {
-		grammar, err = sample.NewGrammar(s.vocab, req.Grammar)
-		if err != nil {
-			http.Error(w, "failed to load model vocabulary required for format", http.StatusInternalServerError)
-			return
+	n := max(req.N, 1)
+	if n > s.parallel {
+		http.Error(w, fmt.Sprintf("n (%d) exceeds the number of parallel sequences (%d)", n, s.parallel), http.StatusBadRequest)
+		return
+	}
+
+	tp := s.model.(model.TextProcessor)
+	logitBias, err := common.LogitBias(req.Options.LogitBias, len(tp.Vocabulary().Values), func(s string) ([]int32, error) {
+		return tp.Encode(s, false)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// each completion has its own sampler state. Fixed seeds are offset so
+	// that completions differ but are still reproducible
+	newSampler := func(index int) (sample.Sampler, error) {
+		var grammar *sample.Grammar
+		if req.Grammar != "" {
+			var err error
+			grammar, err = sample.NewGrammar(s.vocab, req.Grammar)
+			if err != nil {
+				return sample.Sampler{}, err
+			}
+		}
+
+		seed := req.Options.Seed
+		if seed != -1 {
+			seed += index
 		}
+
+		return sample.NewSampler(sample.Options{
+			Temperature: req.Options.Temperature,
+			TopK:        req.Options.TopK,
+			TopP:        req.Options.TopP,
+			MinP:        req.Options.MinP,
+			TypicalP:    req.Options.TypicalP,
+			Seed:        seed,
+			Penalties: sample.Penalties{
+				RepeatLastN: req.Options.RepeatLastN,
+				Repeat:      req.Options.RepeatPenalty,
+				Presence:    req.Options.PresencePenalty,
+				Frequency:   req.Options.FrequencyPenalty,
+			},
+			Mirostat: sample.Mirostat{
+				Version: req.Options.Mirostat,
+				Tau:     req.Options.MirostatTau,
+				Eta:     req.Options.MirostatEta,
+			},
+			LogitBias: logitBias,
+			Grammar:   grammar,
+		}), nil
 	}
 
-	sampler := sample.NewSampler(
-		req.Options.Temperature,
-		req.Options.TopK,
-		req.Options.TopP,
-		req.Options.MinP,
-		req.Options.Seed,
-		grammar,
-	)
+	sampler, err := newSampler(0)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid grammar: %v", err), http.StatusBadRequest)
+		return
+	}
 
 	seq, err := s.NewSequence(req.Prompt, req.Images, NewSequenceParams{
-		numPredict: req.Options.NumPredict,
-		stop:       req.Options.Stop,
-		numKeep:    int32(req.Options.NumKeep),
-		sampler:    sampler,
-		embedding:  false,
+		numPredict:  req.Options.NumPredict,
+		stop:        req.Options.Stop,
+		numKeep:     int32(req.Options.NumKeep),
+		sampler:     sampler,
+		embedding:   false,
+		logprobs:    req.Logprobs,
+		topLogprobs: req.TopLogprobs,
 	})
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to create new sequence: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	// Ensure there is a place to put the sequence, released when removed from s.seqs
-	if err := s.seqsSem.Acquire(r.Context(), 1); err != nil {
+	// additional completions share the processed prompt rather than
+	// evaluating it again
+	seqs := []*Sequence{seq}
+	for i := 1; i < n; i++ {
+		sampler, err := newSampler(i)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid grammar: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		seqs = append(seqs, seq.fork(i, sampler))
+	}
+
+	// Ensure there is a place to put the sequences, released when removed from s.seqs
+	if err := s.seqsSem.Acquire(r.Context(), int64(n)); err != nil {
 		if errors.Is(err, context.Canceled) {
 			slog.Info("aborting completion request due to client closing the connection")
 		} else {
@@ -654,12 +931,13 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 			seq.cache, seq.inputs, err = s.cache.LoadCacheSlot(seq.inputs)
 			if err != nil {
 				s.mu.Unlock()
-				s.seqsSem.Release(1)
+				s.seqsSem.Release(int64(n))
 				http.Error(w, fmt.Sprintf("Failed to load cache: %v", err), http.StatusInternalServerError)
 				return
 			}
 
 			s.seqs[i] = seq
+			s.updateUsage()
 			s.cond.Signal()
 			found = true
 			break
@@ -668,45 +946,250 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 	s.mu.Unlock()
 
 	if !found {
-		s.seqsSem.Release(1)
+		s.seqsSem.Release(int64(n))
 		http.Error(w, "could not find an available sequence", http.StatusInternalServerError)
 		return
 	}
 
-	for {
+	quit := func() {
+		for _, seq := range seqs {
+			close(seq.quit)
+		}
+	}
+
+	// merge the responses of all completions. Each sequence closes its
+	// channel once it is done
+	type result struct {
+		seq  *Sequence
+		resp response
+		ok   bool
+	}
+
+	results := make(chan result)
+	for _, seq := range seqs {
+		go func() {
+			for {
+				resp, ok := <-seq.responses
+				select {
+				case results <- result{seq: seq, resp: resp, ok: ok}:
+				case <-r.Context().Done():
+					return
+				}
+
+				if !ok {
+					return
+				}
+			}
+		}()
+	}
+
+	for remaining := len(seqs); remaining > 0; {
 		select {
 		case <-r.Context().Done():
-			close(seq.quit)
+			quit()
 			return
-		case content, ok := <-seq.responses:
-			if ok {
+		case res := <-results:
+			seq := res.seq
+			if res.ok {
 				if err := json.NewEncoder(w).Encode(&llm.CompletionResponse{
-					Content: content,
+					Index:    seq.index,
+					Content:  res.resp.content,
+					Logprobs: res.resp.logprobs,
 				}); err != nil {
 					http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
-					close(seq.quit)
+					quit()
 					return
 				}
 
 				flusher.Flush()
 			} else {
+				remaining--
+				var errMsg string
+				if seq.err != nil {
+					errMsg = seq.err.Error()
+				}
+
 				if err := json.NewEncoder(w).Encode(&llm.CompletionResponse{
+					Index:              seq.index,
 					Done:               true,
 					DoneReason:         seq.doneReason,
+					Error:              errMsg,
 					PromptEvalCount:    seq.numPromptInputs,
 					PromptEvalDuration: seq.startGenerationTime.Sub(seq.startProcessingTime),
 					EvalCount:          seq.numPredicted,
 					EvalDuration:       time.Since(seq.startGenerationTime),
 				}); err != nil {
 					http.Error(w, fmt.Sprintf("failed to encode final response: %v", err), http.StatusInternalServerError)
+					quit()
+					return
 				}
 
-				return
+				flusher.Flush()
 			}
 		}
 	}
 }
 
+// pin processes a prompt into a cache slot that is then reserved so that
+// its inputs are never evicted. Sequences with a prompt that starts with the
+// same inputs copy them from the pinned slot
+func (s *Server) pin(w http.ResponseWriter, r *http.Request) {
+	var req llm.PinRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	if !s.cache.enabled {
+		http.Error(w, "model does not support caching", http.StatusBadRequest)
+		return
+	}
+
+	seq, err := s.NewSequence(req.Prompt, nil, NewSequenceParams{pin: true})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create new sequence: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.seqsSem.Acquire(r.Context(), 1); err != nil {
+		if errors.Is(err, context.Canceled) {
+			slog.Info("aborting pin request due to client closing the connection")
+		} else {
+			http.Error(w, fmt.Sprintf("Failed to acquire semaphore: %v", err), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	s.mu.Lock()
+
+	// at least one slot must remain for sequences to run in, including
+	// pins that are still being processed
+	pinned := len(s.cache.PinnedSlots())
+	for _, sq := range s.seqs {
+		if sq != nil && sq.pin {
+			pinned++
+		}
+	}
+
+	if pinned+1 >= len(s.cache.slots) {
+		s.mu.Unlock()
+		s.seqsSem.Release(1)
+		http.Error(w, fmt.Sprintf("no cache slots available to pin (parallel: %d)", s.parallel), http.StatusBadRequest)
+		return
+	}
+
+	i := slices.Index(s.seqs, nil)
+	if i < 0 {
+		s.mu.Unlock()
+		s.seqsSem.Release(1)
+		http.Error(w, "could not find an available sequence", http.StatusInternalServerError)
+		return
+	}
+
+	seq.cache, seq.inputs, err = s.cache.LoadCacheSlot(seq.inputs)
+	if err != nil {
+		s.mu.Unlock()
+		s.seqsSem.Release(1)
+		http.Error(w, fmt.Sprintf("Failed to load cache: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	s.seqs[i] = seq
+	s.updateUsage()
+	s.cond.Signal()
+	s.mu.Unlock()
+
+	// the sequence ends once the prompt has been processed
+	for range seq.responses {
+	}
+
+	s.mu.Lock()
+	ok := seq.cache.Pinned
+	s.mu.Unlock()
+
+	if !ok {
+		http.Error(w, fmt.Sprintf("failed to pin prompt: %s", seq.doneReason), http.StatusInternalServerError)
+		return
+	}
+
+	slog.Debug("pinned cache slot", "id", seq.cache.Id, "inputs", seq.numPromptInputs)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&llm.Pin{ID: seq.cache.Id, Inputs: seq.numPromptInputs}); err != nil {
+		http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+	}
+}
+
+func (s *Server) pins(w http.ResponseWriter, r *http.Request) {
+	s.ready.Wait()
+
+	s.mu.Lock()
+	resp := llm.PinsResponse{Pins: []llm.Pin{}}
+	for _, slot := range s.cache.PinnedSlots() {
+		resp.Pins = append(resp.Pins, llm.Pin{ID: slot.Id, Inputs: len(slot.Inputs)})
+	}
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&resp); err != nil {
+		http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+	}
+}
+
+func (s *Server) stats(w http.ResponseWriter, r *http.Request) {
+	s.ready.Wait()
+
+	// s.mu is held while batches are processed, which is when stats are
+	// most useful, so they are read without it
+	stats := llm.Stats{
+		Slots:                 len(s.cache.slots),
+		SlotsInUse:            int(s.slotsInUse.Load()),
+		ContextLength:         int(s.cache.numCtx) * len(s.cache.slots),
+		ContextUsed:           int(s.contextUsed.Load()),
+		PromptTokensPerSecond: s.promptRate.Rate(),
+		TokensPerSecond:       s.evalRate.Rate(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&stats); err != nil {
+		http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+	}
+}
+
+func (s *Server) unpin(w http.ResponseWriter, r *http.Request) {
+	s.ready.Wait()
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid pin id: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	err = s.cache.UnpinCacheSlot(id)
+	s.updateUsage()
+	s.mu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	slog.Debug("unpinned cache slot", "id", id)
+	s.seqsSem.Release(1)
+}
+
+// save writes the prompts in the cache to disk so that they can be restored
+// after the runner exits
+func (s *Server) save(w http.ResponseWriter, r *http.Request) {
+	s.ready.Wait()
+
+	s.mu.Lock()
+	s.cache.SaveAll()
+	s.mu.Unlock()
+
+	s.cache.WaitSaved()
+}
+
 func (s *Server) health(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(&llm.ServerStatusResponse{
@@ -728,20 +1211,22 @@ func (m *multiLPath) String() string {
 	return strings.Join(*m, ", ")
 }
 
-func (s *Server) reserveWorstCaseGraph() error {
-	ctx := s.model.Backend().NewContext()
+// reserveWorstCaseGraph allocates the memory needed for a batch of
+// batchSize inputs with numOutputs outputs
+func reserveWorstCaseGraph(m model.Model, batchSize, numOutputs int) error {
+	ctx := m.Backend().NewContext()
 	defer ctx.Close()
 
 	var batch input.Batch
 
-	inputs := make([]int32, s.batchSize)
+	inputs := make([]int32, batchSize)
 	batch.Positions = make([]int32, len(inputs))
 	batch.Sequences = make([]int, len(inputs))
 	for i := range inputs {
 		batch.Positions[i] = int32(i)
 	}
 
-	batch.Outputs = make([]int32, s.parallel)
+	batch.Outputs = make([]int32, numOutputs)
 	for i := range batch.Outputs {
 		batch.Outputs[i] = int32(i)
 	}
@@ -752,7 +1237,7 @@ func (s *Server) reserveWorstCaseGraph() error {
 		return err
 	}
 
-	cache := s.model.Config().Cache
+	cache := m.Config().Cache
 	if cache != nil {
 		err := cache.StartForward(ctx, batch, true)
 		if err != nil {
@@ -760,7 +1245,7 @@ func (s *Server) reserveWorstCaseGraph() error {
 		}
 	}
 
-	t, err := s.model.Forward(ctx, batch)
+	t, err := m.Forward(ctx, batch)
 	if err != nil {
 		return err
 	}
@@ -782,6 +1267,9 @@ func (s *Server) loadModel(
 	kvCacheType string,
 	kvSize int,
 	multiUserCache bool,
+	draftPath string,
+	numDraft int,
+	promptCacheDir string,
 ) {
 	var err error
 	s.model, err = model.New(ctx, mpath, params)
@@ -789,7 +1277,7 @@ func (s *Server) loadModel(
 		panic(err)
 	}
 
-	s.vocab = sample.NewVocab(mpath)
+	s.vocab = sample.NewVocab(s.model.(model.TextProcessor))
 
 	// TODO(jessegross): LoRA loading
 	if lpath.String() != "" {
@@ -806,11 +1294,39 @@ func (s *Server) loadModel(
 		slog.Warn("model does not support caching, disabling parallel processing")
 	}
 
+	if promptCacheDir != "" && s.cache.enabled {
+		s.cache.disk, err = newDiskCache(promptCacheDir, s.cache.cache)
+		if err != nil {
+			slog.Warn("unable to save prompt cache to disk", "error", err)
+			s.cache.disk = nil
+		}
+	}
+
 	s.parallel = parallel
 	s.seqs = make([]*Sequence, s.parallel)
 	s.seqsSem = semaphore.NewWeighted(int64(s.parallel))
 
-	err = s.reserveWorstCaseGraph()
+	// the draft model runs on the CPU so that it does not take memory
+	// from the model
+	if draftPath != "" && s.cache.enabled {
+		draftParams := params
+		draftParams.Progress = nil
+		draftParams.NumGPULayers = 0
+		draftParams.TensorSplit = nil
+
+		s.draft, err = newDraft(ctx, draftPath, draftParams, s.model, kvCacheType, s.cache.numCtx, s.parallel, s.batchSize, numDraft)
+		if err != nil {
+			slog.Warn("unable to load draft model, disabling speculative decoding", "error", err)
+			s.draft = nil
+		}
+	}
+
+	numOutputs := s.parallel
+	if s.draft != nil {
+		numOutputs = min(s.parallel*(s.draft.numDraft+1), s.batchSize)
+	}
+
+	err = reserveWorstCaseGraph(s.model, s.batchSize, numOutputs)
 	if err != nil {
 		panic(err)
 	}
@@ -836,6 +1352,9 @@ func Execute(args []string) error {
 	_ = fs.Bool("mlock", false, "force system to keep model in RAM rather than swapping or compressing")
 	tensorSplit := fs.String("tensor-split", "", "fraction of the model to offload to each GPU, comma-separated list of proportions")
 	multiUserCache := fs.Bool("multiuser-cache", false, "optimize input cache algorithm for multiple users")
+	draftPath := fs.String("draft-model", "", "Path to a draft model for speculative decoding")
+	numDraft := fs.Int("draft-max", 4, "Number of tokens to draft for speculative decoding")
+	promptCacheDir := fs.String("prompt-cache-dir", "", "Directory to save shared prompt prefixes to across restarts")
 
 	var lpaths multiLPath
 	fs.Var(&lpaths, "lora", "Path to lora layer file (can be specified multiple times)")
@@ -899,7 +1418,7 @@ func Execute(args []string) error {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	go server.loadModel(ctx, *mpath, params, lpaths, *parallel, *kvCacheType, *kvSize, *multiUserCache)
+	go server.loadModel(ctx, *mpath, params, lpaths, *parallel, *kvCacheType, *kvSize, *multiUserCache, *draftPath, *numDraft, *promptCacheDir)
 
 	server.cond = sync.NewCond(&server.mu)
 
@@ -921,6 +1440,11 @@ func Execute(args []string) error {
 
 	mux.HandleFunc("POST /completion", server.completion)
 	mux.HandleFunc("GET /health", server.health)
+	mux.HandleFunc("GET /stats", server.stats)
+	mux.HandleFunc("POST /pin", server.pin)
+	mux.HandleFunc("GET /pins", server.pins)
+	mux.HandleFunc("DELETE /pin/{id}", server.unpin)
+	mux.HandleFunc("POST /save", server.save)
 
 	httpServer := http.Server{
 		Handler: mux,
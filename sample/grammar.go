@@ -0,0 +1,254 @@
+package sample
+
+import (
+	"cmp"
+	"math"
+	"slices"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/ollama/ollama/grammar"
+	"github.com/ollama/ollama/model"
+)
+
+// Grammar constrains sampling to tokens that continue a match of a
+// GBNF grammar
+type Grammar struct {
+	vocab   *Vocab
+	matcher *grammar.Matcher
+
+	// pending holds the leading bytes of a UTF-8 character that has
+	// been split across tokens
+	pending []byte
+}
+
+func NewGrammar(vocab *Vocab, gbnf string) (*Grammar, error) {
+	g, err := grammar.Parse(gbnf)
+	if err != nil {
+		return nil, err
+	}
+
+	vocab.Load()
+
+	return &Grammar{
+		vocab:   vocab,
+		matcher: g.Matcher(),
+	}, nil
+}
+
+// applyAllThreshold is the number of tokens above which Apply checks the
+// whole vocabulary at once rather than one token at a time
+const applyAllThreshold = 64
+
+// Apply sets the logits of tokens that are not allowed by the grammar
+// to -Inf
+func (g *Grammar) Apply(tokens []token) {
+	if len(tokens) < applyAllThreshold || len(g.pending) > 0 {
+		for i := range tokens {
+			if !g.allowed(tokens[i].id) {
+				tokens[i].value = float32(math.Inf(-1))
+			}
+		}
+		return
+	}
+
+	allowed := g.allowedAll()
+	for i := range tokens {
+		if !allowed[tokens[i].id] {
+			tokens[i].value = float32(math.Inf(-1))
+		}
+	}
+}
+
+// Accept advances the grammar past token, which must be allowed
+func (g *Grammar) Accept(token int32) {
+	if g.vocab.eos[token] {
+		return
+	}
+
+	g.pending, _ = advance(g.matcher, g.pending, g.vocab.pieces[token])
+}
+
+// allowed reports whether the grammar allows token next
+func (g *Grammar) allowed(token int32) bool {
+	if token < 0 || int(token) >= len(g.vocab.pieces) {
+		return false
+	}
+
+	if g.vocab.eos[token] {
+		return len(g.pending) == 0 && g.matcher.Complete()
+	}
+
+	piece := g.vocab.pieces[token]
+	if piece == "" {
+		return false
+	}
+
+	_, ok := advance(g.matcher.Clone(), g.pending, piece)
+	return ok
+}
+
+// allowedAll returns whether each token in the vocabulary is allowed next
+func (g *Grammar) allowedAll() []bool {
+	allowed := make([]bool, len(g.vocab.pieces))
+	g.walk(g.vocab.trie, g.matcher, allowed)
+
+	for _, id := range g.vocab.partial {
+		allowed[id] = g.allowed(id)
+	}
+
+	for id, eos := range g.vocab.eos {
+		if eos {
+			allowed[id] = g.allowed(int32(id))
+		}
+	}
+
+	return allowed
+}
+
+// walk marks the tokens in the trie that m accepts, only descending into
+// prefixes that are accepted
+func (g *Grammar) walk(t *trie, m *grammar.Matcher, allowed []bool) {
+	for _, child := range t.children {
+		next := *m
+		if !next.AcceptRune(child.r) {
+			continue
+		}
+
+		for _, id := range child.tokens {
+			allowed[id] = true
+		}
+
+		g.walk(child, &next, allowed)
+	}
+}
+
+// advance matches the text of a token, prefixed by any pending bytes from
+// previous tokens, against m. It returns the bytes of a trailing incomplete
+// character and whether the text was accepted
+func advance(m *grammar.Matcher, pending []byte, piece string) ([]byte, bool) {
+	b := append(pending[:len(pending):len(pending)], piece...)
+	for len(b) > 0 {
+		r, size := utf8.DecodeRune(b)
+		if r == utf8.RuneError && size <= 1 {
+			if !utf8.FullRune(b) {
+				// the rest of this character is in the next token
+				lo, hi := partialRange(b)
+				return b, m.CanAcceptRange(lo, hi)
+			}
+			return nil, false
+		}
+
+		if !m.AcceptRune(r) {
+			return nil, false
+		}
+		b = b[size:]
+	}
+
+	return nil, true
+}
+
+// partialRange returns the range of runes that an incomplete UTF-8
+// encoding can be completed to
+func partialRange(b []byte) (rune, rune) {
+	var n int
+	var lo rune
+	switch {
+	case b[0]&0xe0 == 0xc0:
+		n, lo = 2, rune(b[0]&0x1f)
+	case b[0]&0xf0 == 0xe0:
+		n, lo = 3, rune(b[0]&0x0f)
+	default:
+		n, lo = 4, rune(b[0]&0x07)
+	}
+
+	for _, c := range b[1:] {
+		lo = lo<<6 | rune(c&0x3f)
+	}
+
+	hi := lo
+	for range n - len(b) {
+		lo = lo << 6
+		hi = hi<<6 | 0x3f
+	}
+
+	return lo, hi
+}
+
+// trie indexes the text of tokens by rune so that tokens sharing a prefix
+// are matched against the grammar together
+type trie struct {
+	r        rune
+	children []*trie
+	tokens   []int32
+}
+
+func (t *trie) insert(s string, id int32) {
+	for _, r := range s {
+		i, ok := slices.BinarySearchFunc(t.children, r, func(child *trie, r rune) int {
+			return cmp.Compare(child.r, r)
+		})
+		if !ok {
+			t.children = slices.Insert(t.children, i, &trie{r: r})
+		}
+		t = t.children[i]
+	}
+
+	t.tokens = append(t.tokens, id)
+}
+
+// Vocab is the decoded text of each token in a model's vocabulary, which is
+// needed for grammar-based constrained generation (json mode, structured outputs)
+type Vocab struct {
+	once sync.Once
+	tp   model.TextProcessor
+
+	pieces []string
+	eos    []bool
+
+	// trie holds the tokens whose text is valid UTF-8
+	trie *trie
+
+	// partial holds the tokens whose text is not valid UTF-8 on its own
+	partial []int32
+}
+
+func NewVocab(tp model.TextProcessor) *Vocab {
+	return &Vocab{tp: tp}
+}
+
+// Load lazily decodes the vocabulary
+func (v *Vocab) Load() {
+	v.once.Do(func() {
+		vocab := v.tp.Vocabulary()
+
+		v.pieces = make([]string, len(vocab.Values))
+		v.eos = make([]bool, len(vocab.Values))
+		v.trie = &trie{}
+		for i := range vocab.Values {
+			id := int32(i)
+			if v.tp.Is(id, model.SpecialEOS) {
+				v.eos[i] = true
+				continue
+			}
+
+			// control tokens such as <|start_header_id|> are never
+			// generated as part of structured output
+			if i < len(vocab.Types) && vocab.Types[i] == model.TOKEN_TYPE_CONTROL {
+				continue
+			}
+
+			piece, err := v.tp.Decode([]int32{id})
+			if err != nil || piece == "" {
+				continue
+			}
+
+			v.pieces[i] = piece
+			if utf8.ValidString(piece) {
+				v.trie.insert(piece, id)
+			} else {
+				v.partial = append(v.partial, id)
+			}
+		}
+	})
+}
@@ -0,0 +1,140 @@
+package sample
+
+import (
+	"math"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/ollama/ollama/model"
+)
+
+// testTextProcessor decodes each token to its value in the vocabulary
+type testTextProcessor struct {
+	vocab *model.Vocabulary
+}
+
+func (tp testTextProcessor) Encode(s string, addSpecial bool) ([]int32, error) {
+	return nil, nil
+}
+
+func (tp testTextProcessor) Decode(ids []int32) (string, error) {
+	var sb strings.Builder
+	for _, id := range ids {
+		sb.WriteString(tp.vocab.Values[id])
+	}
+	return sb.String(), nil
+}
+
+func (tp testTextProcessor) Is(id int32, special model.Special) bool {
+	return tp.vocab.Is(id, special)
+}
+
+func (tp testTextProcessor) Vocabulary() *model.Vocabulary {
+	return tp.vocab
+}
+
+func testVocab(values ...string) *Vocab {
+	types := make([]uint32, len(values))
+	for i, v := range values {
+		types[i] = model.TOKEN_TYPE_NORMAL
+		if strings.HasPrefix(v, "<|") {
+			types[i] = model.TOKEN_TYPE_CONTROL
+		}
+	}
+
+	return NewVocab(testTextProcessor{&model.Vocabulary{
+		Values: values,
+		Types:  types,
+		BOS:    -1,
+		EOS:    0,
+		EOT:    -1,
+	}})
+}
+
+func allowed(tokens []token) []int32 {
+	var ids []int32
+	for _, t := range tokens {
+		if !math.IsInf(float64(t.value), -1) {
+			ids = append(ids, t.id)
+		}
+	}
+	return ids
+}
+
+func TestGrammar(t *testing.T) {
+	vocab := testVocab("<|end|>", "<|start|>", "{", "}", `"`, "a", "ab", `{"`, `":`, " ", "1", "\xc3", "\xa9", "é", "")
+
+	g, err := NewGrammar(vocab, `root ::= "{" "\"" [a-zé]+ "\":" " "? [0-9] "}"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		want   []int32
+		accept int32
+	}{
+		{want: []int32{2, 7}, accept: 7},
+		{want: []int32{5, 6, 11, 13}, accept: 11},
+		// a character split across tokens must be completed
+		{want: []int32{12}, accept: 12},
+		{want: []int32{4, 5, 6, 8, 11, 13}, accept: 8},
+		{want: []int32{9, 10}, accept: 10},
+		{want: []int32{3}, accept: 3},
+		{want: []int32{0}},
+	}
+
+	for i, step := range steps {
+		// check both the per token and whole vocabulary paths
+		for _, n := range []int{len(vocab.pieces), applyAllThreshold} {
+			tokens := make([]token, n)
+			for j := range tokens {
+				tokens[j] = token{id: int32(j % len(vocab.pieces))}
+			}
+			g.Apply(tokens)
+
+			got := allowed(tokens[:len(vocab.pieces)])
+			if !slices.Equal(got, step.want) {
+				t.Fatalf("step %d (%d tokens): allowed = %v, want %v", i, n, got, step.want)
+			}
+		}
+
+		if step.accept != 0 {
+			g.Accept(step.accept)
+		}
+	}
+}
+
+func TestGrammarInvalid(t *testing.T) {
+	if _, err := NewGrammar(testVocab("<|end|>", "a"), `root ::= missing`); err == nil {
+		t.Error("expected error for invalid grammar")
+	}
+}
+
+func TestSamplerGrammar(t *testing.T) {
+	vocab := testVocab("<|end|>", "yes", "no", "maybe")
+
+	g, err := NewGrammar(vocab, `root ::= "no" | "maybe"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the most likely token is rejected by the grammar
+	sampler := NewSampler(Options{Grammar: g})
+	got, err := sampler.Sample([]float32{0, 10, 5, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 2 {
+		t.Errorf("index mismatch: want %d, got %d", 2, got)
+	}
+
+	// only the end of sequence token is allowed once the grammar is complete
+	got, err = sampler.Sample([]float32{0, 10, 5, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 0 {
+		t.Errorf("index mismatch: want %d, got %d", 0, got)
+	}
+}
@@ -5,9 +5,6 @@ import (
 	"math"
 	"math/rand/v2"
 	"slices"
-	"sync"
-
-	"github.com/ollama/ollama/llama"
 )
 
 // token represents information about a single token during sampling
@@ -16,26 +13,135 @@ type token struct {
 	value float32 // The raw logit or probability from the model
 }
 
+// Penalties configures how previously seen tokens are penalized
+type Penalties struct {
+	// RepeatLastN is the number of most recent tokens considered for
+	// penalties. Zero disables penalties and a negative value considers
+	// all tokens
+	RepeatLastN int
+
+	// Repeat scales down the logits of tokens that have already
+	// appeared. A value of 1 disables the repeat penalty
+	Repeat float32
+
+	// Presence is subtracted once from the logit of any token that
+	// has already appeared
+	Presence float32
+
+	// Frequency is subtracted from the logit of a token for each
+	// time it has already appeared
+	Frequency float32
+}
+
+func (p Penalties) enabled() bool {
+	return p.RepeatLastN != 0 && (p.Repeat != 1 || p.Presence != 0 || p.Frequency != 0)
+}
+
+// Mirostat configures mirostat sampling, which replaces topK, topP,
+// minP and typicalP with truncation that targets a constant surprise
+type Mirostat struct {
+	// Version selects mirostat 1 or 2. Zero disables mirostat
+	Version int
+
+	// Tau is the target surprise (cross-entropy) of the output
+	Tau float32
+
+	// Eta is the learning rate used to adjust towards Tau
+	Eta float32
+}
+
+// Options configures a [Sampler]
+type Options struct {
+	// Temperature scales the logits before sampling. Zero always picks
+	// the most likely token
+	Temperature float32
+
+	// TopK keeps only the K most likely tokens. Zero or less keeps all
+	// tokens
+	TopK int
+
+	// TopP keeps the most likely tokens whose probabilities add up to P
+	TopP float32
+
+	// MinP drops tokens less likely than P times the most likely token
+	MinP float32
+
+	// TypicalP keeps the tokens closest to the expected surprise whose
+	// probabilities add up to P. Values outside (0, 1) disable it
+	TypicalP float32
+
+	// Seed makes sampling reproducible. -1 samples randomly
+	Seed int
+
+	Penalties Penalties
+	Mirostat  Mirostat
+
+	// LogitBias is added to the logits of the given tokens
+	LogitBias map[int32]float32
+
+	// Grammar constrains the tokens that can be sampled, if set
+	Grammar *Grammar
+}
+
+// mirostatM is the number of tokens used to estimate the
+// Zipf exponent in mirostat 1
+const mirostatM = 100
+
 type Sampler struct {
 	rng         *rand.Rand
 	topK        int
 	topP        float32
 	minP        float32
+	typicalP    float32
 	temperature float32
+	penalties   Penalties
+	history     []int32
+	mirostat    Mirostat
+	mu          float32
+	logitBias   map[int32]float32
 	grammar     *Grammar
 }
 
-func (s *Sampler) Sample(logits []float32) (int32, error) {
-	if len(logits) == 0 {
-		return -1, errors.New("sample: no logits provided to sample")
+// Accept records tokens, such as those from the prompt, in the
+// history used for penalties without sampling them
+func (s *Sampler) Accept(tokens ...int32) {
+	if !s.penalties.enabled() {
+		return
 	}
 
-	tokens := make([]token, len(logits))
+	s.history = append(s.history, tokens...)
+	if s.penalties.RepeatLastN > 0 && len(s.history) > s.penalties.RepeatLastN {
+		s.history = slices.Clone(s.history[len(s.history)-s.penalties.RepeatLastN:])
+	}
+}
+
+// reset fills tokens from logits and applies the logit bias and the
+// penalties for the sampler's history
+func (s *Sampler) reset(tokens []token, logits []float32) {
 	for i := range logits {
 		tokens[i].id = int32(i)
 		tokens[i].value = logits[i]
 	}
 
+	for id, bias := range s.logitBias {
+		if id >= 0 && int(id) < len(tokens) {
+			tokens[id].value += bias
+		}
+	}
+
+	if s.penalties.enabled() {
+		penalties(tokens, s.history, s.penalties.Repeat, s.penalties.Frequency, s.penalties.Presence)
+	}
+}
+
+func (s *Sampler) Sample(logits []float32) (int32, error) {
+	if len(logits) == 0 {
+		return -1, errors.New("sample: no logits provided to sample")
+	}
+
+	tokens := make([]token, len(logits))
+	s.reset(tokens, logits)
+
 	t, err := s.sample(tokens)
 	if err != nil {
 		return -1, err
@@ -48,16 +154,14 @@ func (s *Sampler) Sample(logits []float32) (int32, error) {
 		s.grammar.Apply(top)
 		if !math.IsInf(float64(top[0].value), -1) {
 			s.grammar.Accept(top[0].id)
-			return top[0].id, nil
+			s.accept(t)
+			return t.id, nil
 		}
 
 		// since .sample has side effects of modifying the tokens
 		// we need to reset them before applying the grammar and
 		// sampling again
-		for i := range logits {
-			tokens[i].id = int32(i)
-			tokens[i].value = logits[i]
-		}
+		s.reset(tokens, logits)
 		s.grammar.Apply(tokens)
 		t, err = s.sample(tokens)
 		if err != nil {
@@ -66,9 +170,22 @@ func (s *Sampler) Sample(logits []float32) (int32, error) {
 		s.grammar.Accept(t.id)
 	}
 
+	s.accept(t)
 	return t.id, nil
 }
 
+// accept updates the sampler's state once t has been chosen
+func (s *Sampler) accept(t token) {
+	s.Accept(t.id)
+
+	if s.mirostat.Version != 0 && s.temperature != 0 {
+		// move mu towards the target surprise based on the
+		// surprise of the chosen token
+		surprise := -float32(math.Log2(float64(t.value)))
+		s.mu -= s.mirostat.Eta * (surprise - s.mirostat.Tau)
+	}
+}
+
 // greedy returns the highest probability token from the tokens
 func greedy(tokens []token) token {
 	max := tokens[0]
@@ -88,6 +205,10 @@ func (s *Sampler) sample(tokens []token) (token, error) {
 		return greedy(tokens), nil
 	}
 
+	if s.mirostat.Version != 0 {
+		return s.sampleMirostat(tokens)
+	}
+
 	// topK also sorts the tokens in descending order of logits
 	tokens = topK(tokens, s.topK)
 
@@ -95,9 +216,38 @@ func (s *Sampler) sample(tokens []token) (token, error) {
 	temperature(tokens, s.temperature)
 	softmax(tokens)
 
+	tokens = typicalP(tokens, s.typicalP)
 	tokens = topP(tokens, s.topP)
 	tokens = minP(tokens, s.minP)
 
+	return s.weighted(tokens)
+}
+
+// sampleMirostat truncates the tokens based on the current mu before
+// sampling. It also has side effects of modifying the tokens
+func (s *Sampler) sampleMirostat(tokens []token) (token, error) {
+	n := len(tokens)
+
+	// sort the tokens in descending order of logits
+	tokens = topK(tokens, -1)
+
+	temperature(tokens, s.temperature)
+	softmax(tokens)
+
+	switch s.mirostat.Version {
+	case 1:
+		tokens = mirostatV1(tokens, s.mu, mirostatM, n)
+	case 2:
+		tokens = mirostatV2(tokens, s.mu)
+	}
+
+	return s.weighted(tokens)
+}
+
+// weighted randomly picks a token with probability proportional to its value.
+// The returned token's value is its normalized probability. It also has side
+// effects of modifying the tokens
+func (s *Sampler) weighted(tokens []token) (token, error) {
 	var r float32
 	if s.rng != nil {
 		r = s.rng.Float32()
@@ -123,11 +273,21 @@ func (s *Sampler) sample(tokens []token) (token, error) {
 	if math.IsNaN(float64(sum)) {
 		return token{}, errors.New("sample: logits sum to NaN, check model output")
 	}
-	return tokens[idx], nil
+
+	t := tokens[idx]
+	if idx > 0 {
+		t.value -= tokens[idx-1].value
+	}
+	t.value /= sum
+
+	return t, nil
 }
 
 // TODO(parthsareen): update sampler interface to use json unmarshal https://github.com/ollama/ollama/issues/9278
-func NewSampler(temperature float32, topK int, topP float32, minP float32, seed int, grammar *Grammar) Sampler {
+func NewSampler(opts Options) Sampler {
+	temperature, topP, minP, typicalP := opts.Temperature, opts.TopP, opts.MinP, opts.TypicalP
+	seed, penalties, mirostat := opts.Seed, opts.Penalties, opts.Mirostat
+
 	var rng *rand.Rand
 	if seed != -1 {
 		// PCG requires two parameters: sequence and stream
@@ -154,73 +314,29 @@ func NewSampler(temperature float32, topK int, topP float32, minP float32, seed
 		minP = 1.0
 	}
 
-	return Sampler{
-		rng:         rng,
-		topK:        topK,
-		topP:        topP,
-		minP:        minP,
-		temperature: temperature,
-		grammar:     grammar,
+	if typicalP <= 0.0 || typicalP >= 1.0 {
+		typicalP = 1.0
 	}
-}
 
-type Grammar struct {
-	vocab   *Vocab
-	grammar string
-	sampler *llama.Sampler
-}
-
-func NewGrammar(vocab *Vocab, grammar string) (*Grammar, error) {
-	v, err := vocab.Load()
-	if err != nil {
-		return nil, err
+	if penalties.Repeat <= 0.0 {
+		penalties.Repeat = 1.0
 	}
 
-	return &Grammar{
-		vocab:   vocab,
-		grammar: grammar,
-		sampler: llama.NewGrammarSampler(v, grammar),
-	}, nil
-}
-
-func (g *Grammar) Apply(tokens []token) {
-	tds := make([]llama.TokenData, len(tokens))
-	for i, token := range tokens {
-		tds[i].Id = token.id
-		tds[i].Logit = token.value
+	if mirostat.Version != 1 && mirostat.Version != 2 {
+		mirostat.Version = 0
 	}
 
-	g.sampler.Apply(tds)
-
-	for i := range tokens {
-		tokens[i].value = tds[i].Logit
+	return Sampler{
+		rng:         rng,
+		topK:        opts.TopK,
+		topP:        topP,
+		minP:        minP,
+		typicalP:    typicalP,
+		temperature: temperature,
+		penalties:   penalties,
+		mirostat:    mirostat,
+		mu:          2 * mirostat.Tau,
+		logitBias:   opts.LogitBias,
+		grammar:     opts.Grammar,
 	}
 }
-
-func (g *Grammar) Accept(token int32) {
-	g.sampler.Accept(token)
-}
-
-type Vocab struct {
-	once  sync.Once
-	vocab *llama.Vocab
-	err   error
-	path  string
-}
-
-func NewVocab(path string) *Vocab {
-	return &Vocab{path: path}
-}
-
-// Load returns the lazily-loaded vocabulary
-func (v *Vocab) Load() (*llama.Vocab, error) {
-	v.once.Do(func() {
-		vocab, err := llama.LoadVocabFromFile(v.path)
-		if err != nil {
-			v.err = err
-			return
-		}
-		v.vocab = vocab
-	})
-	return v.vocab, v.err
-}
@@ -8,7 +8,7 @@ import (
 
 func TestWeighted(t *testing.T) {
 	logits := []float32{-10, 3, -10, -10}
-	sampler := NewSampler(0, 0, 0, 0, 0, nil)
+	sampler := NewSampler(Options{})
 	got, err := sampler.Sample(logits)
 	if err != nil {
 		t.Error(err)
@@ -20,7 +20,7 @@ func TestWeighted(t *testing.T) {
 	}
 
 	logits = []float32{-100, -10, 0, 10}
-	sampler = NewSampler(0, 0, 0, 0, 0, nil)
+	sampler = NewSampler(Options{})
 	got, err = sampler.Sample(logits)
 	if err != nil {
 		t.Error(err)
@@ -34,7 +34,7 @@ func TestWeighted(t *testing.T) {
 	// Test very high p
 	logits = []float32{1.0, 0.9999999999999999, 0.5, 0.1}
 	// Use extremely small topP to filter out all tokens
-	sampler = NewSampler(1.0, 0, 1e-10, 0, 0, nil)
+	sampler = NewSampler(Options{Temperature: 1.0, TopP: 1e-10})
 	got, err = sampler.Sample(logits)
 	if err != nil {
 		t.Error(err)
@@ -47,7 +47,7 @@ func TestWeighted(t *testing.T) {
 	}
 
 	logits = []float32{float32(math.NaN()), float32(math.NaN()), float32(math.NaN())}
-	sampler = NewSampler(1, 0, 0.95, 0.05, 0, nil)
+	sampler = NewSampler(Options{Temperature: 1, TopP: 0.95, MinP: 0.05})
 	got, err = sampler.Sample(logits)
 	if err == nil {
 		t.Errorf("expected error, got %d", got)
@@ -55,10 +55,115 @@ func TestWeighted(t *testing.T) {
 	}
 }
 
+func TestSamplerPenalties(t *testing.T) {
+	logits := []float32{-10, 3, 2.9, -10}
+
+	sampler := NewSampler(Options{Penalties: Penalties{RepeatLastN: 64, Repeat: 1.1}})
+	got, err := sampler.Sample(logits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 1 {
+		t.Errorf("index mismatch: want %d, got %d", 1, got)
+	}
+
+	// the sampled token is now penalized so the next best is chosen
+	got, err = sampler.Sample(logits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 2 {
+		t.Errorf("index mismatch: want %d, got %d", 2, got)
+	}
+
+	// tokens outside of the last n are no longer penalized
+	sampler = NewSampler(Options{Penalties: Penalties{RepeatLastN: 2, Repeat: 1.1}})
+	sampler.Accept(1, 0, 3)
+	got, err = sampler.Sample(logits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 1 {
+		t.Errorf("index mismatch: want %d, got %d", 1, got)
+	}
+
+	// disabled penalties do not track history
+	sampler = NewSampler(Options{Penalties: Penalties{RepeatLastN: 64, Repeat: 1}})
+	sampler.Accept(1)
+	if len(sampler.history) != 0 {
+		t.Errorf("history should be empty, got %v", sampler.history)
+	}
+}
+
+func TestSamplerLogitBias(t *testing.T) {
+	logits := []float32{-10, 3, 2.9, -10}
+
+	// banning the most likely token
+	sampler := NewSampler(Options{LogitBias: map[int32]float32{1: -100}})
+	got, err := sampler.Sample(logits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 2 {
+		t.Errorf("index mismatch: want %d, got %d", 2, got)
+	}
+
+	// out of range tokens are ignored
+	sampler = NewSampler(Options{Temperature: 1, LogitBias: map[int32]float32{3: 100, 4: 100, -1: 100}})
+	got, err = sampler.Sample(logits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 3 {
+		t.Errorf("index mismatch: want %d, got %d", 3, got)
+	}
+}
+
+func TestSamplerMirostat(t *testing.T) {
+	logits := make([]float32, 1000)
+	for i := range logits {
+		logits[i] = -float32(math.Log(float64(i + 1)))
+	}
+
+	for _, version := range []int{1, 2} {
+		sampler := NewSampler(Options{Temperature: 1, Mirostat: Mirostat{Version: version, Tau: 5, Eta: 0.1}})
+		if sampler.mu != 10 {
+			t.Errorf("mirostat %d: mu should start at 2*tau, got %f", version, sampler.mu)
+		}
+
+		for range 50 {
+			mu := sampler.mu
+			got, err := sampler.Sample(logits)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got < 0 || int(got) >= len(logits) {
+				t.Fatalf("mirostat %d: token out of range: %d", version, got)
+			}
+			if sampler.mu == mu {
+				t.Errorf("mirostat %d: mu was not updated", version)
+			}
+		}
+	}
+
+	// greedy sampling does not use mirostat
+	sampler := NewSampler(Options{Mirostat: Mirostat{Version: 2, Tau: 5, Eta: 0.1}})
+	got, err := sampler.Sample(logits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 0 {
+		t.Errorf("index mismatch: want %d, got %d", 0, got)
+	}
+	if sampler.mu != 10 {
+		t.Errorf("greedy sampling should not update mu, got %f", sampler.mu)
+	}
+}
+
 func BenchmarkSample(b *testing.B) {
 	samplers := map[string]Sampler{
-		"Greedy":   NewSampler(0, 0, 0, 0, 0, nil), // Use NewSampler with temp=0 for greedy
-		"Weighted": NewSampler(0.5, 10, 0.9, 0.2, -1, nil),
+		"Greedy":   NewSampler(Options{}), // Use NewSampler with temp=0 for greedy
+		"Weighted": NewSampler(Options{Temperature: 0.5, TopK: 10, TopP: 0.9, MinP: 0.2, Seed: -1}),
 	}
 
 	// Generate random logits for benchmarking
@@ -1,6 +1,7 @@
 package sample
 
 import (
+	"cmp"
 	"container/heap"
 	"math"
 	"slices"
@@ -34,6 +35,31 @@ func temperature(ts []token, temp float32) {
 	}
 }
 
+// penalties applies repeat, frequency and presence penalties to the logits
+// of tokens that appear in history. requires ts to be indexed by token id
+func penalties(ts []token, history []int32, repeat, frequency, presence float32) {
+	counts := make(map[int32]int, len(history))
+	for _, id := range history {
+		counts[id]++
+	}
+
+	for id, count := range counts {
+		if id < 0 || int(id) >= len(ts) {
+			continue
+		}
+
+		// divide positive logits and multiply negative ones so that the
+		// penalty always makes the token less likely
+		if ts[id].value <= 0 {
+			ts[id].value *= repeat
+		} else {
+			ts[id].value /= repeat
+		}
+
+		ts[id].value -= float32(count)*frequency + presence
+	}
+}
+
 // softmax applies normalization to the logits
 func softmax(ts []token) {
 	// Find max logit for numerical stability
@@ -128,3 +154,110 @@ func minP(ts []token, p float32) []token {
 	}
 	return ts
 }
+
+// typicalP limits tokens to the locally typical set: those whose information
+// content is closest to the entropy of the distribution, up to a cumulative
+// probability of p. The result is renormalized and sorted in descending order
+// of probabilities. requires ts to be normalized probabilities
+func typicalP(ts []token, p float32) []token {
+	if p >= 1.0 {
+		return ts
+	}
+
+	var entropy float64
+	for _, t := range ts {
+		if t.value > 0 {
+			entropy -= float64(t.value) * math.Log(float64(t.value))
+		}
+	}
+
+	// sort by the distance between each token's information content and
+	// the entropy
+	type scored struct {
+		token
+		distance float64
+	}
+
+	ss := make([]scored, len(ts))
+	for i, t := range ts {
+		ss[i] = scored{t, math.Abs(-math.Log(float64(t.value)) - entropy)}
+	}
+
+	slices.SortStableFunc(ss, func(a, b scored) int {
+		return cmp.Compare(a.distance, b.distance)
+	})
+
+	for i := range ss {
+		ts[i] = ss[i].token
+	}
+
+	// Find cutoff index where cumulative sum exceeds p
+	var sum float32
+	n := len(ts)
+	for i, t := range ts {
+		sum += t.value
+		if sum > p {
+			n = i + 1
+			break
+		}
+	}
+
+	ts = ts[:n]
+
+	var total float32
+	for _, t := range ts {
+		total += t.value
+	}
+
+	for i := range ts {
+		ts[i].value /= total
+	}
+
+	slices.SortStableFunc(ts, func(a, b token) int {
+		return cmp.Compare(b.value, a.value)
+	})
+
+	return ts
+}
+
+// mirostatV1 limits tokens to the top k, where k is estimated from the Zipf
+// exponent of the m most likely tokens so that the expected surprise is mu.
+// n is the size of the vocabulary. requires ts to be sorted in descending order
+// of probabilities
+func mirostatV1(ts []token, mu float32, m int, n int) []token {
+	m = min(m, len(ts))
+
+	// estimate the Zipf exponent s from the ratio of consecutive probabilities
+	var sumTiBi, sumTiSq float64
+	for i := range m - 1 {
+		ti := math.Log(float64(i+2) / float64(i+1))
+		bi := math.Log(float64(ts[i].value) / float64(ts[i+1].value))
+		sumTiBi += ti * bi
+		sumTiSq += ti * ti
+	}
+
+	if sumTiSq == 0 || math.IsNaN(sumTiBi) || math.IsInf(sumTiBi, 0) {
+		return ts[:1]
+	}
+
+	sHat := sumTiBi / sumTiSq
+	epsilonHat := sHat - 1
+	k := math.Pow(epsilonHat*math.Pow(2, float64(mu))/(1-math.Pow(float64(n), -epsilonHat)), 1/sHat)
+	if math.IsNaN(k) || k < 1 {
+		return ts[:1]
+	}
+
+	return ts[:int(min(k, float64(len(ts))))]
+}
+
+// mirostatV2 limits tokens to those with surprise no greater than mu, keeping
+// at least one. requires ts to be sorted in descending order of probabilities
+func mirostatV2(ts []token, mu float32) []token {
+	for i, t := range ts {
+		if -math.Log2(float64(t.value)) > float64(mu) {
+			return ts[:max(i, 1)]
+		}
+	}
+
+	return ts
+}
@@ -52,6 +52,33 @@ func TestTemperature(t *testing.T) {
 	compareLogits(t, "temperature(0)", want, tokens)
 }
 
+func TestPenalties(t *testing.T) {
+	input := []float32{1.0, 4.0, -2.0, 0.0}
+	tokens := toTokens(input)
+	penalties(tokens, []int32{1, 2}, 2.0, 0, 0)
+	want := []float32{1.0, 2.0, -4.0, 0.0}
+	compareLogits(t, "penalties(repeat=2)", want, tokens)
+
+	tokens = toTokens(input)
+	penalties(tokens, []int32{1, 1, 1, 3}, 1.0, 0.5, 0)
+	want = []float32{1.0, 2.5, -2.0, -0.5}
+	compareLogits(t, "penalties(frequency=0.5)", want, tokens)
+
+	tokens = toTokens(input)
+	penalties(tokens, []int32{1, 1, 1, 3}, 1.0, 0, 0.5)
+	want = []float32{1.0, 3.5, -2.0, -0.5}
+	compareLogits(t, "penalties(presence=0.5)", want, tokens)
+
+	tokens = toTokens(input)
+	penalties(tokens, []int32{0, 0, -1, 10}, 2.0, 0.25, 0.5)
+	want = []float32{-0.5, 4.0, -2.0, 0.0}
+	compareLogits(t, "penalties(combined)", want, tokens)
+
+	tokens = toTokens(input)
+	penalties(tokens, nil, 2.0, 0.25, 0.5)
+	compareLogits(t, "penalties(no history)", input, tokens)
+}
+
 func TestSoftmax(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -295,6 +322,121 @@ func TestMinP(t *testing.T) {
 	}
 }
 
+func TestTypicalP(t *testing.T) {
+	input := []float32{-3, -2, -1, 0, 1, 2, 4}
+	tokens := toTokens(input)
+	softmax(tokens)
+	tokens = topK(tokens, 20)
+
+	// Should keep all tokens since p is 1
+	got := typicalP(tokens, 1.0)
+	if len(got) != len(input) {
+		t.Errorf("typicalP(1.0): should keep all tokens, got %d, want %d", len(got), len(input))
+	}
+
+	tokens = toTokens(input)
+	softmax(tokens)
+	got = typicalP(tokens, 0.5)
+	if len(got) != 1 {
+		t.Fatalf("typicalP(0.5): wrong length: want 1, got %d", len(got))
+	}
+	compareLogits(t, "typicalP(0.5)", []float32{1.0}, got)
+
+	// the most likely token is not the most typical in a flat distribution
+	// with a single outlier
+	input = []float32{10, 1, 1, 1, 1, 1, 1, 1, 1}
+	tokens = toTokens(input)
+	softmax(tokens)
+	got = typicalP(tokens, 0.9)
+	if len(got) == 0 {
+		t.Fatal("typicalP should keep at least one token")
+	}
+	if got[0].id != 0 {
+		t.Errorf("typicalP(0.9): want token 0 first, got %d", got[0].id)
+	}
+
+	var sum float32
+	for i, tok := range got {
+		sum += tok.value
+		if i > 0 && tok.value > got[i-1].value {
+			t.Errorf("typicalP(0.9): not sorted at index %d", i)
+		}
+	}
+	if math.Abs(float64(sum-1.0)) > 1e-6 {
+		t.Errorf("typicalP(0.9): probabilities don't sum to 1: got %f", sum)
+	}
+
+	// the most likely token is atypical when many tokens share the rest
+	// of the probability mass
+	input = make([]float32, 21)
+	input[0] = 2
+	tokens = toTokens(input)
+	softmax(tokens)
+	got = typicalP(tokens, 0.3)
+	if len(got) != 9 {
+		t.Errorf("typicalP(0.3): wrong length: want 9, got %d", len(got))
+	}
+	for _, tok := range got {
+		if tok.id == 0 {
+			t.Errorf("typicalP(0.3): atypical token 0 should be removed")
+		}
+	}
+}
+
+func TestMirostatV1(t *testing.T) {
+	// Zipf distribution with exponent 1
+	input := make([]float32, 1000)
+	for i := range input {
+		input[i] = -float32(math.Log(float64(i + 1)))
+	}
+
+	tokens := toTokens(input)
+	tokens = topK(tokens, -1)
+	softmax(tokens)
+
+	got := mirostatV1(tokens, 10, 100, len(tokens))
+	if len(got) < 2 || len(got) >= len(input) {
+		t.Errorf("mirostatV1(10): wrong length: got %d", len(got))
+	}
+
+	low := mirostatV1(tokens, 2, 100, len(tokens))
+	if len(low) >= len(got) {
+		t.Errorf("mirostatV1: lower mu should keep fewer tokens: got %d, want < %d", len(low), len(got))
+	}
+
+	got = mirostatV1(tokens, -10, 100, len(tokens))
+	if len(got) != 1 {
+		t.Errorf("mirostatV1(-10): should keep one token, got %d", len(got))
+	}
+
+	// a single token cannot estimate the exponent
+	got = mirostatV1(tokens[:1], 10, 100, len(tokens))
+	if len(got) != 1 {
+		t.Errorf("mirostatV1: should keep one token, got %d", len(got))
+	}
+}
+
+func TestMirostatV2(t *testing.T) {
+	input := []float32{0.5, 0.25, 0.125, 0.0625, 0.0625}
+	tokens := toTokens(input)
+
+	// surprises are 1, 2, 3, 4 and 4 bits
+	got := mirostatV2(tokens, 2.5)
+	if len(got) != 2 {
+		t.Errorf("mirostatV2(2.5): wrong length: want 2, got %d", len(got))
+	}
+
+	got = mirostatV2(tokens, 10)
+	if len(got) != len(input) {
+		t.Errorf("mirostatV2(10): should keep all tokens, got %d", len(got))
+	}
+
+	got = mirostatV2(tokens, 0)
+	if len(got) != 1 {
+		t.Errorf("mirostatV2(0): should keep one token, got %d", len(got))
+	}
+}
+
 func BenchmarkTransforms(b *testing.B) {
 	// Generate random logits
 	tokens := make([]token, 1<<16)
@@ -315,6 +457,19 @@ func BenchmarkTransforms(b *testing.B) {
 		}
 	})
 
+	b.Run("Penalties", func(b *testing.B) {
+		history := make([]int32, 64)
+		for i := range history {
+			history[i] = rand.Int32N(int32(len(tokens)))
+		}
+
+		b.ResetTimer()
+		for b.Loop() {
+			copy(tokensCopy, tokens)
+			penalties(tokensCopy, history, 1.1, 0.1, 0.1)
+		}
+	})
+
 	b.Run("Softmax", func(b *testing.B) {
 		b.ResetTimer()
 		for b.Loop() {
@@ -347,6 +502,15 @@ func BenchmarkTransforms(b *testing.B) {
 		}
 	})
 
+	b.Run("TypicalP", func(b *testing.B) {
+		b.ResetTimer()
+		for b.Loop() {
+			copy(tokensCopy, tokens)
+			softmax(tokensCopy)
+			typicalP(tokensCopy, 0.9)
+		}
+	})
+
 	b.Run("SortTokens", func(b *testing.B) {
 		b.ResetTimer()
 		for b.Loop() {
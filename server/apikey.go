@@ -0,0 +1,205 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// apiKeyNameKey is the key of the name of a request's API key in its
+// [gin.Context]
+const apiKeyNameKey = "ollama.apikey"
+
+// role is what an API key is allowed to do. Each role can do everything
+// that the roles before it can
+type role int
+
+const (
+	// roleInference can run and list models
+	roleInference role = iota + 1
+
+	// roleModelManagement can also pull, push, create, copy and delete
+	// models
+	roleModelManagement
+
+	// roleAdmin can also see how clients are using the server
+	roleAdmin
+)
+
+func (r role) String() string {
+	switch r {
+	case roleInference:
+		return "inference"
+	case roleModelManagement:
+		return "model-management"
+	case roleAdmin:
+		return "admin"
+	default:
+		return "unknown"
+	}
+}
+
+func (r *role) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	for _, v := range []role{roleInference, roleModelManagement, roleAdmin} {
+		if s == v.String() {
+			*r = v
+			return nil
+		}
+	}
+
+	return fmt.Errorf("invalid role %q", s)
+}
+
+// apiKeyConfig is the format of the file that OLLAMA_AUTH_KEYS names
+type apiKeyConfig struct {
+	Keys []struct {
+		Name string `json:"name"`
+		Key  string `json:"key"`
+		Role role   `json:"role"`
+	} `json:"keys"`
+}
+
+type apiKey struct {
+	name string
+	role role
+}
+
+// apiKeys are the API keys that requests must authenticate with, by the
+// SHA-256 digest of the key so that looking them up doesn't reveal them
+type apiKeys map[[sha256.Size]byte]apiKey
+
+// loadAPIKeys reads the API keys in the file at path. Authentication is
+// disabled if path is empty
+func loadAPIKeys(path string) (apiKeys, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var config apiKeyConfig
+	d := json.NewDecoder(f)
+	d.DisallowUnknownFields()
+	if err := d.Decode(&config); err != nil {
+		return nil, fmt.Errorf("auth keys: %w", err)
+	}
+
+	return newAPIKeys(config)
+}
+
+func newAPIKeys(config apiKeyConfig) (apiKeys, error) {
+	if len(config.Keys) == 0 {
+		return nil, errors.New("auth keys: no keys are listed")
+	}
+
+	keys := make(apiKeys)
+	for _, k := range config.Keys {
+		switch {
+		case k.Name == "":
+			return nil, errors.New("auth keys: key name is required")
+		case len(k.Key) < 16:
+			return nil, fmt.Errorf("auth keys: key %q must be at least 16 characters", k.Name)
+		case k.Role == 0:
+			return nil, fmt.Errorf("auth keys: key %q has no role", k.Name)
+		}
+
+		digest := sha256.Sum256([]byte(k.Key))
+		if _, ok := keys[digest]; ok {
+			return nil, fmt.Errorf("auth keys: key %q is listed more than once", k.Name)
+		}
+
+		keys[digest] = apiKey{name: k.Name, role: k.Role}
+	}
+
+	return keys, nil
+}
+
+// requestKey returns the bearer token of a request, or the API key of an
+// Anthropic compatible request
+func requestKey(r *http.Request) string {
+	if key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return key
+	}
+
+	return r.Header.Get("x-api-key")
+}
+
+// authorize returns the API key of a request if it has at least role r, or
+// the status code and error to respond with otherwise
+func (keys apiKeys) authorize(req *http.Request, r role) (apiKey, int, error) {
+	key, ok := keys[sha256.Sum256([]byte(requestKey(req)))]
+	if !ok {
+		return apiKey{}, http.StatusUnauthorized, errors.New("unauthorized: missing or invalid API key")
+	}
+
+	if key.role < r {
+		return apiKey{}, http.StatusForbidden, fmt.Errorf("forbidden: API key %q doesn't have the %s role", key.name, r)
+	}
+
+	return key, 0, nil
+}
+
+// require rejects requests that don't authenticate with an API key that
+// has at least role r. All requests are allowed if keys is nil
+func (keys apiKeys) require(r role) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if keys == nil {
+			c.Next()
+			return
+		}
+
+		key, status, err := keys.authorize(c.Request, r)
+		if err != nil {
+			if status == http.StatusUnauthorized {
+				c.Header("WWW-Authenticate", "Bearer")
+			}
+
+			c.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.Set(apiKeyNameKey, key.name)
+		c.Next()
+	}
+}
+
+// registryHandler requires the model management role for the requests that
+// h handles itself instead of passing them on to the routes
+func (keys apiKeys) registryHandler(h http.Handler) http.Handler {
+	if keys == nil {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/delete", "/api/pull":
+			if _, status, err := keys.authorize(r, roleModelManagement); err != nil {
+				if status == http.StatusUnauthorized {
+					w.Header().Set("WWW-Authenticate", "Bearer")
+				}
+
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(status)
+				json.NewEncoder(w).Encode(map[string]string{"error": err.Error()}) //nolint:errcheck
+				return
+			}
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
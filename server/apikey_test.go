@@ -0,0 +1,141 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ollama/ollama/server/internal/client/ollama"
+)
+
+func TestNewAPIKeys(t *testing.T) {
+	cases := []struct {
+		name   string
+		config string
+		err    string
+	}{
+		{
+			name:   "no keys",
+			config: `{"keys": []}`,
+			err:    "auth keys: no keys are listed",
+		},
+		{
+			name:   "missing name",
+			config: `{"keys": [{"key": "0123456789abcdef", "role": "admin"}]}`,
+			err:    "auth keys: key name is required",
+		},
+		{
+			name:   "short key",
+			config: `{"keys": [{"name": "a", "key": "secret", "role": "admin"}]}`,
+			err:    `auth keys: key "a" must be at least 16 characters`,
+		},
+		{
+			name:   "missing role",
+			config: `{"keys": [{"name": "a", "key": "0123456789abcdef"}]}`,
+			err:    `auth keys: key "a" has no role`,
+		},
+		{
+			name:   "duplicate key",
+			config: `{"keys": [{"name": "a", "key": "0123456789abcdef", "role": "admin"}, {"name": "b", "key": "0123456789abcdef", "role": "inference"}]}`,
+			err:    `auth keys: key "b" is listed more than once`,
+		},
+		{
+			name:   "valid",
+			config: `{"keys": [{"name": "a", "key": "0123456789abcdef", "role": "model-management"}]}`,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			var config apiKeyConfig
+			if err := json.Unmarshal([]byte(tt.config), &config); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := newAPIKeys(config)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else if err == nil || err.Error() != tt.err {
+				t.Fatalf("expected error %q, got %v", tt.err, err)
+			}
+		})
+	}
+
+	var config apiKeyConfig
+	if err := json.Unmarshal([]byte(`{"keys": [{"name": "a", "key": "0123456789abcdef", "role": "root"}]}`), &config); err == nil {
+		t.Error("expected error for unknown role")
+	}
+}
+
+func TestAPIKeyRoutes(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	const (
+		inferenceKey = "inference-0123456789"
+		manageKey    = "manage-0123456789"
+		adminKey     = "admin-0123456789"
+	)
+
+	var config apiKeyConfig
+	if err := json.Unmarshal([]byte(`{"keys": [
+		{"name": "app", "key": "`+inferenceKey+`", "role": "inference"},
+		{"name": "ci", "key": "`+manageKey+`", "role": "model-management"},
+		{"name": "ops", "key": "`+adminKey+`", "role": "admin"}
+	]}`), &config); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := newAPIKeys(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{keys: keys}
+	router, err := s.GenerateRoutes(&ollama.Registry{HTTPClient: panicOnRoundTrip})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name         string
+		method, path string
+		header, key  string
+		body         string
+		status       int
+	}{
+		{name: "public", method: http.MethodGet, path: "/api/version", status: http.StatusOK},
+		{name: "missing key", method: http.MethodGet, path: "/api/tags", status: http.StatusUnauthorized},
+		{name: "invalid key", method: http.MethodGet, path: "/api/tags", header: "Authorization", key: "Bearer nope", status: http.StatusUnauthorized},
+		{name: "inference", method: http.MethodGet, path: "/api/tags", header: "Authorization", key: "Bearer " + inferenceKey, status: http.StatusOK},
+		{name: "anthropic key", method: http.MethodGet, path: "/v1/models", header: "x-api-key", key: inferenceKey, status: http.StatusOK},
+		{name: "inference copy", method: http.MethodPost, path: "/api/copy", header: "Authorization", key: "Bearer " + inferenceKey, body: "{}", status: http.StatusForbidden},
+		{name: "manage copy", method: http.MethodPost, path: "/api/copy", header: "Authorization", key: "Bearer " + manageKey, body: "{}", status: http.StatusBadRequest},
+		{name: "inference delete", method: http.MethodDelete, path: "/api/delete", header: "Authorization", key: "Bearer " + inferenceKey, body: `{"model": "missing"}`, status: http.StatusForbidden},
+		{name: "missing key pull", method: http.MethodPost, path: "/api/pull", body: `{"model": "missing"}`, status: http.StatusUnauthorized},
+		{name: "manage quotas", method: http.MethodGet, path: "/api/quotas", header: "Authorization", key: "Bearer " + manageKey, status: http.StatusForbidden},
+		{name: "admin quotas", method: http.MethodGet, path: "/api/quotas", header: "Authorization", key: "Bearer " + adminKey, status: http.StatusOK},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, bytes.NewBufferString(tt.body))
+			if tt.header != "" {
+				req.Header.Set(tt.header, tt.key)
+			}
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if w.Code != tt.status {
+				t.Fatalf("expected status %d, got %d: %s", tt.status, w.Code, w.Body.String())
+			}
+
+			if tt.status == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") != "Bearer" {
+				t.Errorf("expected WWW-Authenticate header, got %q", w.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"io"
 	"log"
 	"log/slog"
+	"maps"
 	"net"
 	"net/http"
 	"net/url"
@@ -37,6 +38,7 @@ var (
 	errCapabilityInsert     = errors.New("insert")
 	errCapabilityVision     = errors.New("vision")
 	errCapabilityEmbedding  = errors.New("embedding")
+	errCapabilityRerank     = errors.New("rerank")
 	errInsecureProtocol     = errors.New("insecure protocol http")
 )
 
@@ -77,8 +79,14 @@ func (m *Model) Capabilities() []model.Capability {
 
 		f, _, err := ggml.Decode(r, 0)
 		if err == nil {
-			if _, ok := f.KV()[fmt.Sprintf("%s.pooling_type", f.KV().Architecture())]; ok {
-				capabilities = append(capabilities, model.CapabilityEmbedding)
+			if pooling, ok := f.KV()[fmt.Sprintf("%s.pooling_type", f.KV().Architecture())]; ok {
+				// models with rank pooling have a classification head that
+				// scores pairs of texts rather than embedding them
+				if pooling == uint32(4) {
+					capabilities = append(capabilities, model.CapabilityRerank)
+				} else {
+					capabilities = append(capabilities, model.CapabilityEmbedding)
+				}
 			} else {
 				capabilities = append(capabilities, model.CapabilityCompletion)
 			}
@@ -122,6 +130,7 @@ func (m *Model) CheckCapabilities(want ...model.Capability) error {
 		model.CapabilityInsert:     errCapabilityInsert,
 		model.CapabilityVision:     errCapabilityVision,
 		model.CapabilityEmbedding:  errCapabilityEmbedding,
+		model.CapabilityRerank:     errCapabilityRerank,
 	}
 
 	for _, cap := range want {
@@ -188,6 +197,13 @@ func (m *Model) String() string {
 					Args: fmt.Sprintf("%v", s),
 				})
 			}
+		case map[string]any:
+			for _, mk := range slices.Sorted(maps.Keys(v)) {
+				modelfile.Commands = append(modelfile.Commands, parser.Command{
+					Name: k,
+					Args: fmt.Sprintf("%s:%v", mk, v[mk]),
+				})
+			}
 		default:
 			modelfile.Commands = append(modelfile.Commands, parser.Command{
 				Name: k,
@@ -8,6 +8,7 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/ollama/ollama/fs/ggml"
 	"github.com/ollama/ollama/template"
 	"github.com/ollama/ollama/types/model"
 )
@@ -116,6 +117,10 @@ func TestModelCapabilities(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to create embedding model file: %v", err)
 	}
+	rerankModelPath, _ := createBinFile(t, ggml.KV{
+		"general.architecture": "bert",
+		"bert.pooling_type":    uint32(4),
+	}, nil)
 	err = os.WriteFile(simpleModelPath, []byte("dummy model data"), 0o644)
 	if err != nil {
 		t.Fatalf("Failed to create simple model file: %v", err)
@@ -196,6 +201,14 @@ func TestModelCapabilities(t *testing.T) {
 			},
 			expectedCaps: []model.Capability{model.CapabilityEmbedding},
 		},
+		{
+			name: "model with rerank capability",
+			model: Model{
+				ModelPath: rerankModelPath,
+				Template:  chatTemplate,
+			},
+			expectedCaps: []model.Capability{model.CapabilityRerank},
+		},
 	}
 
 	// compare two slices of model.Capability regardless of order
@@ -258,6 +271,10 @@ func TestModelCheckCapabilities(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to create embedding model file: %v", err)
 	}
+	rerankModelPath, _ := createBinFile(t, ggml.KV{
+		"general.architecture": "bert",
+		"bert.pooling_type":    uint32(4),
+	}, nil)
 
 	toolsInsertTemplate, err := template.Parse("{{ .prompt }}{{ if .tools }}{{ .tools }}{{ end }}{{ if .suffix }}{{ .suffix }}{{ end }}")
 	if err != nil {
@@ -329,6 +346,23 @@ func TestModelCheckCapabilities(t *testing.T) {
 			},
 			checkCaps: []model.Capability{model.CapabilityEmbedding},
 		},
+		{
+			name: "model with rerank capability",
+			model: Model{
+				ModelPath: rerankModelPath,
+				Template:  chatTemplate,
+			},
+			checkCaps: []model.Capability{model.CapabilityRerank},
+		},
+		{
+			name: "embedding model missing rerank capability",
+			model: Model{
+				ModelPath: embeddingModelPath,
+				Template:  chatTemplate,
+			},
+			checkCaps:      []model.Capability{model.CapabilityRerank},
+			expectedErrMsg: "does not support rerank",
+		},
 		{
 			name: "unknown capability",
 			model: Model{
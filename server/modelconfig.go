@@ -0,0 +1,226 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/types/model"
+)
+
+// warmInterval is how often the server checks that preloaded models are
+// still running
+var warmInterval = 10 * time.Second
+
+// modelConfig is the format of the file that OLLAMA_MODEL_CONFIG names. It
+// configures how the server runs particular models
+type modelConfig struct {
+	Models []modelSettings `json:"models"`
+}
+
+// modelSettings are how the server runs a model. Its options take
+// precedence over the parameters of the model's Modelfile, but not over the
+// options of a request
+type modelSettings struct {
+	Model   string         `json:"model"`
+	Options map[string]any `json:"options"`
+
+	// Preload loads the model when the server starts and keeps it loaded.
+	// It isn't unloaded to make room for other models, and it's loaded
+	// again if its runner exits
+	Preload bool `json:"preload"`
+
+	// KeepAlive is how long the model stays loaded after requests that
+	// don't set keep_alive, instead of OLLAMA_KEEP_ALIVE
+	KeepAlive *api.Duration `json:"keep_alive"`
+
+	// NumParallel is how many requests the model runs at a time, instead
+	// of OLLAMA_NUM_PARALLEL
+	NumParallel int `json:"num_parallel"`
+
+	name model.Name
+}
+
+// loadModelConfig reads the model configuration in the file at path. No
+// models are configured if path is empty
+func loadModelConfig(path string) (*modelConfig, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var config modelConfig
+	d := json.NewDecoder(f)
+	d.DisallowUnknownFields()
+	if err := d.Decode(&config); err != nil {
+		return nil, fmt.Errorf("model config: %w", err)
+	}
+
+	if err := config.init(); err != nil {
+		return nil, err
+	}
+
+	return &config, nil
+}
+
+// init checks the names and options of the configured models
+func (c *modelConfig) init() error {
+	for i := range c.Models {
+		m := &c.Models[i]
+		m.name = model.ParseName(m.Model)
+		if !m.name.IsValid() {
+			return fmt.Errorf("model config: invalid model name %q", m.Model)
+		}
+
+		for _, o := range c.Models[:i] {
+			if o.name.EqualFold(m.name) {
+				return fmt.Errorf("model config: model %q is listed more than once", m.Model)
+			}
+		}
+
+		opts := api.DefaultOptions()
+		if err := opts.FromMap(m.Options); err != nil {
+			return fmt.Errorf("model config: %s: %w", m.Model, err)
+		}
+
+		if err := checkPlacement(opts.Runner); err != nil {
+			return fmt.Errorf("model config: %s: %w", m.Model, err)
+		}
+
+		if m.NumParallel < 0 {
+			return fmt.Errorf("model config: %s: num_parallel can't be negative", m.Model)
+		}
+	}
+
+	return nil
+}
+
+// settings returns the settings of the model with the given name, or nil
+// if it isn't configured
+func (c *modelConfig) settings(name string) *modelSettings {
+	if c == nil {
+		return nil
+	}
+
+	n := model.ParseName(name)
+	for i := range c.Models {
+		if c.Models[i].name.EqualFold(n) {
+			return &c.Models[i]
+		}
+	}
+
+	return nil
+}
+
+// options returns the options configured for the model with the given
+// name, or nil if it isn't configured
+func (c *modelConfig) options(name string) map[string]any {
+	if m := c.settings(name); m != nil {
+		return m.Options
+	}
+
+	return nil
+}
+
+// keepAlive returns how long the model with the given name stays loaded
+// after a request that asks for keepAlive, or nil for the default
+func (c *modelConfig) keepAlive(name string, keepAlive *api.Duration) *api.Duration {
+	if keepAlive != nil {
+		return keepAlive
+	}
+
+	if m := c.settings(name); m != nil {
+		return m.KeepAlive
+	}
+
+	return nil
+}
+
+// numParallel returns how many requests the model with the given name runs
+// at a time, or 0 to use OLLAMA_NUM_PARALLEL
+func (c *modelConfig) numParallel(name string) int {
+	if m := c.settings(name); m != nil {
+		return m.NumParallel
+	}
+
+	return 0
+}
+
+// preloaded reports whether the model with the given name is kept loaded
+func (c *modelConfig) preloaded(name string) bool {
+	if m := c.settings(name); m != nil {
+		return m.Preload
+	}
+
+	return false
+}
+
+// preloads returns the names of the models that are kept loaded
+func (c *modelConfig) preloads() []string {
+	if c == nil {
+		return nil
+	}
+
+	var names []string
+	for _, m := range c.Models {
+		if m.Preload {
+			names = append(names, m.Model)
+		}
+	}
+
+	return names
+}
+
+// keepWarm loads the preloaded models, and loads them again whenever their
+// runner isn't running, until ctx is done
+func (s *Server) keepWarm(ctx context.Context) {
+	names := s.config.preloads()
+	if len(names) == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(warmInterval)
+	defer ticker.Stop()
+	for {
+		for _, name := range names {
+			if err := s.warm(ctx, name); err != nil {
+				slog.Warn("failed to preload model", "model", name, "error", err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// warm loads the model with the given name if it isn't running
+func (s *Server) warm(ctx context.Context, name string) error {
+	m, err := GetModel(name)
+	if err != nil {
+		return err
+	}
+
+	if s.sched.running(ctx, m) {
+		return nil
+	}
+
+	slog.Info("preloading model", "model", name)
+
+	// the runner is released once it has loaded
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	_, _, _, err = s.scheduleRunner(withSchedInfo(ctx, "preload", ""), name, nil, nil, nil)
+	return err
+}
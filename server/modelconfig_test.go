@@ -0,0 +1,121 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+)
+
+func TestModelConfig(t *testing.T) {
+	cases := []struct {
+		name   string
+		config string
+		err    string
+	}{
+		{
+			name:   "invalid name",
+			config: `{"models": [{"model": "://"}]}`,
+			err:    `model config: invalid model name "://"`,
+		},
+		{
+			name:   "duplicate model",
+			config: `{"models": [{"model": "llama3.2"}, {"model": "LLAMA3.2:latest"}]}`,
+			err:    `model config: model "LLAMA3.2:latest" is listed more than once`,
+		},
+		{
+			name:   "invalid option",
+			config: `{"models": [{"model": "llama3.2", "options": {"num_ctx": "large"}}]}`,
+			err:    `model config: llama3.2: option "num_ctx" must be of type integer`,
+		},
+		{
+			name:   "invalid placement",
+			config: `{"models": [{"model": "llama3.2", "options": {"placement": "random"}}]}`,
+			err:    `model config: llama3.2: invalid placement: placement must be "binpack" or "spread", not "random"`,
+		},
+		{
+			name:   "negative parallel",
+			config: `{"models": [{"model": "llama3.2", "num_parallel": -1}]}`,
+			err:    "model config: llama3.2: num_parallel can't be negative",
+		},
+		{
+			name:   "valid",
+			config: `{"models": [{"model": "llama3.2", "options": {"gpus": ["GPU-1"], "placement": "binpack", "max_vram_fraction": 0.5}}]}`,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			var config modelConfig
+			if err := json.Unmarshal([]byte(tt.config), &config); err != nil {
+				t.Fatal(err)
+			}
+
+			err := config.init()
+			if tt.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else if err == nil || err.Error() != tt.err {
+				t.Fatalf("expected error %q, got %v", tt.err, err)
+			}
+		})
+	}
+
+	var config modelConfig
+	if err := json.Unmarshal([]byte(`{"models": [
+		{"model": "llama3.2", "options": {"placement": "spread"}, "keep_alive": "1h", "num_parallel": 2},
+		{"model": "qwen3:8b", "preload": true}
+	]}`), &config); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := config.init(); err != nil {
+		t.Fatal(err)
+	}
+
+	if opts := config.options("Llama3.2:latest"); opts["placement"] != "spread" {
+		t.Errorf("expected spread placement, got %v", opts)
+	}
+
+	if opts := config.options("qwen3"); opts != nil {
+		t.Errorf("expected no options, got %v", opts)
+	}
+
+	if d := config.keepAlive("llama3.2", nil); d == nil || d.Duration != time.Hour {
+		t.Errorf("expected keep alive of 1h, got %v", d)
+	}
+
+	if d := config.keepAlive("llama3.2", &api.Duration{}); d == nil || d.Duration != 0 {
+		t.Errorf("expected the request's keep alive, got %v", d)
+	}
+
+	if n := config.numParallel("llama3.2"); n != 2 {
+		t.Errorf("expected 2 parallel requests, got %d", n)
+	}
+
+	if !config.preloaded("qwen3:8b") || config.preloaded("llama3.2") {
+		t.Error("expected only qwen3:8b to be preloaded")
+	}
+
+	if diff := cmp.Diff([]string{"qwen3:8b"}, config.preloads()); diff != "" {
+		t.Errorf("preloads mismatch (-want +got):\n%s", diff)
+	}
+
+	var nilConfig *modelConfig
+	if opts := nilConfig.options("llama3.2"); opts != nil {
+		t.Errorf("expected no options, got %v", opts)
+	}
+
+	if nilConfig.preloaded("llama3.2") || nilConfig.numParallel("llama3.2") != 0 || nilConfig.keepAlive("llama3.2", nil) != nil {
+		t.Error("expected no settings")
+	}
+
+	if err := (&modelConfig{Models: []modelSettings{{Model: "llama3.2", Options: map[string]any{"max_vram_fraction": 2.0}}}}).init(); !errors.Is(err, errInvalidPlacement) {
+		t.Errorf("expected invalid placement error, got %v", err)
+	}
+}
@@ -0,0 +1,338 @@
+package server
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+)
+
+var errQuotaExceeded = errors.New("quota exceeded")
+
+// clientUsageKey is the key of the [clientUsage] of a request in its
+// [gin.Context]
+const clientUsageKey = "ollama.client"
+
+// quotaConfig is the format of the file that OLLAMA_QUOTAS names
+type quotaConfig struct {
+	// Default is the quota of each client that isn't listed in Clients.
+	// These clients are told apart by their IP address
+	Default api.Quota     `json:"default"`
+	Clients []quotaClient `json:"clients"`
+}
+
+// quotaClient is a client that shares one quota between the API keys it
+// sends as bearer tokens and the hosts it sends requests from. Hosts are
+// IP addresses or CIDR prefixes
+type quotaClient struct {
+	Name  string   `json:"name"`
+	Keys  []string `json:"keys"`
+	Hosts []string `json:"hosts"`
+
+	api.Quota
+}
+
+// quotas enforces the quotas of the clients of the inference endpoints
+type quotas struct {
+	def api.Quota
+
+	clients map[string]*clientUsage
+	keys    map[string]*clientUsage
+	hosts   []hostUsage
+
+	// others are the clients that aren't configured, by IP address
+	mu     sync.Mutex
+	others map[string]*clientUsage
+}
+
+type hostUsage struct {
+	prefix netip.Prefix
+	usage  *clientUsage
+}
+
+// clientUsage is the usage of a client that counts against its quota
+type clientUsage struct {
+	name  string
+	quota api.Quota
+
+	mu     sync.Mutex
+	active int
+
+	// requests are the times of the requests allowed in the last minute,
+	// oldest first
+	requests []time.Time
+
+	// tokens have been processed since the start of day
+	day    time.Time
+	tokens int64
+
+	rejected int64
+}
+
+// loadQuotas reads the quotas configured in the file at path, which are
+// disabled if path is empty
+func loadQuotas(path string) (*quotas, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var config quotaConfig
+	d := json.NewDecoder(f)
+	d.DisallowUnknownFields()
+	if err := d.Decode(&config); err != nil {
+		return nil, fmt.Errorf("quotas: %w", err)
+	}
+
+	return newQuotas(config)
+}
+
+func newQuotas(config quotaConfig) (*quotas, error) {
+	q := quotas{
+		def:     config.Default,
+		clients: make(map[string]*clientUsage),
+		keys:    make(map[string]*clientUsage),
+		others:  make(map[string]*clientUsage),
+	}
+
+	for _, client := range config.Clients {
+		if client.Name == "" {
+			return nil, errors.New("quotas: client name is required")
+		}
+
+		if _, ok := q.clients[client.Name]; ok {
+			return nil, fmt.Errorf("quotas: client %q is listed more than once", client.Name)
+		}
+
+		u := &clientUsage{name: client.Name, quota: client.Quota}
+		q.clients[client.Name] = u
+
+		for _, key := range client.Keys {
+			if _, ok := q.keys[key]; ok || key == "" {
+				return nil, fmt.Errorf("quotas: client %q has an empty or duplicate key", client.Name)
+			}
+
+			q.keys[key] = u
+		}
+
+		for _, host := range client.Hosts {
+			prefix, err := netip.ParsePrefix(host)
+			if err != nil {
+				addr, err := netip.ParseAddr(host)
+				if err != nil {
+					return nil, fmt.Errorf("quotas: client %q has invalid host %q", client.Name, host)
+				}
+
+				prefix = netip.PrefixFrom(addr, addr.BitLen())
+			}
+
+			q.hosts = append(q.hosts, hostUsage{prefix: prefix.Masked(), usage: u})
+		}
+	}
+
+	return &q, nil
+}
+
+// middleware rejects requests from clients that are over their quota with
+// 429 Too Many Requests. Requests that are allowed count against the quota
+// of their client while they run
+func (q *quotas) middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if q == nil {
+			c.Next()
+			return
+		}
+
+		now := time.Now()
+		u := q.client(requestKey(c.Request), c.ClientIP(), now)
+		if retry, err := u.acquire(now); err != nil {
+			c.Header("Retry-After", strconv.Itoa(max(1, int(math.Ceil(retry.Seconds())))))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+			return
+		}
+		defer u.release()
+
+		c.Set(clientUsageKey, u)
+		c.Next()
+	}
+}
+
+// client returns the usage of the client a request is from. Requests with
+// a configured key belong to its client, then requests from a configured
+// host. Any other request has the default quota of its IP address
+func (q *quotas) client(key, ip string, now time.Time) *clientUsage {
+	if u, ok := q.keys[key]; ok {
+		return u
+	}
+
+	if addr, err := netip.ParseAddr(ip); err == nil {
+		addr = addr.Unmap()
+		for _, h := range q.hosts {
+			if h.prefix.Contains(addr) {
+				return h.usage
+			}
+		}
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	u, ok := q.others[ip]
+	if !ok {
+		q.forget(now)
+
+		u = &clientUsage{name: ip, quota: q.def}
+		q.others[ip] = u
+	}
+
+	return u
+}
+
+// forget removes the clients that aren't configured and no longer have any
+// usage counting against their quota. q.mu must be held
+func (q *quotas) forget(now time.Time) {
+	for ip, u := range q.others {
+		u.mu.Lock()
+		u.prune(now)
+		idle := u.active == 0 && len(u.requests) == 0 && u.tokens == 0
+		u.mu.Unlock()
+
+		if idle {
+			delete(q.others, ip)
+		}
+	}
+}
+
+// usage reports the usage of every configured client and of the other
+// clients that have recently sent requests, sorted by name
+func (q *quotas) usage(now time.Time) []api.ClientQuota {
+	q.mu.Lock()
+	q.forget(now)
+	clients := make([]*clientUsage, 0, len(q.clients)+len(q.others))
+	for _, u := range q.clients {
+		clients = append(clients, u)
+	}
+	for _, u := range q.others {
+		clients = append(clients, u)
+	}
+	q.mu.Unlock()
+
+	usage := make([]api.ClientQuota, 0, len(clients))
+	for _, u := range clients {
+		u.mu.Lock()
+		u.prune(now)
+		usage = append(usage, api.ClientQuota{
+			Name:               u.name,
+			Quota:              u.quota,
+			ActiveRequests:     u.active,
+			RequestsLastMinute: len(u.requests),
+			TokensToday:        u.tokens,
+			RejectedRequests:   u.rejected,
+		})
+		u.mu.Unlock()
+	}
+
+	slices.SortFunc(usage, func(a, b api.ClientQuota) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+
+	return usage
+}
+
+// acquire counts a request at now against the client's quota. If the client
+// is over its quota, it returns an error and how long to wait before
+// retrying
+func (u *clientUsage) acquire(now time.Time) (time.Duration, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.prune(now)
+
+	var retry time.Duration
+	var err error
+	switch {
+	case u.quota.ConcurrentRequests > 0 && u.active >= u.quota.ConcurrentRequests:
+		retry = time.Second
+		err = fmt.Errorf("%w: %d concurrent requests", errQuotaExceeded, u.quota.ConcurrentRequests)
+	case u.quota.RequestsPerMinute > 0 && len(u.requests) >= u.quota.RequestsPerMinute:
+		retry = u.requests[len(u.requests)-u.quota.RequestsPerMinute].Add(time.Minute).Sub(now)
+		err = fmt.Errorf("%w: %d requests per minute", errQuotaExceeded, u.quota.RequestsPerMinute)
+	case u.quota.TokensPerDay > 0 && u.tokens >= u.quota.TokensPerDay:
+		retry = u.day.Add(24 * time.Hour).Sub(now)
+		err = fmt.Errorf("%w: %d tokens per day", errQuotaExceeded, u.quota.TokensPerDay)
+	}
+
+	if err != nil {
+		u.rejected++
+		return retry, err
+	}
+
+	u.active++
+	u.requests = append(u.requests, now)
+	return 0, nil
+}
+
+// release ends a request allowed by acquire
+func (u *clientUsage) release() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.active--
+}
+
+// addTokens counts n tokens processed at now against the client's quota
+func (u *clientUsage) addTokens(now time.Time, n int) {
+	if u == nil {
+		return
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.prune(now)
+	u.tokens += int64(n)
+}
+
+// prune drops the usage that no longer counts against the client's quota
+// at now. Requests count for a minute and tokens until the end of the day,
+// in UTC. u.mu must be held
+func (u *clientUsage) prune(now time.Time) {
+	i := 0
+	for i < len(u.requests) && !u.requests[i].After(now.Add(-time.Minute)) {
+		i++
+	}
+	u.requests = slices.Delete(u.requests, 0, i)
+
+	if day := now.UTC().Truncate(24 * time.Hour); !u.day.Equal(day) {
+		u.day = day
+		u.tokens = 0
+	}
+}
+
+// requestUsage returns the usage of the client of a request, or nil if
+// quotas are disabled. Handlers get it before starting work that can outlive
+// the request, since c is reused for other requests once they return
+func requestUsage(c *gin.Context) *clientUsage {
+	if u, ok := c.Get(clientUsageKey); ok {
+		return u.(*clientUsage)
+	}
+
+	return nil
+}
@@ -0,0 +1,289 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+)
+
+func TestNewQuotas(t *testing.T) {
+	cases := []struct {
+		name   string
+		config quotaConfig
+		err    string
+	}{
+		{
+			name:   "missing name",
+			config: quotaConfig{Clients: []quotaClient{{Keys: []string{"a"}}}},
+			err:    "quotas: client name is required",
+		},
+		{
+			name:   "duplicate client",
+			config: quotaConfig{Clients: []quotaClient{{Name: "a"}, {Name: "a"}}},
+			err:    `quotas: client "a" is listed more than once`,
+		},
+		{
+			name:   "duplicate key",
+			config: quotaConfig{Clients: []quotaClient{{Name: "a", Keys: []string{"k"}}, {Name: "b", Keys: []string{"k"}}}},
+			err:    `quotas: client "b" has an empty or duplicate key`,
+		},
+		{
+			name:   "invalid host",
+			config: quotaConfig{Clients: []quotaClient{{Name: "a", Hosts: []string{"example.com"}}}},
+			err:    `quotas: client "a" has invalid host "example.com"`,
+		},
+		{
+			name:   "valid",
+			config: quotaConfig{Clients: []quotaClient{{Name: "a", Keys: []string{"k"}, Hosts: []string{"10.0.0.1", "10.1.0.0/16"}}}},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newQuotas(tt.config)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else if err == nil || err.Error() != tt.err {
+				t.Fatalf("expected error %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestQuotasClient(t *testing.T) {
+	q, err := newQuotas(quotaConfig{
+		Default: api.Quota{RequestsPerMinute: 10},
+		Clients: []quotaClient{
+			{Name: "keyed", Keys: []string{"secret"}, Quota: api.Quota{RequestsPerMinute: 100}},
+			{Name: "lab", Hosts: []string{"10.1.0.0/16", "192.168.1.7"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	cases := []struct {
+		key, ip string
+		name    string
+	}{
+		{key: "secret", ip: "10.1.2.3", name: "keyed"},
+		{ip: "10.1.2.3", name: "lab"},
+		{ip: "::ffff:192.168.1.7", name: "lab"},
+		{key: "unknown", ip: "10.2.0.1", name: "10.2.0.1"},
+		{ip: "10.2.0.1", name: "10.2.0.1"},
+	}
+
+	for _, tt := range cases {
+		if u := q.client(tt.key, tt.ip, now); u.name != tt.name {
+			t.Errorf("client(%q, %q) = %q, expected %q", tt.key, tt.ip, u.name, tt.name)
+		}
+	}
+
+	if u := q.client("", "10.2.0.1", now); u.quota != q.def {
+		t.Errorf("expected default quota, got %+v", u.quota)
+	}
+
+	if q.client("", "10.2.0.1", now) != q.client("", "10.2.0.1", now) {
+		t.Error("expected requests from the same address to share usage")
+	}
+
+	// clients that aren't configured are forgotten once they are idle
+	q.client("", "10.3.0.1", now)
+	if _, ok := q.others["10.2.0.1"]; ok {
+		t.Error("expected idle client to be forgotten")
+	}
+}
+
+func TestClientUsage(t *testing.T) {
+	now := time.Date(2025, 6, 1, 23, 0, 0, 0, time.UTC)
+
+	t.Run("concurrent requests", func(t *testing.T) {
+		u := clientUsage{quota: api.Quota{ConcurrentRequests: 2}}
+		for range 2 {
+			if _, err := u.acquire(now); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if _, err := u.acquire(now); !errors.Is(err, errQuotaExceeded) {
+			t.Fatalf("expected quota exceeded, got %v", err)
+		}
+
+		u.release()
+		if _, err := u.acquire(now); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("requests per minute", func(t *testing.T) {
+		u := clientUsage{quota: api.Quota{RequestsPerMinute: 2}}
+		for _, d := range []time.Duration{0, 20 * time.Second} {
+			if _, err := u.acquire(now.Add(d)); err != nil {
+				t.Fatal(err)
+			}
+			u.release()
+		}
+
+		retry, err := u.acquire(now.Add(30 * time.Second))
+		if err == nil || err.Error() != "quota exceeded: 2 requests per minute" {
+			t.Fatalf("expected quota exceeded, got %v", err)
+		}
+
+		if retry != 30*time.Second {
+			t.Errorf("expected to retry in 30s, got %v", retry)
+		}
+
+		if _, err := u.acquire(now.Add(time.Minute + time.Second)); err != nil {
+			t.Fatal(err)
+		}
+
+		if u.rejected != 1 {
+			t.Errorf("expected 1 rejected request, got %d", u.rejected)
+		}
+	})
+
+	t.Run("tokens per day", func(t *testing.T) {
+		u := clientUsage{quota: api.Quota{TokensPerDay: 100}}
+		if _, err := u.acquire(now); err != nil {
+			t.Fatal(err)
+		}
+		u.addTokens(now, 150)
+		u.release()
+
+		// the request that went over the quota is allowed to finish but
+		// the next has to wait until midnight UTC
+		retry, err := u.acquire(now.Add(time.Minute))
+		if err == nil || err.Error() != "quota exceeded: 100 tokens per day" {
+			t.Fatalf("expected quota exceeded, got %v", err)
+		}
+
+		if retry != 59*time.Minute {
+			t.Errorf("expected to retry in 59m, got %v", retry)
+		}
+
+		if _, err := u.acquire(now.Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestQuotasMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	q, err := newQuotas(quotaConfig{
+		Clients: []quotaClient{
+			{Name: "team", Keys: []string{"secret"}, Quota: api.Quota{RequestsPerMinute: 1}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := Server{quotas: q}
+
+	r := gin.New()
+	r.POST("/api/generate", q.middleware(), func(c *gin.Context) {
+		requestUsage(c).addTokens(time.Now(), 7)
+		c.String(http.StatusOK, clientID(c))
+	})
+	r.GET("/api/quotas", s.QuotasHandler)
+
+	generate := func(key string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/api/generate", nil)
+		req.Header.Set("Authorization", "Bearer "+key)
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := generate("secret")
+	if w.Code != http.StatusOK || w.Body.String() != "team" {
+		t.Fatalf("expected client team, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = generate("secret")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status 429, got %d", w.Code)
+	}
+
+	if retry := w.Header().Get("Retry-After"); retry != "60" {
+		t.Errorf("expected Retry-After 60, got %q", retry)
+	}
+
+	// clients without a configured key are identified by address and
+	// aren't limited without a default quota
+	w = generate("other")
+	if w.Code != http.StatusOK || w.Body.String() != "192.0.2.1" {
+		t.Fatalf("expected client 192.0.2.1, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/quotas", nil))
+
+	var resp api.QuotasResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff(resp.Clients, []api.ClientQuota{
+		{Name: "192.0.2.1", RequestsLastMinute: 1, TokensToday: 7},
+		{Name: "team", Quota: api.Quota{RequestsPerMinute: 1}, RequestsLastMinute: 1, TokensToday: 7, RejectedRequests: 1},
+	}); diff != "" {
+		t.Errorf("mismatch (-got +want):\n%s", diff)
+	}
+}
+
+func TestQuotasForwardedFor(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cases := []struct {
+		name    string
+		proxies string
+		status  int
+	}{
+		// an untrusted client can't pretend to be another one to get a
+		// fresh default quota
+		{name: "untrusted", status: http.StatusTooManyRequests},
+		{name: "trusted proxy", proxies: "192.0.2.0/24", status: http.StatusBadRequest},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("OLLAMA_TRUSTED_PROXIES", tt.proxies)
+
+			q, err := newQuotas(quotaConfig{Default: api.Quota{RequestsPerMinute: 1}})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			s := &Server{quotas: q}
+			router, err := s.GenerateRoutes(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var w *httptest.ResponseRecorder
+			for _, ip := range []string{"203.0.113.1", "203.0.113.2"} {
+				req := httptest.NewRequest(http.MethodPost, "/api/generate", nil)
+				req.Header.Set("X-Forwarded-For", ip)
+				w = httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+			}
+
+			if w.Code != tt.status {
+				t.Errorf("expected status %d, got %d: %s", tt.status, w.Code, w.Body.String())
+			}
+		})
+	}
+}
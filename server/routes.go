@@ -11,6 +11,7 @@ import (
 	"io"
 	"io/fs"
 	"log/slog"
+	"maps"
 	"math"
 	"net"
 	"net/http"
@@ -20,13 +21,14 @@ import (
 	"path/filepath"
 	"slices"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
-	"golang.org/x/sync/errgroup"
 
+	"github.com/ollama/ollama/anthropic"
 	"github.com/ollama/ollama/api"
 	"github.com/ollama/ollama/discover"
 	"github.com/ollama/ollama/envconfig"
@@ -51,8 +53,11 @@ var useClient2 = experimentEnabled("client2")
 var mode string = gin.DebugMode
 
 type Server struct {
-	addr  net.Addr
-	sched *Scheduler
+	addr   net.Addr
+	sched  *Scheduler
+	quotas *quotas
+	keys   apiKeys
+	config *modelConfig
 }
 
 func init() {
@@ -72,12 +77,16 @@ var (
 	errBadTemplate = errors.New("template error")
 )
 
-func modelOptions(model *Model, requestOpts map[string]any) (api.Options, error) {
+func modelOptions(model *Model, configOpts, requestOpts map[string]any) (api.Options, error) {
 	opts := api.DefaultOptions()
 	if err := opts.FromMap(model.Options); err != nil {
 		return api.Options{}, err
 	}
 
+	if err := opts.FromMap(configOpts); err != nil {
+		return api.Options{}, err
+	}
+
 	if err := opts.FromMap(requestOpts); err != nil {
 		return api.Options{}, err
 	}
@@ -85,6 +94,21 @@ func modelOptions(model *Model, requestOpts map[string]any) (api.Options, error)
 	return opts, nil
 }
 
+// clientID identifies who a request is from, for sharing the scheduler
+// fairly between clients. Clients with a quota are identified by the name
+// it is configured with, then by the name of their API key
+func clientID(c *gin.Context) string {
+	if u, ok := c.Get(clientUsageKey); ok {
+		return u.(*clientUsage).name
+	}
+
+	if name := c.GetString(apiKeyNameKey); name != "" {
+		return name
+	}
+
+	return c.ClientIP()
+}
+
 // scheduleRunner schedules a runner after validating inputs such as capabilities and model options.
 // It returns the allocated runner, model instance, and consolidated options if successful and error otherwise.
 func (s *Server) scheduleRunner(ctx context.Context, name string, caps []model.Capability, requestOpts map[string]any, keepAlive *api.Duration) (llm.LlamaServer, *Model, *api.Options, error) {
@@ -101,12 +125,28 @@ func (s *Server) scheduleRunner(ctx context.Context, name string, caps []model.C
 		return nil, nil, nil, fmt.Errorf("%s %w", name, err)
 	}
 
-	opts, err := modelOptions(model, requestOpts)
+	opts, err := modelOptions(model, s.config.options(name), requestOpts)
 	if err != nil {
 		return nil, nil, nil, err
 	}
 
-	runnerCh, errCh := s.sched.GetRunner(ctx, model, opts, keepAlive)
+	if err := checkPlacement(opts.Runner); err != nil {
+		return nil, nil, nil, err
+	}
+
+	// the runner loads the draft model from its path
+	if opts.DraftModel != "" {
+		draft, err := GetModel(opts.DraftModel)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil, nil, fmt.Errorf("draft model %q not found, try pulling it first", opts.DraftModel)
+		} else if err != nil {
+			return nil, nil, nil, err
+		}
+
+		opts.DraftModel = draft.ModelPath
+	}
+
+	runnerCh, errCh := s.sched.GetRunner(ctx, model, opts, s.config.keepAlive(name, keepAlive))
 	var runner *runnerRef
 	select {
 	case runner = <-runnerCh:
@@ -117,6 +157,36 @@ func (s *Server) scheduleRunner(ctx context.Context, name string, caps []model.C
 	return runner.llama, model, &opts, nil
 }
 
+func checkLogprobs(logprobs bool, topLogprobs int) error {
+	if topLogprobs < 0 || topLogprobs > api.MaxTopLogprobs {
+		return fmt.Errorf("top_logprobs must be between 0 and %d", api.MaxTopLogprobs)
+	}
+
+	if topLogprobs > 0 && !logprobs {
+		return errors.New("top_logprobs requires logprobs to be enabled")
+	}
+
+	return nil
+}
+
+// completionMetrics combines the metrics of the completions of a request.
+// The prompt is shared so it is only counted once
+type completionMetrics struct {
+	api.Metrics
+	done int
+}
+
+func (m *completionMetrics) add(cr llm.CompletionResponse) {
+	if cr.Index == 0 {
+		m.PromptEvalCount = cr.PromptEvalCount
+		m.PromptEvalDuration = cr.PromptEvalDuration
+	}
+
+	m.EvalCount += cr.EvalCount
+	m.EvalDuration = max(m.EvalDuration, cr.EvalDuration)
+	m.done++
+}
+
 func (s *Server) GenerateHandler(c *gin.Context) {
 	checkpointStart := time.Now()
 	var req api.GenerateRequest
@@ -128,6 +198,16 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 		return
 	}
 
+	if err := checkLogprobs(req.Logprobs, req.TopLogprobs); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.N < 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "n must be at least 1"})
+		return
+	}
+
 	name := model.ParseName(req.Model)
 	if !name.IsValid() {
 		// Ideally this is "invalid model name" but we're keeping with
@@ -181,7 +261,8 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 		caps = append(caps, model.CapabilityInsert)
 	}
 
-	r, m, opts, err := s.scheduleRunner(c.Request.Context(), name.String(), caps, req.Options, req.KeepAlive)
+	ctx := withSchedInfo(c.Request.Context(), clientID(c), req.Priority)
+	r, m, opts, err := s.scheduleRunner(ctx, name.String(), caps, req.Options, req.KeepAlive)
 	if errors.Is(err, errCapabilityCompletion) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%q does not support generate", req.Model)})
 		return
@@ -296,41 +377,60 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 
 	slog.Debug("generate request", "images", len(images), "prompt", prompt)
 
+	n := max(req.N, 1)
+
+	// c can't be used once the handler returns, which may be before the
+	// completion finishes
+	usage := requestUsage(c)
+
+	// errs holds the error of each completion that failed, which is only
+	// read once ch is closed
+	errs := make([]string, n)
+
 	ch := make(chan any)
 	go func() {
 		// TODO (jmorganca): avoid building the response twice both here and below
 		var sb strings.Builder
+		var metrics completionMetrics
 		defer close(ch)
-		if err := r.Completion(c.Request.Context(), llm.CompletionRequest{
-			Prompt:  prompt,
-			Images:  images,
-			Format:  req.Format,
-			Options: opts,
+		if err := r.Completion(ctx, llm.CompletionRequest{
+			Prompt:      prompt,
+			Images:      images,
+			Format:      req.Format,
+			Options:     opts,
+			Logprobs:    req.Logprobs,
+			TopLogprobs: req.TopLogprobs,
+			N:           n,
 		}, func(cr llm.CompletionResponse) {
 			res := api.GenerateResponse{
 				Model:     req.Model,
 				CreatedAt: time.Now().UTC(),
 				Response:  cr.Content,
-				Done:      cr.Done,
-				Metrics: api.Metrics{
-					PromptEvalCount:    cr.PromptEvalCount,
-					PromptEvalDuration: cr.PromptEvalDuration,
-					EvalCount:          cr.EvalCount,
-					EvalDuration:       cr.EvalDuration,
-				},
+				Logprobs:  cr.Logprobs,
+				Index:     cr.Index,
 			}
 
-			if _, err := sb.WriteString(cr.Content); err != nil {
-				ch <- gin.H{"error": err.Error()}
+			// only the first completion is used for the context
+			if cr.Index == 0 {
+				if _, err := sb.WriteString(cr.Content); err != nil {
+					ch <- gin.H{"error": err.Error()}
+				}
 			}
 
 			if cr.Done {
 				res.DoneReason = cr.DoneReason.String()
+				errs[cr.Index] = cr.Error
+				metrics.add(cr)
+			}
+
+			if metrics.done == n {
+				res.Done = true
+				res.Metrics = metrics.Metrics
 				res.TotalDuration = time.Since(checkpointStart)
 				res.LoadDuration = checkpointLoaded.Sub(checkpointStart)
 
 				if !req.Raw {
-					tokens, err := r.Tokenize(c.Request.Context(), prompt+sb.String())
+					tokens, err := r.Tokenize(ctx, prompt+sb.String())
 					if err != nil {
 						ch <- gin.H{"error": err.Error()}
 						return
@@ -343,15 +443,22 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 		}); err != nil {
 			ch <- gin.H{"error": err.Error()}
 		}
+
+		usage.addTokens(time.Now(), metrics.PromptEvalCount+metrics.EvalCount)
 	}()
 
 	if req.Stream != nil && !*req.Stream {
 		var r api.GenerateResponse
-		var sb strings.Builder
+		sb := make([]strings.Builder, n)
+		choices := make([]api.GenerateChoice, n)
 		for rr := range ch {
 			switch t := rr.(type) {
 			case api.GenerateResponse:
-				sb.WriteString(t.Response)
+				sb[t.Index].WriteString(t.Response)
+				choices[t.Index].Logprobs = append(choices[t.Index].Logprobs, t.Logprobs...)
+				if t.DoneReason != "" {
+					choices[t.Index].DoneReason = t.DoneReason
+				}
 				r = t
 			case gin.H:
 				msg, ok := t["error"].(string)
@@ -367,7 +474,20 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 			}
 		}
 
-		r.Response = sb.String()
+		for i := range choices {
+			choices[i].Index = i
+			choices[i].Response = sb[i].String()
+			choices[i].Error = errs[i]
+		}
+
+		r.Index = 0
+		r.Response = choices[0].Response
+		r.DoneReason = choices[0].DoneReason
+		r.Logprobs = choices[0].Logprobs
+		if n > 1 {
+			r.Choices = choices
+		}
+
 		c.JSON(http.StatusOK, r)
 		return
 	}
@@ -394,6 +514,16 @@ func (s *Server) EmbedHandler(c *gin.Context) {
 		truncate = false
 	}
 
+	normalizeEmbeddings := true
+	if req.Normalize != nil && !*req.Normalize {
+		normalizeEmbeddings = false
+	}
+
+	if req.Dimensions < 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "dimensions must not be negative"})
+		return
+	}
+
 	var input []string
 
 	switch i := req.Input.(type) {
@@ -422,7 +552,8 @@ func (s *Server) EmbedHandler(c *gin.Context) {
 		return
 	}
 
-	r, m, opts, err := s.scheduleRunner(c.Request.Context(), name.String(), []model.Capability{}, req.Options, req.KeepAlive)
+	ctx := withSchedInfo(c.Request.Context(), clientID(c), req.Priority)
+	r, m, opts, err := s.scheduleRunner(ctx, name.String(), []model.Capability{}, req.Options, req.KeepAlive)
 	if err != nil {
 		handleScheduleError(c, req.Model, err)
 		return
@@ -441,6 +572,11 @@ func (s *Server) EmbedHandler(c *gin.Context) {
 		return
 	}
 
+	if n := int(kvData.EmbeddingLength()); n > 0 && req.Dimensions > n {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("dimensions must be at most %d", n)})
+		return
+	}
+
 	var count int
 	for i, s := range input {
 		tokens, err := r.Tokenize(c.Request.Context(), s)
@@ -469,24 +605,26 @@ func (s *Server) EmbedHandler(c *gin.Context) {
 		input[i] = s
 	}
 
-	var g errgroup.Group
-	embeddings := make([][]float32, len(input))
-	for i, text := range input {
-		g.Go(func() error {
-			embedding, err := r.Embedding(c.Request.Context(), text)
-			if err != nil {
-				return err
-			}
-			embeddings[i] = normalize(embedding)
-			return nil
-		})
-	}
-
-	if err := g.Wait(); err != nil {
+	embeddings, err := r.Embedding(ctx, input)
+	if err != nil {
 		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": strings.TrimSpace(err.Error())})
 		return
 	}
 
+	requestUsage(c).addTokens(time.Now(), count)
+
+	for i, embedding := range embeddings {
+		if req.Dimensions > 0 {
+			embedding = embedding[:min(req.Dimensions, len(embedding))]
+		}
+
+		if normalizeEmbeddings {
+			embedding = normalize(embedding)
+		}
+
+		embeddings[i] = embedding
+	}
+
 	resp := api.EmbedResponse{
 		Model:           req.Model,
 		Embeddings:      embeddings,
@@ -514,6 +652,155 @@ func normalize(vec []float32) []float32 {
 	return vec
 }
 
+func (s *Server) RerankHandler(c *gin.Context) {
+	checkpointStart := time.Now()
+	var req api.RerankRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Query == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "query is required"})
+		return
+	}
+
+	if req.TopN < 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "top_n must not be negative"})
+		return
+	}
+
+	truncate := true
+	if req.Truncate != nil && !*req.Truncate {
+		truncate = false
+	}
+
+	name := model.ParseName(req.Model)
+	if !name.IsValid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "model is required"})
+		return
+	}
+	name, err := getExistingName(name)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
+		return
+	}
+
+	ctx := withSchedInfo(c.Request.Context(), clientID(c), "")
+	r, m, opts, err := s.scheduleRunner(ctx, name.String(), []model.Capability{model.CapabilityRerank}, req.Options, req.KeepAlive)
+	if errors.Is(err, errCapabilityRerank) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%q does not support rerank", req.Model)})
+		return
+	} else if err != nil {
+		handleScheduleError(c, req.Model, err)
+		return
+	}
+
+	checkpointLoaded := time.Now()
+
+	if len(req.Documents) == 0 {
+		c.JSON(http.StatusOK, api.RerankResponse{Model: req.Model, Results: []api.RerankResult{}})
+		return
+	}
+
+	kvData, _, err := getModelData(m.ModelPath, false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// the query and document are joined with the separator token, and the
+	// runner adds the tokens that start and end the input
+	sepID, ok := kvData["tokenizer.ggml.seperator_token_id"].(uint32)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "model has no separator token"})
+		return
+	}
+
+	sep, err := r.Detokenize(ctx, []int{int(sepID)})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctxLen := max(min(opts.NumCtx, int(kvData.ContextLength()))-2, 0)
+
+	var count int
+	input := make([]string, len(req.Documents))
+	for i, doc := range req.Documents {
+		s := req.Query + sep + doc
+		tokens, err := r.Tokenize(ctx, s)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		if len(tokens) > ctxLen {
+			if !truncate {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "input length exceeds maximum context length"})
+				return
+			}
+
+			tokens = tokens[:ctxLen]
+			s, err = r.Detokenize(ctx, tokens)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		count += len(tokens)
+
+		input[i] = s
+	}
+
+	scores, err := r.Embedding(ctx, input)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": strings.TrimSpace(err.Error())})
+		return
+	}
+
+	results := make([]api.RerankResult, len(scores))
+	for i, score := range scores {
+		if len(score) != 1 {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("expected a single score, got %d values", len(score))})
+			return
+		}
+
+		results[i] = api.RerankResult{
+			Index:          i,
+			Document:       req.Documents[i],
+			RelevanceScore: sigmoid(score[0]),
+		}
+	}
+
+	slices.SortStableFunc(results, func(a, b api.RerankResult) int {
+		return cmp.Compare(b.RelevanceScore, a.RelevanceScore)
+	})
+
+	if req.TopN > 0 && req.TopN < len(results) {
+		results = results[:req.TopN]
+	}
+
+	requestUsage(c).addTokens(time.Now(), count)
+
+	c.JSON(http.StatusOK, api.RerankResponse{
+		Model:           req.Model,
+		Results:         results,
+		TotalDuration:   time.Since(checkpointStart),
+		LoadDuration:    checkpointLoaded.Sub(checkpointStart),
+		PromptEvalCount: count,
+	})
+}
+
+// sigmoid converts the logit of a classifier to a score between 0 and 1
+func sigmoid(x float32) float64 {
+	return 1 / (1 + math.Exp(-float64(x)))
+}
+
 func (s *Server) EmbeddingsHandler(c *gin.Context) {
 	var req api.EmbeddingRequest
 	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
@@ -530,7 +817,7 @@ func (s *Server) EmbeddingsHandler(c *gin.Context) {
 		return
 	}
 
-	r, _, _, err := s.scheduleRunner(c.Request.Context(), name.String(), []model.Capability{}, req.Options, req.KeepAlive)
+	r, _, _, err := s.scheduleRunner(withSchedInfo(c.Request.Context(), clientID(c), ""), name.String(), []model.Capability{}, req.Options, req.KeepAlive)
 	if err != nil {
 		handleScheduleError(c, req.Model, err)
 		return
@@ -542,14 +829,14 @@ func (s *Server) EmbeddingsHandler(c *gin.Context) {
 		return
 	}
 
-	embedding, err := r.Embedding(c.Request.Context(), req.Prompt)
+	embeddings, err := r.Embedding(c.Request.Context(), []string{req.Prompt})
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": strings.TrimSpace(err.Error())})
 		return
 	}
 
 	var e []float64
-	for _, v := range embedding {
+	for _, v := range embeddings[0] {
 		e = append(e, float64(v))
 	}
 
@@ -830,6 +1117,10 @@ func GetModelInfo(req api.ShowRequest) (*api.ShowResponse, error) {
 			for _, nv := range val {
 				params = append(params, fmt.Sprintf("%-*s %#v", cs, k, nv))
 			}
+		case map[string]any:
+			for _, mk := range slices.Sorted(maps.Keys(val)) {
+				params = append(params, fmt.Sprintf("%-*s %#v", cs, k, fmt.Sprintf("%s:%v", mk, val[mk])))
+			}
 		default:
 			params = append(params, fmt.Sprintf("%-*s %#v", cs, k, v))
 		}
@@ -1164,10 +1455,27 @@ func (s *Server) GenerateRoutes(rc *ollama.Registry) (http.Handler, error) {
 		"x-stainless-poll-helper",
 		"x-stainless-custom-poll-interval",
 		"x-stainless-timeout",
+
+		// Anthropic compatibility headers
+		"anthropic-version",
+		"anthropic-beta",
+		"x-api-key",
 	}
 	corsConfig.AllowOrigins = envconfig.AllowedOrigins()
 
+	inference := s.keys.require(roleInference)
+	manage := s.keys.require(roleModelManagement)
+	admin := s.keys.require(roleAdmin)
+	quota := s.quotas.middleware()
+
 	r := gin.Default()
+
+	// client IP addresses identify clients for quotas, so they are only
+	// taken from the headers of trusted proxies
+	if err := r.SetTrustedProxies(envconfig.TrustedProxies()); err != nil {
+		return nil, err
+	}
+
 	r.Use(
 		cors.New(corsConfig),
 		allowedHostsMiddleware(s.addr),
@@ -1180,32 +1488,51 @@ func (s *Server) GenerateRoutes(rc *ollama.Registry) (http.Handler, error) {
 	r.GET("/api/version", func(c *gin.Context) { c.JSON(http.StatusOK, gin.H{"version": version.Version}) })
 
 	// Local model cache management (new implementation is at end of function)
-	r.POST("/api/pull", s.PullHandler)
-	r.POST("/api/push", s.PushHandler)
-	r.HEAD("/api/tags", s.ListHandler)
-	r.GET("/api/tags", s.ListHandler)
-	r.POST("/api/show", s.ShowHandler)
-	r.DELETE("/api/delete", s.DeleteHandler)
+	r.POST("/api/pull", manage, s.PullHandler)
+	r.POST("/api/push", manage, s.PushHandler)
+	r.HEAD("/api/tags", inference, s.ListHandler)
+	r.GET("/api/tags", inference, s.ListHandler)
+	r.POST("/api/show", inference, s.ShowHandler)
+	r.DELETE("/api/delete", manage, s.DeleteHandler)
 
 	// Create
-	r.POST("/api/create", s.CreateHandler)
-	r.POST("/api/blobs/:digest", s.CreateBlobHandler)
-	r.HEAD("/api/blobs/:digest", s.HeadBlobHandler)
-	r.POST("/api/copy", s.CopyHandler)
+	r.POST("/api/create", manage, s.CreateHandler)
+	r.POST("/api/blobs/:digest", manage, s.CreateBlobHandler)
+	r.HEAD("/api/blobs/:digest", manage, s.HeadBlobHandler)
+	r.POST("/api/copy", manage, s.CopyHandler)
 
 	// Inference
-	r.GET("/api/ps", s.PsHandler)
-	r.POST("/api/generate", s.GenerateHandler)
-	r.POST("/api/chat", s.ChatHandler)
-	r.POST("/api/embed", s.EmbedHandler)
-	r.POST("/api/embeddings", s.EmbeddingsHandler)
+	r.GET("/api/ps", inference, s.PsHandler)
+	r.GET("/api/quotas", admin, s.QuotasHandler)
+	r.POST("/api/cache/pin", inference, quota, s.PinHandler)
+	r.GET("/api/cache/pins", inference, s.ListPinsHandler)
+	r.DELETE("/api/cache/pin", inference, s.UnpinHandler)
+	r.POST("/api/generate", inference, quota, s.GenerateHandler)
+	r.POST("/api/chat", inference, quota, s.ChatHandler)
+	r.POST("/api/embed", inference, quota, s.EmbedHandler)
+	r.POST("/api/embeddings", inference, quota, s.EmbeddingsHandler)
+	r.POST("/api/rerank", inference, quota, s.RerankHandler)
+	r.POST("/api/tokenize", inference, s.TokenizeHandler)
+	r.POST("/api/detokenize", inference, s.DetokenizeHandler)
 
 	// Inference (OpenAI compatibility)
-	r.POST("/v1/chat/completions", openai.ChatMiddleware(), s.ChatHandler)
-	r.POST("/v1/completions", openai.CompletionsMiddleware(), s.GenerateHandler)
-	r.POST("/v1/embeddings", openai.EmbeddingsMiddleware(), s.EmbedHandler)
-	r.GET("/v1/models", openai.ListMiddleware(), s.ListHandler)
-	r.GET("/v1/models/:model", openai.RetrieveMiddleware(), s.ShowHandler)
+	r.POST("/v1/chat/completions", inference, quota, openai.ChatMiddleware(), s.ChatHandler)
+	r.POST("/v1/completions", inference, quota, openai.CompletionsMiddleware(), s.GenerateHandler)
+	r.POST("/v1/embeddings", inference, quota, openai.EmbeddingsMiddleware(), s.EmbedHandler)
+	r.POST("/v1/rerank", inference, quota, openai.RerankMiddleware(), s.RerankHandler)
+	r.GET("/v1/models", inference, openai.ListMiddleware(), s.ListHandler)
+	r.GET("/v1/models/:model", inference, openai.RetrieveMiddleware(), s.ShowHandler)
+
+	// stored responses belong to the API key that created them
+	responses := openai.NewResponseStore(filepath.Join(envconfig.Models(), "responses"), func(c *gin.Context) string {
+		return c.GetString(apiKeyNameKey)
+	})
+	r.POST("/v1/responses", inference, quota, openai.ResponsesMiddleware(responses), s.ChatHandler)
+	r.GET("/v1/responses/:id", inference, responses.RetrieveHandler)
+	r.DELETE("/v1/responses/:id", inference, responses.DeleteHandler)
+
+	// Inference (Anthropic compatibility)
+	r.POST("/v1/messages", inference, quota, anthropic.MessagesMiddleware(), s.ChatHandler)
 
 	if rc != nil {
 		// wrap old with new
@@ -1216,7 +1543,7 @@ func (s *Server) GenerateRoutes(rc *ollama.Registry) (http.Handler, error) {
 
 			Prune: PruneLayers,
 		}
-		return rs, nil
+		return s.keys.registryHandler(rs), nil
 	}
 
 	return r, nil
@@ -1272,7 +1599,22 @@ func Serve(ln net.Listener) error {
 		}
 	}
 
-	s := &Server{addr: ln.Addr()}
+	quotas, err := loadQuotas(envconfig.Quotas())
+	if err != nil {
+		return err
+	}
+
+	keys, err := loadAPIKeys(envconfig.AuthKeys())
+	if err != nil {
+		return err
+	}
+
+	config, err := loadModelConfig(envconfig.ModelConfig())
+	if err != nil {
+		return err
+	}
+
+	s := &Server{addr: ln.Addr(), quotas: quotas, keys: keys, config: config}
 
 	var rc *ollama.Registry
 	if useClient2 {
@@ -1293,6 +1635,7 @@ func Serve(ln net.Listener) error {
 	ctx, done := context.WithCancel(context.Background())
 	schedCtx, schedDone := context.WithCancel(ctx)
 	sched := InitScheduler(schedCtx)
+	sched.config = config
 	s.sched = sched
 
 	slog.Info(fmt.Sprintf("Listening on %s (version %s)", ln.Addr(), version.Version))
@@ -1326,6 +1669,8 @@ func Serve(ln net.Listener) error {
 	gpus := discover.GetGPUInfo()
 	gpus.LogDetails()
 
+	go s.keepWarm(schedCtx)
+
 	err = srvr.Serve(ln)
 	// If server is closed from the signal handler, wait for the ctx to be done
 	// otherwise error out quickly
@@ -1393,7 +1738,24 @@ func streamResponse(c *gin.Context, ch chan any) {
 func (s *Server) PsHandler(c *gin.Context) {
 	models := []api.ProcessModelResponse{}
 
-	for _, v := range s.sched.loaded {
+	s.sched.loadedMu.Lock()
+	runners := slices.Collect(maps.Values(s.sched.loaded))
+	s.sched.loadedMu.Unlock()
+
+	// ask the runners for their stats at the same time so a busy runner
+	// doesn't hold up the others
+	var wg sync.WaitGroup
+	stats := make([]*api.ProcessStats, len(runners))
+	for i, v := range runners {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stats[i] = runnerStats(c.Request.Context(), v)
+		}()
+	}
+	wg.Wait()
+
+	for i, v := range runners {
 		model := v.model
 		modelDetails := api.ModelDetails{
 			Format:            model.Config.ModelFormat,
@@ -1420,6 +1782,8 @@ func (s *Server) PsHandler(c *gin.Context) {
 			mr.ExpiresAt = time.Now().Add(v.sessionDuration)
 		}
 
+		mr.Stats = stats[i]
+
 		models = append(models, mr)
 	}
 
@@ -1431,6 +1795,288 @@ func (s *Server) PsHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, api.ProcessResponse{Models: models})
 }
 
+func (s *Server) QuotasHandler(c *gin.Context) {
+	clients := []api.ClientQuota{}
+	if s.quotas != nil {
+		clients = s.quotas.usage(time.Now())
+	}
+
+	c.JSON(http.StatusOK, api.QuotasResponse{Clients: clients})
+}
+
+// runnerStats asks a runner for its activity, returning nil if it is still
+// loading or doesn't respond in time
+func runnerStats(ctx context.Context, runner *runnerRef) *api.ProcessStats {
+	runner.refMu.Lock()
+	llama, loading := runner.llama, runner.loading
+	runner.refMu.Unlock()
+
+	if llama == nil || loading {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+
+	stats, err := llama.Stats(ctx)
+	if err != nil {
+		slog.Debug("failed to get runner stats", "model", runner.modelPath, "error", err)
+		return nil
+	}
+
+	layers := make([]api.LayerPlacement, len(stats.Layers))
+	for i, l := range stats.Layers {
+		layers[i] = api.LayerPlacement{Library: l.Library, ID: l.ID, First: l.First, Last: l.Last}
+	}
+
+	return &api.ProcessStats{
+		ActiveRequests:        stats.ActiveRequests,
+		QueuedRequests:        stats.QueuedRequests,
+		SlotsInUse:            stats.SlotsInUse,
+		Slots:                 stats.Slots,
+		ContextUsed:           stats.ContextUsed,
+		ContextLength:         stats.ContextLength,
+		PromptTokensPerSecond: stats.PromptTokensPerSecond,
+		TokensPerSecond:       stats.TokensPerSecond,
+		Layers:                layers,
+	}
+}
+
+func (s *Server) PinHandler(c *gin.Context) {
+	var req api.PinRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if (req.Prompt == "") == (len(req.Messages) == 0) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "one of prompt or messages is required"})
+		return
+	}
+
+	name := model.ParseName(req.Model)
+	if !name.IsValid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "model is required"})
+		return
+	}
+	name, err := getExistingName(name)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
+		return
+	}
+
+	r, m, opts, err := s.scheduleRunner(withSchedInfo(c.Request.Context(), clientID(c), ""), name.String(), []model.Capability{model.CapabilityCompletion}, req.Options, req.KeepAlive)
+	if errors.Is(err, errCapabilityCompletion) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%q does not support generate", req.Model)})
+		return
+	} else if err != nil {
+		handleScheduleError(c, req.Model, err)
+		return
+	}
+
+	prompt := req.Prompt
+	if len(req.Messages) > 0 {
+		msgs := append(m.Messages, req.Messages...)
+		if req.Messages[0].Role != "system" && m.System != "" {
+			msgs = append([]api.Message{{Role: "system", Content: m.System}}, msgs...)
+		}
+
+		var images []llm.ImageData
+		prompt, images, err = chatPrompt(c.Request.Context(), m, r.Tokenize, opts, msgs, nil)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		if len(images) > 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "prompts with images cannot be pinned"})
+			return
+		}
+	}
+
+	pin, err := r.Pin(c.Request.Context(), prompt)
+	if errors.Is(err, llm.ErrPinNotSupported) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	requestUsage(c).addTokens(time.Now(), pin.Inputs)
+
+	c.JSON(http.StatusOK, api.PinResponse{Model: req.Model, ID: pin.ID, Tokens: pin.Inputs})
+}
+
+func (s *Server) ListPinsHandler(c *gin.Context) {
+	pins := []api.PinResponse{}
+
+	for _, runner := range s.sched.readyRunners() {
+		runnerPins, err := runner.llama.Pins(c.Request.Context())
+		if errors.Is(err, llm.ErrPinNotSupported) {
+			continue
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		for _, pin := range runnerPins {
+			pins = append(pins, api.PinResponse{Model: runner.model.ShortName, ID: pin.ID, Tokens: pin.Inputs})
+		}
+	}
+
+	slices.SortFunc(pins, func(a, b api.PinResponse) int {
+		return cmp.Or(cmp.Compare(a.Model, b.Model), cmp.Compare(a.ID, b.ID))
+	})
+
+	c.JSON(http.StatusOK, api.ListPinsResponse{Pins: pins})
+}
+
+func (s *Server) UnpinHandler(c *gin.Context) {
+	var req api.UnpinRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	m, err := GetModel(req.Model)
+	if err != nil {
+		switch {
+		case os.IsNotExist(err):
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
+		case err.Error() == errtypes.InvalidModelNameErrMsg:
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	for _, runner := range s.sched.readyRunners() {
+		if runner.modelPath != m.ModelPath {
+			continue
+		}
+
+		if err := runner.llama.Unpin(c.Request.Context(), req.ID); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.Status(http.StatusOK)
+		return
+	}
+
+	c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' is not loaded", req.Model)})
+}
+
+func (s *Server) TokenizeHandler(c *gin.Context) {
+	var req api.TokenizeRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if (req.Prompt == "") == (len(req.Messages) == 0) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "one of prompt or messages is required"})
+		return
+	}
+
+	name := model.ParseName(req.Model)
+	if !name.IsValid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "model is required"})
+		return
+	}
+	name, err := getExistingName(name)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
+		return
+	}
+
+	r, m, opts, err := s.scheduleRunner(withSchedInfo(c.Request.Context(), clientID(c), ""), name.String(), []model.Capability{}, req.Options, req.KeepAlive)
+	if err != nil {
+		handleScheduleError(c, req.Model, err)
+		return
+	}
+
+	prompt := req.Prompt
+	if len(req.Messages) > 0 {
+		msgs := append(m.Messages, req.Messages...)
+		if req.Messages[0].Role != "system" && m.System != "" {
+			msgs = append([]api.Message{{Role: "system", Content: m.System}}, msgs...)
+		}
+
+		// messages are not truncated to the context length so that the
+		// tokens cover the whole conversation
+		full := *opts
+		full.NumCtx = math.MaxInt
+		prompt, _, err = chatPrompt(c.Request.Context(), m, r.Tokenize, &full, msgs, req.Tools)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	tokens, err := r.Tokenize(c.Request.Context(), prompt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if tokens == nil {
+		tokens = []int{}
+	}
+
+	c.JSON(http.StatusOK, api.TokenizeResponse{Model: req.Model, Tokens: tokens})
+}
+
+func (s *Server) DetokenizeHandler(c *gin.Context) {
+	var req api.DetokenizeRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	name := model.ParseName(req.Model)
+	if !name.IsValid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "model is required"})
+		return
+	}
+	name, err := getExistingName(name)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
+		return
+	}
+
+	r, _, _, err := s.scheduleRunner(withSchedInfo(c.Request.Context(), clientID(c), ""), name.String(), []model.Capability{}, req.Options, req.KeepAlive)
+	if err != nil {
+		handleScheduleError(c, req.Model, err)
+		return
+	}
+
+	content, err := r.Detokenize(c.Request.Context(), req.Tokens)
+	if errors.Is(err, llm.ErrInvalidToken) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, api.DetokenizeResponse{Model: req.Model, Content: content})
+}
+
 func (s *Server) ChatHandler(c *gin.Context) {
 	checkpointStart := time.Now()
 
@@ -1443,6 +2089,16 @@ func (s *Server) ChatHandler(c *gin.Context) {
 		return
 	}
 
+	if err := checkLogprobs(req.Logprobs, req.TopLogprobs); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.N < 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "n must be at least 1"})
+		return
+	}
+
 	// expire the runner
 	if len(req.Messages) == 0 && req.KeepAlive != nil && int(req.KeepAlive.Seconds()) == 0 {
 		model, err := GetModel(req.Model)
@@ -1469,6 +2125,35 @@ func (s *Server) ChatHandler(c *gin.Context) {
 		return
 	}
 
+	// forceTools is set if the model must call a tool, constraining its
+	// output to valid tool calls
+	var forceTools bool
+	if req.ToolChoice != nil {
+		switch req.ToolChoice.Type {
+		case api.ToolChoiceNone:
+			req.Tools = nil
+		case api.ToolChoiceRequired, api.ToolChoiceNamed:
+			if len(req.Tools) == 0 {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "tool_choice requires tools"})
+				return
+			}
+
+			if len(req.Format) > 0 {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "format cannot be used when tool_choice requires a tool call"})
+				return
+			}
+
+			if req.ToolChoice.Type == api.ToolChoiceNamed && !slices.ContainsFunc(req.Tools, func(t api.Tool) bool {
+				return t.Function.Name == req.ToolChoice.Function.Name
+			}) {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("tool_choice function %q is not in tools", req.ToolChoice.Function.Name)})
+				return
+			}
+
+			forceTools = true
+		}
+	}
+
 	caps := []model.Capability{model.CapabilityCompletion}
 	if len(req.Tools) > 0 {
 		caps = append(caps, model.CapabilityTools)
@@ -1485,7 +2170,8 @@ func (s *Server) ChatHandler(c *gin.Context) {
 		return
 	}
 
-	r, m, opts, err := s.scheduleRunner(c.Request.Context(), name.String(), caps, req.Options, req.KeepAlive)
+	ctx := withSchedInfo(c.Request.Context(), clientID(c), req.Priority)
+	r, m, opts, err := s.scheduleRunner(ctx, name.String(), caps, req.Options, req.KeepAlive)
 	if errors.Is(err, errCapabilityCompletion) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%q does not support chat", req.Model)})
 		return
@@ -1494,6 +2180,15 @@ func (s *Server) ChatHandler(c *gin.Context) {
 		return
 	}
 
+	var toolGrammar string
+	if forceTools {
+		toolGrammar, err = toolCallGrammar(m.Template, req.Tools, req.ToolChoice.Function.Name)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
 	checkpointLoaded := time.Now()
 
 	if len(req.Messages) == 0 {
@@ -1521,79 +2216,129 @@ func (s *Server) ChatHandler(c *gin.Context) {
 
 	slog.Debug("chat request", "images", len(images), "prompt", prompt)
 
+	n := max(req.N, 1)
+
+	// c can't be used once the handler returns, which may be before the
+	// completion finishes
+	usage := requestUsage(c)
+
+	// errs holds the error of each completion that failed, which is only
+	// read once ch is closed
+	errs := make([]string, n)
+
 	ch := make(chan any)
 	go func() {
 		defer close(ch)
-		var sb strings.Builder
-		var toolCallIndex int = 0
-		if err := r.Completion(c.Request.Context(), llm.CompletionRequest{
-			Prompt:  prompt,
-			Images:  images,
-			Format:  req.Format,
-			Options: opts,
+
+		// the completion is stopped if a forced tool call doesn't match the
+		// grammar it was constrained to
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		var toolErr error
+
+		// tool calls are parsed separately for each completion
+		type toolCallState struct {
+			parser   *toolParser
+			logprobs []api.Logprob
+		}
+
+		var states []toolCallState
+		if len(req.Tools) > 0 && (req.Stream == nil || *req.Stream) {
+			states = make([]toolCallState, n)
+			for i := range states {
+				states[i].parser, _ = newToolParser(m.Template)
+			}
+		}
+
+		var metrics completionMetrics
+		if err := r.Completion(ctx, llm.CompletionRequest{
+			Prompt:      prompt,
+			Images:      images,
+			Format:      req.Format,
+			Options:     opts,
+			Logprobs:    req.Logprobs,
+			TopLogprobs: req.TopLogprobs,
+			N:           n,
+			Grammar:     toolGrammar,
 		}, func(r llm.CompletionResponse) {
+			if toolErr != nil {
+				return
+			}
+
 			res := api.ChatResponse{
 				Model:     req.Model,
 				CreatedAt: time.Now().UTC(),
 				Message:   api.Message{Role: "assistant", Content: r.Content},
-				Done:      r.Done,
-				Metrics: api.Metrics{
-					PromptEvalCount:    r.PromptEvalCount,
-					PromptEvalDuration: r.PromptEvalDuration,
-					EvalCount:          r.EvalCount,
-					EvalDuration:       r.EvalDuration,
-				},
+				Logprobs:  r.Logprobs,
+				Index:     r.Index,
 			}
 
 			if r.Done {
 				res.DoneReason = r.DoneReason.String()
+				errs[r.Index] = r.Error
+				metrics.add(r)
+			}
+
+			if metrics.done == n {
+				res.Done = true
+				res.Metrics = metrics.Metrics
 				res.TotalDuration = time.Since(checkpointStart)
 				res.LoadDuration = checkpointLoaded.Sub(checkpointStart)
 			}
 
-			// TODO: tool call checking and filtering should be moved outside of this callback once streaming
-			// however this was a simple change for now without reworking streaming logic of this (and other)
-			// handlers
-			if req.Stream != nil && !*req.Stream || len(req.Tools) == 0 {
+			if states == nil || states[r.Index].parser == nil {
 				ch <- res
 				return
 			}
 
 			// Streaming tool calls:
-			// If tools are recognized, use a flag to track the sending of a tool downstream
-			// This ensures that content is cleared from the message on the last chunk sent
-			sb.WriteString(r.Content)
-			if toolCalls, ok := m.parseToolCalls(sb.String()); ok {
-				res.Message.ToolCalls = toolCalls
-				for i := range toolCalls {
-					toolCalls[i].Function.Index = toolCallIndex
-					toolCallIndex++
-				}
-				res.Message.Content = ""
-				sb.Reset()
-				ch <- res
-				return
-			}
+			// Content is sent as soon as it can't be part of a tool call, while
+			// tool calls are sent in parts as they are generated and then in full
+			// once complete. Logprobs are held along with any content.
+			st := &states[r.Index]
+			st.logprobs = append(st.logprobs, r.Logprobs...)
 
+			res.Message.Content, res.Message.ToolCalls, res.Message.ToolCallDeltas = st.parser.Add(r.Content)
 			if r.Done {
-				// Send any remaining content if no tool calls were detected
-				if toolCallIndex == 0 {
-					res.Message.Content = sb.String()
+				res.Message.Content += st.parser.Flush()
+			}
+
+			if forceTools {
+				if err := validateToolCalls(req.Tools, res.Message.ToolCalls); err != nil {
+					toolErr = err
+					cancel()
+					return
 				}
-				ch <- res
 			}
-		}); err != nil {
+
+			if res.Message.Content == "" && len(res.Message.ToolCalls) == 0 && len(res.Message.ToolCallDeltas) == 0 && !r.Done {
+				return
+			}
+
+			res.Logprobs = st.logprobs
+			st.logprobs = nil
+			ch <- res
+		}); toolErr != nil {
+			ch <- gin.H{"error": toolErr.Error()}
+		} else if err != nil {
 			ch <- gin.H{"error": err.Error()}
 		}
+
+		usage.addTokens(time.Now(), metrics.PromptEvalCount+metrics.EvalCount)
 	}()
 
 	if req.Stream != nil && !*req.Stream {
 		var resp api.ChatResponse
-		var sb strings.Builder
+		sb := make([]strings.Builder, n)
+		choices := make([]api.ChatChoice, n)
 		for rr := range ch {
 			switch t := rr.(type) {
 			case api.ChatResponse:
-				sb.WriteString(t.Message.Content)
+				sb[t.Index].WriteString(t.Message.Content)
+				choices[t.Index].Logprobs = append(choices[t.Index].Logprobs, t.Logprobs...)
+				if t.DoneReason != "" {
+					choices[t.Index].DoneReason = t.DoneReason
+				}
 				resp = t
 			case gin.H:
 				msg, ok := t["error"].(string)
@@ -1609,15 +2354,34 @@ func (s *Server) ChatHandler(c *gin.Context) {
 			}
 		}
 
-		resp.Message.Content = sb.String()
+		for i := range choices {
+			choices[i].Index = i
+			choices[i].Message = api.Message{Role: "assistant", Content: sb[i].String()}
+			choices[i].Error = errs[i]
+
+			if len(req.Tools) > 0 {
+				if toolCalls, ok := m.parseToolCalls(sb[i].String()); ok {
+					if forceTools {
+						if err := validateToolCalls(req.Tools, toolCalls); err != nil {
+							c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+							return
+						}
+					}
 
-		if len(req.Tools) > 0 {
-			if toolCalls, ok := m.parseToolCalls(sb.String()); ok {
-				resp.Message.ToolCalls = toolCalls
-				resp.Message.Content = ""
+					choices[i].Message.ToolCalls = toolCalls
+					choices[i].Message.Content = ""
+				}
 			}
 		}
 
+		resp.Index = 0
+		resp.Message = choices[0].Message
+		resp.DoneReason = choices[0].DoneReason
+		resp.Logprobs = choices[0].Logprobs
+		if n > 1 {
+			resp.Choices = choices
+		}
+
 		c.JSON(http.StatusOK, resp)
 		return
 	}
@@ -1627,7 +2391,7 @@ func (s *Server) ChatHandler(c *gin.Context) {
 
 func handleScheduleError(c *gin.Context, name string, err error) {
 	switch {
-	case errors.Is(err, errCapabilities), errors.Is(err, errRequired):
+	case errors.Is(err, errCapabilities), errors.Is(err, errRequired), errors.Is(err, errInvalidPlacement), errors.Is(err, errPreloadedOptions):
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 	case errors.Is(err, context.Canceled):
 		c.JSON(499, gin.H{"error": "request canceled"})
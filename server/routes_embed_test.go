@@ -0,0 +1,136 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/discover"
+	"github.com/ollama/ollama/fs/ggml"
+	"github.com/ollama/ollama/llm"
+)
+
+type embedRunner struct {
+	mockRunner
+}
+
+func (embedRunner) Embedding(_ context.Context, input []string) ([][]float32, error) {
+	embeddings := make([][]float32, len(input))
+	for i := range input {
+		embeddings[i] = []float32{3, 4, 12, float32(i)}
+	}
+
+	return embeddings, nil
+}
+
+func TestEmbed(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var mock embedRunner
+
+	s := Server{
+		sched: &Scheduler{
+			pendingReqCh:  make(chan *LlmRequest, 1),
+			finishedReqCh: make(chan *LlmRequest, 1),
+			expiredCh:     make(chan *runnerRef, 1),
+			unloadedCh:    make(chan any, 1),
+			loaded:        make(map[string]*runnerRef),
+			newServerFn: func(discover.GpuInfoList, string, *ggml.GGML, []string, []string, api.Options, int) (llm.LlamaServer, error) {
+				return &mock, nil
+			},
+			getGpuFn:     discover.GetGPUInfo,
+			getCpuFn:     discover.GetCPUInfo,
+			reschedDelay: 250 * time.Millisecond,
+			loadFn: func(req *LlmRequest, _ *ggml.GGML, _ discover.GpuInfoList, _ int) {
+				req.successCh <- &runnerRef{
+					llama: &mock,
+				}
+			},
+		},
+	}
+
+	go s.sched.Run(t.Context())
+
+	_, digest := createBinFile(t, ggml.KV{
+		"general.architecture":  "bert",
+		"bert.pooling_type":     uint32(1),
+		"bert.context_length":   uint32(16),
+		"bert.embedding_length": uint32(4),
+	}, nil)
+
+	stream := false
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model:  "embedder",
+		Files:  map[string]string{"file.gguf": digest},
+		Stream: &stream,
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	embed := func(t *testing.T, req api.EmbedRequest) [][]float32 {
+		t.Helper()
+
+		w := createRequest(t, s.EmbedHandler, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.EmbedResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		return resp.Embeddings
+	}
+
+	t.Run("normalized", func(t *testing.T) {
+		got := embed(t, api.EmbedRequest{Model: "embedder", Input: "Hello"})
+		if diff := cmp.Diff(got, [][]float32{{3.0 / 13, 4.0 / 13, 12.0 / 13, 0}}, cmpopts.EquateApprox(0, 1e-6)); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("not normalized", func(t *testing.T) {
+		normalize := false
+		got := embed(t, api.EmbedRequest{Model: "embedder", Input: "Hello", Normalize: &normalize})
+		if diff := cmp.Diff(got, [][]float32{{3, 4, 12, 0}}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("batch", func(t *testing.T) {
+		// embeddings are returned in the order of the input
+		normalize := false
+		got := embed(t, api.EmbedRequest{Model: "embedder", Input: []any{"Hello", "World", "!"}, Normalize: &normalize})
+		if diff := cmp.Diff(got, [][]float32{{3, 4, 12, 0}, {3, 4, 12, 1}, {3, 4, 12, 2}}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("dimensions", func(t *testing.T) {
+		// embeddings are shortened before they are normalized
+		got := embed(t, api.EmbedRequest{Model: "embedder", Input: "Hello", Dimensions: 2})
+		if diff := cmp.Diff(got, [][]float32{{0.6, 0.8}}, cmpopts.EquateApprox(0, 1e-6)); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("too many dimensions", func(t *testing.T) {
+		w := createRequest(t, s.EmbedHandler, api.EmbedRequest{Model: "embedder", Input: "Hello", Dimensions: 8})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff(w.Body.String(), `{"error":"dimensions must be at most 4"}`); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+}
@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"io"
 	"net/http"
+	"net/http/httptest"
 	"strings"
 	"sync"
 	"testing"
@@ -17,6 +18,7 @@ import (
 	"github.com/ollama/ollama/api"
 	"github.com/ollama/ollama/discover"
 	"github.com/ollama/ollama/fs/ggml"
+	"github.com/ollama/ollama/grammar"
 	"github.com/ollama/ollama/llm"
 )
 
@@ -368,32 +370,7 @@ func TestGenerateChat(t *testing.T) {
 				Function: api.ToolFunction{
 					Name:        "get_weather",
 					Description: "Get the current weather",
-					Parameters: struct {
-						Type       string   `json:"type"`
-						Required   []string `json:"required"`
-						Properties map[string]struct {
-							Type        api.PropertyType `json:"type"`
-							Description string           `json:"description"`
-							Enum        []any            `json:"enum,omitempty"`
-						} `json:"properties"`
-					}{
-						Type:     "object",
-						Required: []string{"location"},
-						Properties: map[string]struct {
-							Type        api.PropertyType `json:"type"`
-							Description string           `json:"description"`
-							Enum        []any            `json:"enum,omitempty"`
-						}{
-							"location": {
-								Type:        api.PropertyType{"string"},
-								Description: "The city and state",
-							},
-							"unit": {
-								Type: api.PropertyType{"string"},
-								Enum: []any{"celsius", "fahrenheit"},
-							},
-						},
-					},
+					Parameters:  api.ToolSchema(`{"type":"object","required":["location"],"properties":{"location":{"type":"string","description":"The city and state"},"unit":{"type":"string","enum":["celsius","fahrenheit"]}}}`),
 				},
 			},
 		}
@@ -465,32 +442,7 @@ func TestGenerateChat(t *testing.T) {
 				Function: api.ToolFunction{
 					Name:        "get_weather",
 					Description: "Get the current weather",
-					Parameters: struct {
-						Type       string   `json:"type"`
-						Required   []string `json:"required"`
-						Properties map[string]struct {
-							Type        api.PropertyType `json:"type"`
-							Description string           `json:"description"`
-							Enum        []any            `json:"enum,omitempty"`
-						} `json:"properties"`
-					}{
-						Type:     "object",
-						Required: []string{"location"},
-						Properties: map[string]struct {
-							Type        api.PropertyType `json:"type"`
-							Description string           `json:"description"`
-							Enum        []any            `json:"enum,omitempty"`
-						}{
-							"location": {
-								Type:        api.PropertyType{"string"},
-								Description: "The city and state",
-							},
-							"unit": {
-								Type: api.PropertyType{"string"},
-								Enum: []any{"celsius", "fahrenheit"},
-							},
-						},
-					},
+					Parameters:  api.ToolSchema(`{"type":"object","required":["location"],"properties":{"location":{"type":"string","description":"The city and state"},"unit":{"type":"string","enum":["celsius","fahrenheit"]}}}`),
 				},
 			},
 		}
@@ -537,13 +489,15 @@ func TestGenerateChat(t *testing.T) {
 			return nil
 		}
 
+		streamRequest := true
+
 		w := createRequest(t, s.ChatHandler, api.ChatRequest{
 			Model: "test-system",
 			Messages: []api.Message{
 				{Role: "user", Content: "What's the weather in Seattle?"},
 			},
 			Tools:  tools,
-			Stream: &stream,
+			Stream: &streamRequest,
 		})
 
 		wg.Wait()
@@ -555,6 +509,7 @@ func TestGenerateChat(t *testing.T) {
 		// Read and validate the streamed responses
 		decoder := json.NewDecoder(w.Body)
 		var finalToolCall api.ToolCall
+		var arguments string
 
 		for {
 			var resp api.ChatResponse
@@ -564,6 +519,10 @@ func TestGenerateChat(t *testing.T) {
 				t.Fatal(err)
 			}
 
+			for _, d := range resp.Message.ToolCallDeltas {
+				arguments += d.Arguments
+			}
+
 			if resp.Done {
 				if len(resp.Message.ToolCalls) != 1 {
 					t.Errorf("expected 1 tool call in final response, got %d", len(resp.Message.ToolCalls))
@@ -585,6 +544,194 @@ func TestGenerateChat(t *testing.T) {
 		if diff := cmp.Diff(finalToolCall, expectedToolCall); diff != "" {
 			t.Errorf("final tool call mismatch (-got +want):\n%s", diff)
 		}
+
+		if diff := cmp.Diff(arguments, `{"location":"Seattle, WA","unit":"celsius"}`); diff != "" {
+			t.Errorf("streamed arguments mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("tool choice", func(t *testing.T) {
+		mock.CompletionFn = nil
+		mock.CompletionResponse = llm.CompletionResponse{
+			Content:    `{"name": "get_weather", "arguments": {"location": "Seattle, WA"}}`,
+			Done:       true,
+			DoneReason: llm.DoneReasonStop,
+		}
+
+		tools := []api.Tool{
+			{Type: "function", Function: api.ToolFunction{Name: "get_time"}},
+			{Type: "function", Function: api.ToolFunction{
+				Name:       "get_weather",
+				Parameters: api.ToolSchema(`{"type":"object","required":["location"],"properties":{"location":{"type":"string"}}}`),
+			}},
+		}
+
+		chat := func(choice api.ToolChoice, format json.RawMessage) *httptest.ResponseRecorder {
+			stream := false
+			return createRequest(t, s.ChatHandler, api.ChatRequest{
+				Model:      "test-system",
+				Messages:   []api.Message{{Role: "user", Content: "What's the weather in Seattle?"}},
+				Tools:      tools,
+				ToolChoice: &choice,
+				Format:     format,
+				Stream:     &stream,
+			})
+		}
+
+		t.Run("required", func(t *testing.T) {
+			w := chat(api.ToolChoice{Type: api.ToolChoiceRequired}, nil)
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+			}
+
+			g, err := grammar.Parse(mock.CompletionRequest.Grammar)
+			if err != nil {
+				t.Fatalf("invalid grammar: %v", err)
+			}
+
+			for output, want := range map[string]bool{
+				mock.CompletionResponse.Content:                         true,
+				`{"name": "get_time", "arguments": {}}`:                 true,
+				`{"name": "get_weather", "arguments": {}}`:              false,
+				`{"name": "get_weather", "arguments": {"location": 1}}`: false,
+				`{"name": "get_date", "arguments": {}}`:                 false,
+				`It is sunny in Seattle.`:                               false,
+			} {
+				if m := g.Matcher(); (m.AcceptString(output) && m.Complete()) != want {
+					t.Errorf("grammar match of %s = %v, want %v", output, !want, want)
+				}
+			}
+
+			var resp api.ChatResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(resp.Message.ToolCalls, []api.ToolCall{
+				{Function: api.ToolCallFunction{Name: "get_weather", Arguments: api.ToolCallFunctionArguments{"location": "Seattle, WA"}}},
+			}); diff != "" {
+				t.Errorf("tool calls mismatch (-got +want):\n%s", diff)
+			}
+		})
+
+		t.Run("function", func(t *testing.T) {
+			w := chat(api.ToolChoice{Type: api.ToolChoiceNamed, Function: api.ToolChoiceFunction{Name: "get_time"}}, nil)
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+			}
+
+			g, err := grammar.Parse(mock.CompletionRequest.Grammar)
+			if err != nil {
+				t.Fatalf("invalid grammar: %v", err)
+			}
+
+			if m := g.Matcher(); m.AcceptString(mock.CompletionResponse.Content) {
+				t.Errorf("grammar should only allow calls to get_time")
+			}
+		})
+
+		t.Run("none", func(t *testing.T) {
+			w := chat(api.ToolChoice{Type: api.ToolChoiceNone}, nil)
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+			}
+
+			if mock.CompletionRequest.Grammar != "" {
+				t.Errorf("expected no grammar, got %s", mock.CompletionRequest.Grammar)
+			}
+
+			if diff := cmp.Diff(mock.CompletionRequest.Prompt, "system: You are a helpful assistant.\nuser: What's the weather in Seattle?\n"); diff != "" {
+				t.Errorf("prompt mismatch (-got +want):\n%s", diff)
+			}
+		})
+
+		t.Run("unknown function", func(t *testing.T) {
+			w := chat(api.ToolChoice{Type: api.ToolChoiceNamed, Function: api.ToolChoiceFunction{Name: "get_date"}}, nil)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("expected status 400, got %d", w.Code)
+			}
+
+			if diff := cmp.Diff(w.Body.String(), `{"error":"tool_choice function \"get_date\" is not in tools"}`); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+		})
+
+		t.Run("format", func(t *testing.T) {
+			w := chat(api.ToolChoice{Type: api.ToolChoiceRequired}, json.RawMessage(`"json"`))
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("expected status 400, got %d", w.Code)
+			}
+		})
+
+		t.Run("auto with invalid arguments", func(t *testing.T) {
+			mock.CompletionResponse.Content = `{"name": "get_weather", "arguments": {"location": 1}}`
+			want := []api.ToolCall{
+				{Function: api.ToolCallFunction{Name: "get_weather", Arguments: api.ToolCallFunctionArguments{"location": float64(1)}}},
+			}
+
+			// the output isn't constrained, so the call is returned as written
+			w := chat(api.ToolChoice{Type: api.ToolChoiceAuto}, nil)
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+			}
+
+			var resp api.ChatResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(resp.Message.ToolCalls, want); diff != "" {
+				t.Errorf("tool calls mismatch (-got +want):\n%s", diff)
+			}
+
+			stream := true
+			w = createRequest(t, s.ChatHandler, api.ChatRequest{
+				Model:    "test-system",
+				Messages: []api.Message{{Role: "user", Content: "What's the weather in Seattle?"}},
+				Tools:    tools,
+				Stream:   &stream,
+			})
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+			}
+
+			var calls []api.ToolCall
+			for dec := json.NewDecoder(w.Body); dec.More(); {
+				var resp api.ChatResponse
+				if err := dec.Decode(&resp); err != nil {
+					t.Fatal(err)
+				}
+				calls = append(calls, resp.Message.ToolCalls...)
+			}
+
+			if diff := cmp.Diff(calls, want); diff != "" {
+				t.Errorf("tool calls mismatch (-got +want):\n%s", diff)
+			}
+		})
+
+		t.Run("required with invalid arguments", func(t *testing.T) {
+			// the mock doesn't apply the grammar, so this stands in for a
+			// grammar that fails to constrain the output
+			mock.CompletionResponse.Content = `{"name": "get_weather", "arguments": {"location": 1}}`
+			want := `invalid tool call: model called "get_weather" with invalid arguments: location: expected string, got number`
+
+			w := chat(api.ToolChoice{Type: api.ToolChoiceRequired}, nil)
+			if w.Code != http.StatusInternalServerError {
+				t.Errorf("expected status 500, got %d", w.Code)
+			}
+
+			var resp struct {
+				Error string `json:"error"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.Error != want {
+				t.Errorf("expected error %q, got %q", want, resp.Error)
+			}
+		})
 	})
 }
 
@@ -830,6 +977,119 @@ func TestGenerate(t *testing.T) {
 		checkGenerateResponse(t, w.Body, "test", "Hi!")
 	})
 
+	t.Run("prompt with logprobs", func(t *testing.T) {
+		logprobs := []api.Logprob{{
+			TokenLogprob: api.TokenLogprob{Token: "Hi!", Logprob: -0.25},
+			TopLogprobs:  []api.TokenLogprob{{Token: "Hi!", Logprob: -0.25}},
+		}}
+		mock.CompletionResponse.Logprobs = logprobs
+		defer func() { mock.CompletionResponse.Logprobs = nil }()
+
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:       "test",
+			Prompt:      "Hello!",
+			Stream:      &stream,
+			Logprobs:    true,
+			TopLogprobs: 1,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		if !mock.CompletionRequest.Logprobs || mock.CompletionRequest.TopLogprobs != 1 {
+			t.Errorf("logprobs not passed to runner: %v %d", mock.CompletionRequest.Logprobs, mock.CompletionRequest.TopLogprobs)
+		}
+
+		var actual api.GenerateResponse
+		if err := json.NewDecoder(w.Body).Decode(&actual); err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(logprobs, actual.Logprobs); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("prompt with invalid top logprobs", func(t *testing.T) {
+		for _, req := range []api.GenerateRequest{
+			{Model: "test", Prompt: "Hello!", TopLogprobs: 1},
+			{Model: "test", Prompt: "Hello!", Logprobs: true, TopLogprobs: api.MaxTopLogprobs + 1},
+		} {
+			w := createRequest(t, s.GenerateHandler, req)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("expected status 400, got %d", w.Code)
+			}
+		}
+	})
+
+	t.Run("prompt with multiple completions", func(t *testing.T) {
+		mock.CompletionFn = func(ctx context.Context, r llm.CompletionRequest, fn func(r llm.CompletionResponse)) error {
+			fn(llm.CompletionResponse{Index: 1, Content: "Hello"})
+			fn(llm.CompletionResponse{Index: 0, Content: "Hi!"})
+			fn(llm.CompletionResponse{Index: 0, Done: true, DoneReason: llm.DoneReasonStop, PromptEvalCount: 2, EvalCount: 1, EvalDuration: 1})
+			fn(llm.CompletionResponse{Index: 1, Content: " there"})
+			fn(llm.CompletionResponse{Index: 1, Done: true, DoneReason: llm.DoneReasonLength, PromptEvalCount: 2, EvalCount: 2, EvalDuration: 2})
+			return nil
+		}
+		defer func() { mock.CompletionFn = nil }()
+
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "test",
+			Prompt: "Hello!",
+			Stream: &stream,
+			N:      2,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		if mock.CompletionRequest.N != 2 {
+			t.Errorf("n not passed to runner: %d", mock.CompletionRequest.N)
+		}
+
+		var actual api.GenerateResponse
+		if err := json.NewDecoder(w.Body).Decode(&actual); err != nil {
+			t.Fatal(err)
+		}
+
+		want := []api.GenerateChoice{
+			{Index: 0, Response: "Hi!", DoneReason: "stop"},
+			{Index: 1, Response: "Hello there", DoneReason: "length"},
+		}
+		if diff := cmp.Diff(want, actual.Choices); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+
+		if actual.Response != "Hi!" || !actual.Done || actual.PromptEvalCount != 2 || actual.EvalCount != 3 {
+			t.Errorf("unexpected response: %+v", actual)
+		}
+	})
+
+	t.Run("prompt with missing draft model", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:   "test",
+			Prompt:  "Hello!",
+			Options: map[string]any{"draft_model": "missing"},
+		})
+
+		if w.Code != http.StatusInternalServerError {
+			t.Errorf("expected status 500, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff(w.Body.String(), `{"error":"draft model \"missing\" not found, try pulling it first"}`); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("prompt with invalid n", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{Model: "test", Prompt: "Hello!", N: -1})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+	})
+
 	w = createRequest(t, s.CreateHandler, api.CreateRequest{
 		Model:  "test-system",
 		From:   "test",
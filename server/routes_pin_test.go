@@ -0,0 +1,216 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/discover"
+	"github.com/ollama/ollama/fs/ggml"
+	"github.com/ollama/ollama/llm"
+)
+
+type pinRunner struct {
+	mockRunner
+
+	prompt string
+	pins   []llm.Pin
+}
+
+func (m *pinRunner) Pin(_ context.Context, prompt string) (llm.Pin, error) {
+	m.prompt = prompt
+	pin := llm.Pin{ID: len(m.pins), Inputs: len(prompt)}
+	m.pins = append(m.pins, pin)
+	return pin, nil
+}
+
+func (m *pinRunner) Pins(context.Context) ([]llm.Pin, error) {
+	return m.pins, nil
+}
+
+func (m *pinRunner) Unpin(_ context.Context, id int) error {
+	i := slices.IndexFunc(m.pins, func(p llm.Pin) bool { return p.ID == id })
+	if i < 0 {
+		return fmt.Errorf("no pinned cache slot with id %d", id)
+	}
+
+	m.pins = slices.Delete(m.pins, i, i+1)
+	return nil
+}
+
+func TestPin(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var mock pinRunner
+
+	s := Server{
+		sched: &Scheduler{
+			pendingReqCh:  make(chan *LlmRequest, 1),
+			finishedReqCh: make(chan *LlmRequest, 1),
+			expiredCh:     make(chan *runnerRef, 1),
+			unloadedCh:    make(chan any, 1),
+			loaded:        make(map[string]*runnerRef),
+			newServerFn: func(discover.GpuInfoList, string, *ggml.GGML, []string, []string, api.Options, int) (llm.LlamaServer, error) {
+				return &mock, nil
+			},
+			getGpuFn:     discover.GetGPUInfo,
+			getCpuFn:     discover.GetCPUInfo,
+			reschedDelay: 250 * time.Millisecond,
+			loadFn: func(req *LlmRequest, _ *ggml.GGML, _ discover.GpuInfoList, _ int) {
+				req.successCh <- &runnerRef{
+					llama: &mock,
+				}
+			},
+		},
+	}
+
+	go s.sched.Run(t.Context())
+
+	_, digest := createBinFile(t, ggml.KV{
+		"general.architecture":          "llama",
+		"llama.block_count":             uint32(1),
+		"llama.context_length":          uint32(8192),
+		"llama.embedding_length":        uint32(4096),
+		"llama.attention.head_count":    uint32(32),
+		"llama.attention.head_count_kv": uint32(8),
+		"tokenizer.ggml.tokens":         []string{""},
+		"tokenizer.ggml.scores":         []float32{0},
+		"tokenizer.ggml.token_type":     []int32{0},
+	}, []ggml.Tensor{
+		{Name: "token_embd.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+		{Name: "blk.0.attn_norm.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+		{Name: "blk.0.ffn_down.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+		{Name: "blk.0.ffn_gate.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+		{Name: "blk.0.ffn_up.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+		{Name: "blk.0.ffn_norm.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+		{Name: "blk.0.attn_k.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+		{Name: "blk.0.attn_output.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+		{Name: "blk.0.attn_q.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+		{Name: "blk.0.attn_v.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+		{Name: "output.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+	})
+
+	stream := false
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model: "test",
+		Files: map[string]string{"file.gguf": digest},
+		Template: `{{- range .Messages }}{{ .Role }}: {{ .Content }}
+{{ end }}`,
+		Stream: &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	t.Run("missing prompt", func(t *testing.T) {
+		w := createRequest(t, s.PinHandler, api.PinRequest{Model: "test"})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff(w.Body.String(), `{"error":"one of prompt or messages is required"}`); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("missing model", func(t *testing.T) {
+		w := createRequest(t, s.PinHandler, api.PinRequest{Model: "missing", Prompt: "Hello"})
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d", w.Code)
+		}
+	})
+
+	t.Run("prompt", func(t *testing.T) {
+		w := createRequest(t, s.PinHandler, api.PinRequest{Model: "test", Prompt: "You are a helpful assistant."})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if diff := cmp.Diff(mock.prompt, "You are a helpful assistant."); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		var resp api.PinResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(resp, api.PinResponse{Model: "test", ID: 0, Tokens: 28}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("messages", func(t *testing.T) {
+		w := createRequest(t, s.PinHandler, api.PinRequest{
+			Model:    "test",
+			Messages: []api.Message{{Role: "system", Content: "You are a pirate."}},
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if diff := cmp.Diff(mock.prompt, "system: You are a pirate.\n"); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	m, err := GetModel("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.sched.loadedMu.Lock()
+	s.sched.loaded[m.ModelPath] = &runnerRef{llama: &mock, model: m, modelPath: m.ModelPath}
+	s.sched.loadedMu.Unlock()
+
+	listPins := func(t *testing.T) []api.PinResponse {
+		t.Helper()
+
+		w := createRequest(t, s.ListPinsHandler, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		var resp api.ListPinsResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		return resp.Pins
+	}
+
+	t.Run("list", func(t *testing.T) {
+		if diff := cmp.Diff(listPins(t), []api.PinResponse{
+			{Model: m.ShortName, ID: 0, Tokens: 28},
+			{Model: m.ShortName, ID: 1, Tokens: 26},
+		}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("unpin", func(t *testing.T) {
+		w := createRequest(t, s.UnpinHandler, api.UnpinRequest{Model: "test", ID: 0})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if diff := cmp.Diff(listPins(t), []api.PinResponse{{Model: m.ShortName, ID: 1, Tokens: 26}}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		w = createRequest(t, s.UnpinHandler, api.UnpinRequest{Model: "test", ID: 0})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+	})
+}
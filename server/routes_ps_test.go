@@ -0,0 +1,94 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/llm"
+)
+
+type statsRunner struct {
+	mockRunner
+}
+
+func (statsRunner) Stats(context.Context) (llm.Stats, error) {
+	return llm.Stats{
+		ActiveRequests:  2,
+		QueuedRequests:  1,
+		Slots:           2,
+		SlotsInUse:      2,
+		ContextLength:   4096,
+		ContextUsed:     1024,
+		TokensPerSecond: 25,
+		Layers: []llm.LayerPlacement{
+			{Library: "cpu", ID: "0", First: 0, Last: 3},
+			{Library: "cuda", ID: "0", First: 4, Last: 8},
+		},
+	}, nil
+}
+
+func TestPs(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var mock statsRunner
+
+	s := Server{
+		sched: &Scheduler{
+			loaded: map[string]*runnerRef{
+				"loaded": {
+					llama:     &mock,
+					model:     &Model{ShortName: "loaded:latest"},
+					expiresAt: time.Now().Add(time.Hour),
+				},
+				"loading": {
+					llama:     &mock,
+					model:     &Model{ShortName: "loading:latest"},
+					loading:   true,
+					expiresAt: time.Now().Add(time.Minute),
+				},
+			},
+		},
+	}
+
+	w := createRequest(t, s.PsHandler, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var resp api.ProcessResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resp.Models) != 2 {
+		t.Fatalf("expected 2 models, got %d", len(resp.Models))
+	}
+
+	if diff := cmp.Diff(resp.Models[0].Stats, &api.ProcessStats{
+		ActiveRequests:  2,
+		QueuedRequests:  1,
+		SlotsInUse:      2,
+		Slots:           2,
+		ContextUsed:     1024,
+		ContextLength:   4096,
+		TokensPerSecond: 25,
+		Layers: []api.LayerPlacement{
+			{Library: "cpu", ID: "0", First: 0, Last: 3},
+			{Library: "cuda", ID: "0", First: 4, Last: 8},
+		},
+	}); diff != "" {
+		t.Errorf("mismatch (-got +want):\n%s", diff)
+	}
+
+	// models that are still loading have no stats
+	if resp.Models[1].Stats != nil {
+		t.Errorf("expected no stats while loading, got %+v", resp.Models[1].Stats)
+	}
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/discover"
+	"github.com/ollama/ollama/fs/ggml"
+	"github.com/ollama/ollama/llm"
+)
+
+type rerankRunner struct {
+	mockRunner
+
+	inputs []string
+}
+
+// Embedding scores each input by the number of words it has
+func (m *rerankRunner) Embedding(_ context.Context, input []string) ([][]float32, error) {
+	m.inputs = append(m.inputs, input...)
+
+	scores := make([][]float32, len(input))
+	for i, s := range input {
+		scores[i] = []float32{float32(len(strings.Fields(s))) - 8}
+	}
+
+	return scores, nil
+}
+
+func (m *rerankRunner) Detokenize(_ context.Context, tokens []int) (string, error) {
+	if slices.Equal(tokens, []int{102}) {
+		return "[SEP]", nil
+	}
+
+	return strings.Repeat("word ", len(tokens)), nil
+}
+
+func TestRerank(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var mock rerankRunner
+
+	s := Server{
+		sched: &Scheduler{
+			pendingReqCh:  make(chan *LlmRequest, 1),
+			finishedReqCh: make(chan *LlmRequest, 1),
+			expiredCh:     make(chan *runnerRef, 1),
+			unloadedCh:    make(chan any, 1),
+			loaded:        make(map[string]*runnerRef),
+			newServerFn: func(discover.GpuInfoList, string, *ggml.GGML, []string, []string, api.Options, int) (llm.LlamaServer, error) {
+				return &mock, nil
+			},
+			getGpuFn:     discover.GetGPUInfo,
+			getCpuFn:     discover.GetCPUInfo,
+			reschedDelay: 250 * time.Millisecond,
+			loadFn: func(req *LlmRequest, _ *ggml.GGML, _ discover.GpuInfoList, _ int) {
+				req.successCh <- &runnerRef{
+					llama: &mock,
+				}
+			},
+		},
+	}
+
+	go s.sched.Run(t.Context())
+
+	stream := false
+
+	_, digest := createBinFile(t, ggml.KV{
+		"general.architecture":              "bert",
+		"bert.pooling_type":                 uint32(4),
+		"bert.context_length":               uint32(16),
+		"tokenizer.ggml.seperator_token_id": uint32(102),
+	}, nil)
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model:  "reranker",
+		Files:  map[string]string{"file.gguf": digest},
+		Stream: &stream,
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	_, digest = createBinFile(t, ggml.KV{
+		"general.architecture": "bert",
+		"bert.pooling_type":    uint32(1),
+	}, nil)
+
+	w = createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model:  "embedder",
+		Files:  map[string]string{"file.gguf": digest},
+		Stream: &stream,
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	documents := []string{
+		"Berlin is in Germany.",
+		"Paris is the capital of France.",
+		"Lyon is a city in France.",
+	}
+
+	t.Run("missing query", func(t *testing.T) {
+		w := createRequest(t, s.RerankHandler, api.RerankRequest{Model: "reranker", Documents: documents})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff(w.Body.String(), `{"error":"query is required"}`); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("missing capability", func(t *testing.T) {
+		w := createRequest(t, s.RerankHandler, api.RerankRequest{Model: "embedder", Query: "France", Documents: documents})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff(w.Body.String(), `{"error":"\"embedder\" does not support rerank"}`); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("rerank", func(t *testing.T) {
+		mock.inputs = nil
+
+		w := createRequest(t, s.RerankHandler, api.RerankRequest{Model: "reranker", Query: "France", Documents: documents, TopN: 2})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if diff := cmp.Diff(mock.inputs, []string{
+			"France[SEP]Berlin is in Germany.",
+			"France[SEP]Paris is the capital of France.",
+			"France[SEP]Lyon is a city in France.",
+		}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		var resp api.RerankResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		// inputs have 4, 6 and 6 words, and ties keep the order of the documents
+		if diff := cmp.Diff(resp.Results, []api.RerankResult{
+			{Index: 1, Document: documents[1], RelevanceScore: sigmoid(-2)},
+			{Index: 2, Document: documents[2], RelevanceScore: sigmoid(-2)},
+		}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		if resp.PromptEvalCount != 16 {
+			t.Errorf("expected 16 tokens, got %d", resp.PromptEvalCount)
+		}
+	})
+
+	t.Run("truncate", func(t *testing.T) {
+		long := strings.Repeat("France ", 20)
+
+		truncate := false
+		w := createRequest(t, s.RerankHandler, api.RerankRequest{Model: "reranker", Query: "France", Documents: []string{long}, Truncate: &truncate})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+
+		mock.inputs = nil
+
+		w = createRequest(t, s.RerankHandler, api.RerankRequest{Model: "reranker", Query: "France", Documents: []string{long}})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		// the context length is 16, less the 2 tokens that start and end
+		// the input
+		if diff := cmp.Diff(mock.inputs, []string{strings.Repeat("word ", 14)}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+}
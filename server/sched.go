@@ -5,13 +5,16 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"math"
 	"os"
 	"reflect"
 	"runtime"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ollama/ollama/api"
@@ -32,6 +35,10 @@ type LlmRequest struct {
 	successCh       chan *runnerRef
 	errCh           chan error
 	schedAttempts   uint
+
+	// client and priority order the request in the scheduler's queue
+	client   string
+	priority api.Priority
 }
 
 type Scheduler struct {
@@ -39,10 +46,18 @@ type Scheduler struct {
 	finishedReqCh chan *LlmRequest
 	expiredCh     chan *runnerRef
 	unloadedCh    chan any
+	wakeCh        chan struct{}
+
+	// queued is the number of requests taken from pendingReqCh that are
+	// waiting to be scheduled
+	queued atomic.Int64
 
 	loaded   map[string]*runnerRef
 	loadedMu sync.Mutex
 
+	// config sets how particular models run, and which are kept loaded
+	config *modelConfig
+
 	loadFn       func(req *LlmRequest, f *ggml.GGML, gpus discover.GpuInfoList, numParallel int)
 	newServerFn  func(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapters []string, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error)
 	getGpuFn     func() discover.GpuInfoList
@@ -62,6 +77,12 @@ var defaultParallel = 4
 
 var ErrMaxQueue = errors.New("server busy, please try again.  maximum pending requests exceeded")
 
+var errInvalidPlacement = errors.New("invalid placement")
+
+// errPreloadedOptions is returned for requests that would need a preloaded
+// model to be loaded again with different options
+var errPreloadedOptions = errors.New("model is preloaded with different options")
+
 func InitScheduler(ctx context.Context) *Scheduler {
 	maxQueue := envconfig.MaxQueue()
 	sched := &Scheduler{
@@ -69,6 +90,7 @@ func InitScheduler(ctx context.Context) *Scheduler {
 		finishedReqCh: make(chan *LlmRequest, maxQueue),
 		expiredCh:     make(chan *runnerRef, maxQueue),
 		unloadedCh:    make(chan any, maxQueue),
+		wakeCh:        make(chan struct{}, 1),
 		loaded:        make(map[string]*runnerRef),
 		newServerFn:   llm.NewLlamaServer,
 		getGpuFn:      discover.GetGPUInfo,
@@ -85,6 +107,7 @@ func (s *Scheduler) GetRunner(c context.Context, model *Model, opts api.Options,
 		opts.NumCtx = 4
 	}
 
+	info := schedInfoFromContext(c)
 	req := &LlmRequest{
 		ctx:             c,
 		model:           model,
@@ -92,6 +115,15 @@ func (s *Scheduler) GetRunner(c context.Context, model *Model, opts api.Options,
 		sessionDuration: sessionDuration,
 		successCh:       make(chan *runnerRef),
 		errCh:           make(chan error, 1),
+		client:          info.client,
+		priority:        info.priority,
+	}
+
+	// requests waiting in the scheduler's queue count toward the maximum
+	// along with those in pendingReqCh
+	if int(s.queued.Load())+len(s.pendingReqCh) >= cap(s.pendingReqCh) {
+		req.errCh <- ErrMaxQueue
+		return req.successCh, req.errCh
 	}
 
 	select {
@@ -115,201 +147,334 @@ func (s *Scheduler) Run(ctx context.Context) {
 }
 
 func (s *Scheduler) processPending(ctx context.Context) {
+	var queue requestQueue
+
+	// unloading is the runner being unloaded to make room for a pending
+	// request, if any. Requests that need a runner loaded wait until it has
+	// been, but requests for other loaded runners are still scheduled
+	var unloading *runnerRef
+
 	for {
 		select {
 		case <-ctx.Done():
 			slog.Debug("shutting down scheduler pending loop")
 			return
 		case pending := <-s.pendingReqCh:
-			// Block other requests until we get this pending request running
-			pending.schedAttempts++
-			if pending.origNumCtx == 0 {
-				pending.origNumCtx = pending.opts.NumCtx
+			queue.Push(pending)
+		case <-s.unloadedCh:
+			if unloading == nil {
+				// An unload request when there are no pending request can be ignored
+				slog.Debug("ignoring unload event with no pending requests")
+			} else {
+				slog.Debug("unload completed", "modelPath", unloading.modelPath)
+				unloading = nil
 			}
+		case <-s.wakeCh:
+		}
 
-			if pending.ctx.Err() != nil {
-				slog.Debug("pending request cancelled or timed out, skipping scheduling")
-				continue
+		// take any other requests that have arrived so that they are
+		// ordered by priority too
+	drain:
+		for {
+			select {
+			case pending := <-s.pendingReqCh:
+				queue.Push(pending)
+			default:
+				break drain
 			}
-			numParallel := int(envconfig.NumParallel())
-			// TODO (jmorganca): mllama doesn't support parallel yet
-			// see https://github.com/ollama/ollama/issues/4165
-			if checkMllamaModelFamily(pending.model) && numParallel != 1 {
-				numParallel = 1
-				slog.Warn("mllama doesn't support parallel requests yet")
+		}
+
+		// waiting holds the requests found to need the current unload
+		// during this scan, which are skipped for the rest of it
+		waiting := make(map[*LlmRequest]bool)
+		for {
+			pending := queue.Pop(func(req *LlmRequest) bool {
+				return !waiting[req] && s.ready(req, unloading)
+			})
+			if pending == nil {
+				break
 			}
 
-			for {
-				var runnerToExpire *runnerRef
-				s.loadedMu.Lock()
-				runner := s.loaded[pending.model.ModelPath]
-				loadedCount := len(s.loaded)
-				s.loadedMu.Unlock()
-				if runner != nil {
-					if runner.needsReload(ctx, pending) {
-						runnerToExpire = runner
-					} else {
-						// Runner is usable, return it
-						pending.useLoadedRunner(runner, s.finishedReqCh)
-						break
-					}
-				} else if envconfig.MaxRunners() > 0 && loadedCount >= int(envconfig.MaxRunners()) {
-					slog.Debug("max runners achieved, unloading one to make room", "runner_count", loadedCount)
-					runnerToExpire = s.findRunnerToUnload()
-				} else {
-					// Either no models are loaded or below envconfig.MaxRunners
-					// Get a refreshed GPU list
-					var gpus discover.GpuInfoList
-					if pending.opts.NumGPU == 0 {
-						gpus = s.getCpuFn()
-					} else {
-						gpus = s.getGpuFn()
-					}
+			if runnerToExpire := s.schedule(ctx, pending, unloading); runnerToExpire != nil {
+				// Wait for the unload to happen, keeping the request's
+				// place in the queue
+				queue.PushFront(pending)
+				if runnerToExpire == unloading {
+					waiting[pending] = true
+					continue
+				}
+				unloading = runnerToExpire
+			}
+		}
 
-					if envconfig.MaxRunners() <= 0 {
-						// No user specified MaxRunners, so figure out what automatic setting to use
-						// If all GPUs have reliable free memory reporting, defaultModelsPerGPU * the number of GPUs
-						// if any GPU has unreliable free memory reporting, 1x the number of GPUs
-						allReliable := true
-						for _, gpu := range gpus {
-							if gpu.UnreliableFreeMemory {
-								allReliable = false
-								break
-							}
-						}
-						if allReliable {
-							// HACK
-							os.Setenv("OLLAMA_MAX_LOADED_MODELS", strconv.Itoa(defaultModelsPerGPU*len(gpus)))
-							slog.Debug("updating default concurrency", "OLLAMA_MAX_LOADED_MODELS", envconfig.MaxRunners(), "gpu_count", len(gpus))
-						} else {
-							// HACK
-							os.Setenv("OLLAMA_MAX_LOADED_MODELS", strconv.Itoa(len(gpus)))
-							slog.Info("one or more GPUs detected that are unable to accurately report free memory - disabling default concurrency")
-						}
-					}
+		s.queued.Store(int64(queue.Len()))
+	}
+}
 
-					// Load model for fitting
-					ggml, err := llm.LoadModel(pending.model.ModelPath, 0)
-					if err != nil {
-						pending.errCh <- err
-						break
-					}
+// ready reports whether a pending request can be scheduled without waiting
+// for a runner to finish loading or for another to unload
+func (s *Scheduler) ready(pending *LlmRequest, unloading *runnerRef) bool {
+	if pending.ctx.Err() != nil {
+		return true
+	}
 
-					// Embedding models should always be loaded with parallel=1
-					if pending.model.CheckCapabilities(model.CapabilityCompletion) != nil {
-						numParallel = 1
-					}
+	s.loadedMu.Lock()
+	runner := s.loaded[pending.model.ModelPath]
+	s.loadedMu.Unlock()
 
-					// Evaluate if the model will fit in the available system memory, or if we should unload a model first
-					if len(gpus) == 1 && gpus[0].Library == "cpu" {
-						// simplifying assumption of defaultParallel when in CPU mode
-						if numParallel <= 0 {
-							numParallel = defaultParallel
-						}
+	if runner == nil {
+		return unloading == nil
+	} else if runner == unloading {
+		return false
+	}
 
-						pending.opts.NumCtx = pending.origNumCtx * numParallel
+	// the lock is held while a runner loads
+	if !runner.refMu.TryLock() {
+		return false
+	}
+	loading := runner.loading
+
+	// a runner that needs reloading has to wait for the unload too. The
+	// runner isn't pinged here so that a slow one doesn't hold up the scan;
+	// schedule does that. Preloaded runners aren't reloaded for other
+	// options, which schedule rejects straight away
+	reload := runner.Options == nil || !runner.pinned && runner.optionsChanged(pending)
+	runner.refMu.Unlock()
+	if loading {
+		return false
+	}
 
-						if loadedCount == 0 {
-							slog.Debug("cpu mode with first model, loading")
-							s.loadFn(pending, ggml, gpus, numParallel)
-							break
-						}
-						runnerToExpire = s.maybeFindCPURunnerToUnload(pending, ggml, gpus)
-						if runnerToExpire == nil {
-							slog.Debug("cpu mode with available system memory or first model, loading")
-							s.loadFn(pending, ggml, gpus, numParallel)
-							break
-						}
-						// else we need to expire a runner
-					} else if loadedCount == 0 {
-						// No models loaded. Load the model but prefer the best fit.
-						slog.Debug("loading first model", "model", pending.model.ModelPath)
-						g := pickBestFullFitByLibrary(pending, ggml, gpus, &numParallel)
-						if g != nil {
-							gpus = g
-						} else {
-							// Only allow partial loads when this is the first model
-							gpus = pickBestPartialFitByLibrary(pending, ggml, gpus, &numParallel)
-						}
-						s.loadFn(pending, ggml, gpus, numParallel)
-						break
-					}
+	return unloading == nil || !reload
+}
 
-					if runnerToExpire == nil {
-						// More than one loaded model, so we have to see if the
-						// new one fits
-						//
-						// We want to avoid loading on any GPUs that have other
-						// models still loading on them to avoid potential races
-						// with VRAM consumption ramping up during load
-						availGpus := s.filterGPUsWithoutLoadingModels(gpus)
-
-						// Update free memory from currently loaded models
-						s.updateFreeSpace(availGpus)
-						fitGpus := pickBestFullFitByLibrary(pending, ggml, availGpus, &numParallel)
-						if fitGpus != nil {
-							slog.Debug("new model fits with existing models, loading")
-							s.loadFn(pending, ggml, fitGpus, numParallel)
-							break
-						}
+// wake prompts the scheduler to look at pending requests again, e.g. once a
+// runner has loaded
+func (s *Scheduler) wake() {
+	select {
+	case s.wakeCh <- struct{}{}:
+	default:
+	}
+}
 
-						// We couldn't find a set of GPUs to fully load the new
-						// model. If no other models are loading (both GPU lists
-						// are the same) then we need to unload another model to
-						// make room
-						if len(availGpus) < len(gpus) {
-							// There are other requests pending, and this one
-							// needs more time, so put it on the back of the
-							// queue so that we might satisfy other pending
-							// requests that aren't blocked
-							go func() {
-								// Process in a go routine to avoid deadlocking
-								// the scheduler if our queue is full
-								slog.Debug("delaying scheduling while other models finish loading", "attempts", pending.schedAttempts, "model", pending.model.ModelPath)
-								time.Sleep(s.reschedDelay)
-								s.pendingReqCh <- pending
-							}()
-							break
-						}
-						runnerToExpire = s.findRunnerToUnload()
-					}
-				}
+// schedule gives a pending request a runner, loading one if needed. If a
+// runner has to be unloaded to make room first, it is expired and returned
+// so that the request can be scheduled again once it has unloaded. While
+// unloading is set, no other runner is expired and unloading is returned
+// instead
+func (s *Scheduler) schedule(ctx context.Context, pending *LlmRequest, unloading *runnerRef) *runnerRef {
+	pending.schedAttempts++
+	if pending.origNumCtx == 0 {
+		pending.origNumCtx = pending.opts.NumCtx
+	}
 
-				if runnerToExpire == nil {
-					// Shouildn't happen
-					slog.Error("runner to expire was nil!")
-					continue
-				}
-				// Trigger an expiration to unload once it's done
-				runnerToExpire.refMu.Lock()
-				slog.Debug("resetting model to expire immediately to make room", "modelPath", runnerToExpire.modelPath, "refCount", runnerToExpire.refCount)
-				if runnerToExpire.expireTimer != nil {
-					runnerToExpire.expireTimer.Stop()
-					runnerToExpire.expireTimer = nil
-				}
-				runnerToExpire.sessionDuration = 0
-				if runnerToExpire.refCount <= 0 {
-					s.expiredCh <- runnerToExpire
-				}
-				runnerToExpire.refMu.Unlock()
-				// Wait for the unload to happen
-				// Note: at this point we're queueing up all incoming requests, even if they were for
-				// a different model that's loaded and not scheduled to be removed.
-				slog.Debug("waiting for pending requests to complete and unload to occur", "modelPath", runnerToExpire.modelPath)
-				select {
-				case <-ctx.Done():
-					slog.Debug("shutting down scheduler pending loop")
-					return
-				case <-s.unloadedCh:
-					slog.Debug("unload completed", "modelPath", runnerToExpire.modelPath)
-					continue
+	if pending.ctx.Err() != nil {
+		slog.Debug("pending request cancelled or timed out, skipping scheduling")
+		return nil
+	}
+	numParallel := int(envconfig.NumParallel())
+	if n := s.config.numParallel(pending.model.Name); n > 0 {
+		numParallel = n
+	} else if pending.model.CheckCapabilities(model.CapabilityCompletion) != nil {
+		// Embedding models are loaded with parallel=1 unless num_parallel
+		// is set for them in the model config
+		numParallel = 1
+	}
+	// TODO (jmorganca): mllama doesn't support parallel yet
+	// see https://github.com/ollama/ollama/issues/4165
+	if checkMllamaModelFamily(pending.model) && numParallel != 1 {
+		numParallel = 1
+		slog.Warn("mllama doesn't support parallel requests yet")
+	}
+
+	var runnerToExpire *runnerRef
+	s.loadedMu.Lock()
+	runner := s.loaded[pending.model.ModelPath]
+	loadedCount := len(s.loaded)
+	s.loadedMu.Unlock()
+	if runner != nil {
+		if runner.needsReload(ctx, pending) {
+			// preloaded models are only reloaded with the options they
+			// were preloaded with, so they stay loaded as configured
+			runner.refMu.Lock()
+			changed := runner.pinned && runner.Options != nil && runner.optionsChanged(pending)
+			runner.refMu.Unlock()
+			if changed {
+				pending.errCh <- fmt.Errorf("%w, remove the options from the request or change them in the model config", errPreloadedOptions)
+				return nil
+			}
+
+			runnerToExpire = runner
+		} else {
+			// Runner is usable, return it
+			pending.useLoadedRunner(runner, s.finishedReqCh)
+			return nil
+		}
+	} else if envconfig.MaxRunners() > 0 && loadedCount >= int(envconfig.MaxRunners()) {
+		slog.Debug("max runners achieved, unloading one to make room", "runner_count", loadedCount)
+		if unloading != nil {
+			return unloading
+		}
+		runnerToExpire = s.findRunnerToUnload()
+	} else {
+		// Either no models are loaded or below envconfig.MaxRunners
+		// Get a refreshed GPU list
+		var gpus discover.GpuInfoList
+		if pending.opts.NumGPU == 0 {
+			gpus = s.getCpuFn()
+		} else {
+			gpus = s.getGpuFn()
+		}
+
+		if envconfig.MaxRunners() <= 0 {
+			// No user specified MaxRunners, so figure out what automatic setting to use
+			// If all GPUs have reliable free memory reporting, defaultModelsPerGPU * the number of GPUs
+			// if any GPU has unreliable free memory reporting, 1x the number of GPUs
+			allReliable := true
+			for _, gpu := range gpus {
+				if gpu.UnreliableFreeMemory {
+					allReliable = false
+					break
 				}
 			}
-		case <-s.unloadedCh:
-			// An unload request when there are no pending request can be ignored
-			slog.Debug("ignoring unload event with no pending requests")
+			if allReliable {
+				// HACK
+				os.Setenv("OLLAMA_MAX_LOADED_MODELS", strconv.Itoa(defaultModelsPerGPU*len(gpus)))
+				slog.Debug("updating default concurrency", "OLLAMA_MAX_LOADED_MODELS", envconfig.MaxRunners(), "gpu_count", len(gpus))
+			} else {
+				// HACK
+				os.Setenv("OLLAMA_MAX_LOADED_MODELS", strconv.Itoa(len(gpus)))
+				slog.Info("one or more GPUs detected that are unable to accurately report free memory - disabling default concurrency")
+			}
+		}
+
+		gpus, err := placementGPUs(gpus, pending.opts.Runner)
+		if err != nil {
+			pending.errCh <- err
+			return nil
+		}
+
+		// Load model for fitting
+		ggml, err := llm.LoadModel(pending.model.ModelPath, 0)
+		if err != nil {
+			pending.errCh <- err
+			return nil
+		}
+
+		// Evaluate if the model will fit in the available system memory, or if we should unload a model first
+		if len(gpus) == 1 && gpus[0].Library == "cpu" {
+			// simplifying assumption of defaultParallel when in CPU mode
+			if numParallel <= 0 {
+				numParallel = defaultParallel
+			}
+
+			pending.opts.NumCtx = pending.origNumCtx * numParallel
+
+			if loadedCount == 0 {
+				slog.Debug("cpu mode with first model, loading")
+				s.loadFn(pending, ggml, gpus, numParallel)
+				return nil
+			}
+			runnerToExpire = s.maybeFindCPURunnerToUnload(pending, ggml, gpus)
+			if runnerToExpire == nil {
+				slog.Debug("cpu mode with available system memory or first model, loading")
+				s.loadFn(pending, ggml, gpus, numParallel)
+				return nil
+			}
+			// else we need to expire a runner
+		} else if loadedCount == 0 {
+			// No models loaded. Load the model but prefer the best fit.
+			slog.Debug("loading first model", "model", pending.model.ModelPath)
+			g := pickBestFullFitByLibrary(pending, ggml, gpus, &numParallel)
+			if g != nil {
+				gpus = g
+			} else if pending.opts.NoCPUOffload {
+				pending.errCh <- errors.New("model requires more VRAM than is available and no_cpu_offload is set")
+				return nil
+			} else {
+				// Only allow partial loads when this is the first model
+				gpus = pickBestPartialFitByLibrary(pending, ggml, gpus, &numParallel)
+			}
+			s.loadFn(pending, ggml, gpus, numParallel)
+			return nil
+		}
+
+		if runnerToExpire == nil {
+			// More than one loaded model, so we have to see if the
+			// new one fits
+			//
+			// We want to avoid loading on any GPUs that have other
+			// models still loading on them to avoid potential races
+			// with VRAM consumption ramping up during load
+			availGpus := s.filterGPUsWithoutLoadingModels(gpus)
+
+			// Update free memory from currently loaded models
+			s.updateFreeSpace(availGpus)
+			fitGpus := pickBestFullFitByLibrary(pending, ggml, availGpus, &numParallel)
+			if fitGpus != nil {
+				slog.Debug("new model fits with existing models, loading")
+				s.loadFn(pending, ggml, fitGpus, numParallel)
+				return nil
+			}
+
+			// We couldn't find a set of GPUs to fully load the new
+			// model. If no other models are loading (both GPU lists
+			// are the same) then we need to unload another model to
+			// make room
+			if len(availGpus) < len(gpus) {
+				// There are other requests pending, and this one
+				// needs more time, so put it on the back of the
+				// queue so that we might satisfy other pending
+				// requests that aren't blocked
+				s.requeue(pending)
+				return nil
+			}
+			runnerToExpire = s.findRunnerToUnload()
 		}
 	}
+
+	if unloading != nil {
+		return unloading
+	}
+
+	if runnerToExpire == nil && s.allPinned() {
+		pending.errCh <- errors.New("not enough memory to load the model without unloading a preloaded model")
+		return nil
+	}
+
+	if runnerToExpire == nil {
+		// Shouildn't happen
+		slog.Error("runner to expire was nil!")
+		s.requeue(pending)
+		return nil
+	}
+	// Trigger an expiration to unload once it's done
+	runnerToExpire.refMu.Lock()
+	slog.Debug("resetting model to expire immediately to make room", "modelPath", runnerToExpire.modelPath, "refCount", runnerToExpire.refCount)
+	if runnerToExpire.expireTimer != nil {
+		runnerToExpire.expireTimer.Stop()
+		runnerToExpire.expireTimer = nil
+	}
+	runnerToExpire.sessionDuration = 0
+	if runnerToExpire.refCount <= 0 {
+		s.expiredCh <- runnerToExpire
+	}
+	runnerToExpire.refMu.Unlock()
+	// Requests that need a runner loaded wait for the unload, but requests
+	// for other loaded runners are still scheduled in the meantime
+	slog.Debug("waiting for pending requests to complete and unload to occur", "modelPath", runnerToExpire.modelPath)
+	return runnerToExpire
+}
+
+// requeue puts a pending request that needs more time back on the queue
+// after a delay
+func (s *Scheduler) requeue(pending *LlmRequest) {
+	go func() {
+		// Process in a go routine to avoid deadlocking
+		// the scheduler if our queue is full
+		slog.Debug("delaying scheduling while other models finish loading", "attempts", pending.schedAttempts, "model", pending.model.ModelPath)
+		time.Sleep(s.reschedDelay)
+		s.pendingReqCh <- pending
+	}()
 }
 
 func (s *Scheduler) processCompleted(ctx context.Context) {
@@ -400,7 +565,7 @@ func (pending *LlmRequest) useLoadedRunner(runner *runnerRef, finished chan *Llm
 		runner.expireTimer.Stop()
 		runner.expireTimer = nil
 	}
-	if pending.sessionDuration != nil {
+	if pending.sessionDuration != nil && !runner.pinned {
 		runner.sessionDuration = pending.sessionDuration.Duration
 	}
 	pending.successCh <- runner
@@ -419,6 +584,10 @@ func (s *Scheduler) load(req *LlmRequest, f *ggml.GGML, gpus discover.GpuInfoLis
 	if req.sessionDuration != nil {
 		sessionDuration = req.sessionDuration.Duration
 	}
+	pinned := s.config.preloaded(req.model.Name)
+	if pinned {
+		sessionDuration = time.Duration(math.MaxInt64)
+	}
 	llama, err := s.newServerFn(gpus, req.model.ModelPath, f, req.model.AdapterPaths, req.model.ProjectorPaths, req.opts, numParallel)
 	if err != nil {
 		// some older models are not compatible with newer versions of llama.cpp
@@ -441,6 +610,7 @@ func (s *Scheduler) load(req *LlmRequest, f *ggml.GGML, gpus discover.GpuInfoLis
 		estimatedVRAM:   llama.EstimatedVRAM(),
 		estimatedTotal:  llama.EstimatedTotal(),
 		loading:         true,
+		pinned:          pinned,
 		refCount:        1,
 	}
 	runner.numParallel = numParallel
@@ -452,6 +622,8 @@ func (s *Scheduler) load(req *LlmRequest, f *ggml.GGML, gpus discover.GpuInfoLis
 	s.loadedMu.Unlock()
 
 	go func() {
+		// requests for the model wait until it is no longer locked
+		defer s.wake()
 		defer runner.refMu.Unlock()
 		if err = llama.WaitUntilRunning(req.ctx); err != nil {
 			slog.Error("error loading llama server", "error", err)
@@ -552,6 +724,10 @@ type runnerRef struct {
 	expireTimer     *time.Timer
 	expiresAt       time.Time
 
+	// pinned runners are kept loaded by the model config, so they don't
+	// expire and aren't unloaded to make room for other models
+	pinned bool
+
 	model       *Model
 	modelPath   string
 	numParallel int
@@ -587,6 +763,19 @@ func (runner *runnerRef) needsReload(ctx context.Context, req *LlmRequest) bool
 		return true
 	}
 
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if runner.optionsChanged(req) || runner.llama.Ping(ctx) != nil {
+		return true
+	}
+
+	return false
+}
+
+// optionsChanged reports whether the runner would have to be loaded with
+// different adapters, projectors or options for req. runner.refMu must be
+// held and runner.Options must be set
+func (runner *runnerRef) optionsChanged(req *LlmRequest) bool {
 	// Don't reload runner if num_gpu=-1 was provided
 	optsExisting := runner.Options.Runner
 	optsNew := req.opts.Runner
@@ -598,16 +787,9 @@ func (runner *runnerRef) needsReload(ctx context.Context, req *LlmRequest) bool
 	// Normalize the NumCtx for parallelism
 	optsExisting.NumCtx = optsExisting.NumCtx / runner.numParallel
 
-	ctx, cancel := context.WithTimeout(ctx, timeout)
-	defer cancel()
-	if !reflect.DeepEqual(runner.model.AdapterPaths, req.model.AdapterPaths) || // have the adapters changed?
+	return !reflect.DeepEqual(runner.model.AdapterPaths, req.model.AdapterPaths) || // have the adapters changed?
 		!reflect.DeepEqual(runner.model.ProjectorPaths, req.model.ProjectorPaths) || // have the projectors changed?
-		!reflect.DeepEqual(optsExisting, optsNew) || // have the runner options changed?
-		runner.llama.Ping(ctx) != nil {
-		return true
-	}
-
-	return false
+		!reflect.DeepEqual(optsExisting, optsNew) // have the runner options changed?
 }
 
 // Free memory reporting on GPUs can lag for a while even after the runner
@@ -698,6 +880,14 @@ func pickBestFullFitByLibrary(req *LlmRequest, f *ggml.GGML, gpus discover.GpuIn
 		numParallelToTry = []int{*numParallel}
 	}
 
+	spread := envconfig.SchedSpread()
+	switch req.opts.Placement {
+	case api.PlacementSpread:
+		spread = true
+	case api.PlacementBinpack:
+		spread = false
+	}
+
 	for _, gl := range gpus.ByLibrary() {
 		var ok bool
 		sgl := append(make(discover.GpuInfoList, 0, len(gl)), gl...)
@@ -707,11 +897,18 @@ func pickBestFullFitByLibrary(req *LlmRequest, f *ggml.GGML, gpus discover.GpuIn
 		// Note: at present, this will favor more VRAM over faster GPU speed in mixed setups
 		sort.Sort(sort.Reverse(discover.ByFreeMemory(sgl)))
 
+		// Bin packing tries the GPUs with the least free memory first
+		single := sgl
+		if req.opts.Placement == api.PlacementBinpack {
+			single = slices.Clone(sgl)
+			slices.Reverse(single)
+		}
+
 		// First attempt to fit the model into a single GPU
 		for _, p := range numParallelToTry {
 			req.opts.NumCtx = req.origNumCtx * p
-			if !envconfig.SchedSpread() {
-				for _, g := range sgl {
+			if !spread {
+				for _, g := range single {
 					if ok, estimatedVRAM = llm.PredictServerFit([]discover.GpuInfo{g}, f, req.model.AdapterPaths, req.model.ProjectorPaths, req.opts, p); ok {
 						slog.Info("new model will fit in available VRAM in single GPU, loading", "model", req.model.ModelPath, "gpu", g.ID, "parallel", p, "available", g.FreeMemory, "required", format.HumanBytes2(estimatedVRAM))
 						*numParallel = p
@@ -738,6 +935,58 @@ func pickBestFullFitByLibrary(req *LlmRequest, f *ggml.GGML, gpus discover.GpuIn
 	return nil
 }
 
+// placementGPUs returns the GPUs that a model may be loaded on following its
+// placement options, with their free memory limited to the fraction of VRAM
+// that the model may use
+func placementGPUs(gpus discover.GpuInfoList, opts api.Runner) (discover.GpuInfoList, error) {
+	if len(gpus) == 1 && gpus[0].Library == "cpu" {
+		if opts.NoCPUOffload {
+			return nil, errors.New("no GPUs are available and no_cpu_offload is set")
+		}
+
+		return gpus, nil
+	}
+
+	if len(opts.GPUs) > 0 {
+		gpus = slices.DeleteFunc(slices.Clone(gpus), func(g discover.GpuInfo) bool {
+			return !slices.Contains(opts.GPUs, g.ID)
+		})
+
+		if len(gpus) == 0 {
+			return nil, fmt.Errorf("none of the GPUs %s are available", strings.Join(opts.GPUs, ", "))
+		}
+	}
+
+	if opts.MaxVRAMFraction > 0 && opts.MaxVRAMFraction < 1 {
+		gpus = slices.Clone(gpus)
+		for i := range gpus {
+			limit := uint64(float64(gpus[i].TotalMemory) * float64(opts.MaxVRAMFraction))
+			gpus[i].FreeMemory = min(gpus[i].FreeMemory, limit)
+		}
+	}
+
+	return gpus, nil
+}
+
+// checkPlacement validates the placement options of a request
+func checkPlacement(opts api.Runner) error {
+	switch opts.Placement {
+	case "", api.PlacementBinpack, api.PlacementSpread:
+	default:
+		return fmt.Errorf("%w: placement must be %q or %q, not %q", errInvalidPlacement, api.PlacementBinpack, api.PlacementSpread, opts.Placement)
+	}
+
+	if opts.MaxVRAMFraction < 0 || opts.MaxVRAMFraction > 1 {
+		return fmt.Errorf("%w: max_vram_fraction must be between 0 and 1", errInvalidPlacement)
+	}
+
+	if opts.NoCPUOffload && opts.NumGPU == 0 {
+		return fmt.Errorf("%w: no_cpu_offload can't be set with num_gpu 0", errInvalidPlacement)
+	}
+
+	return nil
+}
+
 // If multiple Libraries are detected, pick the Library which loads the most layers for the model
 func pickBestPartialFitByLibrary(req *LlmRequest, f *ggml.GGML, gpus discover.GpuInfoList, numParallel *int) discover.GpuInfoList {
 	if *numParallel <= 0 {
@@ -765,7 +1014,9 @@ func (s *Scheduler) findRunnerToUnload() *runnerRef {
 	s.loadedMu.Lock()
 	runnerList := make([]*runnerRef, 0, len(s.loaded))
 	for _, r := range s.loaded {
-		runnerList = append(runnerList, r)
+		if !r.pinned {
+			runnerList = append(runnerList, r)
+		}
 	}
 	s.loadedMu.Unlock()
 	if len(runnerList) == 0 {
@@ -792,6 +1043,38 @@ func (s *Scheduler) findRunnerToUnload() *runnerRef {
 	return runnerList[0]
 }
 
+// allPinned reports whether every loaded runner is kept loaded by the model
+// config, so none can be unloaded to make room
+func (s *Scheduler) allPinned() bool {
+	s.loadedMu.Lock()
+	defer s.loadedMu.Unlock()
+	for _, runner := range s.loaded {
+		if !runner.pinned {
+			return false
+		}
+	}
+	return len(s.loaded) > 0
+}
+
+// running reports whether a runner for model is loaded or loading, and
+// hasn't exited
+func (s *Scheduler) running(ctx context.Context, model *Model) bool {
+	s.loadedMu.Lock()
+	runner := s.loaded[model.ModelPath]
+	s.loadedMu.Unlock()
+	if runner == nil {
+		return false
+	}
+
+	// the lock is held while a runner loads
+	if !runner.refMu.TryLock() {
+		return true
+	}
+	defer runner.refMu.Unlock()
+
+	return runner.llama != nil && runner.llama.Ping(ctx) == nil
+}
+
 func (s *Scheduler) unloadAllRunners() {
 	s.loadedMu.Lock()
 	defer s.loadedMu.Unlock()
@@ -807,7 +1090,9 @@ func (s *Scheduler) expireRunner(model *Model) {
 	s.loadedMu.Lock()
 	defer s.loadedMu.Unlock()
 	runner, ok := s.loaded[model.ModelPath]
-	if ok {
+	if ok && runner.pinned {
+		slog.Debug("not expiring preloaded model", "model", model.ModelPath)
+	} else if ok {
 		runner.refMu.Lock()
 		runner.expiresAt = time.Now()
 		if runner.expireTimer != nil {
@@ -822,6 +1107,23 @@ func (s *Scheduler) expireRunner(model *Model) {
 	}
 }
 
+// readyRunners returns the loaded runners that have finished loading
+func (s *Scheduler) readyRunners() []*runnerRef {
+	s.loadedMu.Lock()
+	defer s.loadedMu.Unlock()
+
+	var runners []*runnerRef
+	for _, runner := range s.loaded {
+		runner.refMu.Lock()
+		if !runner.loading && runner.llama != nil {
+			runners = append(runners, runner)
+		}
+		runner.refMu.Unlock()
+	}
+
+	return runners
+}
+
 // If other runners are loaded, make sure the pending request will fit in system memory
 // If not, pick a runner to unload, else return nil and the request can be loaded
 func (s *Scheduler) maybeFindCPURunnerToUnload(req *LlmRequest, f *ggml.GGML, gpus discover.GpuInfoList) *runnerRef {
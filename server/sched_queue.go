@@ -0,0 +1,145 @@
+package server
+
+import (
+	"context"
+	"slices"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/llm"
+)
+
+type schedInfoKey struct{}
+
+// schedInfo is who a request is from and how urgently it should run, used
+// by the scheduler to order pending requests
+type schedInfo struct {
+	client   string
+	priority api.Priority
+}
+
+// withSchedInfo adds the client and priority of a request to ctx so that
+// requests passing it to [Scheduler.GetRunner] are queued fairly, and wait
+// for a free slot in the runner by priority
+func withSchedInfo(ctx context.Context, client string, priority api.Priority) context.Context {
+	ctx = llm.WithPriority(ctx, priority)
+	return context.WithValue(ctx, schedInfoKey{}, schedInfo{client: client, priority: priority})
+}
+
+func schedInfoFromContext(ctx context.Context) schedInfo {
+	info, _ := ctx.Value(schedInfoKey{}).(schedInfo)
+	if info.priority == "" {
+		info.priority = api.PriorityInteractive
+	}
+
+	return info
+}
+
+// priorities are the priority classes in the order they are scheduled
+var priorities = []api.Priority{api.PriorityInteractive, api.PriorityBatch}
+
+// requestFlow is the pending requests of one client for one model, in the
+// order they arrived
+type requestFlow struct {
+	key      string
+	requests []*LlmRequest
+}
+
+// requestQueue orders pending requests for the scheduler. Requests of a
+// higher priority are scheduled first, and within a priority the flows of
+// each client and model take turns so that a client flooding one model
+// can't starve everyone else
+type requestQueue struct {
+	classes map[api.Priority][]*requestFlow
+
+	// next is the index of the flow to take a request from next in each
+	// priority class
+	next map[api.Priority]int
+
+	len int
+}
+
+func (q *requestQueue) Len() int {
+	return q.len
+}
+
+// Push adds a request to the back of its flow
+func (q *requestQueue) Push(req *LlmRequest) {
+	flow := q.flow(req, false)
+	flow.requests = append(flow.requests, req)
+	q.len++
+}
+
+// PushFront returns a request that couldn't be scheduled yet to the front
+// of its flow, and its flow to the front of the turns, so it keeps its place
+func (q *requestQueue) PushFront(req *LlmRequest) {
+	flow := q.flow(req, true)
+	flow.requests = append([]*LlmRequest{req}, flow.requests...)
+	q.len++
+}
+
+// Pop removes and returns the next request for which ready returns true,
+// or nil if there isn't one. Only the first request of each flow is
+// considered since the rest are for the same model
+func (q *requestQueue) Pop(ready func(*LlmRequest) bool) *LlmRequest {
+	for _, priority := range priorities {
+		flows := q.classes[priority]
+		for i := range flows {
+			j := (q.next[priority] + i) % len(flows)
+			flow := flows[j]
+			if !ready(flow.requests[0]) {
+				continue
+			}
+
+			req := flow.requests[0]
+			flow.requests = flow.requests[1:]
+			q.len--
+
+			if len(flow.requests) == 0 {
+				q.classes[priority] = append(flows[:j], flows[j+1:]...)
+				q.next[priority] = j
+			} else {
+				q.next[priority] = j + 1
+			}
+
+			if n := len(q.classes[priority]); n > 0 {
+				q.next[priority] %= n
+			} else {
+				q.next[priority] = 0
+			}
+
+			return req
+		}
+	}
+
+	return nil
+}
+
+// flow returns the flow of a request's client and model. If there isn't
+// one, it is added to take the next turn if front is set or the last turn
+// otherwise
+func (q *requestQueue) flow(req *LlmRequest, front bool) *requestFlow {
+	if q.classes == nil {
+		q.classes = make(map[api.Priority][]*requestFlow)
+		q.next = make(map[api.Priority]int)
+	}
+
+	if req.priority == "" {
+		req.priority = api.PriorityInteractive
+	}
+
+	key := req.client + "\x00" + req.model.ModelPath
+	flows := q.classes[req.priority]
+	for _, flow := range flows {
+		if flow.key == key {
+			return flow
+		}
+	}
+
+	flow := &requestFlow{key: key}
+	if front {
+		q.classes[req.priority] = slices.Insert(flows, q.next[req.priority], flow)
+	} else {
+		q.classes[req.priority] = append(flows, flow)
+	}
+	return flow
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+)
+
+func TestRequestQueue(t *testing.T) {
+	type nameKey struct{}
+
+	newRequest := func(name, client, model string, priority api.Priority) *LlmRequest {
+		return &LlmRequest{
+			ctx:      context.WithValue(t.Context(), nameKey{}, name),
+			model:    &Model{ModelPath: model},
+			client:   client,
+			priority: priority,
+		}
+	}
+
+	name := func(req *LlmRequest) string {
+		if req == nil {
+			return ""
+		}
+
+		return req.ctx.Value(nameKey{}).(string)
+	}
+
+	all := func(*LlmRequest) bool { return true }
+
+	pop := func(q *requestQueue, ready func(*LlmRequest) bool) []string {
+		var names []string
+		for req := q.Pop(ready); req != nil; req = q.Pop(ready) {
+			names = append(names, name(req))
+		}
+		return names
+	}
+
+	t.Run("priority", func(t *testing.T) {
+		var q requestQueue
+		q.Push(newRequest("batch", "a", "m", api.PriorityBatch))
+		q.Push(newRequest("interactive", "a", "m", api.PriorityInteractive))
+		q.Push(newRequest("default", "b", "m", ""))
+
+		if diff := cmp.Diff(pop(&q, all), []string{"interactive", "default", "batch"}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("fair", func(t *testing.T) {
+		// client a floods model m, but b's requests and a's requests for
+		// model n take turns with them
+		var q requestQueue
+		q.Push(newRequest("a1", "a", "m", api.PriorityBatch))
+		q.Push(newRequest("a2", "a", "m", api.PriorityBatch))
+		q.Push(newRequest("a3", "a", "m", api.PriorityBatch))
+		q.Push(newRequest("b1", "b", "m", api.PriorityBatch))
+		q.Push(newRequest("an1", "a", "n", api.PriorityBatch))
+		q.Push(newRequest("b2", "b", "m", api.PriorityBatch))
+
+		if q.Len() != 6 {
+			t.Errorf("expected 6 requests, got %d", q.Len())
+		}
+
+		if diff := cmp.Diff(pop(&q, all), []string{"a1", "b1", "an1", "a2", "b2", "a3"}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		if q.Len() != 0 {
+			t.Errorf("expected no requests, got %d", q.Len())
+		}
+	})
+
+	t.Run("ready", func(t *testing.T) {
+		// requests for a model that isn't ready keep their place while
+		// others are scheduled
+		var q requestQueue
+		q.Push(newRequest("m1", "a", "m", api.PriorityInteractive))
+		q.Push(newRequest("m2", "b", "m", api.PriorityInteractive))
+		q.Push(newRequest("n1", "c", "n", api.PriorityBatch))
+
+		notM := func(req *LlmRequest) bool { return req.model.ModelPath != "m" }
+		if diff := cmp.Diff(pop(&q, notM), []string{"n1"}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		req := q.Pop(all)
+		if name(req) != "m1" {
+			t.Fatalf("expected m1, got %q", name(req))
+		}
+
+		q.PushFront(req)
+		if diff := cmp.Diff(pop(&q, all), []string{"m1", "m2"}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+}
+
+func TestSchedInfoFromContext(t *testing.T) {
+	info := schedInfoFromContext(t.Context())
+	if diff := cmp.Diff(info, schedInfo{priority: api.PriorityInteractive}, cmp.AllowUnexported(schedInfo{})); diff != "" {
+		t.Errorf("mismatch (-got +want):\n%s", diff)
+	}
+
+	info = schedInfoFromContext(withSchedInfo(t.Context(), "127.0.0.1", api.PriorityBatch))
+	if diff := cmp.Diff(info, schedInfo{client: "127.0.0.1", priority: api.PriorityBatch}, cmp.AllowUnexported(schedInfo{})); diff != "" {
+		t.Errorf("mismatch (-got +want):\n%s", diff)
+	}
+}
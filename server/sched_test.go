@@ -354,6 +354,118 @@ func TestRequestsMultipleLoadedModels(t *testing.T) {
 	s.loadedMu.Unlock()
 }
 
+func TestRequestsWhileLoading(t *testing.T) {
+	ctx, done := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer done()
+	s := InitScheduler(ctx)
+	s.getGpuFn = getGpuFn
+	s.getCpuFn = getCpuFn
+
+	a := newScenarioRequest(t, ctx, "ollama-model-5a", 1*format.GigaByte, nil)
+	b := newScenarioRequest(t, ctx, "ollama-model-5b", 1*format.GigaByte, nil)
+	b.srv.waitCh = make(chan struct{})
+	a2 := newScenarioRequest(t, ctx, "ollama-model-5a", 1*format.GigaByte, nil)
+	a2.req.model = a.req.model
+	b2 := newScenarioRequest(t, ctx, "ollama-model-5b", 1*format.GigaByte, nil)
+	b2.req.model = b.req.model
+
+	s.newServerFn = a.newServer
+	s.pendingReqCh <- a.req
+	s.Run(ctx)
+	select {
+	case resp := <-a.req.successCh:
+		require.Equal(t, resp.llama, a.srv)
+	case err := <-a.req.errCh:
+		t.Fatal(err.Error())
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
+
+	// b starts loading, and a second request for it waits for the load
+	s.newServerFn = b.newServer
+	s.pendingReqCh <- b.req
+	require.Eventually(t, func() bool {
+		s.loadedMu.Lock()
+		defer s.loadedMu.Unlock()
+		return len(s.loaded) == 2
+	}, 100*time.Millisecond, time.Millisecond)
+	s.pendingReqCh <- b2.req
+
+	// a is already loaded so it is scheduled without waiting for b
+	s.pendingReqCh <- a2.req
+	select {
+	case resp := <-a2.req.successCh:
+		require.Equal(t, resp.llama, a.srv)
+	case err := <-a2.req.errCh:
+		t.Fatal(err.Error())
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
+	require.Empty(t, b.req.successCh)
+	require.Empty(t, b2.req.successCh)
+
+	close(b.srv.waitCh)
+	for _, req := range []*LlmRequest{b.req, b2.req} {
+		select {
+		case resp := <-req.successCh:
+			require.Equal(t, resp.llama, b.srv)
+		case err := <-req.errCh:
+			t.Fatal(err.Error())
+		case <-ctx.Done():
+			t.Fatal("timeout")
+		}
+	}
+}
+
+func TestRequestsWhileUnloading(t *testing.T) {
+	ctx, done := context.WithTimeout(t.Context(), 500*time.Millisecond)
+	defer done()
+	t.Setenv("OLLAMA_MAX_LOADED_MODELS", "3")
+	s := InitScheduler(ctx)
+	s.getGpuFn = getGpuFn
+	s.getCpuFn = getCpuFn
+
+	// a, b and c are loaded and busy, so a has to wait for its request to
+	// finish before it unloads to make room for d
+	a := newScenarioRequest(t, ctx, "ollama-model-6a", 10, &api.Duration{Duration: time.Millisecond})
+	b := newScenarioRequest(t, ctx, "ollama-model-6b", 10, &api.Duration{Duration: time.Hour})
+	c := newScenarioRequest(t, ctx, "ollama-model-6c", 10, &api.Duration{Duration: time.Hour})
+	d := newScenarioRequest(t, ctx, "ollama-model-6d", 10, nil)
+	s.loadedMu.Lock()
+	for _, r := range []*reqBundle{a, b, c} {
+		opts := r.req.opts
+		s.loaded[r.req.model.ModelPath] = &runnerRef{
+			model:           r.req.model,
+			modelPath:       r.req.model.ModelPath,
+			llama:           r.srv,
+			Options:         &opts,
+			sessionDuration: r.req.sessionDuration.Duration,
+			numParallel:     1,
+			refCount:        1,
+		}
+	}
+	s.loadedMu.Unlock()
+
+	// b needs reloading, which has to wait for a to unload, but c can be
+	// used in the meantime
+	b.srv.pingResp = errors.New("connection refused")
+	s.pendingReqCh <- d.req
+	s.pendingReqCh <- b.req
+	s.pendingReqCh <- c.req
+	s.Run(ctx)
+
+	select {
+	case resp := <-c.req.successCh:
+		require.Equal(t, resp.llama, c.srv)
+	case err := <-c.req.errCh:
+		t.Fatal(err.Error())
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
+	require.Empty(t, b.req.successCh)
+	require.Empty(t, d.req.successCh)
+}
+
 func TestGetRunner(t *testing.T) {
 	ctx, done := context.WithTimeout(context.Background(), 200*time.Millisecond)
 	defer done()
@@ -613,6 +725,151 @@ func TestFindRunnerToUnload(t *testing.T) {
 	r2.refCount = 1
 	resp = s.findRunnerToUnload()
 	require.Equal(t, r1, resp)
+
+	// preloaded runners are never unloaded to make room
+	r1.pinned = true
+	r2.pinned = true
+	require.Nil(t, s.findRunnerToUnload())
+	require.True(t, s.allPinned())
+}
+
+func TestPreload(t *testing.T) {
+	ctx, done := context.WithTimeout(t.Context(), 500*time.Millisecond)
+	defer done()
+
+	s := InitScheduler(ctx)
+	s.getGpuFn = getGpuFn
+	s.getCpuFn = getCpuFn
+	s.config = &modelConfig{Models: []modelSettings{{Model: "ollama-model-1", Preload: true, NumParallel: 2}}}
+	require.NoError(t, s.config.init())
+
+	a := newScenarioRequest(t, ctx, "ollama-model-1", 10, &api.Duration{Duration: time.Millisecond})
+	var numParallel int
+	s.newServerFn = func(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapters []string, projectors []string, opts api.Options, n int) (llm.LlamaServer, error) {
+		numParallel = n
+		return a.srv, nil
+	}
+
+	s.pendingReqCh <- a.req
+	s.Run(ctx)
+
+	var runner *runnerRef
+	select {
+	case runner = <-a.req.successCh:
+	case err := <-a.req.errCh:
+		t.Fatal(err)
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
+
+	require.True(t, runner.pinned)
+	require.Equal(t, 2, numParallel)
+	require.True(t, s.running(ctx, a.req.model))
+
+	// requests with different options don't unload the runner
+	b := &LlmRequest{
+		ctx:             ctx,
+		model:           a.req.model,
+		opts:            a.req.opts,
+		sessionDuration: a.req.sessionDuration,
+		successCh:       make(chan *runnerRef, 1),
+		errCh:           make(chan error, 1),
+	}
+	b.opts.NumCtx *= 2
+	s.pendingReqCh <- b
+	select {
+	case <-b.successCh:
+		t.Fatal("expected the request to be rejected")
+	case err := <-b.errCh:
+		require.ErrorIs(t, err, errPreloadedOptions)
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
+	require.True(t, s.running(ctx, a.req.model))
+
+	// the runner stays loaded after the request's keep alive, and isn't
+	// expired by requests to unload it
+	a.ctxDone()
+	time.Sleep(20 * time.Millisecond)
+	s.expireRunner(a.req.model)
+	time.Sleep(20 * time.Millisecond)
+	s.loadedMu.Lock()
+	require.Len(t, s.loaded, 1)
+	s.loadedMu.Unlock()
+
+	// a runner that has exited needs loading again
+	a.srv.pingResp = errors.New("connection refused")
+	require.False(t, s.running(ctx, a.req.model))
+	require.False(t, s.running(ctx, &Model{ModelPath: "missing"}))
+}
+
+func TestEmbeddingParallel(t *testing.T) {
+	t.Setenv("OLLAMA_NUM_PARALLEL", "4")
+
+	cases := []struct {
+		name   string
+		config *modelConfig
+		want   int
+	}{
+		{name: "default", want: 1},
+		{name: "num_parallel", config: &modelConfig{Models: []modelSettings{{Model: "embed", NumParallel: 3}}}, want: 3},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, done := context.WithTimeout(t.Context(), 500*time.Millisecond)
+			defer done()
+
+			s := InitScheduler(ctx)
+			s.getGpuFn = getGpuFn
+			s.getCpuFn = getCpuFn
+			if tt.config != nil {
+				s.config = tt.config
+				require.NoError(t, s.config.init())
+			}
+
+			a := newScenarioRequest(t, ctx, "embed", 10, nil)
+
+			// a model with pooling only embeds
+			f, err := os.Create(a.req.model.ModelPath)
+			require.NoError(t, err)
+			require.NoError(t, ggml.WriteGGUF(f, ggml.KV{
+				"general.architecture":          "llama",
+				"llama.context_length":          uint32(32),
+				"llama.embedding_length":        uint32(4096),
+				"llama.block_count":             uint32(1),
+				"llama.attention.head_count":    uint32(32),
+				"llama.attention.head_count_kv": uint32(32),
+				"llama.pooling_type":            uint32(1),
+				"tokenizer.ggml.tokens":         []string{" "},
+				"tokenizer.ggml.scores":         []float32{0},
+				"tokenizer.ggml.token_type":     []int32{0},
+			}, []ggml.Tensor{
+				{Name: "blk.0.attn.weight", Kind: uint32(0), Offset: uint64(0), Shape: []uint64{1, 1, 1, 1}, WriterTo: bytes.NewReader(make([]byte, 32))},
+				{Name: "output.weight", Kind: uint32(0), Offset: uint64(0), Shape: []uint64{1, 1, 1, 1}, WriterTo: bytes.NewReader(make([]byte, 32))},
+			}))
+			require.NoError(t, f.Close())
+
+			var numParallel int
+			s.newServerFn = func(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapters []string, projectors []string, opts api.Options, n int) (llm.LlamaServer, error) {
+				numParallel = n
+				return a.srv, nil
+			}
+
+			s.pendingReqCh <- a.req
+			s.Run(ctx)
+
+			select {
+			case <-a.req.successCh:
+			case err := <-a.req.errCh:
+				t.Fatal(err)
+			case <-ctx.Done():
+				t.Fatal("timeout")
+			}
+
+			require.Equal(t, tt.want, numParallel)
+		})
+	}
 }
 
 func TestNeedsReload(t *testing.T) {
@@ -662,6 +919,48 @@ func TestNeedsReload(t *testing.T) {
 	require.False(t, resp)
 }
 
+func TestReady(t *testing.T) {
+	ctx, done := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer done()
+
+	s := InitScheduler(ctx)
+	a := newScenarioRequest(t, ctx, "ollama-model-a", 10, nil)
+	b := newScenarioRequest(t, ctx, "ollama-model-b", 10, nil)
+
+	opts := a.req.opts
+	runner := &runnerRef{
+		model:       a.req.model,
+		modelPath:   a.req.model.ModelPath,
+		llama:       a.srv,
+		Options:     &opts,
+		numParallel: 1,
+	}
+	unloading := &runnerRef{modelPath: b.req.model.ModelPath}
+	s.loaded[a.req.model.ModelPath] = runner
+
+	// the runner isn't pinged, so one that fails the ping is still ready
+	a.srv.pingResp = errors.New("connection refused")
+	require.True(t, s.ready(a.req, unloading))
+
+	// a runner that is locked, such as while loading, isn't waited for
+	runner.refMu.Lock()
+	require.False(t, s.ready(a.req, unloading))
+	runner.refMu.Unlock()
+
+	// a runner that needs reloading for other options waits for the unload
+	a.req.opts.NumBatch = 1234
+	require.False(t, s.ready(a.req, unloading))
+	require.True(t, s.ready(a.req, nil))
+
+	// unless it is preloaded, in which case the request is rejected
+	runner.pinned = true
+	require.True(t, s.ready(a.req, unloading))
+
+	// a model that isn't loaded waits for the unload
+	require.False(t, s.ready(b.req, unloading))
+	require.True(t, s.ready(b.req, nil))
+}
+
 func TestUnloadAllRunners(t *testing.T) {
 	ctx, done := context.WithTimeout(context.Background(), 100*time.Millisecond)
 	defer done()
@@ -750,11 +1049,98 @@ func TestHomogeneousGPUs(t *testing.T) {
 	}
 }
 
+func TestPlacement(t *testing.T) {
+	gpus := func() discover.GpuInfoList {
+		gpus := []discover.GpuInfo{
+			{Library: "cuda", ID: "0"},
+			{Library: "cuda", ID: "1"},
+		}
+		gpus[0].TotalMemory = 16 * format.GibiByte
+		gpus[0].FreeMemory = 8 * format.GibiByte
+		gpus[1].TotalMemory = 16 * format.GibiByte
+		gpus[1].FreeMemory = 4 * format.GibiByte
+		return gpus
+	}
+
+	cases := []struct {
+		name string
+		opts api.Runner
+		gpus []string
+		err  string
+	}{
+		{name: "default", gpus: []string{"0"}},
+		{name: "binpack", opts: api.Runner{Placement: api.PlacementBinpack}, gpus: []string{"1"}},
+		{name: "spread", opts: api.Runner{Placement: api.PlacementSpread}, gpus: []string{"0", "1"}},
+		{name: "pinned", opts: api.Runner{GPUs: []string{"1"}}, gpus: []string{"1"}},
+		{name: "pinned missing", opts: api.Runner{GPUs: []string{"2"}}, err: "none of the GPUs 2 are available"},
+		{name: "no cpu offload", opts: api.Runner{NoCPUOffload: true, MaxVRAMFraction: 0.00001}, err: "model requires more VRAM than is available and no_cpu_offload is set"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, done := context.WithTimeout(t.Context(), 500*time.Millisecond)
+			defer done()
+
+			s := InitScheduler(ctx)
+			s.getGpuFn = gpus
+			s.getCpuFn = getCpuFn
+
+			a := newScenarioRequest(t, ctx, "ollama-model-1", 10, nil)
+			a.req.opts.GPUs = tt.opts.GPUs
+			a.req.opts.Placement = tt.opts.Placement
+			a.req.opts.NoCPUOffload = tt.opts.NoCPUOffload
+			a.req.opts.MaxVRAMFraction = tt.opts.MaxVRAMFraction
+
+			var ids []string
+			s.newServerFn = func(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapters []string, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
+				for _, g := range gpus {
+					ids = append(ids, g.ID)
+				}
+				return a.newServer(gpus, model, f, adapters, projectors, opts, numParallel)
+			}
+
+			s.pendingReqCh <- a.req
+			s.Run(ctx)
+
+			select {
+			case <-a.req.successCh:
+				require.Empty(t, tt.err)
+				require.ElementsMatch(t, tt.gpus, ids)
+			case err := <-a.req.errCh:
+				require.EqualError(t, err, tt.err)
+			case <-ctx.Done():
+				t.Fatal("timeout")
+			}
+		})
+	}
+}
+
+func TestPlacementGPUs(t *testing.T) {
+	gpus := getGpuFn()
+
+	limited, err := placementGPUs(gpus, api.Runner{MaxVRAMFraction: 0.25})
+	require.NoError(t, err)
+	require.Equal(t, 6*format.GigaByte, int(limited[0].FreeMemory))
+	require.Equal(t, 12*format.GigaByte, int(gpus[0].FreeMemory), "the GPUs passed in are unchanged")
+
+	_, err = placementGPUs(getCpuFn(), api.Runner{NoCPUOffload: true})
+	require.EqualError(t, err, "no GPUs are available and no_cpu_offload is set")
+}
+
+func TestCheckPlacement(t *testing.T) {
+	require.NoError(t, checkPlacement(api.DefaultOptions().Runner))
+	require.NoError(t, checkPlacement(api.Runner{Placement: api.PlacementBinpack, MaxVRAMFraction: 1, NumGPU: -1, NoCPUOffload: true}))
+	require.ErrorIs(t, checkPlacement(api.Runner{Placement: "random"}), errInvalidPlacement)
+	require.ErrorIs(t, checkPlacement(api.Runner{MaxVRAMFraction: 1.5}), errInvalidPlacement)
+	require.ErrorIs(t, checkPlacement(api.Runner{NoCPUOffload: true}), errInvalidPlacement)
+}
+
 type mockLlm struct {
 	pingResp           error
 	waitResp           error
+	waitCh             chan struct{} // if set, loading waits until it is closed
 	completionResp     error
-	embeddingResp      []float32
+	embeddingResp      [][]float32
 	embeddingRespErr   error
 	tokenizeResp       []int
 	tokenizeRespErr    error
@@ -767,13 +1153,18 @@ type mockLlm struct {
 	estimatedVRAMByGPU map[string]uint64
 }
 
-func (s *mockLlm) Ping(ctx context.Context) error             { return s.pingResp }
-func (s *mockLlm) WaitUntilRunning(ctx context.Context) error { return s.waitResp }
+func (s *mockLlm) Ping(ctx context.Context) error { return s.pingResp }
+func (s *mockLlm) WaitUntilRunning(ctx context.Context) error {
+	if s.waitCh != nil {
+		<-s.waitCh
+	}
+	return s.waitResp
+}
 func (s *mockLlm) Completion(ctx context.Context, req llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
 	return s.completionResp
 }
 
-func (s *mockLlm) Embedding(ctx context.Context, input string) ([]float32, error) {
+func (s *mockLlm) Embedding(ctx context.Context, input []string) ([][]float32, error) {
 	return s.embeddingResp, s.embeddingRespErr
 }
 
@@ -785,6 +1176,22 @@ func (s *mockLlm) Detokenize(ctx context.Context, tokens []int) (string, error)
 	return s.detokenizeResp, s.detonekizeRespErr
 }
 
+func (s *mockLlm) Pin(ctx context.Context, prompt string) (llm.Pin, error) {
+	return llm.Pin{}, llm.ErrPinNotSupported
+}
+
+func (s *mockLlm) Pins(ctx context.Context) ([]llm.Pin, error) {
+	return nil, llm.ErrPinNotSupported
+}
+
+func (s *mockLlm) Unpin(ctx context.Context, id int) error {
+	return llm.ErrPinNotSupported
+}
+
+func (s *mockLlm) Stats(ctx context.Context) (llm.Stats, error) {
+	return llm.Stats{}, nil
+}
+
 func (s *mockLlm) Close() error {
 	s.closeCalled = true
 	return s.closeResp
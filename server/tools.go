@@ -0,0 +1,708 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"reflect"
+	"slices"
+	"strings"
+	"text/template/parse"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/grammar"
+	"github.com/ollama/ollama/template"
+)
+
+var templateToolCalls = []api.ToolCall{
+	{
+		Function: api.ToolCallFunction{
+			Name: "@@name@@",
+			Arguments: api.ToolCallFunctionArguments{
+				"@@argument@@": 1,
+			},
+		},
+	},
+}
+
+// toolCallKeys returns the keys of the name and arguments of tool call
+// objects written by the template
+func toolCallKeys(tmpl *template.Template) (name, arguments string, ok bool) {
+	// create a subtree from the node that ranges over .ToolCalls
+	sub := tmpl.Subtree(func(n parse.Node) bool {
+		if t, ok := n.(*parse.RangeNode); ok {
+			return slices.Contains(template.Identifiers(t.Pipe), "ToolCalls")
+		}
+
+		return false
+	})
+
+	if sub == nil {
+		return "", "", false
+	}
+
+	var b bytes.Buffer
+	if err := sub.Execute(&b, map[string][]api.ToolCall{"ToolCalls": templateToolCalls}); err != nil {
+		return "", "", false
+	}
+
+	templateObjects := parseObjects(b.String())
+	if len(templateObjects) == 0 {
+		return "", "", false
+	}
+
+	// find the keys that correspond to the name and arguments fields
+	for k, v := range templateObjects[0] {
+		switch v.(type) {
+		case string:
+			name = k
+		case map[string]any:
+			arguments = k
+		}
+	}
+
+	return name, arguments, name != "" && arguments != ""
+}
+
+// toolCallFormat returns the text that the template writes before the first
+// tool call, between tool calls and after the last, such as "[TOOL_CALLS] [",
+// "" and "]". It is found by comparing an assistant message with two tool
+// calls to one with content
+func toolCallFormat(tmpl *template.Template) (before, sep, after string, ok bool) {
+	tools := []api.Tool{{Type: "function", Function: api.ToolFunction{Name: "@@tool@@"}}}
+	user := api.Message{Role: "user", Content: "@@user@@"}
+
+	var calls, content bytes.Buffer
+	if err := tmpl.Execute(&calls, template.Values{
+		Messages: []api.Message{user, {Role: "assistant", ToolCalls: slices.Concat(templateToolCalls, templateToolCalls)}},
+		Tools:    tools,
+	}); err != nil {
+		return "", "", "", false
+	}
+
+	if err := tmpl.Execute(&content, template.Values{
+		Messages: []api.Message{user, {Role: "assistant", Content: "@@content@@"}},
+		Tools:    tools,
+	}); err != nil {
+		return "", "", "", false
+	}
+
+	s, c := calls.String(), content.String()
+
+	var start int
+	for start < len(s) && start < len(c) && s[start] == c[start] {
+		start++
+	}
+
+	end := len(s)
+	for end > start && len(s)-end < len(c) && s[end-1] == c[len(c)-(len(s)-end)-1] {
+		end--
+	}
+
+	first, firstEnd, ok := toolCallObject(s, start)
+	if !ok {
+		return "", "", "", false
+	}
+
+	second, secondEnd, ok := toolCallObject(s, firstEnd)
+	if !ok || secondEnd > end {
+		return "", "", "", false
+	}
+
+	return s[start:first], s[firstEnd:second], s[secondEnd:end], true
+}
+
+// toolCallObject returns the start and end of the first tool call object in s
+// at or after offset i
+func toolCallObject(s string, i int) (int, int, bool) {
+	name := strings.Index(s[i:], `"@@name@@"`)
+	if name < 0 {
+		return 0, 0, false
+	}
+
+	// find the brace that opens the object holding the name
+	var depth int
+	for j := i + name - 1; j >= i; j-- {
+		switch s[j] {
+		case '}':
+			depth++
+		case '{':
+			if depth == 0 {
+				d := json.NewDecoder(strings.NewReader(s[j:]))
+				var v map[string]any
+				if err := d.Decode(&v); err != nil {
+					return 0, 0, false
+				}
+
+				return j, j + int(d.InputOffset()), true
+			}
+			depth--
+		}
+	}
+
+	return 0, 0, false
+}
+
+// toolCallTag returns the text that the template writes before tool calls,
+// such as [TOOL_CALLS] or <tool_call>, or an empty string if there is none.
+// This is the text before the first tool call, less any JSON that opens the
+// list of tool calls
+func toolCallTag(tmpl *template.Template) string {
+	before, _, _, ok := toolCallFormat(tmpl)
+	if !ok {
+		return ""
+	}
+
+	return strings.TrimSpace(strings.TrimRight(before, " \t\r\n[{"))
+}
+
+// toolCallGrammar returns a grammar that constrains the output to one or more
+// tool calls in the format of tmpl, with arguments matching the parameters of
+// each tool. If name is set, only that tool can be called
+func toolCallGrammar(tmpl *template.Template, tools []api.Tool, name string) (string, error) {
+	nameKey, argumentsKey, ok := toolCallKeys(tmpl)
+	if !ok {
+		return "", errors.New("model template does not support forcing tool calls")
+	}
+
+	before, sep, after, ok := toolCallFormat(tmpl)
+	if !ok {
+		return "", errors.New("model template does not support forcing tool calls")
+	}
+
+	before, sep, after = strings.TrimSpace(before), strings.TrimSpace(sep), strings.TrimSpace(after)
+
+	// templates often write lists of tool calls without commas, which models
+	// generally add anyway
+	if sep == "" && strings.HasSuffix(before, "[") {
+		sep = ","
+	}
+
+	nk, err := json.Marshal(nameKey)
+	if err != nil {
+		return "", err
+	}
+
+	ak, err := json.Marshal(argumentsKey)
+	if err != nil {
+		return "", err
+	}
+
+	var alts []string
+
+	// definitions referenced by the parameters are moved to the top level
+	// of the schema since that is where references are resolved
+	defs := make(map[string]json.RawMessage)
+
+	for _, tool := range tools {
+		if name != "" && tool.Function.Name != name {
+			continue
+		}
+
+		n, err := json.Marshal(tool.Function.Name)
+		if err != nil {
+			return "", err
+		}
+
+		params := tool.Function.Parameters
+		if len(params) == 0 {
+			params = api.ToolSchema(`{"type":"object"}`)
+		}
+
+		var schema struct {
+			Defs        map[string]json.RawMessage `json:"$defs"`
+			Definitions map[string]json.RawMessage `json:"definitions"`
+		}
+		if err := json.Unmarshal(params, &schema); err == nil {
+			for _, m := range []map[string]json.RawMessage{schema.Defs, schema.Definitions} {
+				for k, v := range m {
+					if existing, ok := defs[k]; ok && !bytes.Equal(existing, v) {
+						return "", fmt.Errorf("tools have conflicting definitions of %q", k)
+					}
+					defs[k] = v
+				}
+			}
+		}
+
+		alts = append(alts, fmt.Sprintf(`{"type": "object", "properties": {%s: {"const": %s}, %s: %s}, "required": [%s, %s]}`, nk, n, ak, params, nk, ak))
+	}
+
+	if len(alts) == 0 {
+		return "", fmt.Errorf("tool %q not found", name)
+	}
+
+	d, err := json.Marshal(defs)
+	if err != nil {
+		return "", err
+	}
+
+	g, err := grammar.SchemaListToGrammar([]byte(`{"$defs": `+string(d)+`, "anyOf": [`+strings.Join(alts, ", ")+`]}`), before, sep, after)
+	if err != nil {
+		return "", fmt.Errorf("invalid tool parameters: %w", err)
+	}
+
+	return string(g), nil
+}
+
+// errInvalidToolCall is returned when the model calls a tool that wasn't
+// given or with arguments that don't match its parameters
+var errInvalidToolCall = errors.New("invalid tool call")
+
+// validateToolCalls checks that each call is to one of tools with arguments
+// that match the tool's parameters. It is used for calls constrained by the
+// grammar from toolCallGrammar, so an error means the grammar failed rather
+// than the model. Keywords other than type, enum, required, properties and
+// items are not checked
+func validateToolCalls(tools []api.Tool, calls []api.ToolCall) error {
+	for _, call := range calls {
+		i := slices.IndexFunc(tools, func(t api.Tool) bool { return t.Function.Name == call.Function.Name })
+		if i < 0 {
+			return fmt.Errorf("%w: model called unknown tool %q", errInvalidToolCall, call.Function.Name)
+		}
+
+		if err := validateToolValue(tools[i].Function.Parameters, map[string]any(call.Function.Arguments)); err != nil {
+			return fmt.Errorf("%w: model called %q with invalid arguments: %w", errInvalidToolCall, call.Function.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// validateToolValue checks that v, decoded from JSON, matches the schema s
+func validateToolValue(s api.ToolSchema, v any) error {
+	if len(s) == 0 {
+		return nil
+	}
+
+	if types := s.Type(); len(types) > 0 && !slices.ContainsFunc(types, func(t string) bool { return jsonTypeMatches(t, v) }) {
+		return fmt.Errorf("expected %s, got %s", strings.Join(types, " or "), jsonType(v))
+	}
+
+	if enum := s.Enum(); len(enum) > 0 && !slices.ContainsFunc(enum, func(e any) bool { return reflect.DeepEqual(e, v) }) {
+		return fmt.Errorf("%v is not one of %v", v, enum)
+	}
+
+	switch v := v.(type) {
+	case map[string]any:
+		for _, r := range s.Required() {
+			if _, ok := v[r]; !ok {
+				return fmt.Errorf("missing required property %q", r)
+			}
+		}
+
+		props := s.Properties()
+		for _, k := range slices.Sorted(maps.Keys(v)) {
+			if err := validateToolValue(props[k], v[k]); err != nil {
+				return fmt.Errorf("%s: %w", k, err)
+			}
+		}
+	case []any:
+		items := s.Items()
+		for i, item := range v {
+			if err := validateToolValue(items, item); err != nil {
+				return fmt.Errorf("[%d]: %w", i, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// jsonTypeMatches reports whether v, decoded from JSON, is of the JSON
+// Schema type t. Unknown types match anything
+func jsonTypeMatches(t string, v any) bool {
+	switch t {
+	case "integer":
+		f, ok := v.(float64)
+		return ok && f == math.Trunc(f)
+	case "string", "number", "boolean", "array", "object", "null":
+		return jsonType(v) == t
+	default:
+		return true
+	}
+}
+
+// jsonType returns the JSON Schema type of v, decoded from JSON
+func jsonType(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
+
+// toolParser parses tool calls from the output of a model as it is streamed.
+// Output is returned as content as soon as it can't be part of a tool call.
+// Once a tool call is found, the rest of the output is expected to be tool
+// calls and any other text is dropped.
+type toolParser struct {
+	// tag is the text the template writes before tool calls, if any
+	tag string
+
+	// name and arguments are the keys of the tool call objects
+	name, arguments string
+
+	// buf holds the output that has not been returned, starting with the
+	// JSON value being parsed
+	buf string
+
+	// pos is the offset in buf that has been parsed
+	pos int
+
+	// stack holds the objects and arrays that are open at pos
+	stack []jsonFrame
+
+	// str is the offset in buf of the string being parsed, or -1
+	str    int
+	escape bool
+
+	// calls is set once the output is known to contain tool calls
+	calls bool
+
+	// dropped holds the output that was dropped as part of tool calls. It is
+	// returned as content if no tool call is found by the end of the output
+	dropped strings.Builder
+
+	// index is the index of the next tool call
+	index int
+}
+
+// jsonFrame is an object or array that is being parsed
+type jsonFrame struct {
+	object bool
+
+	// value is set when an object expects a value rather than a key
+	value bool
+
+	// key is the last key read in an object
+	key string
+
+	// name is the name of a tool call object, if read
+	name    *string
+	isArgs  bool
+	args    int
+	argsEnd int
+
+	// index is the index of a tool call once it has been returned, or -1
+	index int
+
+	// sent is the offset in buf of the arguments returned so far
+	sent int
+}
+
+func (f *jsonFrame) isCall() bool {
+	return f.object && f.name != nil && f.args >= 0
+}
+
+// newToolParser returns a parser for the tool call format of tmpl
+func newToolParser(tmpl *template.Template) (*toolParser, bool) {
+	name, arguments, ok := toolCallKeys(tmpl)
+	if !ok {
+		return nil, false
+	}
+
+	return &toolParser{
+		tag:       toolCallTag(tmpl),
+		name:      name,
+		arguments: arguments,
+		str:       -1,
+	}, true
+}
+
+// Add parses the next part of the output, returning any content that can be
+// sent, tool calls that have been completed, and the parts of tool calls
+// that have been generated
+func (p *toolParser) Add(s string) (string, []api.ToolCall, []api.ToolCallDelta) {
+	p.buf += s
+
+	var content strings.Builder
+	var calls []api.ToolCall
+	var deltas []api.ToolCallDelta
+
+	for {
+		if len(p.stack) == 0 {
+			if !p.start(&content) {
+				break
+			}
+		}
+
+		complete, ok := p.parse(&calls, &deltas)
+		if !ok {
+			// not JSON, so the first character is content
+			p.release(&content, 1)
+			continue
+		}
+
+		deltas = p.delta(deltas)
+
+		if !complete {
+			break
+		}
+
+		// the value holds no tool calls, so it is content
+		p.release(&content, p.pos)
+	}
+
+	return content.String(), calls, deltas
+}
+
+// Flush returns any output that is still held back at the end of the output
+func (p *toolParser) Flush() string {
+	var content string
+	if !p.calls {
+		content = p.buf
+	} else if p.index == 0 {
+		content = p.dropped.String() + p.buf
+	}
+
+	p.buf = ""
+	p.reset()
+	return content
+}
+
+func (p *toolParser) reset() {
+	p.pos = 0
+	p.stack = p.stack[:0]
+	p.str = -1
+	p.escape = false
+}
+
+// release returns the first n bytes of buf as content, or drops them if the
+// output has tool calls
+func (p *toolParser) release(content *strings.Builder, n int) {
+	if p.calls {
+		if p.index == 0 {
+			p.dropped.WriteString(p.buf[:n])
+		}
+	} else {
+		content.WriteString(p.buf[:n])
+	}
+
+	p.buf = p.buf[n:]
+	p.reset()
+}
+
+// start moves buf to the start of the next JSON value, returning content
+// that comes before it. It returns false if there is no JSON value yet
+func (p *toolParser) start(content *strings.Builder) bool {
+	if p.calls {
+		i := strings.IndexAny(p.buf, "{[")
+		if i < 0 {
+			p.release(content, len(p.buf))
+			return false
+		}
+
+		p.release(content, i)
+		return true
+	}
+
+	i := strings.IndexAny(p.buf, "{[")
+	if p.tag != "" {
+		if t := strings.Index(p.buf, p.tag); t >= 0 && (i < 0 || t <= i) {
+			p.release(content, t)
+			p.calls = true
+			p.release(content, len(p.tag))
+			return p.start(content)
+		}
+
+		// hold back the end of buf if it could be the start of the tag
+		for j := max(0, len(p.buf)-len(p.tag)+1); j < len(p.buf) && (i < 0 || j <= i); j++ {
+			if strings.HasPrefix(p.tag, p.buf[j:]) {
+				p.release(content, j)
+				return false
+			}
+		}
+	}
+
+	if i < 0 {
+		p.release(content, len(p.buf))
+		return false
+	}
+
+	p.release(content, i)
+	return true
+}
+
+// parse continues parsing the JSON value at the start of buf. It returns
+// whether the value is complete and false if buf isn't JSON
+func (p *toolParser) parse(calls *[]api.ToolCall, deltas *[]api.ToolCallDelta) (bool, bool) {
+	for ; p.pos < len(p.buf); p.pos++ {
+		c := p.buf[p.pos]
+
+		if p.str >= 0 {
+			switch {
+			case p.escape:
+				p.escape = false
+			case c == '\\':
+				p.escape = true
+			case c == '"':
+				p.string(p.buf[p.str : p.pos+1])
+				p.str = -1
+			}
+
+			continue
+		}
+
+		var top *jsonFrame
+		if len(p.stack) > 0 {
+			top = &p.stack[len(p.stack)-1]
+		}
+
+		switch c {
+		case ' ', '\t', '\r', '\n':
+		case '"':
+			p.str = p.pos
+		case '{', '[':
+			if top != nil && top.object && !top.value {
+				return false, false
+			}
+
+			frame := jsonFrame{object: c == '{', args: -1, argsEnd: -1, index: -1}
+			if c == '{' && top != nil && top.object && top.key == p.arguments && top.args < 0 {
+				top.args = p.pos
+				frame.isArgs = true
+			}
+
+			p.stack = append(p.stack, frame)
+			p.commit(top)
+		case '}', ']':
+			if top == nil || top.object != (c == '}') {
+				return false, false
+			}
+
+			if top.isArgs && len(p.stack) > 1 {
+				p.stack[len(p.stack)-2].argsEnd = p.pos + 1
+			}
+
+			if top.isCall() && top.argsEnd >= 0 {
+				*deltas = p.delta(*deltas)
+				if call, ok := p.call(top); ok {
+					*calls = append(*calls, call)
+				}
+			}
+
+			p.stack = p.stack[:len(p.stack)-1]
+			if len(p.stack) == 0 {
+				p.pos++
+				return true, true
+			}
+		case ':':
+			if top == nil || !top.object || top.value {
+				return false, false
+			}
+
+			top.value = true
+		case ',':
+			if top == nil {
+				return false, false
+			}
+
+			top.value = false
+		default:
+			if top == nil || top.object && !top.value || !strings.ContainsRune("-+.0123456789eEtrufalsn", rune(c)) {
+				return false, false
+			}
+		}
+	}
+
+	return false, true
+}
+
+// string handles a complete JSON string
+func (p *toolParser) string(s string) {
+	if len(p.stack) == 0 {
+		return
+	}
+
+	top := &p.stack[len(p.stack)-1]
+	if !top.object {
+		return
+	}
+
+	var v string
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		return
+	}
+
+	if !top.value {
+		top.key = v
+		return
+	}
+
+	if top.key == p.name && top.name == nil {
+		top.name = &v
+		p.commit(top)
+	}
+}
+
+// commit marks the output as having tool calls once a tool call is found
+func (p *toolParser) commit(f *jsonFrame) {
+	if f != nil && f.isCall() {
+		p.calls = true
+	}
+}
+
+// delta returns the arguments of tool calls that have been parsed but not
+// yet returned
+func (p *toolParser) delta(deltas []api.ToolCallDelta) []api.ToolCallDelta {
+	for i := range p.stack {
+		f := &p.stack[i]
+		if !f.isCall() {
+			continue
+		}
+
+		end := f.argsEnd
+		if end < 0 {
+			end = p.pos
+		}
+
+		var delta api.ToolCallDelta
+		if f.index < 0 {
+			f.index = p.index
+			f.sent = f.args
+			p.index++
+
+			delta.Name = *f.name
+		} else if f.sent >= end {
+			continue
+		}
+
+		delta.Index = f.index
+		delta.Arguments = p.buf[f.sent:end]
+		f.sent = end
+
+		deltas = append(deltas, delta)
+	}
+
+	return deltas
+}
+
+// call returns the completed tool call of f
+func (p *toolParser) call(f *jsonFrame) (api.ToolCall, bool) {
+	var args api.ToolCallFunctionArguments
+	if err := json.Unmarshal([]byte(p.buf[f.args:f.argsEnd]), &args); err != nil {
+		return api.ToolCall{}, false
+	}
+
+	return api.ToolCall{
+		Function: api.ToolCallFunction{
+			Index:     f.index,
+			Name:      *f.name,
+			Arguments: args,
+		},
+	}, true
+}
@@ -0,0 +1,422 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/grammar"
+	"github.com/ollama/ollama/template"
+)
+
+func TestToolCallTag(t *testing.T) {
+	cases := map[string]string{
+		"mistral":              "[TOOL_CALLS]",
+		"command-r-plus":       "Action: ```json",
+		"firefunction":         "functools",
+		"llama3-groq-tool-use": "<tool_call>",
+		"xlam":                 `{"tool_calls":`,
+		"nemotron":             "<toolcall>",
+	}
+
+	for model, want := range cases {
+		t.Run(model, func(t *testing.T) {
+			tmpl, err := template.Parse(readFile(t, filepath.Join("testdata", "tools"), fmt.Sprintf("%s.gotmpl", model)).String())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := toolCallTag(tmpl); got != want {
+				t.Errorf("toolCallTag = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestToolCallGrammar(t *testing.T) {
+	var tools []api.Tool
+	if err := json.Unmarshal(readFile(t, filepath.Join("testdata", "tools"), "tools.json").Bytes(), &tools); err != nil {
+		t.Fatal(err)
+	}
+
+	tools = append(tools, api.Tool{Type: "function", Function: api.ToolFunction{Name: "get_time"}})
+
+	cases := []struct {
+		model  string
+		name   string
+		match  []string
+		reject []string
+	}{
+		{
+			model: "mistral",
+			match: []string{
+				`[TOOL_CALLS] [{"name": "get_current_weather", "arguments": {"location": "Toronto, Canada", "format": "celsius"}}]`,
+				`[TOOL_CALLS] [{"name": "get_time", "arguments": {}}, {"name": "get_current_weather", "arguments": {"location": "Toronto", "format": "celsius"}}]`,
+			},
+			reject: []string{
+				`The weather is nice.`,
+				`[TOOL_CALLS] []`,
+				`[TOOL_CALLS] [{"name": "get_weather", "arguments": {}}]`,
+				`[TOOL_CALLS] [{"name": "get_current_weather", "arguments": {"format": "kelvin", "location": "Toronto"}}]`,
+				`[TOOL_CALLS] [{"name": "get_current_weather", "arguments": {"location": "Toronto"}}]`,
+			},
+		},
+		{
+			model: "mistral",
+			name:  "get_time",
+			match: []string{`[TOOL_CALLS] [{"name": "get_time", "arguments": {}}]`},
+			reject: []string{
+				`[TOOL_CALLS] [{"name": "get_current_weather", "arguments": {"location": "Toronto", "format": "celsius"}}]`,
+			},
+		},
+		{
+			model: "llama3-groq-tool-use",
+			match: []string{
+				"<tool_call>\n{\"name\": \"get_time\", \"arguments\": {}}\n</tool_call>",
+				"<tool_call>\n{\"name\": \"get_time\", \"arguments\": {}}\n{\"name\": \"get_time\", \"arguments\": {}}\n</tool_call>",
+			},
+			reject: []string{`{"name": "get_time", "arguments": {}}`},
+		},
+		{
+			model:  "xlam",
+			match:  []string{`{"tool_calls": [{"name": "get_time", "arguments": {}}]}`},
+			reject: []string{`{"tool_calls": []}`},
+		},
+		{
+			model: "command-r-plus",
+			match: []string{"Action: ```json\n[\n    {\n        \"tool_name\": \"get_time\",\n        \"parameters\": {}\n    }\n]```"},
+		},
+		{
+			model:  "nemotron",
+			match:  []string{`<toolcall> {"name": "get_time", "arguments": {}} </toolcall> <toolcall> {"name": "get_time", "arguments": {}} </toolcall>`},
+			reject: []string{`<toolcall> {"name": "get_time", "arguments": {}}`},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.model+"/"+tt.name, func(t *testing.T) {
+			tmpl, err := template.Parse(readFile(t, filepath.Join("testdata", "tools"), fmt.Sprintf("%s.gotmpl", tt.model)).String())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			s, err := toolCallGrammar(tmpl, tools, tt.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			g, err := grammar.Parse(s)
+			if err != nil {
+				t.Fatalf("%v\n%s", err, s)
+			}
+
+			for _, output := range tt.match {
+				if m := g.Matcher(); !m.AcceptString(output) || !m.Complete() {
+					t.Errorf("%s should match\n%s", output, s)
+				}
+			}
+
+			for _, output := range tt.reject {
+				if m := g.Matcher(); m.AcceptString(output) && m.Complete() {
+					t.Errorf("%s should not match\n%s", output, s)
+				}
+			}
+		})
+	}
+
+	t.Run("definitions", func(t *testing.T) {
+		tmpl, err := template.Parse(readFile(t, filepath.Join("testdata", "tools"), "mistral.gotmpl").String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tools := []api.Tool{{Type: "function", Function: api.ToolFunction{
+			Name:       "add_points",
+			Parameters: api.ToolSchema(`{"type":"object","properties":{"points":{"type":"array","items":{"$ref":"#/$defs/point"}}},"required":["points"],"$defs":{"point":{"type":"object","properties":{"x":{"type":"number"},"y":{"type":"number"}},"required":["x","y"]}}}`),
+		}}}
+
+		s, err := toolCallGrammar(tmpl, tools, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		g, err := grammar.Parse(s)
+		if err != nil {
+			t.Fatalf("%v\n%s", err, s)
+		}
+
+		if m := g.Matcher(); !m.AcceptString(`[TOOL_CALLS] [{"name": "add_points", "arguments": {"points": [{"x": 1, "y": 2}]}}]`) || !m.Complete() {
+			t.Errorf("should match\n%s", s)
+		}
+
+		if m := g.Matcher(); m.AcceptString(`[TOOL_CALLS] [{"name": "add_points", "arguments": {"points": [{"x": 1}]}}]`) && m.Complete() {
+			t.Errorf("should not match\n%s", s)
+		}
+	})
+
+	t.Run("missing tool", func(t *testing.T) {
+		tmpl, err := template.Parse(readFile(t, filepath.Join("testdata", "tools"), "mistral.gotmpl").String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := toolCallGrammar(tmpl, tools, "get_weather"); err == nil {
+			t.Error("expected error")
+		}
+	})
+}
+
+// streamToolCalls feeds output to a tool parser n bytes at a time
+func streamToolCalls(t *testing.T, p *toolParser, output string, n int) (content []string, calls []api.ToolCall, arguments map[int]string) {
+	t.Helper()
+
+	arguments = make(map[int]string)
+	for i := 0; i < len(output); i += n {
+		c, tc, deltas := p.Add(output[i:min(i+n, len(output))])
+		if c != "" {
+			content = append(content, c)
+		}
+
+		calls = append(calls, tc...)
+
+		for _, d := range deltas {
+			if _, ok := arguments[d.Index]; ok == (d.Name != "") {
+				t.Fatalf("delta %+v: name must be set only in the first delta of a tool call", d)
+			}
+
+			arguments[d.Index] += d.Arguments
+		}
+	}
+
+	if c := p.Flush(); c != "" {
+		content = append(content, c)
+	}
+
+	return content, calls, arguments
+}
+
+func TestToolParser(t *testing.T) {
+	calls := []api.ToolCall{
+		{
+			Function: api.ToolCallFunction{
+				Index: 0,
+				Name:  "get_current_weather",
+				Arguments: api.ToolCallFunctionArguments{
+					"format":   "fahrenheit",
+					"location": "San Francisco, CA",
+				},
+			},
+		},
+		{
+			Function: api.ToolCallFunction{
+				Index: 1,
+				Name:  "get_current_weather",
+				Arguments: api.ToolCallFunctionArguments{
+					"format":   "celsius",
+					"location": "Toronto, Canada",
+				},
+			},
+		},
+	}
+
+	cases := []struct {
+		name    string
+		model   string
+		output  string
+		content string
+		calls   []api.ToolCall
+	}{
+		{
+			name:   "tag",
+			model:  "mistral",
+			output: `[TOOL_CALLS]  [{"name": "get_current_weather", "arguments": {"format":"fahrenheit","location":"San Francisco, CA"}},{"name": "get_current_weather", "arguments": {"format":"celsius","location":"Toronto, Canada"}}]`,
+			calls:  calls,
+		},
+		{
+			name:    "content before",
+			model:   "mistral",
+			output:  `Let me check. [{"name": "get_current_weather", "arguments": {"format":"fahrenheit","location":"San Francisco, CA"}}]`,
+			content: "Let me check. ",
+			calls:   calls[:1],
+		},
+		{
+			name:    "content",
+			model:   "mistral",
+			output:  `The weather [in San Francisco] is {"sunny": true}, [TOOL or not.`,
+			content: `The weather [in San Francisco] is {"sunny": true}, [TOOL or not.`,
+		},
+		{
+			name:    "unfinished",
+			model:   "mistral",
+			output:  `The weather is {"sunny": tru`,
+			content: `The weather is {"sunny": tru`,
+		},
+		{
+			name:    "tag without calls",
+			model:   "mistral",
+			output:  `[TOOL_CALLS] sorry`,
+			content: `[TOOL_CALLS] sorry`,
+		},
+		{
+			name:  "xml tag",
+			model: "llama3-groq-tool-use",
+			output: `<tool_call>
+{"name": "get_current_weather", "arguments": {"format":"fahrenheit","location":"San Francisco, CA"}}
+{"name": "get_current_weather", "arguments": {"format":"celsius","location":"Toronto, Canada"}}
+</tool_call>`,
+			calls: calls,
+		},
+		{
+			name:   "nested",
+			model:  "xlam",
+			output: `{"tool_calls": [{"name": "get_current_weather", "arguments": {"format":"fahrenheit","location":"San Francisco, CA"}},{"name": "get_current_weather", "arguments": {"format":"celsius","location":"Toronto, Canada"}}]}`,
+			calls:  calls,
+		},
+		{
+			name:   "arguments first",
+			model:  "command-r-plus",
+			output: "Action: ```json\n[\n  {\"parameters\": {\"format\": \"fahrenheit\", \"location\": \"San Francisco, CA\"}, \"tool_name\": \"get_current_weather\"}\n]\n```",
+			calls:  calls[:1],
+		},
+		{
+			name:   "trailing content",
+			model:  "nemotron",
+			output: `<toolcall> {"name": "get_current_weather", "arguments": {"format":"fahrenheit","location":"San Francisco, CA"}} </toolcall> The weather is nice.`,
+			calls:  calls[:1],
+		},
+	}
+
+	for _, tt := range cases {
+		for _, n := range []int{1, 3, len(tt.output)} {
+			t.Run(fmt.Sprintf("%s/%d", tt.name, n), func(t *testing.T) {
+				tmpl, err := template.Parse(readFile(t, filepath.Join("testdata", "tools"), fmt.Sprintf("%s.gotmpl", tt.model)).String())
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				p, ok := newToolParser(tmpl)
+				if !ok {
+					t.Fatal("expected tool parser")
+				}
+
+				content, got, arguments := streamToolCalls(t, p, tt.output, n)
+				if diff := cmp.Diff(strings.Join(content, ""), tt.content); diff != "" {
+					t.Errorf("content mismatch (-got +want):\n%s", diff)
+				}
+
+				if diff := cmp.Diff(got, tt.calls); diff != "" {
+					t.Errorf("tool calls mismatch (-got +want):\n%s", diff)
+				}
+
+				if len(arguments) != len(tt.calls) {
+					t.Fatalf("got deltas for %d tool calls, want %d", len(arguments), len(tt.calls))
+				}
+
+				for _, call := range tt.calls {
+					var args api.ToolCallFunctionArguments
+					if err := json.Unmarshal([]byte(arguments[call.Function.Index]), &args); err != nil {
+						t.Fatalf("invalid arguments %q: %v", arguments[call.Function.Index], err)
+					}
+
+					if diff := cmp.Diff(args, call.Function.Arguments); diff != "" {
+						t.Errorf("arguments mismatch (-got +want):\n%s", diff)
+					}
+				}
+			})
+		}
+	}
+
+	t.Run("content is not delayed", func(t *testing.T) {
+		tmpl, err := template.Parse(readFile(t, filepath.Join("testdata", "tools"), "mistral.gotmpl").String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p, _ := newToolParser(tmpl)
+		for _, s := range []string{"The weather", " is nice", " today."} {
+			if content, _, _ := p.Add(s); content != s {
+				t.Errorf("content = %q, want %q", content, s)
+			}
+		}
+
+		// a possible start of the tag is held until it can be ruled out
+		if content, _, _ := p.Add(" [TOOL"); content != " " {
+			t.Errorf("content = %q, want %q", content, " ")
+		}
+
+		if content, _, _ := p.Add("S]"); content != "[TOOLS]" {
+			t.Errorf("content = %q, want %q", content, "[TOOLS]")
+		}
+	})
+
+	t.Run("arguments are streamed", func(t *testing.T) {
+		tmpl, err := template.Parse(readFile(t, filepath.Join("testdata", "tools"), "mistral.gotmpl").String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p, _ := newToolParser(tmpl)
+
+		var deltas []api.ToolCallDelta
+		for _, s := range []string{`[TOOL_CALLS] [{"name": "get_current_weather", "arguments": {"format":`, `"celsius",`, `"location":"Toronto"}}]`} {
+			_, _, d := p.Add(s)
+			deltas = append(deltas, d...)
+		}
+
+		if diff := cmp.Diff(deltas, []api.ToolCallDelta{
+			{Index: 0, Name: "get_current_weather", Arguments: `{"format":`},
+			{Index: 0, Arguments: `"celsius",`},
+			{Index: 0, Arguments: `"location":"Toronto"}`},
+		}); diff != "" {
+			t.Errorf("deltas mismatch (-got +want):\n%s", diff)
+		}
+	})
+}
+
+func TestValidateToolCalls(t *testing.T) {
+	tools := []api.Tool{
+		{Type: "function", Function: api.ToolFunction{Name: "get_time"}},
+		{Type: "function", Function: api.ToolFunction{
+			Name:       "get_weather",
+			Parameters: api.ToolSchema(`{"type":"object","required":["location"],"properties":{"location":{"type":"string"},"unit":{"type":"string","enum":["celsius","fahrenheit"]},"days":{"type":"integer"},"hours":{"type":"array","items":{"type":"integer"}}}}`),
+		}},
+	}
+
+	cases := []struct {
+		name string
+		call string
+		err  string
+	}{
+		{name: "valid", call: `{"name": "get_weather", "arguments": {"location": "Seattle", "unit": "celsius", "days": 3, "hours": [1, 2]}}`},
+		{name: "no parameters", call: `{"name": "get_time", "arguments": {"zone": "UTC"}}`},
+		{name: "unknown tool", call: `{"name": "get_date", "arguments": {}}`, err: `invalid tool call: model called unknown tool "get_date"`},
+		{name: "missing required", call: `{"name": "get_weather", "arguments": {"unit": "celsius"}}`, err: `invalid tool call: model called "get_weather" with invalid arguments: missing required property "location"`},
+		{name: "wrong type", call: `{"name": "get_weather", "arguments": {"location": 1}}`, err: `invalid tool call: model called "get_weather" with invalid arguments: location: expected string, got number`},
+		{name: "not integer", call: `{"name": "get_weather", "arguments": {"location": "Seattle", "days": 1.5}}`, err: `invalid tool call: model called "get_weather" with invalid arguments: days: expected integer, got number`},
+		{name: "not in enum", call: `{"name": "get_weather", "arguments": {"location": "Seattle", "unit": "kelvin"}}`, err: `invalid tool call: model called "get_weather" with invalid arguments: unit: kelvin is not one of [celsius fahrenheit]`},
+		{name: "invalid item", call: `{"name": "get_weather", "arguments": {"location": "Seattle", "hours": [1, "2"]}}`, err: `invalid tool call: model called "get_weather" with invalid arguments: hours: [1]: expected integer, got string`},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			var call api.ToolCallFunction
+			if err := json.Unmarshal([]byte(tt.call), &call); err != nil {
+				t.Fatal(err)
+			}
+
+			err := validateToolCalls(tools, []api.ToolCall{{Function: call}})
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			} else if err == nil || err.Error() != tt.err {
+				t.Fatalf("expected error %q, got %v", tt.err, err)
+			}
+		})
+	}
+}